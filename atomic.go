@@ -2,6 +2,8 @@ package gonion
 
 import (
 	"sync"
+
+	"github.com/robogg133/gonion/pkg/circpad"
 )
 
 type circuits struct {
@@ -35,6 +37,13 @@ func (m *circuits) Delete(id uint32) {
 	delete(m.circs, id)
 }
 
+func (m *circuits) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.circs)
+}
+
 /////////////////////////////////////////////////
 
 type streams struct {
@@ -71,4 +80,77 @@ func (m *streams) Delete(id uint16) {
 
 /////////////////////////////////////////////////
 
+// paddingMachines holds the circuit padding runtimes of a circuit. Like tor,
+// a circuit runs at most maxPaddingMachines at once.
+type paddingMachines struct {
+	slots [maxPaddingMachines]*circpad.Runtime
+	ctr   uint32
+
+	mu sync.Mutex
+}
+
+// attach stores rt in a free slot and returns the slot and a fresh
+// machine_ctr. ok is false when every slot is taken.
+func (m *paddingMachines) attach(rt *circpad.Runtime) (slot int, ctr uint32, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, cur := range m.slots {
+		if cur == nil {
+			m.slots[i] = rt
+			m.ctr++
+			return i, m.ctr, true
+		}
+	}
+	return 0, 0, false
+}
+
+// detach stops and removes rt if it is still in slot.
+func (m *paddingMachines) detach(slot int, rt *circpad.Runtime) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.slots[slot] == rt {
+		m.slots[slot] = nil
+	}
+	rt.Stop()
+}
+
+// byType returns the runtime running the given machine number.
+func (m *paddingMachines) byType(machine uint8) (int, *circpad.Runtime) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, rt := range m.slots {
+		if rt != nil && rt.Machine().Number == machine {
+			return i, rt
+		}
+	}
+	return 0, nil
+}
+
+func (m *paddingMachines) Event(ev circpad.Event) {
+	m.mu.Lock()
+	slots := m.slots
+	m.mu.Unlock()
+
+	for _, rt := range slots {
+		if rt != nil {
+			rt.Event(ev)
+		}
+	}
+}
+
+func (m *paddingMachines) StopAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, rt := range m.slots {
+		if rt != nil {
+			rt.Stop()
+			m.slots[i] = nil
+		}
+	}
+}
+
 /////////////////////////////////////////////////
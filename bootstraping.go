@@ -2,24 +2,32 @@ package gonion
 
 import (
 	"context"
-	"crypto/ecdh"
 	"math/rand"
 	"time"
 
+	"github.com/robogg133/gonion/pkg/clock"
 	"github.com/robogg133/gonion/pkg/common"
+	"github.com/robogg133/gonion/pkg/netdir"
 )
 
-// StartConsensusRefresh schedules periodic consensus re-fetch on circuit.
-// It runs until ctx is cancelled. Safe to call once after bootstrap.
-func (circuit *Circuit) StartConsensusRefresh(ctx context.Context, cns *common.Consensus) {
+// StartConsensusRefresh schedules periodic consensus re-fetch on circuit,
+// starting from the current consensus of dir (nil for netdir.Default). It
+// runs until ctx is cancelled. Safe to call once after bootstrap.
+//
+// Published consensuses are never modified: each refresh builds a new one,
+// with the microdescriptors it shares with the previous one carried over,
+// and swaps it into dir once it is complete.
+func (circuit *Circuit) StartConsensusRefresh(ctx context.Context, dir *netdir.NetDir) {
+	dir = orDefaultDir(dir)
+	cns := dir.Consensus()
 	if cns == nil {
 		return
 	}
-	go circuit.nextConsensus(ctx, cns)
+	go circuit.nextConsensus(ctx, dir, cns)
 }
 
 // nextConsensus will refresh the consensus when needed (Tor client schedule).
-func (circuit *Circuit) nextConsensus(ctx context.Context, cns *common.Consensus) {
+func (circuit *Circuit) nextConsensus(ctx context.Context, dir *netdir.NetDir, cns *common.Consensus) {
 	log := logger(ctx).With().Str("job", "consensus_refresh").Logger()
 
 	for {
@@ -30,7 +38,8 @@ func (circuit *Circuit) nextConsensus(ctx context.Context, cns *common.Consensus
 		default:
 		}
 
-		fetchTime, err := nextConsensusFetchTime(cns, time.Now().UTC())
+		now := clock.Now().UTC()
+		fetchTime, err := nextConsensusFetchTime(cns, now)
 		if err != nil {
 			log.Error().Err(err).Msg("compute consensus fetch window failed")
 			// Retry later instead of spinning.
@@ -42,12 +51,14 @@ func (circuit *Circuit) nextConsensus(ctx context.Context, cns *common.Consensus
 
 		log.Info().Time("fetch_at", fetchTime).Msg("scheduled consensus refresh")
 
-		if err := sleepCtx(ctx, time.Until(fetchTime)); err != nil {
+		// fetchTime is network time; sleep the difference from our
+		// corrected clock, not from the local one.
+		if err := sleepCtx(ctx, fetchTime.Sub(now)); err != nil {
 			log.Debug().Err(err).Msg("consensus refresh cancelled")
 			return
 		}
 
-		cnsPtr, err := circuit.GetConsensus()
+		next, err := circuit.GetConsensusFrom(cns)
 		if err != nil {
 			log.Error().Err(err).Msg("consensus refresh failed; retrying in 30m")
 			if err := sleepCtx(ctx, 30*time.Minute); err != nil {
@@ -56,11 +67,52 @@ func (circuit *Circuit) nextConsensus(ctx context.Context, cns *common.Consensus
 			continue
 		}
 
-		// Keep microdesc keys from previous consensus where digests match;
-		// full re-bootstrap of microdescs is left to a higher-level client later.
-		*cns = *cnsPtr
-		common.SetGlobalConsensus(cns)
-		log.Info().Int("relays", len(cns.RelayInformation)).Msg("consensus refreshed")
+		if err := checkProtocols(ctx, next); err != nil {
+			log.Error().Err(err).Msg("refreshed consensus unusable; retrying in 30m")
+			if err := sleepCtx(ctx, 30*time.Minute); err != nil {
+				return
+			}
+			continue
+		}
+
+		missing := next.CarryMicrodescs(cns)
+		carried := len(next.RelayInformation) - countMissingKeys(next)
+		applied, err := circuit.fetchMicrodescriptors(ctx, next, missing)
+		if err != nil {
+			// Relays without keys are skipped by path selection; the
+			// next refresh asks for them again.
+			log.Warn().Err(err).Int("applied", applied).Msg("microdescriptor refresh incomplete")
+		}
+
+		cns = next
+		observeConsensusClock(ctx, cns)
+		dir.Set(cns)
+		circuit.conn.UseConsensus(cns)
+		log.Info().
+			Int("relays", len(cns.RelayInformation)).
+			Int("microdescs_carried", carried).
+			Int("microdescs_fetched", applied).
+			Msg("consensus refreshed")
+	}
+}
+
+// observeConsensusClock bounds clock.Default with the validity of a freshly
+// fetched consensus and explains a skewed clock before it shows up as
+// confusing certificate or descriptor failures.
+func observeConsensusClock(ctx context.Context, cns *common.Consensus) {
+	clock.Default.ObserveConsensus(cns.ValidAfter, cns.ValidUntil)
+	if !clock.Default.Skewed() {
+		return
+	}
+	skew := clock.Skew()
+	ev := logger(ctx).Warn().
+		Dur("skew", skew).
+		Time("valid_after", cns.ValidAfter).
+		Time("valid_until", cns.ValidUntil)
+	if skew > 0 {
+		ev.Msg("local clock is behind network time; using the estimated skew")
+	} else {
+		ev.Msg("local clock is ahead of network time; using the estimated skew")
 	}
 }
 
@@ -111,44 +163,45 @@ func nextConsensusFetchTime(cns *common.Consensus, now time.Time) (time.Time, er
 	return time.Unix(ns+rand.Int63n(span), 0).UTC(), nil
 }
 
-// BootstrapOneConn fetches consensus and microdescriptors using one OR connection.
+// BootstrapOneConn fetches consensus and microdescriptors using one OR connection
+// and publishes them in dir (nil for netdir.Default).
 // On success it starts the consensus refresh scheduler on the bootstrap circuit.
-func BootstrapOneConn(conn *Conn) error {
+func BootstrapOneConn(conn *Conn, dir *netdir.NetDir) error {
 	ctx := conn.ctx
 	log := logger(ctx).With().Str("job", "bootstrap").Logger()
 	ctx = withLogger(ctx, log)
 	log.Info().Msg("bootstrap starting")
 
-	circuit, err := conn.NewFastCircuit(1)
+	circuit, err := conn.NewFastCircuit()
 	if err != nil {
 		return fail(ctx, ErrBootstrap, "create bootstrap circuit failed", err)
 	}
+	return bootstrapCircuit(ctx, conn, circuit, orDefaultDir(dir))
+}
+
+// bootstrapCircuit fetches the consensus and microdescriptors over circuit
+// into dir and starts the refresh scheduler on it.
+func bootstrapCircuit(ctx context.Context, conn *Conn, circuit *Circuit, dir *netdir.NetDir) error {
+	log := logger(ctx)
 
 	cns, err := circuit.GetConsensus()
 	if err != nil {
 		return fail(ctx, ErrBootstrap, "fetch consensus failed", err)
 	}
 	log.Info().Int("relays", len(cns.RelayInformation)).Msg("consensus fetched")
-
-	common.SetGlobalConsensus(cns)
-
-	var allDigests []string
-	for _, relay := range cns.RelayInformation {
-		allDigests = append(allDigests, relay.MicrodescriptorDigest)
+	if err := checkProtocols(ctx, cns); err != nil {
+		return err
 	}
 
-	applied := 0
-	for i := 0; i < len(allDigests); i += 91 {
-		end := min(i+91, len(allDigests))
-		chunk := allDigests[i:end]
-		log.Debug().Int("offset", i).Int("count", len(chunk)).Msg("fetching microdescriptor chunk")
-		n, err := circuit.fetchAndApplyMicrodescriptors(ctx, cns, chunk, i)
-		if err != nil {
-			return err
-		}
-		applied += n
+	applied, err := circuit.fetchMicrodescriptors(ctx, cns, cns.CarryMicrodescs(nil))
+	if err != nil {
+		return err
 	}
 
+	observeConsensusClock(ctx, cns)
+	dir.Set(cns)
+	conn.UseConsensus(cns)
+
 	withKeys := 0
 	exitPort80 := 0
 	for i := range cns.RelayInformation {
@@ -168,49 +221,65 @@ func BootstrapOneConn(conn *Conn) error {
 		Msg("bootstrap complete")
 
 	// Keep refreshing consensus until the connection is closed.
-	circuit.StartConsensusRefresh(conn.ctx, cns)
+	circuit.StartConsensusRefresh(conn.ctx, dir)
 	return nil
 }
 
-func (circuit *Circuit) fetchAndApplyMicrodescriptors(ctx context.Context, cons *common.Consensus, digestsSlice []string, offset int) (int, error) {
-	desc, err := circuit.GetMicrodescriptors(digestsSlice)
-	if err != nil {
-		return 0, fail(ctx, ErrDirectory, "fetch microdescriptors failed", err)
+// MICRODESC_BATCH is how many digests go in one microdescriptor request,
+// keeping the URL within what directories accept.
+const MICRODESC_BATCH = 91
+
+// fetchMicrodescriptors downloads the microdescriptors for digests in
+// batches and applies each to every relay of cons that references it.
+func (circuit *Circuit) fetchMicrodescriptors(ctx context.Context, cons *common.Consensus, digests []string) (int, error) {
+	log := logger(ctx)
+
+	byDigest := make(map[string][]int, len(cons.RelayInformation))
+	for i := range cons.RelayInformation {
+		d := cons.RelayInformation[i].MicrodescriptorDigest
+		byDigest[d] = append(byDigest[d], i)
 	}
 
-	curve := ecdh.X25519()
 	applied := 0
-	for i, v := range desc {
-		if v == nil {
-			continue
-		}
-		idx := offset + i
-		if idx >= len(cons.RelayInformation) {
-			logger(ctx).Error().Int("idx", idx).Int("len", len(cons.RelayInformation)).Msg("microdesc index out of bounds")
-			return applied, Public(ErrDirectory, "microdescriptor index out of bounds")
-		}
+	for i := 0; i < len(digests); i += MICRODESC_BATCH {
+		chunk := digests[i:min(i+MICRODESC_BATCH, len(digests))]
+		log.Debug().Int("offset", i).Int("count", len(chunk)).Msg("fetching microdescriptor chunk")
 
-		cons.RelayInformation[idx].OnionKey = v.OnionKey
-		if len(v.NTorOnionKey) > 0 {
-			ntor, err := curve.NewPublicKey(v.NTorOnionKey)
-			if err != nil {
-				logger(ctx).Debug().Err(err).Int("idx", idx).Msg("skip invalid ntor key")
+		desc, err := circuit.GetMicrodescriptors(chunk)
+		if err != nil {
+			return applied, fail(ctx, ErrDirectory, "fetch microdescriptors failed", err)
+		}
+		for j, v := range desc {
+			if v == nil {
 				continue
 			}
-			cons.RelayInformation[idx].NTorOnionKey = ntor
-		}
-		if v.ExitRules != nil {
-			cons.RelayInformation[idx].Ports = *v.ExitRules
+			for _, idx := range byDigest[chunk[j]] {
+				if err := cons.RelayInformation[idx].ApplyMicrodesc(v); err != nil {
+					log.Debug().Err(err).Int("idx", idx).Msg("skip invalid ntor key")
+					continue
+				}
+				applied++
+			}
 		}
-		cons.RelayInformation[idx].Family = v.Family
-		cons.RelayInformation[idx].Familys = v.Familys
-		if len(v.IdEd25519) > 0 {
-			cons.RelayInformation[idx].IdEd25519 = v.IdEd25519
+	}
+	return applied, nil
+}
+
+func countMissingKeys(cns *common.Consensus) int {
+	n := 0
+	for i := range cns.RelayInformation {
+		if cns.RelayInformation[i].NTorOnionKey == nil {
+			n++
 		}
-		applied++
 	}
+	return n
+}
 
-	return applied, nil
+func orDefaultDir(dir *netdir.NetDir) *netdir.NetDir {
+	if dir == nil {
+		return netdir.Default
+	}
+	return dir
 }
 
 func sleepCtx(ctx context.Context, d time.Duration) error {
@@ -0,0 +1,144 @@
+package gonion
+
+import (
+	"context"
+	"io"
+	"net/netip"
+
+	"github.com/robogg133/gonion/pkg/bridge"
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+// DialBridge is RelayDialer.DialBridge with default settings.
+func DialBridge(b *bridge.Bridge, logOut io.Writer, debug bool) (*Conn, *Circuit, *common.RouterStatus, error) {
+	d := &RelayDialer{LogOut: logOut, Debug: debug}
+	return d.DialBridge(b)
+}
+
+// DialBridge connects to b, runs the link handshake, checks the bridge
+// identity when the line has a fingerprint and learns the bridge's server
+// descriptor over BEGIN_DIR. The returned circuit is the one-hop directory
+// circuit used for the descriptor.
+func (d *RelayDialer) DialBridge(b *bridge.Bridge) (*Conn, *Circuit, *common.RouterStatus, error) {
+	ctx := withLogger(context.Background(), newLogger(d.LogOut, d.Debug).With().
+		Str("component", "bridge").
+		Str("bridge", b.Addr).
+		Str("transport", b.Transport).
+		Logger())
+	log := logger(ctx)
+
+	raw, err := b.Dial(d.Upstream)
+	if err != nil {
+		return nil, nil, nil, failf(ctx, ErrIO, err, "dial bridge %s failed", b.Addr)
+	}
+
+	conn, err := NewConn(raw, d.LogOut, d.Debug)
+	if err != nil {
+		raw.Close()
+		return nil, nil, nil, err
+	}
+	if b.HasFingerprint {
+		if err := conn.VerifyIdentity(&common.RouterStatus{Nickname: b.Addr, NodeID: b.Fingerprint}); err != nil {
+			conn.Close()
+			return nil, nil, nil, err
+		}
+	}
+
+	circuit, err := conn.NewFastCircuit()
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fail(ctx, ErrCircuit, "create bridge directory circuit failed", err)
+	}
+
+	desc, err := circuit.GetServerDescriptor()
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	if desc.Fingerprint != conn.RSAIdentity() {
+		conn.Close()
+		log.Error().
+			Hex("desc_rsa_id", desc.Fingerprint[:]).
+			Hex("link_rsa_id", conn.identity.RSA[:]).
+			Msg("bridge served a descriptor for another relay")
+		return nil, nil, nil, Public(ErrIdentity, "bridge descriptor does not match link identity")
+	}
+
+	rs, err := desc.RouterStatus()
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fail(ctx, ErrDirectory, "unusable bridge descriptor", err)
+	}
+	setBridgeAddr(&rs, b.Addr)
+	if db := orDefaultDir(d.Dir).GeoIP(); db != nil {
+		db.AnnotateRelay(&rs)
+	}
+
+	log.Info().Str("nickname", rs.Nickname).Msg("bridge descriptor learned")
+	return conn, circuit, &rs, nil
+}
+
+// SetBridgeAddrForTest exposes setBridgeAddr for unit tests.
+func SetBridgeAddrForTest(rs common.RouterStatus, addr string) common.RouterStatus {
+	setBridgeAddr(&rs, addr)
+	return rs
+}
+
+// setBridgeAddr points rs at the bridge line address: circuits reach the
+// bridge through it, which is not necessarily the ORPort it advertises.
+// An IPv6 line replaces the IPv6 ORPort only; the advertised IPv4 address
+// and its IPLevel stay.
+func setBridgeAddr(rs *common.RouterStatus, addr string) {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return
+	}
+	if ip := ap.Addr().Unmap(); ip.Is4() {
+		rs.Ipv4Addr, rs.ORPort = ip.String(), ap.Port()
+		rs.IPLevel, _ = common.IPLevel(rs.Ipv4Addr)
+		return
+	}
+	rs.SetIPv6(addr)
+}
+
+// BootstrapBridges is RelayDialer.BootstrapBridges with default settings.
+func BootstrapBridges(m *bridge.Manager, logOut io.Writer, debug bool) (*Conn, error) {
+	d := &RelayDialer{LogOut: logOut, Debug: debug}
+	return d.BootstrapBridges(m)
+}
+
+// BootstrapBridges bootstraps through the first reachable bridge in m: it
+// learns the bridge descriptor, then fetches the consensus and
+// microdescriptors from the bridge instead of a fallback directory. Use
+// path.Selector.UseGuards(m.Guards()) to build circuits through bridges.
+func (d *RelayDialer) BootstrapBridges(m *bridge.Manager) (*Conn, error) {
+	ctx := withLogger(context.Background(), newLogger(d.LogOut, d.Debug).With().
+		Str("component", "bridge").
+		Str("job", "bootstrap").
+		Logger())
+	log := logger(ctx)
+
+	candidates := m.Candidates()
+	if len(candidates) == 0 {
+		return nil, Public(ErrBootstrap, "no usable bridge")
+	}
+
+	for _, b := range candidates {
+		conn, circuit, rs, err := d.DialBridge(b)
+		if err != nil {
+			log.Warn().Err(err).Str("bridge", b.Addr).Msg("bridge unusable")
+			m.MarkFailed(b)
+			continue
+		}
+		m.SetDescriptor(b, *rs)
+
+		if err := bootstrapCircuit(conn.ctx, conn, circuit, orDefaultDir(d.Dir)); err != nil {
+			log.Warn().Err(err).Str("bridge", b.Addr).Msg("bootstrap through bridge failed")
+			m.MarkFailed(b)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+	return nil, Public(ErrBootstrap, "all bridges failed")
+}
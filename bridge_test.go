@@ -0,0 +1,29 @@
+package gonion_test
+
+import (
+	"testing"
+
+	"github.com/robogg133/gonion"
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+func TestSetBridgeAddr(t *testing.T) {
+	desc := common.RouterStatus{Nickname: "bridge", Ipv4Addr: "198.51.100.7", ORPort: 443}
+	desc.IPLevel, _ = common.IPLevel(desc.Ipv4Addr)
+
+	rs := gonion.SetBridgeAddrForTest(desc, "192.0.2.1:9001")
+	if ap, ok := rs.IPv4AddrPort(); !ok || ap.String() != "192.0.2.1:9001" {
+		t.Fatalf("IPv4 line: ORPort %v %v", ap, ok)
+	}
+	if want, _ := common.IPLevel("192.0.2.1"); rs.IPLevel != want {
+		t.Fatalf("IPv4 line: IPLevel %#x, want %#x", rs.IPLevel, want)
+	}
+
+	rs = gonion.SetBridgeAddrForTest(desc, "[2001:db8::1]:9001")
+	if ap, ok := rs.IPv6AddrPort(); !ok || ap.String() != "[2001:db8::1]:9001" {
+		t.Fatalf("IPv6 line: IPv6 ORPort %v %v", ap, ok)
+	}
+	if rs.Ipv4Addr != desc.Ipv4Addr || rs.ORPort != desc.ORPort || rs.IPLevel != desc.IPLevel {
+		t.Fatalf("IPv6 line clobbered IPv4: %s:%d level %#x", rs.Ipv4Addr, rs.ORPort, rs.IPLevel)
+	}
+}
@@ -0,0 +1,212 @@
+package gonion
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/robogg133/gonion/internal/linkpool"
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+const (
+	// CHANNEL_IDLE_TIMEOUT is how long a link may carry no circuit before
+	// it is closed.
+	CHANNEL_IDLE_TIMEOUT = 3 * time.Minute
+
+	chanReapInterval = 15 * time.Second
+)
+
+// ChanMgr keeps one authenticated link per relay, like tor clients do for
+// their guards. Links are matched by relay identity, not address, so a
+// relay that moved is still reused and an impostor on a known address is
+// not.
+type ChanMgr struct {
+	dialer *RelayDialer
+	pool   *linkpool.Pool
+
+	mu       sync.Mutex
+	onClosed []func(id [20]byte, cause error)
+	onMoved  func(old, moved *Circuit, err error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewChanMgr returns a manager dialing through d (nil for defaults) and
+// closing links idle for idleTimeout; zero means CHANNEL_IDLE_TIMEOUT.
+func NewChanMgr(d *RelayDialer, idleTimeout time.Duration) *ChanMgr {
+	if d == nil {
+		d = &RelayDialer{}
+	}
+	if idleTimeout == 0 {
+		idleTimeout = CHANNEL_IDLE_TIMEOUT
+	}
+	ctx, cancel := context.WithCancel(withLogger(context.Background(), newLogger(d.LogOut, d.Debug).With().
+		Str("component", "chanmgr").
+		Logger()))
+	m := &ChanMgr{
+		dialer: d,
+		pool:   linkpool.New(idleTimeout),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	m.pool.OnClose(func(id [20]byte, cause error) {
+		logger(m.ctx).Info().Hex("rsa_id", id[:]).AnErr("cause", cause).Msg("link closed")
+		m.mu.Lock()
+		fns := m.onClosed
+		m.mu.Unlock()
+		for _, fn := range fns {
+			fn(id, cause)
+		}
+	})
+	go m.reapLoop()
+	return m
+}
+
+// OnLinkClosed adds a callback run when a pooled link dies or is reaped.
+// Earlier callbacks are kept.
+func (m *ChanMgr) OnLinkClosed(fn func(id [20]byte, cause error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onClosed = append(m.onClosed[:len(m.onClosed):len(m.onClosed)], fn)
+}
+
+// OnCircuitMoved sets the callback that moves circuits off broken links.
+// Once set, every circuit built by BuildPath whose link dies is rebuilt
+// over the same path on a new link, and fn gets the dead circuit and its
+// replacement, or the error that prevented it. Streams do not move: the
+// owner reopens them on moved. Without a callback, circuits on a dead
+// link are only closed.
+func (m *ChanMgr) OnCircuitMoved(fn func(old, moved *Circuit, err error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onMoved = fn
+}
+
+// Get returns the open link to rs, dialing one if there is none. A guard
+// disabled by the dialer's path bias tracker is refused, even when a link
+// to it is already open.
+func (m *ChanMgr) Get(rs *common.RouterStatus) (*Conn, error) {
+	if err := m.dialer.checkPathBias(rs); err != nil {
+		return nil, err
+	}
+	l, err := m.pool.Get(rs.NodeID, func() (linkpool.Link, error) {
+		conn, err := m.dialer.Dial(rs)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+	if err != nil {
+		if errors.Is(err, linkpool.ErrClosed) {
+			return nil, Public(ErrClosed, "channel manager closed")
+		}
+		return nil, err
+	}
+	conn := l.(*Conn)
+	// The pool matched the RSA identity; the ed25519 one is only known
+	// once rs has its microdescriptor.
+	if err := conn.VerifyIdentity(rs); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// BuildPath builds a circuit through relays on the pooled link to
+// relays[0]. If that link turns out to be dead, it is dropped and the
+// circuit is built once more on a new link. The circuit is moved if its
+// link dies later; see OnCircuitMoved.
+func (m *ChanMgr) BuildPath(relays []*common.RouterStatus) (*Circuit, error) {
+	if len(relays) == 0 {
+		return nil, Public(ErrCircuit, "empty path")
+	}
+	for attempt := 0; ; attempt++ {
+		conn, err := m.Get(relays[0])
+		if err != nil {
+			return nil, err
+		}
+		circ, err := conn.BuildPath(relays)
+		if err == nil {
+			go m.watchCircuit(circ, conn, relays)
+			return circ, nil
+		}
+		if conn.ctx.Err() == nil || attempt > 0 {
+			return nil, err
+		}
+		logger(m.ctx).Warn().
+			Str("relay", relays[0].Nickname).
+			AnErr("cause", context.Cause(conn.ctx)).
+			Msg("link died during circuit build, redialing")
+		m.pool.Remove(relays[0].NodeID, conn)
+	}
+}
+
+// watchCircuit moves circ to a new link when conn dies under it.
+func (m *ChanMgr) watchCircuit(circ *Circuit, conn *Conn, relays []*common.RouterStatus) {
+	m.watch(circ, conn.ctx, func() (*Circuit, error) {
+		logger(m.ctx).Info().
+			Str("relay", relays[0].Nickname).
+			AnErr("cause", context.Cause(conn.ctx)).
+			Msg("link died, moving circuit")
+		m.pool.Remove(relays[0].NodeID, conn)
+		return m.BuildPath(relays)
+	})
+}
+
+// WatchCircuitForTest runs the circuit watch on circ and the link context
+// link, rebuilding through rebuild instead of the network.
+func (m *ChanMgr) WatchCircuitForTest(circ *Circuit, link context.Context, rebuild func() (*Circuit, error)) {
+	m.watch(circ, link, rebuild)
+}
+
+// watch waits for circ to end and, when the link under it died, rebuilds
+// it and reports to the OnCircuitMoved callback. A circuit that ended on
+// its own, or with the manager, stays closed.
+func (m *ChanMgr) watch(circ *Circuit, link context.Context, rebuild func() (*Circuit, error)) {
+	select {
+	case <-circ.Ctx.Done():
+	case <-m.ctx.Done():
+		return
+	}
+	// A circuit killed by its link inherits the link's cause.
+	if link.Err() == nil || context.Cause(circ.Ctx) != context.Cause(link) || m.ctx.Err() != nil {
+		return
+	}
+	m.mu.Lock()
+	fn := m.onMoved
+	m.mu.Unlock()
+	if fn == nil {
+		return
+	}
+	moved, err := rebuild()
+	fn(circ, moved, err)
+}
+
+// Len is the number of open links.
+func (m *ChanMgr) Len() int {
+	return m.pool.Len()
+}
+
+// Close closes every link and stops the manager.
+func (m *ChanMgr) Close() error {
+	m.cancel()
+	m.pool.Close()
+	return nil
+}
+
+func (m *ChanMgr) reapLoop() {
+	t := time.NewTicker(chanReapInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if n := m.pool.Reap(); n > 0 {
+				logger(m.ctx).Debug().Int("closed", n).Msg("idle links closed")
+			}
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
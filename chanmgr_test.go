@@ -0,0 +1,91 @@
+package gonion_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/robogg133/gonion"
+)
+
+type movedCircuit struct {
+	old, moved *gonion.Circuit
+	err        error
+}
+
+// newWatchedCircuit returns a circuit on a fake link, with the link's and
+// the circuit's cancel functions, the way Conn and Circuit derive them.
+func newWatchedCircuit() (*gonion.Circuit, context.Context, context.CancelCauseFunc, context.CancelCauseFunc) {
+	link, killLink := context.WithCancelCause(context.Background())
+	circCtx, closeCirc := context.WithCancelCause(link)
+	return &gonion.Circuit{Ctx: circCtx}, link, killLink, closeCirc
+}
+
+func TestChanMgr_MovesCircuitOffDeadLink(t *testing.T) {
+	m := gonion.NewChanMgr(nil, 0)
+	defer m.Close()
+	got := make(chan movedCircuit, 1)
+	m.OnCircuitMoved(func(old, moved *gonion.Circuit, err error) {
+		got <- movedCircuit{old, moved, err}
+	})
+
+	circ, link, killLink, _ := newWatchedCircuit()
+	replacement := &gonion.Circuit{}
+	go m.WatchCircuitForTest(circ, link, func() (*gonion.Circuit, error) { return replacement, nil })
+	killLink(errors.New("link reset"))
+
+	select {
+	case mc := <-got:
+		if mc.old != circ || mc.moved != replacement || mc.err != nil {
+			t.Fatalf("moved %+v", mc)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("circuit on dead link not moved")
+	}
+}
+
+func TestChanMgr_KeepsClosedCircuits(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		end  func(m *gonion.ChanMgr, killLink, closeCirc context.CancelCauseFunc)
+	}{
+		{"circuit closed", func(_ *gonion.ChanMgr, killLink, closeCirc context.CancelCauseFunc) {
+			closeCirc(gonion.ErrClosed)
+			killLink(errors.New("link reset"))
+		}},
+		{"circuit destroyed", func(_ *gonion.ChanMgr, _, closeCirc context.CancelCauseFunc) {
+			closeCirc(errors.New("destroyed"))
+		}},
+		{"manager closed", func(m *gonion.ChanMgr, killLink, _ context.CancelCauseFunc) {
+			m.Close()
+			killLink(gonion.ErrClosed)
+		}},
+	} {
+		m := gonion.NewChanMgr(nil, 0)
+		moved := false
+		m.OnCircuitMoved(func(*gonion.Circuit, *gonion.Circuit, error) { moved = true })
+
+		circ, link, killLink, closeCirc := newWatchedCircuit()
+		done := make(chan struct{})
+		rebuilt := false
+		go func() {
+			m.WatchCircuitForTest(circ, link, func() (*gonion.Circuit, error) {
+				rebuilt = true
+				return nil, errors.New("unexpected rebuild")
+			})
+			close(done)
+		}()
+		tc.end(m, killLink, closeCirc)
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: watch did not return", tc.name)
+		}
+		if moved || rebuilt {
+			t.Errorf("%s: circuit moved", tc.name)
+		}
+		m.Close()
+	}
+}
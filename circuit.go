@@ -6,9 +6,9 @@ import (
 	"crypto/rand"
 	"io"
 	"sync"
+	"sync/atomic"
 
 	"github.com/robogg133/gonion/internal/hops"
-	"github.com/robogg133/gonion/internal/shared"
 	"github.com/robogg133/gonion/internal/window"
 	cells "github.com/robogg133/gonion/pkg/cells/base"
 	"github.com/robogg133/gonion/pkg/cells/relay"
@@ -18,6 +18,13 @@ import (
 	"github.com/robogg133/gonion/pkg/lspec"
 )
 
+const (
+	// CIRCWINDOW_START is the circuit deliver window (tor-spec §7.3); the
+	// package window starts at the circwindow consensus parameter.
+	CIRCWINDOW_START     = 1000
+	CIRCWINDOW_INCREMENT = 100
+)
+
 type Circuit struct {
 	conn *Conn
 
@@ -40,7 +47,17 @@ type Circuit struct {
 	ctxCancel      context.CancelCauseFunc
 	closeOnce      sync.Once
 
+	// destroyed is set when the relay tore the circuit down, so no DESTROY
+	// is sent back and the ID is free at once.
+	destroyed atomic.Bool
+
+	// pbState is the path bias progress, see pathbias.go.
+	pbState atomic.Uint32
+
 	extended2Received chan *relay.Extended2Cell
+
+	padding           paddingMachines
+	paddingNegotiated chan *relay.PaddingNegotiatedCell
 }
 
 type RelayOut struct {
@@ -48,9 +65,14 @@ type RelayOut struct {
 	Dst  int
 }
 
-func (c *Conn) NewCircuit(id uint32, htype uint16, hs handshakes.Handshake) (*Circuit, error) {
+// NewCircuit creates a circuit with a CREATE2 handshake on a fresh
+// circuit ID.
+func (c *Conn) NewCircuit(htype uint16, hs handshakes.Handshake) (*Circuit, error) {
 	suc := false
-	circID := shared.MSB(id)
+	circID, err := c.ids.Allocate()
+	if err != nil {
+		return nil, fail(c.ctx, ErrCircuit, "allocate circuit ID failed", err)
+	}
 
 	baseLog := logger(c.ctx).With().
 		Str("component", "circuit").
@@ -68,6 +90,7 @@ func (c *Conn) NewCircuit(id uint32, htype uint16, hs handshakes.Handshake) (*Ci
 		Ctx:               ctx,
 		ctxCancel:         cancel,
 		extended2Received: make(chan *relay.Extended2Cell, 1),
+		paddingNegotiated: make(chan *relay.PaddingNegotiatedCell, 1),
 		streams: &streams{
 			streams: make(map[uint16]*Stream),
 		},
@@ -76,10 +99,9 @@ func (c *Conn) NewCircuit(id uint32, htype uint16, hs handshakes.Handshake) (*Ci
 		isUp:          true,
 		Coder:         cells.NewCellCoder(cells.AllKnownCells),
 	}
-	c.circuits.Set(circuit.ID, circuit)
+	c.register(circuit)
 	defer func() {
 		if !suc {
-			c.circuits.Delete(circuit.ID)
 			circuit.ctxCancel(ErrCircuit)
 		}
 	}()
@@ -129,8 +151,8 @@ func (c *Conn) NewCircuit(id uint32, htype uint16, hs handshakes.Handshake) (*Ci
 		return nil, Publicf(ErrHandshake, "unsupported handshake type %d", htype)
 	}
 
-	rcvWindow := window.NewWindow(1000, 100)
-	sndWindow := window.NewWindow(1000, 100)
+	rcvWindow := window.NewWindow(CIRCWINDOW_START, CIRCWINDOW_INCREMENT)
+	sndWindow := window.NewWindow(c.NetParams().CircWindow, CIRCWINDOW_INCREMENT)
 
 	back, err := crypto.NewRunningValues(keys.Kb, keys.Db)
 	if err != nil {
@@ -152,9 +174,14 @@ func (c *Conn) NewCircuit(id uint32, htype uint16, hs handshakes.Handshake) (*Ci
 	return circuit, nil
 }
 
-func (c *Conn) NewFastCircuit(id uint32) (*Circuit, error) {
+// NewFastCircuit creates a one-hop circuit with CREATE_FAST on a fresh
+// circuit ID.
+func (c *Conn) NewFastCircuit() (*Circuit, error) {
 	var suc bool
-	circID := shared.MSB(id)
+	circID, err := c.ids.Allocate()
+	if err != nil {
+		return nil, fail(c.ctx, ErrCircuit, "allocate circuit ID failed", err)
+	}
 
 	baseLog := logger(c.ctx).With().
 		Str("component", "circuit").
@@ -171,6 +198,7 @@ func (c *Conn) NewFastCircuit(id uint32) (*Circuit, error) {
 		Ctx:               ctx,
 		ctxCancel:         cancel,
 		extended2Received: make(chan *relay.Extended2Cell, 1),
+		paddingNegotiated: make(chan *relay.PaddingNegotiatedCell, 1),
 		streams: &streams{
 			streams: make(map[uint16]*Stream),
 		},
@@ -179,10 +207,15 @@ func (c *Conn) NewFastCircuit(id uint32) (*Circuit, error) {
 		isUp:          true,
 		Coder:         cells.NewCellCoder(cells.AllKnownCells),
 	}
+	c.register(circuit)
+	defer func() {
+		if !suc {
+			circuit.ctxCancel(ErrCircuit)
+		}
+	}()
 
 	xMaterial := make([]byte, 20)
 	if _, err := io.ReadFull(rand.Reader, xMaterial); err != nil {
-		cancel(err)
 		return nil, fail(ctx, ErrCircuit, "generate CREATE_FAST material failed", err)
 	}
 
@@ -191,14 +224,6 @@ func (c *Conn) NewFastCircuit(id uint32) (*Circuit, error) {
 		X:         [20]byte(xMaterial),
 	}
 
-	c.circuits.Set(circID, circuit)
-	defer func() {
-		if !suc {
-			c.circuits.Delete(circID)
-			circuit.ctxCancel(ErrCircuit)
-		}
-	}()
-
 	log := logger(ctx)
 	log.Info().Msg("creating fast circuit")
 
@@ -234,8 +259,8 @@ func (c *Conn) NewFastCircuit(id uint32) (*Circuit, error) {
 		return nil, Public(ErrHandshake, "CREATE_FAST key confirmation failed")
 	}
 
-	rcvWindow := window.NewWindow(1000, 100)
-	sndWindow := window.NewWindow(1000, 100)
+	rcvWindow := window.NewWindow(CIRCWINDOW_START, CIRCWINDOW_INCREMENT)
+	sndWindow := window.NewWindow(c.NetParams().CircWindow, CIRCWINDOW_INCREMENT)
 
 	back, err := crypto.NewRunningValues(keys.Kb, keys.Db)
 	if err != nil {
@@ -306,8 +331,8 @@ func (c *Circuit) Extend(lspecs []lspec.Lspec, htype uint16, handshake handshake
 		return Publicf(ErrHandshake, "unsupported handshake type %d", htype)
 	}
 
-	rcvWindow := window.NewWindow(1000, 100)
-	sndWindow := window.NewWindow(1000, 100)
+	rcvWindow := window.NewWindow(CIRCWINDOW_START, CIRCWINDOW_INCREMENT)
+	sndWindow := window.NewWindow(c.conn.NetParams().CircWindow, CIRCWINDOW_INCREMENT)
 
 	backwards, err := crypto.NewRunningValues(keys.Kb, keys.Db)
 	if err != nil {
@@ -329,6 +354,41 @@ func (c *Circuit) HopCount() int {
 	return c.hops.Len()
 }
 
+// register adds circuit to the connection and arranges for its ID to be
+// released once the circuit ends.
+func (c *Conn) register(circuit *Circuit) {
+	c.circuits.Set(circuit.ID, circuit)
+	go circuit.reap()
+}
+
+// reap waits for the circuit to end. Unless the relay destroyed it, the
+// relay is sent a DESTROY and the ID is quarantined, since cells for the
+// old circuit may still be in flight.
+func (c *Circuit) reap() {
+	<-c.Ctx.Done()
+	destroyed := c.destroyed.Load()
+	if !destroyed {
+		c.sendDestroy(cells.DESTROY_REASON_NONE)
+	}
+	c.conn.circuits.Delete(c.ID)
+	c.conn.ids.Release(c.ID, !destroyed)
+	logger(c.Ctx).Debug().Bool("by_relay", destroyed).Msg("circuit ID released")
+}
+
+// sendDestroy queues a DESTROY for the circuit directly on the link, as
+// the circuit context is already done.
+func (c *Circuit) sendDestroy(reason uint8) {
+	b, err := c.Coder.MarshalCell(&cells.DestroyCell{CircuitID: c.ID, Reason: reason})
+	if err != nil {
+		logger(c.Ctx).Error().Err(err).Msg("marshal DESTROY failed")
+		return
+	}
+	select {
+	case c.conn.writeCall <- b:
+	case <-c.conn.ctx.Done():
+	}
+}
+
 func (c *Circuit) Close() error {
 	logger(c.Ctx).Info().Msg("closing circuit")
 	c.ctxCancel(ErrClosed)
@@ -342,6 +402,7 @@ func (c *Circuit) handleCell(cell cells.Cell) {
 		reason := cell.(*cells.DestroyCell).Reason
 		reasonS := common.DestroyGetReasonS(reason)
 		log.Warn().Uint8("reason", reason).Str("reason_s", reasonS).Msg("DESTROY received")
+		c.destroyed.Store(true)
 		c.ctxCancel(Publicf(ErrCircuit, "destroyed: %s", reasonS))
 		return
 	default:
@@ -3,8 +3,8 @@ package gonion
 import (
 	"crypto/ecdh"
 	"crypto/rand"
-	"fmt"
 	"net"
+	"net/netip"
 
 	"github.com/robogg133/gonion/pkg/common"
 	"github.com/robogg133/gonion/pkg/handshakes"
@@ -12,12 +12,12 @@ import (
 )
 
 // NewCircuitTo creates a 1-hop ntor circuit to guard.
-func (c *Conn) NewCircuitTo(id uint32, guard *common.RouterStatus) (*Circuit, error) {
+func (c *Conn) NewCircuitTo(guard *common.RouterStatus) (*Circuit, error) {
 	hs, err := newNTorHandshake(guard)
 	if err != nil {
 		return nil, fail(c.ctx, ErrCircuit, "build ntor handshake failed", err)
 	}
-	return c.NewCircuit(id, handshakes.HTYPE_NTOR, hs)
+	return c.NewCircuit(handshakes.HTYPE_NTOR, hs)
 }
 
 // ExtendTo extends the circuit one hop toward relay via EXTEND2 + ntor.
@@ -30,34 +30,47 @@ func (c *Circuit) ExtendTo(relay *common.RouterStatus) error {
 	if err != nil {
 		return fail(c.Ctx, ErrExtend, "build ntor handshake failed", err)
 	}
-	return c.Extend(lspecs, handshakes.HTYPE_NTOR, hs)
+	if err := c.Extend(lspecs, handshakes.HTYPE_NTOR, hs); err != nil {
+		c.pbBuildFailed()
+		return err
+	}
+	return nil
 }
 
 // BuildPath creates the onion path for relays[0]=guard … relays[n-1]=exit.
 // The circuit must be empty; hop 0 is created, the rest are extended.
-func (c *Conn) BuildPath(id uint32, relays []*common.RouterStatus) (*Circuit, error) {
+func (c *Conn) BuildPath(relays []*common.RouterStatus) (*Circuit, error) {
 	if len(relays) == 0 {
 		return nil, Public(ErrCircuit, "empty path")
 	}
-	circ, err := c.NewCircuitTo(id, relays[0])
+	circ, err := c.NewCircuitTo(relays[0])
 	if err != nil {
 		return nil, err
 	}
+	circ.pbBuildAttempt(len(relays))
 	for i, r := range relays[1:] {
 		if err := circ.ExtendTo(r); err != nil {
 			_ = circ.Close()
 			return nil, failf(circ.Ctx, ErrExtend, err, "extend hop %d failed", i+1)
 		}
 	}
+	circ.pbBuilt()
 	return circ, nil
 }
 
-// Dial opens a stream to addr (host:port) through the circuit exit hop.
+// Dial opens a stream to addr (host:port, "[v6]:port" for IPv6) through
+// the circuit exit hop.
 func (c *Circuit) Dial(addr string) (net.Conn, error) {
+	return c.DialWith(addr, DialOptions{})
+}
+
+// DialWith is Dial with BEGIN options, e.g. to reach IPv6-only hosts by
+// name.
+func (c *Circuit) DialWith(addr string, opts DialOptions) (net.Conn, error) {
 	if c.hops.Len() == 0 {
 		return nil, Public(ErrCircuit, "empty circuit")
 	}
-	stream, err := c.NewStream(addr, c.hops.Len()-1)
+	stream, err := c.NewStreamWith(addr, c.hops.Len()-1, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -83,20 +96,29 @@ func newNTorHandshake(r *common.RouterStatus) (*handshakes.Client_NTorHandshake,
 	}, nil
 }
 
+// linkSpecsFor returns the EXTEND2 link specifiers of r: every ORPort it
+// has, its RSA identity and its ed25519 identity.
 func linkSpecsFor(r *common.RouterStatus) ([]lspec.Lspec, error) {
-	if r.Ipv4Addr == "" || r.ORPort == 0 {
-		return nil, Publicf(ErrExtend, "relay %s missing OR address", r.Nickname)
+	var specs []lspec.Lspec
+	for _, get := range []func() (netip.AddrPort, bool){r.IPv4AddrPort, r.IPv6AddrPort} {
+		ap, ok := get()
+		if !ok {
+			continue
+		}
+		ip, err := lspec.NewLespecFromIPText(ap.String())
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, ip)
 	}
-	ip, err := lspec.NewLespecFromIPText(fmt.Sprintf("%s:%d", r.Ipv4Addr, r.ORPort))
-	if err != nil {
-		return nil, err
+	if len(specs) == 0 {
+		return nil, Publicf(ErrExtend, "relay %s missing OR address", r.Nickname)
 	}
 	if len(r.IdEd25519) != 32 {
 		return nil, Publicf(ErrExtend, "relay %s missing ed25519 id", r.Nickname)
 	}
-	return []lspec.Lspec{
-		ip,
+	return append(specs,
 		lspec.NewNodeID(r.NodeID),
 		lspec.NewEd25519ID(r.IdEd25519),
-	}, nil
+	), nil
 }
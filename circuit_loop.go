@@ -2,6 +2,7 @@ package gonion
 
 import (
 	"bytes"
+	"errors"
 
 	cells "github.com/robogg133/gonion/pkg/cells/base"
 	"github.com/robogg133/gonion/pkg/cells/relay"
@@ -16,6 +17,10 @@ func (c *Circuit) readloop() {
 		select {
 		case rawCell := <-c.Inbound:
 			cell, err := c.Coder.ReadCell(bytes.NewReader(rawCell))
+			if errors.Is(err, cells.ErrUnknownCommandID) {
+				log.Debug().Err(err).Msg("unknown cell on circuit skipped")
+				continue
+			}
 			if err != nil {
 				pub := fail(c.Ctx, ErrIO, "decode inbound cell failed", err)
 				c.ctxCancel(pub)
@@ -39,6 +44,7 @@ func (c *Circuit) readloop() {
 					c.ctxCancel(pub)
 					return
 				}
+				c.padding.Event(paddingEvent(rcCell, false))
 
 				if rcCell.GetStreamID() == 0 {
 					c.relayControlFunc(rcCell, hopN)
@@ -79,6 +85,7 @@ func (c *Circuit) readloop() {
 				go c.handleCell(cell)
 			}
 		case <-c.Ctx.Done():
+			c.padding.StopAll()
 			return
 		}
 	}
@@ -127,6 +134,7 @@ func (c *Circuit) writeLoop() {
 			if err := c.SendCell(&cells.RelayCell{Body: body}); err != nil {
 				return
 			}
+			c.padding.Event(paddingEvent(out.Cell, true))
 
 		case <-c.Ctx.Done():
 			return
@@ -159,6 +167,10 @@ func (c *Circuit) relayControlFunc(rc relay.Cell, dst int) {
 		default:
 			log.Warn().Msg("EXTENDED2 dropped (no waiter)")
 		}
+	case relay.COMMAND_DROP:
+		// Long-range padding; already counted by the padding machines.
+	case relay.COMMAND_PADDING_NEGOTIATED:
+		c.handlePaddingNegotiated(rc.(*relay.PaddingNegotiatedCell))
 	default:
 		log.Debug().Msg("unhandled circuit control relay")
 	}
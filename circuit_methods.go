@@ -3,26 +3,42 @@ package gonion
 import (
 	"bufio"
 	"context"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/robogg133/gonion/pkg/common"
+	"github.com/robogg133/gonion/pkg/dircompress"
 )
 
 const (
 	HTTP_PATH_CONSENSUS_MICRODESC        string = "/tor/status-vote/current/consensus-microdesc"
 	HTTP_PATH_MICRODESCRIPTOR_DIR_FORMAT string = "/tor/micro/d/%s"
+	HTTP_PATH_SERVER_DESCRIPTOR_SELF     string = "/tor/server/authority"
+
+	HTTP_HEADER_DIFF_FROM string = "X-Or-Diff-From-Consensus"
 )
 
 const (
 	TIMEOUT_DOWNLOADS time.Duration = 10 * time.Minute
 )
 
+// GetConsensus fetches the full microdesc consensus.
 func (c *Circuit) GetConsensus() (*common.Consensus, error) {
+	return c.GetConsensusFrom(nil)
+}
+
+// GetConsensusFrom fetches the current consensus. When base kept its
+// document, the directory is asked for a diff from it (prop140) and the
+// diff is applied and checked before parsing; a directory without that
+// diff answers with the full consensus, which is used as is.
+func (c *Circuit) GetConsensusFrom(base *common.Consensus) (*common.Consensus, error) {
 	log := logger(c.Ctx).With().Str("job", "get_consensus").Logger()
-	log.Info().Msg("fetching consensus")
+	wantDiff := base != nil && base.Raw != nil
+	log.Info().Bool("diff", wantDiff).Msg("fetching consensus")
 
 	s, err := c.NewStream("dir", 0)
 	if err != nil {
@@ -36,6 +52,10 @@ func (c *Circuit) GetConsensus() (*common.Consensus, error) {
 	if err != nil {
 		return nil, fail(c.Ctx, ErrDirectory, "build consensus request failed", err)
 	}
+	req.Header.Set("Accept-Encoding", dircompress.ACCEPT_ENCODING)
+	if wantDiff {
+		req.Header.Set(HTTP_HEADER_DIFF_FROM, strings.ToUpper(hex.EncodeToString(base.Digest[:])))
+	}
 
 	go func() {
 		<-s.Ctx.Done()
@@ -57,7 +77,41 @@ func (c *Circuit) GetConsensus() (*common.Consensus, error) {
 		return nil, Publicf(ErrDirectory, "consensus HTTP status %d", consensusResp.StatusCode)
 	}
 
-	consensus, err := common.ParseConsensus(bufio.NewScanner(consensusResp.Body))
+	body, err := dircompress.NewReader(consensusResp.Body, consensusResp.Header.Get("Content-Encoding"), req.URL.Path)
+	if err != nil {
+		return nil, fail(c.Ctx, ErrDirectory, "decode consensus response failed", err)
+	}
+	defer body.Close()
+	br := bufio.NewReader(body)
+
+	// A full consensus is parsed as it arrives; a diff has to be applied
+	// to the whole base first.
+	head, _ := br.Peek(len(common.CONSDIFF_HEADER) + 1)
+	if !common.IsConsensusDiff(head) {
+		consensus, err := common.ParseConsensusReader(br)
+		if err != nil {
+			return nil, fail(c.Ctx, ErrDirectory, "parse consensus failed", err)
+		}
+		log.Info().Int("relays", len(consensus.RelayInformation)).Msg("consensus parsed")
+		return consensus, nil
+	}
+	if !wantDiff {
+		return nil, Public(ErrDirectory, "unrequested consensus diff")
+	}
+
+	diff, err := io.ReadAll(br)
+	if err != nil {
+		return nil, fail(c.Ctx, ErrDirectory, "read consensus diff failed", err)
+	}
+	doc, err := common.ApplyConsensusDiff(base.Raw, diff)
+	if err != nil {
+		// A bad diff costs one full download, not the refresh.
+		log.Warn().Err(err).Msg("consensus diff rejected; fetching full consensus")
+		return c.GetConsensusFrom(nil)
+	}
+	log.Info().Int("diff_bytes", len(diff)).Int("consensus_bytes", len(doc)).Msg("consensus diff applied")
+
+	consensus, err := common.ParseConsensusDocument(doc)
 	if err != nil {
 		return nil, fail(c.Ctx, ErrDirectory, "parse consensus failed", err)
 	}
@@ -88,6 +142,7 @@ func (c *Circuit) GetMicrodescriptors(src []string) ([]*common.Microdesc, error)
 	if err != nil {
 		return nil, fail(c.Ctx, ErrDirectory, "build microdesc request failed", err)
 	}
+	req.Header.Set("Accept-Encoding", dircompress.ACCEPT_ENCODING)
 
 	go func() {
 		<-ctx.Done()
@@ -109,7 +164,13 @@ func (c *Circuit) GetMicrodescriptors(src []string) ([]*common.Microdesc, error)
 		return nil, Publicf(ErrDirectory, "microdescriptor HTTP status %d", microDescs.StatusCode)
 	}
 
-	out, err := common.ParseMicrodescFile(bufio.NewScanner(microDescs.Body), src)
+	body, err := dircompress.NewReader(microDescs.Body, microDescs.Header.Get("Content-Encoding"), req.URL.Path)
+	if err != nil {
+		return nil, fail(c.Ctx, ErrDirectory, "decode microdesc response failed", err)
+	}
+	defer body.Close()
+
+	out, err := common.ParseMicrodescFile(bufio.NewScanner(body), src)
 	if err != nil {
 		return nil, fail(c.Ctx, ErrDirectory, "parse microdescriptors failed", err)
 	}
@@ -117,6 +178,61 @@ func (c *Circuit) GetMicrodescriptors(src []string) ([]*common.Microdesc, error)
 	return out, nil
 }
 
+// GetServerDescriptor asks the first hop for its own server descriptor.
+// Bridges are not in the consensus, so this is how a client learns their
+// onion keys.
+func (c *Circuit) GetServerDescriptor() (*common.ServerDescriptor, error) {
+	log := logger(c.Ctx).With().Str("job", "get_server_descriptor").Logger()
+	log.Debug().Msg("fetching server descriptor")
+
+	s, err := c.NewStream("dir", 0)
+	if err != nil {
+		return nil, fail(c.Ctx, ErrDirectory, "open directory stream failed", err)
+	}
+
+	ctx, cancel := context.WithTimeout(c.Ctx, TIMEOUT_DOWNLOADS)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", HTTP_PATH_SERVER_DESCRIPTOR_SELF, nil)
+	if err != nil {
+		return nil, fail(c.Ctx, ErrDirectory, "build server descriptor request failed", err)
+	}
+	req.Header.Set("Accept-Encoding", dircompress.ACCEPT_ENCODING)
+
+	go func() {
+		<-ctx.Done()
+		s.Free()
+	}()
+
+	if err := req.Write(s); err != nil {
+		return nil, fail(c.Ctx, ErrDirectory, "write server descriptor request failed", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(s.Reader), req)
+	if err != nil {
+		return nil, fail(c.Ctx, ErrDirectory, "read server descriptor response failed", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Error().Int("status", resp.StatusCode).Msg("server descriptor HTTP error")
+		return nil, Publicf(ErrDirectory, "server descriptor HTTP status %d", resp.StatusCode)
+	}
+
+	body, err := dircompress.NewReader(resp.Body, resp.Header.Get("Content-Encoding"), req.URL.Path)
+	if err != nil {
+		return nil, fail(c.Ctx, ErrDirectory, "decode server descriptor response failed", err)
+	}
+	defer body.Close()
+
+	desc, err := common.ParseServerDescriptor(body)
+	if err != nil {
+		return nil, fail(c.Ctx, ErrDirectory, "parse server descriptor failed", err)
+	}
+	log.Debug().Str("nickname", desc.Nickname).Msg("server descriptor parsed")
+	return desc, nil
+}
+
 func buildURL(digests []string) (string, error) {
 	var builder strings.Builder
 	for _, str := range digests {
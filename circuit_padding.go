@@ -0,0 +1,150 @@
+package gonion
+
+import (
+	"context"
+
+	"github.com/robogg133/gonion/pkg/cells/relay"
+	"github.com/robogg133/gonion/pkg/circpad"
+)
+
+// maxPaddingMachines mirrors tor CIRCPAD_MAX_MACHINES.
+const maxPaddingMachines = 2
+
+// NegotiatePadding starts machine m on the circuit and asks hop m.TargetHop
+// to run its peer machine. It blocks until the relay answers
+// PADDING_NEGOTIATED; a refusal tears our side down again.
+//
+// Onion clients should call it with circpad.ClientHideIntroMachine right
+// before INTRODUCE1 and circpad.ClientHideRendMachine right after
+// ESTABLISH_RENDEZVOUS.
+func (c *Circuit) NegotiatePadding(m *circpad.Machine) error {
+	log := logger(c.Ctx).With().
+		Str("machine", m.Name).
+		Uint8("machine_type", m.Number).
+		Int("target_hop", m.TargetHop).
+		Logger()
+
+	dst := m.TargetHop - 1
+	if dst < 0 || dst >= c.hops.Len() {
+		return failf(c.Ctx, ErrInvalidHop, nil, "padding target hop %d out of range", m.TargetHop)
+	}
+
+	var (
+		rt   *circpad.Runtime
+		slot int
+		ctr  uint32
+		ok   bool
+	)
+	rt = circpad.NewRuntime(m,
+		func() { c.sendPadding(dst) },
+		func() { go c.paddingEnded(slot, ctr, rt, dst) },
+	)
+	slot, ctr, ok = c.padding.attach(rt)
+	if !ok {
+		rt.Stop()
+		return Public(ErrPadding, "no free padding machine slot")
+	}
+
+	log.Debug().Uint32("machine_ctr", ctr).Msg("negotiating circuit padding")
+	if err := c.writeRelay(&relay.PaddingNegotiateCell{
+		Command:     relay.PADDING_COMMAND_START,
+		MachineType: m.Number,
+		MachineCtr:  ctr,
+	}, dst); err != nil {
+		c.padding.detach(slot, rt)
+		return err
+	}
+
+	for {
+		var resp *relay.PaddingNegotiatedCell
+		select {
+		case resp = <-c.paddingNegotiated:
+		case <-c.Ctx.Done():
+			c.padding.detach(slot, rt)
+			return fail(c.Ctx, ErrPadding, "circuit closed while waiting PADDING_NEGOTIATED", context.Cause(c.Ctx))
+		}
+
+		if resp.MachineType != m.Number || resp.MachineCtr != ctr {
+			log.Debug().Uint8("resp_type", resp.MachineType).Uint32("resp_ctr", resp.MachineCtr).Msg("stale PADDING_NEGOTIATED ignored")
+			continue
+		}
+		if resp.Response != relay.PADDING_RESPONSE_OK {
+			c.padding.detach(slot, rt)
+			log.Warn().Uint8("response", resp.Response).Msg("relay refused padding machine")
+			return Publicf(ErrPadding, "relay refused machine %s", m.Name)
+		}
+		log.Debug().Msg("circuit padding negotiated")
+		return nil
+	}
+}
+
+// sendPadding queues one RELAY_DROP towards hop dst. It runs on the padding
+// timer goroutine.
+func (c *Circuit) sendPadding(dst int) {
+	select {
+	case c.WriteRelayCell <- RelayOut{Cell: &relay.DropCell{}, Dst: dst}:
+	case <-c.Ctx.Done():
+	}
+}
+
+// paddingEnded releases a finished machine and, when the machine asks for
+// it, tells the relay to stop its half. ctr is the counter sent at START;
+// tor reads a zero counter as "any machine of this type".
+func (c *Circuit) paddingEnded(slot int, ctr uint32, rt *circpad.Runtime, dst int) {
+	c.padding.detach(slot, rt)
+	m := rt.Machine()
+	logger(c.Ctx).Debug().Str("machine", m.Name).Msg("padding machine finished")
+	if !m.ShouldNegotiateEnd {
+		return
+	}
+	_ = c.writeRelay(&relay.PaddingNegotiateCell{
+		Command:     relay.PADDING_COMMAND_STOP,
+		MachineType: m.Number,
+		MachineCtr:  ctr,
+	}, dst)
+}
+
+// handlePaddingNegotiated routes a PADDING_NEGOTIATED: START answers go to
+// the NegotiatePadding waiter, STOP means the relay has shut its half down.
+func (c *Circuit) handlePaddingNegotiated(cell *relay.PaddingNegotiatedCell) {
+	log := logger(c.Ctx).With().Uint8("machine_type", cell.MachineType).Logger()
+
+	if cell.Command == relay.PADDING_COMMAND_STOP {
+		if slot, rt := c.padding.byType(cell.MachineType); rt != nil {
+			c.padding.detach(slot, rt)
+			log.Debug().Msg("relay stopped padding machine")
+		}
+		return
+	}
+
+	select {
+	case c.paddingNegotiated <- cell:
+	case <-c.Ctx.Done():
+	default:
+		log.Warn().Msg("PADDING_NEGOTIATED dropped (no waiter)")
+	}
+}
+
+// paddingEvent classifies a relay cell for the padding machines.
+func paddingEvent(rc relay.Cell, sent bool) circpad.Event {
+	drop := rc.ID() == relay.COMMAND_DROP
+	switch {
+	case sent && drop:
+		return circpad.EventPaddingSent
+	case sent:
+		return circpad.EventNonPaddingSent
+	case drop:
+		return circpad.EventPaddingRecv
+	default:
+		return circpad.EventNonPaddingRecv
+	}
+}
+
+func (c *Circuit) writeRelay(cell relay.Cell, dst int) error {
+	select {
+	case c.WriteRelayCell <- RelayOut{Cell: cell, Dst: dst}:
+		return nil
+	case <-c.Ctx.Done():
+		return fail(c.Ctx, ErrClosed, "circuit closed", context.Cause(c.Ctx))
+	}
+}
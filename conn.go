@@ -10,10 +10,15 @@ import (
 	"net/netip"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/robogg133/gonion/internal/circid"
 	cells "github.com/robogg133/gonion/pkg/cells/base"
+	"github.com/robogg133/gonion/pkg/clock"
+	"github.com/robogg133/gonion/pkg/common"
 	"github.com/robogg133/gonion/pkg/crypto"
+	"github.com/robogg133/gonion/pkg/pathbias"
 )
 
 const CONNECTION_TIMEOUT = 60 * time.Second
@@ -21,12 +26,15 @@ const CONNECTION_TIMEOUT = 60 * time.Second
 type Conn struct {
 	socket         net.Conn
 	circuits       *circuits
+	ids            *circid.Allocator
 	ProtcolVersion uint16
 
 	netInfo cells.NetInfoCell
 
 	Cert *x509.Certificate
 
+	identity *crypto.LinkIdentity
+
 	userDataPipeWriter *io.PipeWriter
 	userDataPipeReader *io.PipeReader
 
@@ -40,6 +48,11 @@ type Conn struct {
 	exitID  uint32
 
 	cellBodyLen int
+
+	padding *linkPadding
+
+	params   atomic.Pointer[common.NetParams]
+	pathBias atomic.Pointer[pathbias.Tracker]
 }
 
 // NewConn performs the Tor link handshake on c.
@@ -64,6 +77,7 @@ func NewConn(c net.Conn, logOut io.Writer, debug bool) (*Conn, error) {
 			circs: make(map[uint32]*Circuit),
 		},
 		cellBodyLen: cells.CELL_BODY_LEN,
+		padding:     newLinkPadding(),
 	}
 
 	log := logger(ctx)
@@ -93,6 +107,7 @@ func NewConn(c net.Conn, logOut io.Writer, debug bool) (*Conn, error) {
 	ctx = conn.ctx
 	log = logger(ctx)
 	log.Info().Uint16("link_version", conn.ProtcolVersion).Msg("version negotiated")
+	conn.ids = circid.New(conn.ProtcolVersion, circid.DEFAULT_MAX_CIRCUITS)
 
 	coder := cells.NewCellCoder(cells.AllKnownCells)
 
@@ -109,29 +124,22 @@ func NewConn(c net.Conn, logOut io.Writer, debug bool) (*Conn, error) {
 	}
 
 	certs := pkg.(*cells.CertsCell)
-	var cert4 *crypto.TorCert
-	var cert5 *crypto.TorCert
+	byType := make(map[uint8][]byte, len(certs.Certificates))
 	for _, v := range certs.Certificates {
-		switch v.Type {
-		case 4:
-			cert4, err = crypto.ParseIdentityVSigningCert(v.Cert)
-			if err != nil {
-				cancel(err)
-				return nil, fail(ctx, ErrHandshake, "parse identity cert failed", err)
-			}
-		case 5:
-			cert5, err = crypto.ParseIdentityVSigningCert(v.Cert)
-			if err != nil {
-				cancel(err)
-				return nil, fail(ctx, ErrHandshake, "parse signing cert failed", err)
-			}
+		if _, dup := byType[v.Type]; dup {
+			pub := Publicf(ErrProtocolViolation, "duplicate certificate type %d", v.Type)
+			log.Error().Uint8("cert_type", v.Type).Msg("duplicate certificate in CERTS")
+			cancel(pub)
+			return nil, pub
 		}
+		byType[v.Type] = v.Cert
 	}
-	if err := crypto.VerifyConnection(cert4, cert5, conn.Cert.Raw); err != nil {
+	conn.identity, err = crypto.VerifyLinkCerts(byType, conn.Cert.Raw, time.Now())
+	if err != nil {
 		cancel(err)
 		return nil, fail(ctx, ErrHandshake, "certificate verification failed", err)
 	}
-	log.Debug().Msg("certs verified")
+	log.Debug().Hex("rsa_id", conn.identity.RSA[:]).Msg("certs verified")
 
 	if err := discardAuthChallenge(ctx, conn.socket); err != nil {
 		cancel(err)
@@ -152,6 +160,7 @@ func NewConn(c net.Conn, logOut io.Writer, debug bool) (*Conn, error) {
 
 	netinfo := pkg.(*cells.NetInfoCell)
 	conn.netInfo = *netinfo
+	conn.observeClock(time.Now())
 
 	info := cells.NetInfoCell{
 		CircuitID: 0,
@@ -172,10 +181,29 @@ func NewConn(c net.Conn, logOut io.Writer, debug bool) (*Conn, error) {
 	log.Info().Msg("link ready")
 	go conn.readLoop()
 	go conn.writeLoop()
+	go conn.paddingLoop()
 
 	return conn, nil
 }
 
+// observeClock feeds the relay's NETINFO timestamp, received at recv, to
+// clock.Default and warns when this relay disagrees with our clock.
+func (conn *Conn) observeClock(recv time.Time) {
+	skew, ok := clock.Default.ObserveNetInfo(string(conn.identity.RSA[:]), conn.netInfo.Timestamp, recv)
+	if !ok {
+		return
+	}
+	log := logger(conn.ctx)
+	if skew > clock.DEFAULT_SKEW_THRESHOLD || skew < -clock.DEFAULT_SKEW_THRESHOLD {
+		log.Warn().
+			Dur("skew", skew).
+			Dur("estimated_skew", clock.Skew()).
+			Msg("relay clock differs from ours; check the system clock")
+		return
+	}
+	log.Debug().Dur("skew", skew).Msg("relay clock observed")
+}
+
 func (conn *Conn) Close() error {
 	logger(conn.ctx).Info().Msg("closing connection")
 	conn.ctxCancel(ErrClosed)
@@ -186,6 +214,47 @@ func (conn *Conn) Context() context.Context {
 	return conn.ctx
 }
 
+// SetNetParams replaces the consensus parameters new circuits use.
+func (conn *Conn) SetNetParams(p common.NetParams) {
+	conn.params.Store(&p)
+}
+
+// NetParams returns the consensus parameters in use, the defaults until
+// SetNetParams is called.
+func (conn *Conn) NetParams() common.NetParams {
+	if p := conn.params.Load(); p != nil {
+		return *p
+	}
+	return common.DefaultNetParams()
+}
+
+// UseConsensus applies the parameters of cns to the link: padding
+// timeouts and the values new circuits start with.
+func (conn *Conn) UseConsensus(cns *common.Consensus) {
+	np := cns.NetParams()
+	conn.SetNetParams(np)
+	conn.SetPaddingParams(LinkPaddingParamsFrom(cns))
+	if t := conn.pathBias.Load(); t != nil {
+		t.SetParams(np)
+	}
+}
+
+// CircuitCount is the number of circuits open on the connection.
+func (conn *Conn) CircuitCount() int {
+	return conn.ids.InUse()
+}
+
+// CircuitCapacity is how many more circuits the connection accepts.
+func (conn *Conn) CircuitCapacity() int {
+	return conn.ids.Capacity()
+}
+
+// SetMaxCircuits caps the circuits open on the connection; n <= 0 restores
+// the default. Circuits already open are not closed.
+func (conn *Conn) SetMaxCircuits(n int) {
+	conn.ids.SetMax(n)
+}
+
 func setupTls(ctx context.Context, c net.Conn) (net.Conn, *x509.Certificate, error) {
 	tctx, cancel := context.WithTimeout(ctx, CONNECTION_TIMEOUT)
 	defer cancel()
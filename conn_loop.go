@@ -30,7 +30,19 @@ func (c *Conn) readLoop() {
 			return
 		}
 
-		buf := make([]byte, cells.CELL_BODY_LEN)
+		bodyLen := c.cellBodyLen
+		if cells.IsVariableLength(cmd) {
+			length := make([]byte, 2)
+			if _, err := io.ReadFull(c.socket, length); err != nil {
+				log.Error().Err(err).Uint8("cmd", cmd).Msg("read cell length failed")
+				c.ctxCancel(fail(c.ctx, ErrIO, "connection read failed", err))
+				return
+			}
+			buffer.Write(length)
+			bodyLen = int(binary.BigEndian.Uint16(length))
+		}
+
+		buf := make([]byte, bodyLen)
 		if _, err := io.ReadFull(c.socket, buf); err != nil {
 			log.Error().Err(err).Uint8("cmd", cmd).Msg("read cell body failed")
 			c.ctxCancel(fail(c.ctx, ErrIO, "connection read failed", err))
@@ -42,6 +54,11 @@ func (c *Conn) readLoop() {
 			return
 		}
 
+		if circuitID == 0 {
+			c.handleLinkCell(cmd, buffer.Bytes())
+			continue
+		}
+
 		circuit := c.circuits.Get(circuitID)
 		if circuit == nil {
 			log.Debug().Uint32("circ_id", circuitID).Uint8("cmd", cmd).Msg("cell for unknown circuit dropped")
@@ -72,8 +89,23 @@ func (c *Conn) writeLoop() {
 				c.ctxCancel(fail(c.ctx, ErrIO, "connection write failed", err))
 				return
 			}
+			c.padding.touch()
 		case <-c.ctx.Done():
 			return
 		}
 	}
 }
+
+// handleLinkCell consumes circuit-0 cells received after the handshake.
+func (c *Conn) handleLinkCell(cmd uint8, raw []byte) {
+	log := logger(c.ctx).With().Uint8("cmd", cmd).Logger()
+
+	switch cmd {
+	case cells.COMMAND_PADDING, cells.COMMAND_VPADDING:
+	case cells.COMMAND_PADDING_NEGOTIATE:
+		// Only relays act on PADDING_NEGOTIATE.
+		log.Debug().Msg("PADDING_NEGOTIATE from relay ignored")
+	default:
+		log.Debug().Int("len", len(raw)).Msg("unhandled link cell skipped")
+	}
+}
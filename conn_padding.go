@@ -0,0 +1,237 @@
+package gonion
+
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cells "github.com/robogg133/gonion/pkg/cells/base"
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+// PaddingMode selects how much link padding a Conn sends and asks its relay
+// for (tor ConnectionPadding / ReducedConnectionPadding).
+type PaddingMode uint8
+
+const (
+	// PaddingNormal pads with the consensus timeouts.
+	PaddingNormal PaddingMode = iota
+	// PaddingReduced pads less often, for mobile and metered links.
+	PaddingReduced
+	// PaddingDisabled sends no padding and asks the relay to stop.
+	PaddingDisabled
+)
+
+// Link padding consensus defaults (padding-spec §2.6).
+const (
+	DEFAULT_NF_ITO_LOW          = 1500
+	DEFAULT_NF_ITO_HIGH         = 9500
+	DEFAULT_NF_ITO_LOW_REDUCED  = 9000
+	DEFAULT_NF_ITO_HIGH_REDUCED = 14000
+)
+
+// LinkPaddingParams are the link padding timeouts, in milliseconds.
+type LinkPaddingParams struct {
+	ItoLow         uint16
+	ItoHigh        uint16
+	ItoLowReduced  uint16
+	ItoHighReduced uint16
+
+	// PadBeforeUsage pads links that carry no circuit yet.
+	PadBeforeUsage bool
+}
+
+// DefaultLinkPaddingParams returns the padding-spec defaults.
+func DefaultLinkPaddingParams() LinkPaddingParams {
+	return LinkPaddingParams{
+		ItoLow:         DEFAULT_NF_ITO_LOW,
+		ItoHigh:        DEFAULT_NF_ITO_HIGH,
+		ItoLowReduced:  DEFAULT_NF_ITO_LOW_REDUCED,
+		ItoHighReduced: DEFAULT_NF_ITO_HIGH_REDUCED,
+		PadBeforeUsage: true,
+	}
+}
+
+// LinkPaddingParamsFrom reads the nf_* consensus parameters, falling back
+// to the defaults for missing or out-of-range values.
+func LinkPaddingParamsFrom(cns *common.Consensus) LinkPaddingParams {
+	np := cns.NetParams()
+	return LinkPaddingParams{
+		ItoLow:         uint16(np.NfItoLow),
+		ItoHigh:        uint16(np.NfItoHigh),
+		ItoLowReduced:  uint16(np.NfItoLowReduced),
+		ItoHighReduced: uint16(np.NfItoHighReduced),
+		PadBeforeUsage: np.NfPadBeforeUsage,
+	}
+}
+
+// timeouts returns the low/high bounds used in mode. ok is false when
+// padding is off, either by mode or because the consensus set both to 0.
+func (p LinkPaddingParams) timeouts(mode PaddingMode) (low, high uint16, ok bool) {
+	switch mode {
+	case PaddingNormal:
+		low, high = p.ItoLow, p.ItoHigh
+	case PaddingReduced:
+		low, high = p.ItoLowReduced, p.ItoHighReduced
+	default:
+		return 0, 0, false
+	}
+	if low == 0 && high == 0 {
+		return 0, 0, false
+	}
+	if high < low {
+		high = low
+	}
+	return low, high, true
+}
+
+// sampleTimeout draws max(X, Y) with X, Y uniform in [low, high], which
+// skews the keepalive towards the upper bound (padding-spec §2.3).
+func sampleTimeout(low, high uint16) time.Duration {
+	draw := func() uint16 {
+		return low + uint16(rand.IntN(int(high-low)+1))
+	}
+	return time.Duration(max(draw(), draw())) * time.Millisecond
+}
+
+// linkPadding is the per-Conn channel padding state.
+type linkPadding struct {
+	mu     sync.Mutex
+	mode   PaddingMode
+	params LinkPaddingParams
+
+	// kick wakes the padding loop after a mode or params change.
+	kick chan struct{}
+
+	lastWrite atomic.Int64
+}
+
+func newLinkPadding() *linkPadding {
+	lp := &linkPadding{
+		mode:   PaddingNormal,
+		params: DefaultLinkPaddingParams(),
+		kick:   make(chan struct{}, 1),
+	}
+	lp.touch()
+	return lp
+}
+
+// touch records that a cell was just written.
+func (lp *linkPadding) touch() { lp.lastWrite.Store(time.Now().UnixNano()) }
+
+func (lp *linkPadding) wake() {
+	select {
+	case lp.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (lp *linkPadding) get() (PaddingMode, LinkPaddingParams) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.mode, lp.params
+}
+
+// SetPaddingMode changes our padding and tells the relay with a
+// PADDING_NEGOTIATE: reduced mode asks for the reduced timeouts, disabled
+// asks it to stop.
+func (conn *Conn) SetPaddingMode(mode PaddingMode) error {
+	conn.padding.mu.Lock()
+	conn.padding.mode = mode
+	params := conn.padding.params
+	conn.padding.mu.Unlock()
+	conn.padding.wake()
+
+	neg := &cells.PaddingNegotiateCell{Command: cells.PADDING_NEGOTIATE_STOP}
+	if low, high, ok := params.timeouts(mode); ok {
+		neg = &cells.PaddingNegotiateCell{
+			Command:   cells.PADDING_NEGOTIATE_START,
+			ItoLowMs:  low,
+			ItoHighMs: high,
+		}
+	}
+	logger(conn.ctx).Debug().
+		Uint8("mode", uint8(mode)).
+		Uint8("command", neg.Command).
+		Uint16("ito_low_ms", neg.ItoLowMs).
+		Uint16("ito_high_ms", neg.ItoHighMs).
+		Msg("negotiating link padding")
+	return conn.sendLinkCell(neg)
+}
+
+// SetPaddingParams replaces the padding timeouts, usually with
+// LinkPaddingParamsFrom(consensus) after each consensus fetch.
+func (conn *Conn) SetPaddingParams(p LinkPaddingParams) {
+	conn.padding.mu.Lock()
+	conn.padding.params = p
+	conn.padding.mu.Unlock()
+	conn.padding.wake()
+}
+
+// paddingLoop sends a PADDING cell whenever the link has been idle for a
+// freshly sampled timeout.
+func (conn *Conn) paddingLoop() {
+	log := logger(conn.ctx)
+	log.Debug().Msg("padding loop started")
+	defer log.Debug().Msg("padding loop stopped")
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	// One timeout is drawn per idle period, i.e. per value of lastWrite.
+	var (
+		timeout time.Duration
+		since   int64
+	)
+	for {
+		mode, params := conn.padding.get()
+		low, high, ok := params.timeouts(mode)
+
+		wait := time.Hour
+		if ok {
+			if last := conn.padding.lastWrite.Load(); timeout == 0 || last != since {
+				since = last
+				timeout = sampleTimeout(low, high)
+			}
+			wait = time.Until(time.Unix(0, since).Add(timeout))
+			if wait <= 0 {
+				if params.PadBeforeUsage || conn.circuits.Len() > 0 {
+					if err := conn.sendLinkCell(&cells.PaddingCell{}); err != nil {
+						return
+					}
+					conn.padding.touch()
+					log.Trace().Dur("timeout", timeout).Msg("link padding sent")
+					continue
+				}
+				timeout = 0
+				wait = time.Duration(high) * time.Millisecond
+			}
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-conn.padding.kick:
+			timer.Stop()
+			timeout = 0
+		case <-conn.ctx.Done():
+			return
+		}
+	}
+}
+
+// sendLinkCell queues a circuit-0 link cell.
+func (conn *Conn) sendLinkCell(cell cells.Cell) error {
+	cell.SetCircuitID(0)
+	b, err := cells.NewCellCoder(cells.AllKnownCells).MarshalCell(cell)
+	if err != nil {
+		return fail(conn.ctx, ErrIO, "marshal link cell failed", err)
+	}
+	select {
+	case conn.writeCall <- b:
+		return nil
+	case <-conn.ctx.Done():
+		return Public(ErrClosed, "connection closed")
+	}
+}
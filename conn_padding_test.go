@@ -0,0 +1,40 @@
+package gonion_test
+
+import (
+	"testing"
+
+	"github.com/robogg133/gonion"
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+func TestLinkPaddingParamsFrom_Defaults(t *testing.T) {
+	want := gonion.DefaultLinkPaddingParams()
+	if got := gonion.LinkPaddingParamsFrom(nil); got != want {
+		t.Fatalf("nil consensus: got %+v", got)
+	}
+	if got := gonion.LinkPaddingParamsFrom(&common.Consensus{}); got != want {
+		t.Fatalf("empty params: got %+v", got)
+	}
+	if want.ItoLow != 1500 || want.ItoHigh != 9500 || want.ItoLowReduced != 9000 || want.ItoHighReduced != 14000 {
+		t.Fatalf("defaults drifted from padding-spec: %+v", want)
+	}
+}
+
+func TestLinkPaddingParamsFrom_Consensus(t *testing.T) {
+	cns := &common.Consensus{Params: map[string]int32{
+		"nf_ito_low":          2000,
+		"nf_ito_high":         8000,
+		"nf_ito_high_reduced": -1,
+		"nf_pad_before_usage": 0,
+	}}
+	got := gonion.LinkPaddingParamsFrom(cns)
+	if got.ItoLow != 2000 || got.ItoHigh != 8000 {
+		t.Fatalf("ito=%d/%d", got.ItoLow, got.ItoHigh)
+	}
+	if got.ItoHighReduced != gonion.DEFAULT_NF_ITO_HIGH_REDUCED {
+		t.Fatalf("out-of-range param not clamped to default: %d", got.ItoHighReduced)
+	}
+	if got.PadBeforeUsage {
+		t.Fatal("nf_pad_before_usage=0 ignored")
+	}
+}
@@ -0,0 +1,230 @@
+package gonion
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"io"
+	"net"
+	"time"
+
+	"github.com/robogg133/gonion/pkg/common"
+	"github.com/robogg133/gonion/pkg/netdir"
+	"github.com/robogg133/gonion/pkg/pathbias"
+	"github.com/robogg133/gonion/pkg/upstream"
+	"golang.org/x/net/proxy"
+)
+
+const DIAL_TIMEOUT = 15 * time.Second
+
+// HAPPY_EYEBALLS_DELAY is the head start of each address over the next
+// when Dial races IPv4 and IPv6 (RFC 8305).
+const HAPPY_EYEBALLS_DELAY = 250 * time.Millisecond
+
+// IPPreference selects which ORPorts Dial uses, like tor's ClientUseIPv4,
+// ClientUseIPv6 and ClientPreferIPv6ORPort.
+type IPPreference uint8
+
+const (
+	// IPv4Only dials the IPv4 ORPort only.
+	IPv4Only IPPreference = iota
+	// PreferIPv4 races both ORPorts, giving IPv4 the head start.
+	PreferIPv4
+	// PreferIPv6 races both ORPorts, giving IPv6 the head start.
+	PreferIPv6
+	// IPv6Only dials the IPv6 ORPort only. Pick guards with
+	// path.ReachableIPv6.
+	IPv6Only
+)
+
+// orAddrs returns the addresses of rs to dial, in order.
+func (p IPPreference) orAddrs(rs *common.RouterStatus) []string {
+	var v4, v6 []string
+	if ap, ok := rs.IPv4AddrPort(); ok && p != IPv6Only {
+		v4 = append(v4, ap.String())
+	}
+	if ap, ok := rs.IPv6AddrPort(); ok && p != IPv4Only {
+		v6 = append(v6, ap.String())
+	}
+	if p == PreferIPv6 {
+		return append(v6, v4...)
+	}
+	return append(v4, v6...)
+}
+
+// RSAIdentity returns the relay fingerprint authenticated by the CERTS cell.
+func (conn *Conn) RSAIdentity() [20]byte {
+	return conn.identity.RSA
+}
+
+// Ed25519Identity returns the relay ed25519 identity authenticated by the
+// CERTS cell.
+func (conn *Conn) Ed25519Identity() ed25519.PublicKey {
+	return conn.identity.Ed25519
+}
+
+// VerifyIdentity checks that the link is authenticated as rs. The ed25519
+// identity is only compared when rs carries one (from its microdescriptor).
+func (conn *Conn) VerifyIdentity(rs *common.RouterStatus) error {
+	log := logger(conn.ctx)
+	if conn.identity.RSA != rs.NodeID {
+		log.Error().
+			Hex("want_rsa_id", rs.NodeID[:]).
+			Hex("got_rsa_id", conn.identity.RSA[:]).
+			Msg("relay RSA identity mismatch")
+		return Publicf(ErrIdentity, "%s: RSA identity mismatch", rs.Nickname)
+	}
+	if len(rs.IdEd25519) > 0 && !bytes.Equal(rs.IdEd25519, conn.identity.Ed25519) {
+		log.Error().
+			Hex("want_ed_id", rs.IdEd25519).
+			Hex("got_ed_id", conn.identity.Ed25519).
+			Msg("relay ed25519 identity mismatch")
+		return Publicf(ErrIdentity, "%s: ed25519 identity mismatch", rs.Nickname)
+	}
+	return nil
+}
+
+// RelayDialer opens authenticated links to relays from the consensus.
+type RelayDialer struct {
+	// LogOut and Debug are passed to NewConn. A nil LogOut disables logging.
+	LogOut io.Writer
+	Debug  bool
+
+	// Timeout bounds the TCP connect; zero means DIAL_TIMEOUT.
+	Timeout time.Duration
+
+	// Upstream, if set, carries every link connection, including
+	// pluggable transport dials; see package upstream. Managed transports
+	// must be launched with the same proxy in managed.Config.ProxyURL,
+	// or their dials fail with managed.ErrUpstreamBypass.
+	Upstream proxy.ContextDialer
+
+	// Dir receives the consensus of a bootstrap; nil means
+	// netdir.Default.
+	Dir *netdir.NetDir
+
+	// IP selects the ORPorts dialed; the zero value is IPv4Only.
+	IP IPPreference
+
+	// PathBias, if set, receives the build and use outcomes of circuits
+	// on every dialed link; see Conn.SetPathBias. Guards it disabled are
+	// refused with ErrGuardDisabled.
+	PathBias *pathbias.Tracker
+}
+
+// Dial connects to rs, runs the link handshake and fails with ErrIdentity
+// when the relay is not the one rs describes.
+func (d *RelayDialer) Dial(rs *common.RouterStatus) (*Conn, error) {
+	if err := d.checkPathBias(rs); err != nil {
+		return nil, err
+	}
+	addrs := d.IP.orAddrs(rs)
+	if len(addrs) == 0 {
+		return nil, Publicf(ErrIO, "%s: no usable address", rs.Nickname)
+	}
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = DIAL_TIMEOUT
+	}
+	ctx := withLogger(context.Background(), newLogger(d.LogOut, d.Debug).With().
+		Str("component", "dial").
+		Str("relay", rs.Nickname).
+		Logger())
+
+	dctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	raw, err := dialHappyEyeballs(dctx, upstream.OrDirect(d.Upstream), addrs)
+	if err != nil {
+		return nil, failf(ctx, ErrIO, err, "dial %s failed", rs.Nickname)
+	}
+	logger(ctx).Debug().Stringer("addr", raw.RemoteAddr()).Msg("relay connected")
+
+	conn, err := NewConn(raw, d.LogOut, d.Debug)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	if err := conn.VerifyIdentity(rs); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetPathBias(d.PathBias)
+	if cns := orDefaultDir(d.Dir).Consensus(); cns != nil {
+		conn.UseConsensus(cns)
+	}
+	return conn, nil
+}
+
+// checkPathBias refuses a guard the path bias tracker disabled.
+func (d *RelayDialer) checkPathBias(rs *common.RouterStatus) error {
+	if d.PathBias != nil && d.PathBias.Disabled(rs.NodeID) {
+		return Publicf(ErrGuardDisabled, "%s", rs.Nickname)
+	}
+	return nil
+}
+
+// dialHappyEyeballs dials addrs in order, starting the next one
+// HAPPY_EYEBALLS_DELAY after the previous, or at once when it fails. The
+// first connection wins and the others are closed.
+func dialHappyEyeballs(ctx context.Context, d proxy.ContextDialer, addrs []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result)
+	next, pending := 0, 0
+	launch := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			c, err := d.DialContext(ctx, "tcp", addr)
+			select {
+			case results <- result{c, err}:
+			case <-ctx.Done():
+				if c != nil {
+					c.Close()
+				}
+			}
+		}()
+	}
+
+	launch()
+	timer := time.NewTimer(HAPPY_EYEBALLS_DELAY)
+	defer timer.Stop()
+
+	var firstErr error
+	for pending > 0 {
+		var head <-chan time.Time
+		if next < len(addrs) {
+			head = timer.C
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				launch()
+				timer.Reset(HAPPY_EYEBALLS_DELAY)
+			}
+		case <-head:
+			launch()
+			timer.Reset(HAPPY_EYEBALLS_DELAY)
+		}
+	}
+	return nil, firstErr
+}
+
+// DialRelay is RelayDialer.Dial with default settings.
+func DialRelay(rs *common.RouterStatus, logOut io.Writer, debug bool) (*Conn, error) {
+	d := &RelayDialer{LogOut: logOut, Debug: debug}
+	return d.Dial(rs)
+}
@@ -0,0 +1,144 @@
+package gonion_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robogg133/gonion"
+	"github.com/robogg133/gonion/pkg/common"
+	"github.com/robogg133/gonion/pkg/pathbias"
+)
+
+// recordDialer fails every dial, after delay for the addresses in slow.
+type recordDialer struct {
+	mu    sync.Mutex
+	addrs []string
+	slow  map[string]time.Duration
+}
+
+func (d *recordDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, addr)
+	d.mu.Unlock()
+	select {
+	case <-time.After(d.slow[addr]):
+	case <-ctx.Done():
+	}
+	return nil, errors.New("unreachable")
+}
+
+func TestRelayDialer_IPPreference(t *testing.T) {
+	rs := &common.RouterStatus{Nickname: "dual", Ipv4Addr: "192.0.2.1", ORPort: 9001}
+	if !rs.SetIPv6("[2001:db8::1]:443") {
+		t.Fatal("SetIPv6 rejected address")
+	}
+	const v4, v6 = "192.0.2.1:9001", "[2001:db8::1]:443"
+
+	for _, tc := range []struct {
+		pref gonion.IPPreference
+		want []string
+	}{
+		{gonion.IPv4Only, []string{v4}},
+		{gonion.IPv6Only, []string{v6}},
+		{gonion.PreferIPv4, []string{v4, v6}},
+		{gonion.PreferIPv6, []string{v6, v4}},
+	} {
+		up := &recordDialer{}
+		d := &gonion.RelayDialer{Upstream: up, IP: tc.pref}
+		if _, err := d.Dial(rs); err == nil {
+			t.Fatal("dial through failing upstream succeeded")
+		}
+		if !slices.Equal(up.addrs, tc.want) {
+			t.Errorf("pref %d dialed %v, want %v", tc.pref, up.addrs, tc.want)
+		}
+	}
+
+	v4only := &common.RouterStatus{Nickname: "v4", Ipv4Addr: "192.0.2.1", ORPort: 9001}
+	if _, err := (&gonion.RelayDialer{IP: gonion.IPv6Only}).Dial(v4only); !errors.Is(err, gonion.ErrIO) {
+		t.Fatalf("err = %v, want ErrIO", err)
+	}
+}
+
+func TestRelayDialer_HappyEyeballsHeadStart(t *testing.T) {
+	rs := &common.RouterStatus{Nickname: "dual", Ipv4Addr: "192.0.2.1", ORPort: 9001}
+	rs.SetIPv6("[2001:db8::1]:443")
+
+	// The preferred address hangs: the other starts after the head start,
+	// not after the timeout.
+	up := &recordDialer{slow: map[string]time.Duration{"[2001:db8::1]:443": time.Hour}}
+	d := &gonion.RelayDialer{Upstream: up, IP: gonion.PreferIPv6, Timeout: time.Second}
+	start := time.Now()
+	go d.Dial(rs)
+	for {
+		up.mu.Lock()
+		n := len(up.addrs)
+		up.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Since(start) > 900*time.Millisecond {
+			t.Fatal("fallback address not tried within the head start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if el := time.Since(start); el < gonion.HAPPY_EYEBALLS_DELAY {
+		t.Fatalf("fallback started after %v, before the head start", el)
+	}
+}
+
+func TestBeginAddrport(t *testing.T) {
+	for _, tc := range []struct {
+		target, want string
+		opts         gonion.DialOptions
+	}{
+		{"example.com:443", "example.com:443", gonion.DialOptions{}},
+		{"192.0.2.1:80", "192.0.2.1:80", gonion.DialOptions{}},
+		{"[2001:db8::1]:443", "[2001:db8::1]:443", gonion.DialOptions{IPv6OK: true, IPv4NotOK: true}},
+	} {
+		got, opts, err := gonion.BeginAddrportForTest(tc.target, gonion.DialOptions{})
+		if err != nil || got != tc.want || opts != tc.opts {
+			t.Errorf("%s: got %q %+v %v", tc.target, got, opts, err)
+		}
+	}
+	for _, bad := range []string{"example.com", "2001:db8::1:443", ":80", "host:0", "host:70000", "[fe80::1%eth0]:80"} {
+		if _, _, err := gonion.BeginAddrportForTest(bad, gonion.DialOptions{}); err == nil {
+			t.Errorf("%s: accepted", bad)
+		}
+	}
+}
+
+func TestRelayDialer_PathBiasDisabledGuard(t *testing.T) {
+	tr := pathbias.New()
+	np := common.DefaultNetParams()
+	np.PBDropGuards = true
+	np.PBMinCircs = 10
+	tr.SetParams(np)
+
+	rs := &common.RouterStatus{Nickname: "guard", NodeID: [20]byte{7}, Ipv4Addr: "192.0.2.1", ORPort: 9001}
+	for range 20 {
+		tr.BuildAttempt(rs.NodeID)
+		tr.BuildFailure(rs.NodeID)
+	}
+	if !tr.Disabled(rs.NodeID) {
+		t.Fatal("guard not disabled")
+	}
+
+	up := &recordDialer{}
+	d := &gonion.RelayDialer{Upstream: up, PathBias: tr}
+	if _, err := d.Dial(rs); !errors.Is(err, gonion.ErrGuardDisabled) {
+		t.Fatalf("err = %v, want ErrGuardDisabled", err)
+	}
+	m := gonion.NewChanMgr(d, 0)
+	defer m.Close()
+	if _, err := m.Get(rs); !errors.Is(err, gonion.ErrGuardDisabled) {
+		t.Fatalf("ChanMgr.Get err = %v, want ErrGuardDisabled", err)
+	}
+	if len(up.addrs) != 0 {
+		t.Fatalf("disabled guard dialed: %v", up.addrs)
+	}
+}
@@ -23,6 +23,10 @@ var (
 	ErrTimeout           = errors.New("gonion: timeout")
 	ErrBootstrap         = errors.New("gonion: bootstrap failed")
 	ErrDirectory         = errors.New("gonion: directory fetch failed")
+	ErrPadding           = errors.New("gonion: padding negotiation failed")
+	ErrIdentity          = errors.New("gonion: relay identity mismatch")
+	ErrUnsupportedProto  = errors.New("gonion: required protocol not supported")
+	ErrGuardDisabled     = errors.New("gonion: guard disabled by path bias")
 )
 
 // publicError is a stable API error. Message is safe for callers; Unwrap is the sentinel.
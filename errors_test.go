@@ -70,6 +70,10 @@ func TestSentinels_UniqueMessages(t *testing.T) {
 		gonion.ErrTimeout,
 		gonion.ErrBootstrap,
 		gonion.ErrDirectory,
+		gonion.ErrPadding,
+		gonion.ErrIdentity,
+		gonion.ErrUnsupportedProto,
+		gonion.ErrGuardDisabled,
 	}
 	seen := map[string]bool{}
 	for _, e := range all {
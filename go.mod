@@ -3,19 +3,21 @@ module github.com/robogg133/gonion
 go 1.25.0
 
 require (
+	filippo.io/edwards25519 v1.1.1
+	github.com/klauspost/compress v1.18.0
 	github.com/rs/zerolog v1.35.1
 	github.com/smallnest/ringbuffer v0.1.2-0.20260703033355-9d1708966377
+	github.com/ulikunitz/xz v0.5.9
 	gitlab.com/yawning/obfs4.git v0.0.0-20231012084234-c3e2d44b1033
 	gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib v1.6.0
+	golang.org/x/crypto v0.53.0
 	golang.org/x/net v0.55.0
 )
 
 require (
-	filippo.io/edwards25519 v1.1.1 // indirect
 	github.com/dchest/siphash v1.2.3 // indirect
 	github.com/mattn/go-colorable v0.1.15 // indirect
 	github.com/mattn/go-isatty v0.0.24 // indirect
 	gitlab.com/yawning/edwards25519-extra v0.0.0-20231005122941-2149dcafc266 // indirect
-	golang.org/x/crypto v0.53.0 // indirect
 	golang.org/x/sys v0.47.0 // indirect
 )
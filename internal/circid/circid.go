@@ -0,0 +1,135 @@
+// Package circid allocates circuit IDs on one link (tor-spec §5.1.1).
+package circid
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_MAX_CIRCUITS caps the circuits open on one link.
+	DEFAULT_MAX_CIRCUITS = 4096
+
+	// QUARANTINE keeps an ID we destroyed out of use for a while, so a
+	// late cell for the old circuit cannot land on a new one.
+	QUARANTINE = time.Minute
+
+	// allocAttempts bounds the random probes before giving up.
+	allocAttempts = 64
+)
+
+var ErrExhausted = errors.New("circuit IDs exhausted")
+
+// Allocator hands out random circuit IDs with the initiator bit set.
+type Allocator struct {
+	mu sync.Mutex
+
+	// msb is the initiator bit: the MSB of a 4-byte ID on link v4+, of a
+	// 2-byte ID before that.
+	msb uint32
+	max int
+
+	used       map[uint32]struct{}
+	quarantine map[uint32]time.Time
+
+	now func() time.Time
+}
+
+// New returns an allocator for a link negotiated at linkVersion. max <= 0
+// means DEFAULT_MAX_CIRCUITS.
+func New(linkVersion uint16, max int) *Allocator {
+	if max <= 0 {
+		max = DEFAULT_MAX_CIRCUITS
+	}
+	msb := uint32(0x80000000)
+	if linkVersion < 4 {
+		msb = 0x8000
+	}
+	return &Allocator{
+		msb:        msb,
+		max:        max,
+		used:       make(map[uint32]struct{}),
+		quarantine: make(map[uint32]time.Time),
+		now:        time.Now,
+	}
+}
+
+// Allocate returns a fresh ID that is neither live nor quarantined.
+func (a *Allocator) Allocate() (uint32, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.used) >= a.max {
+		return 0, ErrExhausted
+	}
+	a.expire()
+
+	var b [4]byte
+	for range allocAttempts {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		id := binary.BigEndian.Uint32(b[:])&(a.msb-1) | a.msb
+		if _, ok := a.used[id]; ok {
+			continue
+		}
+		if _, ok := a.quarantine[id]; ok {
+			continue
+		}
+		a.used[id] = struct{}{}
+		return id, nil
+	}
+	return 0, ErrExhausted
+}
+
+// Release frees id. When we sent the DESTROY, quarantine is true and the
+// ID is only reused after QUARANTINE; after a relay's DESTROY it is free
+// at once.
+func (a *Allocator) Release(id uint32, quarantine bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.used[id]; !ok {
+		return
+	}
+	delete(a.used, id)
+	if quarantine {
+		a.quarantine[id] = a.now().Add(QUARANTINE)
+	}
+}
+
+// InUse is the number of live IDs.
+func (a *Allocator) InUse() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.used)
+}
+
+// Capacity is how many more circuits the link accepts, 0 while SetMax
+// left more live circuits than the cap.
+func (a *Allocator) Capacity() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return max(a.max-len(a.used), 0)
+}
+
+// SetMax changes the circuit cap; live circuits above it are kept.
+func (a *Allocator) SetMax(max int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if max <= 0 {
+		max = DEFAULT_MAX_CIRCUITS
+	}
+	a.max = max
+}
+
+func (a *Allocator) expire() {
+	now := a.now()
+	for id, until := range a.quarantine {
+		if !now.Before(until) {
+			delete(a.quarantine, id)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package circid
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllocate_MSB(t *testing.T) {
+	a := New(5, 0)
+	for range 1000 {
+		id, err := a.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id&0x80000000 == 0 {
+			t.Fatalf("id %#x missing initiator bit", id)
+		}
+	}
+
+	a = New(3, 0)
+	id, err := a.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id&0x8000 == 0 || id > 0xffff {
+		t.Fatalf("v3 id %#x not a 2-byte initiator id", id)
+	}
+}
+
+func TestAllocate_Unique(t *testing.T) {
+	a := New(5, 2000)
+	seen := map[uint32]bool{}
+	for range 2000 {
+		id, err := a.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate id %#x", id)
+		}
+		seen[id] = true
+	}
+	if a.Capacity() != 0 {
+		t.Fatalf("capacity %d", a.Capacity())
+	}
+	if _, err := a.Allocate(); err != ErrExhausted {
+		t.Fatalf("got %v, want ErrExhausted", err)
+	}
+}
+
+func TestRelease_Quarantine(t *testing.T) {
+	now := time.Unix(1000, 0)
+	// Two usable IDs so every probe hits a known one.
+	a := &Allocator{
+		msb:        0x2,
+		max:        10,
+		used:       map[uint32]struct{}{},
+		quarantine: map[uint32]time.Time{},
+		now:        func() time.Time { return now },
+	}
+
+	first, _ := a.Allocate()
+	a.Release(first, true)
+	for range 20 {
+		id, err := a.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == first {
+			t.Fatal("quarantined id reused")
+		}
+		a.Release(id, false)
+	}
+
+	now = now.Add(QUARANTINE)
+	got := map[uint32]bool{}
+	for range 50 {
+		id, _ := a.Allocate()
+		got[id] = true
+		a.Release(id, false)
+	}
+	if !got[first] {
+		t.Fatal("id not reusable after quarantine")
+	}
+}
+
+func TestRelease_Unknown(t *testing.T) {
+	a := New(5, 1)
+	a.Release(0x80000001, true)
+	if a.InUse() != 0 || a.Capacity() != 1 {
+		t.Fatal("release of unknown id changed state")
+	}
+}
+
+func TestSetMax_BelowInUse(t *testing.T) {
+	a := New(5, 10)
+	for range 5 {
+		if _, err := a.Allocate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.SetMax(2)
+	if a.InUse() != 5 || a.Capacity() != 0 {
+		t.Fatalf("in use %d, capacity %d", a.InUse(), a.Capacity())
+	}
+	if _, err := a.Allocate(); err != ErrExhausted {
+		t.Fatalf("got %v, want ErrExhausted", err)
+	}
+}
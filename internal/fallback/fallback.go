@@ -1,16 +1,24 @@
 package fallback
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/robogg133/gonion/internal/shared"
+	"github.com/robogg133/gonion/pkg/upstream"
+	"golang.org/x/net/proxy"
 )
 
+const DIAL_TIMEOUT = 15 * time.Second
+
 type FallBackDialer struct {
 	list []shared.FallbackDir
+
+	// Upstream, if set, is used instead of dialing directly.
+	Upstream proxy.ContextDialer
 }
 
 func New(list []shared.FallbackDir) *FallBackDialer {
@@ -25,27 +33,24 @@ func Dial(ipv6Enabled bool) (net.Conn, error) {
 }
 
 func (fb *FallBackDialer) Dial(tryipv6 bool) (net.Conn, error) {
+	d := upstream.OrDirect(fb.Upstream)
 
 	var allErrors string
 	for _, v := range fb.list {
-		stop := false
-
-		addr := fmt.Sprintf("%s:%d", v.IPv4, v.ORPort)
-
-	dial:
-		conn, err := net.DialTimeout("tcp", addr, 15*time.Second)
-		if err == nil {
-			return conn, nil
+		addrs := []string{net.JoinHostPort(v.IPv4, strconv.Itoa(int(v.ORPort)))}
+		if tryipv6 && v.IPv6 != "" && v.IPv6Port != 0 {
+			addrs = append(addrs, net.JoinHostPort(v.IPv6, strconv.Itoa(int(v.IPv6Port))))
 		}
-		allErrors = allErrors + addr + " ->" + err.Error() + "\n"
 
-		if !tryipv6 || stop || v.IPv6 == "" || v.IPv6Port == 0 {
-			continue
+		for _, addr := range addrs {
+			ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			cancel()
+			if err == nil {
+				return conn, nil
+			}
+			allErrors = allErrors + addr + " ->" + err.Error() + "\n"
 		}
-
-		addr = fmt.Sprintf("[%s]:%d", v.IPv6, v.ORPort)
-		stop = true
-		goto dial
 	}
 	return nil, errors.New(allErrors)
 }
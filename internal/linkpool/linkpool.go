@@ -0,0 +1,198 @@
+// Package linkpool keeps at most one open link per relay identity, closes
+// links that carried no circuit for a while and forgets links that died.
+package linkpool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("link pool closed")
+
+// Link is an authenticated link. Its context ends when the link dies.
+type Link interface {
+	Context() context.Context
+	CircuitCount() int
+	Close() error
+}
+
+// Pool maps relay RSA identities to links.
+type Pool struct {
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	links   map[[20]byte]*entry
+	dials   map[[20]byte]*dial
+	onClose func(id [20]byte, cause error)
+	closed  bool
+
+	now func() time.Time
+}
+
+type entry struct {
+	link Link
+	// idleSince is when the link was first seen without circuits, zero
+	// while it is in use.
+	idleSince time.Time
+}
+
+// dial is a connection attempt other callers for the same relay wait on.
+type dial struct {
+	done chan struct{}
+	link Link
+	err  error
+}
+
+// New returns a pool closing links idle for idleTimeout.
+func New(idleTimeout time.Duration) *Pool {
+	return &Pool{
+		idleTimeout: idleTimeout,
+		links:       make(map[[20]byte]*entry),
+		dials:       make(map[[20]byte]*dial),
+		now:         time.Now,
+	}
+}
+
+// SetNow replaces the clock used for idle tracking.
+func (p *Pool) SetNow(now func() time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.now = now
+}
+
+// OnClose sets a callback run when a pooled link dies or is reaped, with
+// the context cause of the link.
+func (p *Pool) OnClose(fn func(id [20]byte, cause error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onClose = fn
+}
+
+// Get returns the live link to id, or opens one with dialFn. Concurrent
+// callers for the same id share a single dial.
+func (p *Pool) Get(id [20]byte, dialFn func() (Link, error)) (Link, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if e, ok := p.links[id]; ok && e.link.Context().Err() == nil {
+		e.idleSince = time.Time{}
+		p.mu.Unlock()
+		return e.link, nil
+	}
+	if d, ok := p.dials[id]; ok {
+		p.mu.Unlock()
+		<-d.done
+		return d.link, d.err
+	}
+	d := &dial{done: make(chan struct{})}
+	p.dials[id] = d
+	p.mu.Unlock()
+
+	d.link, d.err = dialFn()
+
+	p.mu.Lock()
+	delete(p.dials, id)
+	if d.err == nil {
+		if p.closed {
+			d.link.Close()
+			d.link, d.err = nil, ErrClosed
+		} else {
+			p.links[id] = &entry{link: d.link}
+			go p.watch(id, d.link)
+		}
+	}
+	p.mu.Unlock()
+	close(d.done)
+	return d.link, d.err
+}
+
+// Lookup returns the live link to id without dialing.
+func (p *Pool) Lookup(id [20]byte) (Link, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.links[id]
+	if !ok || e.link.Context().Err() != nil {
+		return nil, false
+	}
+	return e.link, true
+}
+
+// Remove drops link from the pool and closes it, if it is still the link
+// for id.
+func (p *Pool) Remove(id [20]byte, link Link) {
+	p.mu.Lock()
+	e, ok := p.links[id]
+	if ok && e.link == link {
+		delete(p.links, id)
+	}
+	p.mu.Unlock()
+	link.Close()
+}
+
+// Reap closes links that have had no circuit for the idle timeout and
+// returns how many it closed.
+func (p *Pool) Reap() int {
+	p.mu.Lock()
+	now := p.now()
+	var idle []Link
+	for id, e := range p.links {
+		if e.link.CircuitCount() > 0 {
+			e.idleSince = time.Time{}
+			continue
+		}
+		if e.idleSince.IsZero() {
+			e.idleSince = now
+			continue
+		}
+		if now.Sub(e.idleSince) >= p.idleTimeout {
+			delete(p.links, id)
+			idle = append(idle, e.link)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, l := range idle {
+		l.Close()
+	}
+	return len(idle)
+}
+
+// Len is the number of pooled links.
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.links)
+}
+
+// Close closes every link; later Gets fail with ErrClosed.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	links := p.links
+	p.links = make(map[[20]byte]*entry)
+	p.mu.Unlock()
+
+	for _, e := range links {
+		e.link.Close()
+	}
+}
+
+// watch forgets link once it dies.
+func (p *Pool) watch(id [20]byte, link Link) {
+	<-link.Context().Done()
+
+	p.mu.Lock()
+	if e, ok := p.links[id]; ok && e.link == link {
+		delete(p.links, id)
+	}
+	onClose := p.onClose
+	p.mu.Unlock()
+
+	if onClose != nil {
+		onClose(id, context.Cause(link.Context()))
+	}
+}
@@ -0,0 +1,158 @@
+package linkpool_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/robogg133/gonion/internal/linkpool"
+)
+
+type fakeLink struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	circs  atomic.Int32
+}
+
+var errLinkClosed = errors.New("closed")
+
+func newFake() *fakeLink {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &fakeLink{ctx: ctx, cancel: cancel}
+}
+
+func (f *fakeLink) Context() context.Context { return f.ctx }
+func (f *fakeLink) CircuitCount() int        { return int(f.circs.Load()) }
+func (f *fakeLink) Close() error             { f.cancel(errLinkClosed); return nil }
+
+func TestGet_Reuse(t *testing.T) {
+	p := linkpool.New(time.Minute)
+	id := [20]byte{1}
+	dials := 0
+	dialFn := func() (linkpool.Link, error) {
+		dials++
+		return newFake(), nil
+	}
+
+	a, err := p.Get(id, dialFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := p.Get(id, dialFn)
+	if a != b || dials != 1 {
+		t.Fatalf("link not reused: %d dials", dials)
+	}
+
+	other, _ := p.Get([20]byte{2}, dialFn)
+	if other == a || p.Len() != 2 {
+		t.Fatal("different identities share a link")
+	}
+}
+
+func TestGet_SharedDial(t *testing.T) {
+	p := linkpool.New(time.Minute)
+	var dials atomic.Int32
+	release := make(chan struct{})
+	dialFn := func() (linkpool.Link, error) {
+		dials.Add(1)
+		<-release
+		return newFake(), nil
+	}
+
+	var wg sync.WaitGroup
+	links := make([]linkpool.Link, 8)
+	for i := range links {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			links[i], _ = p.Get([20]byte{1}, dialFn)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if dials.Load() != 1 {
+		t.Fatalf("%d dials, want 1", dials.Load())
+	}
+	for _, l := range links {
+		if l != links[0] {
+			t.Fatal("callers got different links")
+		}
+	}
+}
+
+func TestDeadLink_Redial(t *testing.T) {
+	p := linkpool.New(time.Minute)
+	id := [20]byte{1}
+	causes := make(chan error, 1)
+	p.OnClose(func(got [20]byte, cause error) {
+		if got == id {
+			causes <- cause
+		}
+	})
+
+	first := newFake()
+	l, _ := p.Get(id, func() (linkpool.Link, error) { return first, nil })
+	dead := errors.New("read failed")
+	first.cancel(dead)
+
+	select {
+	case c := <-causes:
+		if c != dead {
+			t.Fatalf("cause %v", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnClose not called")
+	}
+	if _, ok := p.Lookup(id); ok {
+		t.Fatal("dead link still pooled")
+	}
+
+	second, _ := p.Get(id, func() (linkpool.Link, error) { return newFake(), nil })
+	if second == l {
+		t.Fatal("dead link reused")
+	}
+}
+
+func TestReap_Idle(t *testing.T) {
+	now := time.Unix(0, 0)
+	p := linkpool.New(time.Minute)
+	p.SetNow(func() time.Time { return now })
+
+	busy, idle := newFake(), newFake()
+	busy.circs.Store(1)
+	p.Get([20]byte{1}, func() (linkpool.Link, error) { return busy, nil })
+	p.Get([20]byte{2}, func() (linkpool.Link, error) { return idle, nil })
+
+	if n := p.Reap(); n != 0 {
+		t.Fatalf("reaped %d on first sight", n)
+	}
+	now = now.Add(30 * time.Second)
+	if n := p.Reap(); n != 0 {
+		t.Fatalf("reaped %d before timeout", n)
+	}
+	now = now.Add(30 * time.Second)
+	if n := p.Reap(); n != 1 {
+		t.Fatalf("reaped %d, want 1", n)
+	}
+	if idle.ctx.Err() == nil || busy.ctx.Err() != nil {
+		t.Fatal("wrong link closed")
+	}
+}
+
+func TestClose(t *testing.T) {
+	p := linkpool.New(time.Minute)
+	l := newFake()
+	p.Get([20]byte{1}, func() (linkpool.Link, error) { return l, nil })
+	p.Close()
+	if l.ctx.Err() == nil {
+		t.Fatal("link left open")
+	}
+	if _, err := p.Get([20]byte{1}, func() (linkpool.Link, error) { return newFake(), nil }); err != linkpool.ErrClosed {
+		t.Fatalf("got %v", err)
+	}
+}
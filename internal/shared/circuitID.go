@@ -1,6 +0,0 @@
-package shared
-
-func MSB(n uint32) uint32 {
-	n |= 0x80000000
-	return n
-}
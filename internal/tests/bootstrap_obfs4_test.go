@@ -6,14 +6,21 @@ import (
 	"testing"
 
 	gonion2 "github.com/robogg133/gonion"
-	"github.com/robogg133/gonion/pkg/transports/obfs4"
+	"github.com/robogg133/gonion/pkg/bridge"
+	"github.com/robogg133/gonion/pkg/netdir"
+	"github.com/robogg133/gonion/pkg/path"
 )
 
-// obfs4 93.177.73.226:24852 99ED350316AFC4ED1964CFE9EC84C201416D143D cert=KciXEUlkxmOHsVFLh6s3fAEWO7p0GHt6jhhTj/XaWM8/VmCYqbzPmRM+Q4PA1AcJ8JyWBA iat-mode=0
+const obfs4Bridge = "Bridge obfs4 93.177.73.226:24852 99ED350316AFC4ED1964CFE9EC84C201416D143D cert=KciXEUlkxmOHsVFLh6s3fAEWO7p0GHt6jhhTj/XaWM8/VmCYqbzPmRM+Q4PA1AcJ8JyWBA iat-mode=0"
+
 func TestMicrodescObfs4(t *testing.T) {
 	skipIfShort(t)
 	t.Parallel()
-	c, err := obfs4.Dial("93.177.73.226:24852", "99ED350316AFC4ED1964CFE9EC84C201416D143D", "KciXEUlkxmOHsVFLh6s3fAEWO7p0GHt6jhhTj/XaWM8/VmCYqbzPmRM+Q4PA1AcJ8JyWBA", "0")
+	b, err := bridge.ParseLine(obfs4Bridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := b.Dial(nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -24,7 +31,7 @@ func TestMicrodescObfs4(t *testing.T) {
 	}
 	t.Log("Created conn")
 
-	circuit, err := conn.NewFastCircuit(1)
+	circuit, err := conn.NewFastCircuit()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -59,3 +66,25 @@ func TestMicrodescObfs4(t *testing.T) {
 	}
 
 }
+
+func TestBootstrapBridges(t *testing.T) {
+	skipIfShort(t)
+	t.Parallel()
+
+	m, err := bridge.NewManagerFromLines(obfs4Bridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := gonion2.BootstrapBridges(m, io.Discard, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sl := path.New(netdir.Default.Consensus(), false)
+	sl.UseGuards(m.Guards())
+	if err := sl.SelectRandomCircuit(3, 80); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("guard %s (%s)", sl.Guard().Nickname, sl.Guard().Ipv4Addr)
+}
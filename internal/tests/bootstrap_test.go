@@ -9,7 +9,7 @@ import (
 	gonion2 "github.com/robogg133/gonion"
 	"github.com/robogg133/gonion/internal/fallback"
 	"github.com/robogg133/gonion/internal/shared"
-	"github.com/robogg133/gonion/pkg/common"
+	"github.com/robogg133/gonion/pkg/netdir"
 	"github.com/robogg133/gonion/pkg/path"
 )
 
@@ -32,11 +32,11 @@ func TestMicrodesc(t *testing.T) {
 	}
 	t.Log("Created conn")
 
-	if err := gonion.BootstrapOneConn(conn); err != nil {
+	if err := gonion.BootstrapOneConn(conn, nil); err != nil {
 		t.Fatal(err)
 	}
 
-	sl := path.New(common.GetGlobalConsensus(), false)
+	sl := path.New(netdir.Default.Consensus(), false)
 
 	if err := sl.SelectRandomCircuit(3, 80); err != nil {
 		t.Fatal(err)
@@ -29,7 +29,7 @@ func TestConsensus(t *testing.T) {
 	}
 	t.Log("Created conn")
 
-	circuit, err := conn.NewFastCircuit(1)
+	circuit, err := conn.NewFastCircuit()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -48,7 +48,7 @@ func TestCreate2Circuit(t *testing.T) {
 		PublicKey:  sk.PublicKey(),
 	}
 
-	circuit, err := conn.NewCircuit(1, handshakes.HTYPE_NTOR, ntorHs)
+	circuit, err := conn.NewCircuit(handshakes.HTYPE_NTOR, ntorHs)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2,17 +2,15 @@ package tests
 
 import (
 	"bufio"
-	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"testing"
-	"time"
 
 	"github.com/robogg133/gonion"
 	"github.com/robogg133/gonion/internal/fallback"
 	"github.com/robogg133/gonion/internal/shared"
 	"github.com/robogg133/gonion/pkg/common"
+	"github.com/robogg133/gonion/pkg/netdir"
 	"github.com/robogg133/gonion/pkg/path"
 )
 
@@ -104,17 +102,11 @@ func exitGET(t *testing.T, cns *common.Consensus, addr, host string) (status int
 }
 
 func dialPath(relays []*common.RouterStatus) (*gonion.Circuit, *gonion.Conn, error) {
-	guard := relays[0]
-	raw, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", guard.Ipv4Addr, guard.ORPort), 15*time.Second)
+	conn, err := gonion.DialRelay(relays[0], io.Discard, false)
 	if err != nil {
 		return nil, nil, err
 	}
-	conn, err := gonion.NewConn(raw, io.Discard, false)
-	if err != nil {
-		raw.Close()
-		return nil, nil, err
-	}
-	circ, err := conn.BuildPath(1, relays)
+	circ, err := conn.BuildPath(relays)
 	if err != nil {
 		conn.Close()
 		return nil, nil, err
@@ -124,7 +116,7 @@ func dialPath(relays []*common.RouterStatus) (*gonion.Circuit, *gonion.Conn, err
 
 func bootstrapConsensus(t *testing.T) *common.Consensus {
 	t.Helper()
-	if cns := common.GetGlobalConsensus(); cns != nil && len(cns.RelayInformation) > 100 {
+	if cns := netdir.Default.Consensus(); cns != nil && len(cns.RelayInformation) > 100 {
 		return cns
 	}
 
@@ -141,10 +133,10 @@ func bootstrapConsensus(t *testing.T) *common.Consensus {
 	}
 	defer conn.Close()
 
-	if err := gonion.BootstrapOneConn(conn); err != nil {
+	if err := gonion.BootstrapOneConn(conn, nil); err != nil {
 		t.Fatal(err)
 	}
-	cns := common.GetGlobalConsensus()
+	cns := netdir.Default.Consensus()
 	if cns == nil {
 		t.Fatal("no global consensus after bootstrap")
 	}
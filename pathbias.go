@@ -0,0 +1,158 @@
+package gonion
+
+import (
+	"context"
+	"errors"
+
+	"github.com/robogg133/gonion/pkg/cells/relay"
+	"github.com/robogg133/gonion/pkg/pathbias"
+)
+
+// PATHBIAS_MIN_HOPS is the shortest path counted for path bias, as in tor
+// pathbias_should_count. Only BuildPath counts: a circuit extended hop by
+// hop has no known length.
+const PATHBIAS_MIN_HOPS = 3
+
+// Per-circuit path bias progress; each step is counted once.
+const (
+	pbNone uint32 = iota
+	pbAttempted
+	pbBuilt
+	pbUseAttempted
+	pbUseSucceeded
+	pbFailed
+)
+
+// SetPathBias makes circuits on the connection report their build and use
+// outcomes to t; nil stops it. The link's relay is the guard. UseConsensus
+// keeps t's thresholds current.
+func (conn *Conn) SetPathBias(t *pathbias.Tracker) {
+	conn.pathBias.Store(t)
+}
+
+func (c *Circuit) tracker() *pathbias.Tracker { return c.conn.pathBias.Load() }
+
+// pbBuildAttempt counts a build attempt once the guard hop is up, for
+// paths of at least PATHBIAS_MIN_HOPS.
+func (c *Circuit) pbBuildAttempt(pathLen int) {
+	t := c.tracker()
+	if t == nil || pathLen < PATHBIAS_MIN_HOPS || !c.pbState.CompareAndSwap(pbNone, pbAttempted) {
+		return
+	}
+	t.BuildAttempt(c.conn.RSAIdentity())
+}
+
+// pbBuilt counts a circuit whose attempt was counted as built.
+func (c *Circuit) pbBuilt() {
+	t := c.tracker()
+	if t == nil || !c.pbState.CompareAndSwap(pbAttempted, pbBuilt) {
+		return
+	}
+	logPathBias(c.Ctx, t.BuildSuccess(c.conn.RSAIdentity()))
+}
+
+func (c *Circuit) pbBuildFailed() {
+	t := c.tracker()
+	if t == nil || !c.pbState.CompareAndSwap(pbAttempted, pbFailed) {
+		return
+	}
+	logPathBias(c.Ctx, t.BuildFailure(c.conn.RSAIdentity()))
+}
+
+// pbStreamAttempt counts the first stream on a built circuit as a use
+// attempt.
+func (c *Circuit) pbStreamAttempt() {
+	t := c.tracker()
+	if t == nil || !c.pbState.CompareAndSwap(pbBuilt, pbUseAttempted) {
+		return
+	}
+	t.UseAttempt(c.conn.RSAIdentity())
+}
+
+// pbUse is what a stream open says about its circuit.
+type pbUse uint8
+
+const (
+	// pbUseNone is a local failure; it says nothing about the path.
+	pbUseNone pbUse = iota
+	pbUseOK
+	pbUseFailed
+)
+
+// pbStreamOutcome classifies the result of opening s like tor
+// connection_ap_process_end_not_open: the exit answering with END shows
+// the path works, unless the reason blames the circuit. A stream closed
+// from our side is not counted.
+func pbStreamOutcome(s *Stream, err error) pbUse {
+	if err == nil {
+		return pbUseOK
+	}
+	if end := s.endCell(); end != nil {
+		switch end.Reason {
+		case relay.END_REASON_TORPROTOCOL, relay.END_REASON_DESTROY, relay.END_REASON_INTERNAL:
+			return pbUseFailed
+		}
+		return pbUseOK
+	}
+	if cause := context.Cause(s.Ctx); cause != nil &&
+		(errors.Is(cause, ErrClosed) || errors.Is(cause, context.Canceled)) {
+		return pbUseNone
+	}
+	return pbUseFailed
+}
+
+// PathBiasStreamOutcomeForTest exposes pbStreamOutcome for unit tests. end
+// is the END reason the exit sent, or -1 for none; cause ends the stream
+// context when set. It returns "ok", "failed" or "none".
+func PathBiasStreamOutcomeForTest(end int, cause error) string {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	s := &Stream{Ctx: ctx}
+	if end >= 0 {
+		s.end = &relay.RelayEndCell{Reason: uint8(end)}
+	}
+	if cause != nil {
+		cancel(cause)
+	}
+	return [...]string{"none", "ok", "failed"}[pbStreamOutcome(s, ErrStream)]
+}
+
+// pbStreamResult counts the first stream that opened, or that the exit
+// refused with a benign END, as a use success.
+func (c *Circuit) pbStreamResult(use pbUse) {
+	t := c.tracker()
+	if t == nil || c.pbState.Load() != pbUseAttempted {
+		return
+	}
+	switch use {
+	case pbUseFailed:
+		if c.pbState.CompareAndSwap(pbUseAttempted, pbFailed) {
+			logPathBias(c.Ctx, t.UseFailure(c.conn.RSAIdentity()))
+		}
+	case pbUseOK:
+		if c.pbState.CompareAndSwap(pbUseAttempted, pbUseSucceeded) {
+			logPathBias(c.Ctx, t.UseSuccess(c.conn.RSAIdentity()))
+		}
+	}
+}
+
+func logPathBias(ctx context.Context, ev *pathbias.Event) {
+	if ev == nil {
+		return
+	}
+	kind := "circuit build"
+	if ev.Use {
+		kind = "circuit use"
+	}
+	log := logger(ctx)
+	e := log.Warn()
+	if ev.Level == pathbias.LevelNotice {
+		e = log.Info()
+	}
+	e.Hex("guard", ev.Guard[:]).
+		Str("rate", kind).
+		Float64("success_rate", ev.Rate).
+		Stringer("level", ev.Level).
+		Bool("guard_disabled", ev.Disabled).
+		Msg("guard success rate is low; it may be failing circuits on purpose")
+}
@@ -0,0 +1,34 @@
+package gonion_test
+
+import (
+	"testing"
+
+	"github.com/robogg133/gonion"
+	"github.com/robogg133/gonion/pkg/cells/relay"
+)
+
+// Stream failures are judged as tor connection_ap_process_end_not_open
+// does: only ENDs that blame the circuit, and failures the relay caused,
+// count against the guard.
+func TestPathBiasStreamOutcome(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		end   int
+		cause error
+		want  string
+	}{
+		{"connection refused", int(relay.END_REASON_CONNECTIONREFUSED), nil, "ok"},
+		{"exit policy", int(relay.END_REASON_EXITPOLICY), nil, "ok"},
+		{"resolve failed", int(relay.END_REASON_RESOLVEFAILED), nil, "ok"},
+		{"tor protocol", int(relay.END_REASON_TORPROTOCOL), nil, "failed"},
+		{"destroy", int(relay.END_REASON_DESTROY), nil, "failed"},
+		{"internal", int(relay.END_REASON_INTERNAL), nil, "failed"},
+		{"closed locally", -1, gonion.ErrClosed, "none"},
+		{"circuit destroyed", -1, gonion.ErrCircuit, "failed"},
+		{"unexpected cell", -1, nil, "failed"},
+	} {
+		if got := gonion.PathBiasStreamOutcomeForTest(tc.end, tc.cause); got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
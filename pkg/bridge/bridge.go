@@ -0,0 +1,184 @@
+// Package bridge parses torrc-style bridge lines and keeps track of which
+// configured bridges are usable as first hops.
+package bridge
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robogg133/gonion/pkg/transports"
+	"github.com/robogg133/gonion/pkg/upstream"
+	"golang.org/x/net/proxy"
+	// obfs4 is built in; other transports come from managed proxies.
+	_ "github.com/robogg133/gonion/pkg/transports/obfs4"
+)
+
+const DIAL_TIMEOUT = 15 * time.Second
+
+// Bridge is one parsed bridge line:
+//
+//	[Bridge] [transport] addr:port [fingerprint] [key=value ...]
+type Bridge struct {
+	// Transport is the pluggable transport name, empty for a plain bridge.
+	Transport string
+	// Addr is "host:port" ("[v6]:port" for IPv6).
+	Addr string
+
+	// Fingerprint is the RSA identity; HasFingerprint is false when the
+	// line omits it, in which case any identity is accepted.
+	Fingerprint    [20]byte
+	HasFingerprint bool
+
+	// Args are the transport arguments, e.g. cert and iat-mode for obfs4.
+	Args map[string]string
+}
+
+// ParseLine parses a bridge line, with or without the leading "Bridge"
+// keyword, as found in torrc and on bridges.torproject.org.
+func ParseLine(line string) (*Bridge, error) {
+	f := strings.Fields(line)
+	if len(f) > 0 && strings.EqualFold(f[0], "Bridge") {
+		f = f[1:]
+	}
+	if len(f) == 0 {
+		return nil, fmt.Errorf("bridge: empty line")
+	}
+
+	b := &Bridge{Args: map[string]string{}}
+
+	// The transport is the only token before the address, and an address
+	// always has a port.
+	if !strings.Contains(f[0], ":") {
+		if !validTransportName(f[0]) {
+			return nil, fmt.Errorf("bridge: invalid transport name %q", f[0])
+		}
+		b.Transport = f[0]
+		f = f[1:]
+		if len(f) == 0 {
+			return nil, fmt.Errorf("bridge: missing address")
+		}
+	}
+
+	host, port, err := net.SplitHostPort(f[0])
+	if err != nil {
+		return nil, fmt.Errorf("bridge: address %q: %w", f[0], err)
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("bridge: address %q is not an IP", host)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return nil, fmt.Errorf("bridge: invalid port %q", port)
+	}
+	b.Addr = net.JoinHostPort(host, port)
+	f = f[1:]
+
+	if len(f) > 0 && !strings.Contains(f[0], "=") {
+		fp, err := hex.DecodeString(strings.TrimPrefix(f[0], "$"))
+		if err != nil || len(fp) != 20 {
+			return nil, fmt.Errorf("bridge: invalid fingerprint %q", f[0])
+		}
+		b.Fingerprint = [20]byte(fp)
+		b.HasFingerprint = true
+		f = f[1:]
+	}
+
+	for _, kv := range f {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("bridge: malformed argument %q", kv)
+		}
+		if b.Transport == "" {
+			return nil, fmt.Errorf("bridge: argument %q without a transport", kv)
+		}
+		b.Args[k] = v
+	}
+
+	if b.Transport == "obfs4" {
+		if !b.HasFingerprint {
+			return nil, fmt.Errorf("bridge: obfs4 requires a fingerprint")
+		}
+		if b.Args["cert"] == "" {
+			return nil, fmt.Errorf("bridge: obfs4 requires cert=")
+		}
+	}
+	return b, nil
+}
+
+// ParseLines parses one bridge per line, skipping blank lines and comments.
+func ParseLines(s string) ([]*Bridge, error) {
+	var out []*Bridge
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b, err := ParseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+// String formats b as a bridge line without the "Bridge" keyword.
+func (b *Bridge) String() string {
+	parts := []string{}
+	if b.Transport != "" {
+		parts = append(parts, b.Transport)
+	}
+	parts = append(parts, b.Addr)
+	if b.HasFingerprint {
+		parts = append(parts, b.FingerprintHex())
+	}
+	for _, k := range slices.Sorted(maps.Keys(b.Args)) {
+		parts = append(parts, k+"="+b.Args[k])
+	}
+	return strings.Join(parts, " ")
+}
+
+// FingerprintHex is the uppercase hex fingerprint, or "" when unknown.
+func (b *Bridge) FingerprintHex() string {
+	if !b.HasFingerprint {
+		return ""
+	}
+	return strings.ToUpper(hex.EncodeToString(b.Fingerprint[:]))
+}
+
+// Dial opens the transport connection to the bridge through upstream (nil
+// for a direct connection); the Tor link handshake is left to the caller.
+// Transports are looked up in the transports registry, so managed proxies
+// registered at runtime work too.
+func (b *Bridge) Dial(upstreamDialer proxy.ContextDialer) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	d := upstream.OrDirect(upstreamDialer)
+
+	if b.Transport == "" {
+		return d.DialContext(ctx, "tcp", b.Addr)
+	}
+	t, ok := transports.Get(b.Transport)
+	if !ok {
+		return nil, fmt.Errorf("bridge: unsupported transport %q (have %v)", b.Transport, transports.Names())
+	}
+	return t.Dial(ctx, d, b.Addr, b.Args)
+}
+
+func validTransportName(s string) bool {
+	for i, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,107 @@
+package bridge_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/robogg133/gonion/pkg/bridge"
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+const obfs4Line = "Bridge obfs4 93.177.73.226:24852 99ED350316AFC4ED1964CFE9EC84C201416D143D cert=KciXEUlkxmOHsVFLh6s3fAEWO7p0GHt6jhhTj/XaWM8/VmCYqbzPmRM+Q4PA1AcJ8JyWBA iat-mode=0"
+
+func TestParseLine_Obfs4(t *testing.T) {
+	b, err := bridge.ParseLine(obfs4Line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Transport != "obfs4" || b.Addr != "93.177.73.226:24852" {
+		t.Fatalf("got %q %q", b.Transport, b.Addr)
+	}
+	if !b.HasFingerprint || b.FingerprintHex() != "99ED350316AFC4ED1964CFE9EC84C201416D143D" {
+		t.Fatalf("fingerprint %q", b.FingerprintHex())
+	}
+	if b.Args["iat-mode"] != "0" || !strings.HasPrefix(b.Args["cert"], "KciXEU") {
+		t.Fatalf("args %v", b.Args)
+	}
+	if got := "Bridge " + b.String(); got != obfs4Line {
+		t.Fatalf("String() = %q", got)
+	}
+}
+
+func TestParseLine_Plain(t *testing.T) {
+	for _, line := range []string{
+		"192.0.2.1:443",
+		"192.0.2.1:443 99ED350316AFC4ED1964CFE9EC84C201416D143D",
+		"bridge [2001:db8::1]:9001 $99ED350316AFC4ED1964CFE9EC84C201416D143D",
+	} {
+		b, err := bridge.ParseLine(line)
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		if b.Transport != "" {
+			t.Fatalf("%q: transport %q", line, b.Transport)
+		}
+	}
+}
+
+func TestParseLine_Rejects(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"Bridge",
+		"obfs4",
+		"192.0.2.1",
+		"192.0.2.1:0",
+		"example.com:443",
+		"192.0.2.1:443 ABCD",
+		"192.0.2.1:443 cert=foo",
+		"obfs4 192.0.2.1:443 cert=foo",
+		"obfs4 192.0.2.1:443 99ED350316AFC4ED1964CFE9EC84C201416D143D",
+		"obfs4 192.0.2.1:443 99ED350316AFC4ED1964CFE9EC84C201416D143D cert",
+		"0bfs 192.0.2.1:443",
+	} {
+		if _, err := bridge.ParseLine(line); err == nil {
+			t.Fatalf("%q: expected error", line)
+		}
+	}
+}
+
+func TestParseLines_SkipsComments(t *testing.T) {
+	bs, err := bridge.ParseLines("# mine\n\n" + obfs4Line + "\n192.0.2.1:443\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs) != 2 {
+		t.Fatalf("got %d bridges", len(bs))
+	}
+	if _, err := bridge.ParseLines("192.0.2.1:443\nnope"); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestManager_Candidates(t *testing.T) {
+	m, err := bridge.NewManagerFromLines("192.0.2.1:443\n192.0.2.2:443\n192.0.2.3:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := m.Bridges()
+
+	m.MarkFailed(bs[0])
+	m.SetDescriptor(bs[2], common.RouterStatus{Nickname: "third"})
+
+	got := m.Candidates()
+	if len(got) != 2 || got[0] != bs[2] || got[1] != bs[1] {
+		t.Fatalf("candidates %v", got)
+	}
+
+	guards := m.Guards()
+	if len(guards) != 1 || guards[0].Nickname != "third" {
+		t.Fatalf("guards %v", guards)
+	}
+
+	// A descriptor resets the failure backoff.
+	m.SetDescriptor(bs[0], common.RouterStatus{Nickname: "first"})
+	if len(m.Candidates()) != 3 || m.Descriptor(bs[0]).Nickname != "first" {
+		t.Fatal("bridge still backing off after success")
+	}
+}
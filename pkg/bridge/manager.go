@@ -0,0 +1,152 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+// Retry backoff after a failed bridge, doubled per consecutive failure.
+const (
+	RETRY_MIN = time.Minute
+	RETRY_MAX = time.Hour
+)
+
+type entry struct {
+	bridge *Bridge
+
+	failures    int
+	retryAt     time.Time
+	descriptor  *common.RouterStatus
+	lastSuccess time.Time
+}
+
+// Manager holds the configured bridges. When bridges are in use they replace
+// guards: every circuit's first hop is one of them.
+type Manager struct {
+	mu      sync.Mutex
+	entries []*entry
+
+	now func() time.Time
+}
+
+// NewManager returns a Manager trying bridges in the given order.
+func NewManager(bridges []*Bridge) *Manager {
+	m := &Manager{now: time.Now}
+	for _, b := range bridges {
+		m.entries = append(m.entries, &entry{bridge: b})
+	}
+	return m
+}
+
+// NewManagerFromLines parses lines with ParseLines.
+func NewManagerFromLines(lines string) (*Manager, error) {
+	bs, err := ParseLines(lines)
+	if err != nil {
+		return nil, err
+	}
+	return NewManager(bs), nil
+}
+
+// Bridges returns the configured bridges.
+func (m *Manager) Bridges() []*Bridge {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]*Bridge, len(m.entries))
+	for i, e := range m.entries {
+		out[i] = e.bridge
+	}
+	return out
+}
+
+// Candidates returns the bridges to try now, in order: those not waiting
+// for a retry, with the last successful one first.
+func (m *Manager) Candidates() []*Bridge {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+
+	var best *entry
+	var out []*Bridge
+	for _, e := range m.entries {
+		if now.Before(e.retryAt) {
+			continue
+		}
+		if !e.lastSuccess.IsZero() && (best == nil || e.lastSuccess.After(best.lastSuccess)) {
+			best = e
+		}
+	}
+	if best != nil {
+		out = append(out, best.bridge)
+	}
+	for _, e := range m.entries {
+		if e == best || now.Before(e.retryAt) {
+			continue
+		}
+		out = append(out, e.bridge)
+	}
+	return out
+}
+
+// MarkFailed records a failed connection to b and schedules its retry.
+func (m *Manager) MarkFailed(b *Bridge) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.find(b)
+	if e == nil {
+		return
+	}
+	e.failures++
+	backoff := RETRY_MIN << min(e.failures-1, 10)
+	e.retryAt = m.now().Add(min(backoff, RETRY_MAX))
+}
+
+// SetDescriptor records b as reachable with the router status built from its
+// server descriptor.
+func (m *Manager) SetDescriptor(b *Bridge, rs common.RouterStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.find(b)
+	if e == nil {
+		return
+	}
+	e.descriptor = &rs
+	e.failures = 0
+	e.retryAt = time.Time{}
+	e.lastSuccess = m.now()
+}
+
+// Descriptor returns the router status learned for b, if any.
+func (m *Manager) Descriptor(b *Bridge) *common.RouterStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e := m.find(b); e != nil {
+		return e.descriptor
+	}
+	return nil
+}
+
+// Guards returns the usable bridges with known descriptors, for
+// path.Selector.UseGuards.
+func (m *Manager) Guards() []*common.RouterStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	var out []*common.RouterStatus
+	for _, e := range m.entries {
+		if e.descriptor != nil && !now.Before(e.retryAt) {
+			out = append(out, e.descriptor)
+		}
+	}
+	return out
+}
+
+func (m *Manager) find(b *Bridge) *entry {
+	for _, e := range m.entries {
+		if e.bridge == b {
+			return e
+		}
+	}
+	return nil
+}
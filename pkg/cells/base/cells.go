@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 )
 
 const CELL_BODY_LEN int = 509
@@ -42,6 +43,10 @@ var AllKnownCells = map[uint8]func() Cell{
 	COMMAND_CREATED2:    func() Cell { return &Created2Cell{} },
 
 	COMMAND_CERTS: func() Cell { return &CertsCell{} },
+
+	COMMAND_PADDING:           func() Cell { return &PaddingCell{} },
+	COMMAND_VPADDING:          func() Cell { return &VPaddingCell{} },
+	COMMAND_PADDING_NEGOTIATE: func() Cell { return &PaddingNegotiateCell{} },
 }
 
 // NewCellCoder can encode and decode link cells.
@@ -52,8 +57,17 @@ func NewCellCoder(knownCells map[uint8]func() Cell) *CellCoder {
 	}
 }
 
+// IsVariableLength reports whether cmd uses the variable-length cell format
+// (tor-spec §3): VERSIONS and every command >= 128 carry a 2-byte length
+// after the command instead of a fixed CELL_BODY_LEN body.
+func IsVariableLength(cmd uint8) bool {
+	return cmd == COMMAND_VERSIONS || cmd >= 128
+}
+
 // ReadCell reads a cell from the reader.
 // The first 4 bytes (circuit id) are discarded; callers that need it must parse the header themselves.
+// The whole body is consumed before decoding, so an unknown command still
+// leaves reader positioned at the next cell.
 func (r *CellCoder) ReadCell(reader io.Reader) (Cell, error) {
 	if _, err := io.CopyN(io.Discard, reader, 4); err != nil {
 		return nil, err
@@ -64,18 +78,41 @@ func (r *CellCoder) ReadCell(reader io.Reader) (Cell, error) {
 		return nil, err
 	}
 
+	body, err := r.readBody(reader, cmd[0])
+	if err != nil {
+		return nil, err
+	}
+
 	factory, ok := r.knownCells[cmd[0]]
 	if !ok {
 		return nil, fmt.Errorf("%w: %d", ErrUnknownCommandID, cmd[0])
 	}
 	cell := factory()
 
-	if err := cell.Decode(reader); err != nil {
+	if err := cell.Decode(bytes.NewReader(body)); err != nil {
 		return nil, err
 	}
 	return cell, nil
 }
 
+// readBody reads the body of a cell whose command byte was just read.
+func (r *CellCoder) readBody(reader io.Reader, cmd uint8) ([]byte, error) {
+	length := r.cellBodyLen
+	if IsVariableLength(cmd) {
+		var l uint16
+		if err := binary.Read(reader, binary.BigEndian, &l); err != nil {
+			return nil, err
+		}
+		length = int(l)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
 func (r *CellCoder) MarshalCell(cell Cell) ([]byte, error) {
 	var a bytes.Buffer
 	err := r.WriteCell(cell, &a)
@@ -99,8 +136,19 @@ func (r *CellCoder) WriteCell(cell Cell, writer io.Writer) error {
 		return err
 	}
 
-	for range r.cellBodyLen - buffer.Len() {
-		buffer.WriteByte(0)
+	if IsVariableLength(cell.ID()) {
+		if buffer.Len() > math.MaxUint16 {
+			return fmt.Errorf("variable-length cell body too long: %d", buffer.Len())
+		}
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(buffer.Len()))
+		if _, err := writer.Write(length); err != nil {
+			return err
+		}
+	} else {
+		for range r.cellBodyLen - buffer.Len() {
+			buffer.WriteByte(0)
+		}
 	}
 
 	_, err := writer.Write(buffer.Bytes())
@@ -3,6 +3,7 @@ package cells_test
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"testing"
 
 	cells "github.com/robogg133/gonion/pkg/cells/base"
@@ -172,3 +173,117 @@ func TestCreatedFast_Decode(t *testing.T) {
 		t.Fatal("fields")
 	}
 }
+
+func TestCellCoder_PaddingNegotiate_RoundTrip(t *testing.T) {
+	coder := cells.NewCellCoder(cells.AllKnownCells)
+	in := &cells.PaddingNegotiateCell{
+		Command:   cells.PADDING_NEGOTIATE_START,
+		ItoLowMs:  9000,
+		ItoHighMs: 14000,
+	}
+	raw, err := coder.MarshalCell(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 4+1+cells.CELL_BODY_LEN {
+		t.Fatalf("len=%d", len(raw))
+	}
+	if !bytes.Equal(raw[5:11], []byte{0, 2, 0x23, 0x28, 0x36, 0xb0}) {
+		t.Fatalf("body=%x", raw[5:11])
+	}
+	got, err := coder.ReadCell(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := got.(*cells.PaddingNegotiateCell); *out != *in {
+		t.Fatalf("got %+v", out)
+	}
+}
+
+func TestCellCoder_Padding(t *testing.T) {
+	coder := cells.NewCellCoder(cells.AllKnownCells)
+	raw, err := coder.MarshalCell(&cells.PaddingCell{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 4+1+cells.CELL_BODY_LEN || raw[4] != cells.COMMAND_PADDING {
+		t.Fatalf("raw=%x", raw[:5])
+	}
+	got, err := coder.ReadCell(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID() != cells.COMMAND_PADDING {
+		t.Fatalf("id=%d", got.ID())
+	}
+}
+
+func TestIsVariableLength(t *testing.T) {
+	for _, cmd := range []uint8{cells.COMMAND_VERSIONS, cells.COMMAND_VPADDING, cells.COMMAND_CERTS, cells.COMMAND_AUTH_CHALLANGE, 132, 255} {
+		if !cells.IsVariableLength(cmd) {
+			t.Fatalf("command %d should be variable-length", cmd)
+		}
+	}
+	for _, cmd := range []uint8{cells.COMMAND_PADDING, cells.COMMAND_RELAY, cells.COMMAND_NETINFO, cells.COMMAND_PADDING_NEGOTIATE, 127} {
+		if cells.IsVariableLength(cmd) {
+			t.Fatalf("command %d should be fixed-length", cmd)
+		}
+	}
+}
+
+func TestCellCoder_VariableLengthStream(t *testing.T) {
+	coder := cells.NewCellCoder(cells.AllKnownCells)
+
+	var stream bytes.Buffer
+	if err := coder.WriteCell(&cells.VPaddingCell{Length: 37}, &stream); err != nil {
+		t.Fatal(err)
+	}
+	if stream.Len() != 4+1+2+37 {
+		t.Fatalf("VPADDING len=%d", stream.Len())
+	}
+	// Unknown variable-length command (AUTHORIZE) followed by a fixed cell.
+	stream.Write([]byte{0, 0, 0, 0, 132, 0, 3, 0xaa, 0xbb, 0xcc})
+	if err := coder.WriteCell(&cells.DestroyCell{CircuitID: 0x80000001, Reason: cells.DESTROY_REASON_FINISHED}, &stream); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bytes.NewReader(stream.Bytes())
+	got, err := coder.ReadCell(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vp := got.(*cells.VPaddingCell); vp.Length != 37 {
+		t.Fatalf("VPADDING length=%d", vp.Length)
+	}
+
+	if _, err := coder.ReadCell(r); !errors.Is(err, cells.ErrUnknownCommandID) {
+		t.Fatalf("expected unknown command, got %v", err)
+	}
+
+	got, err = coder.ReadCell(r)
+	if err != nil {
+		t.Fatalf("stream desynced after unknown cell: %v", err)
+	}
+	if d := got.(*cells.DestroyCell); d.Reason != cells.DESTROY_REASON_FINISHED {
+		t.Fatalf("reason=%d", d.Reason)
+	}
+	if r.Len() != 0 {
+		t.Fatalf("%d trailing bytes", r.Len())
+	}
+}
+
+func TestCellCoder_CertsVariableLength(t *testing.T) {
+	// N_CERTS=1, type 4, len 3, body.
+	body := []byte{1, cells.CERTS_IDENTITY_V_SIGNING_CERT, 0, 3, 7, 8, 9}
+	raw := append([]byte{0, 0, 0, 0, cells.COMMAND_CERTS, 0, byte(len(body))}, body...)
+
+	coder := cells.NewCellCoder(cells.AllKnownCells)
+	got, err := coder.ReadCell(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := got.(*cells.CertsCell)
+	if len(certs.Certificates) != 1 || !bytes.Equal(certs.Certificates[0].Cert, []byte{7, 8, 9}) {
+		t.Fatalf("certs=%+v", certs.Certificates)
+	}
+}
@@ -38,14 +38,12 @@ func (c *CertsCell) Decode(r io.Reader) error {
 		return ErrInvalidCircID
 	}
 
-	var length uint16
-	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+	buffer, err := io.ReadAll(r)
+	if err != nil {
 		return err
 	}
-
-	buffer := make([]byte, length)
-	if _, err := io.ReadFull(r, buffer); err != nil {
-		return err
+	if len(buffer) == 0 {
+		return io.ErrUnexpectedEOF
 	}
 
 	certAmmount := buffer[0]
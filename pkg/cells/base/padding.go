@@ -0,0 +1,93 @@
+package cells
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Link padding commands (tor-spec §3, padding-spec §2).
+const (
+	COMMAND_PADDING           uint8 = 0
+	COMMAND_PADDING_NEGOTIATE uint8 = 12
+	COMMAND_VPADDING          uint8 = 128
+)
+
+// PADDING_NEGOTIATE commands.
+const (
+	PADDING_NEGOTIATE_STOP  uint8 = 1
+	PADDING_NEGOTIATE_START uint8 = 2
+)
+
+// PaddingCell is a fixed-length link padding cell; the body is ignored.
+type PaddingCell struct {
+	CircuitID uint32
+}
+
+func (*PaddingCell) ID() uint8               { return COMMAND_PADDING }
+func (c *PaddingCell) GetCircuitID() uint32  { return c.CircuitID }
+func (c *PaddingCell) SetCircuitID(n uint32) { c.CircuitID = n }
+
+func (c *PaddingCell) Encode(w io.Writer) error { return nil }
+func (c *PaddingCell) Decode(r io.Reader) error { return nil }
+
+// VPaddingCell is a variable-length padding cell carrying Length ignored
+// bytes. The length prefix itself is handled by CellCoder.
+type VPaddingCell struct {
+	CircuitID uint32
+	Length    uint16
+}
+
+func (*VPaddingCell) ID() uint8               { return COMMAND_VPADDING }
+func (c *VPaddingCell) GetCircuitID() uint32  { return c.CircuitID }
+func (c *VPaddingCell) SetCircuitID(n uint32) { c.CircuitID = n }
+
+func (c *VPaddingCell) Encode(w io.Writer) error {
+	_, err := w.Write(make([]byte, c.Length))
+	return err
+}
+
+func (c *VPaddingCell) Decode(r io.Reader) error {
+	n, err := io.Copy(io.Discard, r)
+	c.Length = uint16(n)
+	return err
+}
+
+// PaddingNegotiateCell asks the other side of the link to change its padding
+// timeouts (padding-spec §2.2). Wire:
+//
+//	version(1)=0 command(1) ito_low_ms(2) ito_high_ms(2)
+type PaddingNegotiateCell struct {
+	CircuitID uint32
+
+	Command   uint8
+	ItoLowMs  uint16
+	ItoHighMs uint16
+}
+
+func (*PaddingNegotiateCell) ID() uint8               { return COMMAND_PADDING_NEGOTIATE }
+func (c *PaddingNegotiateCell) GetCircuitID() uint32  { return c.CircuitID }
+func (c *PaddingNegotiateCell) SetCircuitID(n uint32) { c.CircuitID = n }
+
+func (c *PaddingNegotiateCell) Encode(w io.Writer) error {
+	var b [6]byte
+	b[1] = c.Command
+	binary.BigEndian.PutUint16(b[2:], c.ItoLowMs)
+	binary.BigEndian.PutUint16(b[4:], c.ItoHighMs)
+	_, err := w.Write(b[:])
+	return err
+}
+
+func (c *PaddingNegotiateCell) Decode(r io.Reader) error {
+	var b [6]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	if b[0] != 0 {
+		return fmt.Errorf("unsupported padding negotiate version %d", b[0])
+	}
+	c.Command = b[1]
+	c.ItoLowMs = binary.BigEndian.Uint16(b[2:])
+	c.ItoHighMs = binary.BigEndian.Uint16(b[4:])
+	return nil
+}
@@ -2,6 +2,7 @@ package relay_test
 
 import (
 	"bytes"
+	"net/netip"
 	"testing"
 
 	"github.com/robogg133/gonion/pkg/cells/relay"
@@ -209,3 +210,80 @@ func TestAllKnownRelayCells_Registered(t *testing.T) {
 		}
 	}
 }
+
+func TestPaddingNegotiate_RoundTrip(t *testing.T) {
+	in := &relay.PaddingNegotiateCell{
+		Command:     relay.PADDING_COMMAND_START,
+		MachineType: 1,
+		MachineCtr:  0x01020304,
+	}
+	var buf bytes.Buffer
+	if err := in.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0, relay.PADDING_COMMAND_START, 1, 0, 1, 2, 3, 4}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("wire=%x want %x", buf.Bytes(), want)
+	}
+	out := &relay.PaddingNegotiateCell{}
+	if err := out.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if *out != *in {
+		t.Fatalf("got %+v", out)
+	}
+
+	bad := append([]byte{1}, want[1:]...)
+	if err := out.Decode(bytes.NewReader(bad)); err == nil {
+		t.Fatal("expected version error")
+	}
+}
+
+func TestPaddingNegotiated_RoundTrip(t *testing.T) {
+	in := &relay.PaddingNegotiatedCell{
+		Command:     relay.PADDING_COMMAND_STOP,
+		Response:    relay.PADDING_RESPONSE_OK,
+		MachineType: 0,
+		MachineCtr:  7,
+	}
+	var buf bytes.Buffer
+	if err := in.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := relay.AllKnownRellayCells[relay.COMMAND_PADDING_NEGOTIATED]().(*relay.PaddingNegotiatedCell)
+	if err := out.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if *out != *in {
+		t.Fatalf("got %+v", out)
+	}
+	if _, ok := relay.AllKnownRellayCells[relay.COMMAND_DROP]; !ok {
+		t.Fatal("DROP not registered")
+	}
+}
+
+func TestConnected_AddressRoundTrip(t *testing.T) {
+	for _, in := range []*relay.ConnectedCell{
+		{StreamID: 1, Addr: netip.MustParseAddr("93.184.216.34"), TTL: 300},
+		{StreamID: 1, Addr: netip.MustParseAddr("2606:2800:220:1::248"), TTL: 60},
+	} {
+		var buf bytes.Buffer
+		if err := in.Encode(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[bool]int{true: 8, false: 25}[in.Addr.Is4()]; buf.Len() != want {
+			t.Fatalf("%s: body %d bytes, want %d", in.Addr, buf.Len(), want)
+		}
+		out := &relay.ConnectedCell{}
+		if err := out.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		if out.Addr != in.Addr || out.TTL != in.TTL {
+			t.Fatalf("got %s ttl %d, want %s ttl %d", out.Addr, out.TTL, in.Addr, in.TTL)
+		}
+	}
+
+	if err := (&relay.ConnectedCell{}).Decode(bytes.NewReader([]byte{0, 0, 0, 0, 9})); err == nil {
+		t.Fatal("malformed body accepted")
+	}
+}
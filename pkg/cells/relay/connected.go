@@ -1,16 +1,65 @@
 package relay
 
-import "io"
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+)
 
 const COMMAND_CONNECTED uint8 = 4
 
+// CONNECTED address type for IPv6 (tor-spec §6.2).
+const CONNECTED_ADDR_TYPE_IPV6 uint8 = 6
+
+// ConnectedCell answers a BEGIN. Addr is the address the exit connected
+// to and TTL how long it may be cached, in seconds; Addr is invalid for
+// BEGIN_DIR and exits that did not say.
 type ConnectedCell struct {
 	StreamID uint16
+
+	Addr netip.Addr
+	TTL  uint32
 }
 
 func (*ConnectedCell) ID() uint8              { return COMMAND_CONNECTED }
 func (c *ConnectedCell) GetStreamID() uint16  { return c.StreamID }
 func (c *ConnectedCell) SetStreamID(n uint16) { c.StreamID = n }
 
-func (*ConnectedCell) Encode(io.Writer) error { return nil }
-func (*ConnectedCell) Decode(io.Reader) error { return nil }
+func (c *ConnectedCell) Encode(w io.Writer) error {
+	var b []byte
+	switch {
+	case !c.Addr.IsValid():
+		return nil
+	case c.Addr.Is4():
+		a := c.Addr.As4()
+		b = append(b, a[:]...)
+	default:
+		a := c.Addr.As16()
+		b = append(b, 0, 0, 0, 0, CONNECTED_ADDR_TYPE_IPV6)
+		b = append(b, a[:]...)
+	}
+	b = binary.BigEndian.AppendUint32(b, c.TTL)
+	_, err := w.Write(b)
+	return err
+}
+
+func (c *ConnectedCell) Decode(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(b) == 0:
+		return nil
+	case len(b) >= 8 && [4]byte(b) != [4]byte{}:
+		c.Addr = netip.AddrFrom4([4]byte(b))
+		c.TTL = binary.BigEndian.Uint32(b[4:8])
+	case len(b) >= 25 && b[4] == CONNECTED_ADDR_TYPE_IPV6:
+		c.Addr = netip.AddrFrom16([16]byte(b[5:21]))
+		c.TTL = binary.BigEndian.Uint32(b[21:25])
+	default:
+		return fmt.Errorf("connected: malformed address (%d bytes)", len(b))
+	}
+	return nil
+}
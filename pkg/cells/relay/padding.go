@@ -0,0 +1,129 @@
+package relay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Circuit padding relay commands (padding-spec §3, tor src/core/or/or.h).
+const (
+	COMMAND_DROP               uint8 = 10
+	COMMAND_PADDING_NEGOTIATE  uint8 = 41
+	COMMAND_PADDING_NEGOTIATED uint8 = 42
+)
+
+// PADDING_NEGOTIATE commands.
+const (
+	PADDING_COMMAND_STOP  uint8 = 1
+	PADDING_COMMAND_START uint8 = 2
+)
+
+// PADDING_NEGOTIATED responses.
+const (
+	PADDING_RESPONSE_OK  uint8 = 1
+	PADDING_RESPONSE_ERR uint8 = 2
+)
+
+const paddingNegotiateVersion uint8 = 0
+
+// DropCell is a long-range dummy cell. The receiving hop decrypts and
+// discards it; the body is ignored.
+type DropCell struct {
+	StreamID uint16
+}
+
+func (*DropCell) ID() uint8              { return COMMAND_DROP }
+func (c *DropCell) GetStreamID() uint16  { return c.StreamID }
+func (c *DropCell) SetStreamID(n uint16) { c.StreamID = n }
+
+func (c *DropCell) Encode(w io.Writer) error { return nil }
+func (c *DropCell) Decode(r io.Reader) error { return nil }
+
+// PaddingNegotiateCell asks a hop to start or stop its side of a padding
+// machine. Wire (trunnel circpad_negotiate):
+//
+//	version(1) command(1) machine_type(1) echo_request(1) machine_ctr(4)
+type PaddingNegotiateCell struct {
+	StreamID uint16
+
+	Command     uint8
+	MachineType uint8
+	EchoRequest bool
+	MachineCtr  uint32
+}
+
+func (*PaddingNegotiateCell) ID() uint8              { return COMMAND_PADDING_NEGOTIATE }
+func (c *PaddingNegotiateCell) GetStreamID() uint16  { return c.StreamID }
+func (c *PaddingNegotiateCell) SetStreamID(n uint16) { c.StreamID = n }
+
+func (c *PaddingNegotiateCell) Encode(w io.Writer) error {
+	var b [8]byte
+	b[0] = paddingNegotiateVersion
+	b[1] = c.Command
+	b[2] = c.MachineType
+	if c.EchoRequest {
+		b[3] = 1
+	}
+	binary.BigEndian.PutUint32(b[4:], c.MachineCtr)
+	_, err := w.Write(b[:])
+	return err
+}
+
+func (c *PaddingNegotiateCell) Decode(r io.Reader) error {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	if b[0] != paddingNegotiateVersion {
+		return fmt.Errorf("unsupported padding negotiate version %d", b[0])
+	}
+	c.Command = b[1]
+	c.MachineType = b[2]
+	c.EchoRequest = b[3] == 1
+	c.MachineCtr = binary.BigEndian.Uint32(b[4:])
+	return nil
+}
+
+// PaddingNegotiatedCell answers a PADDING_NEGOTIATE. Wire (trunnel
+// circpad_negotiated):
+//
+//	version(1) command(1) response(1) machine_type(1) machine_ctr(4)
+type PaddingNegotiatedCell struct {
+	StreamID uint16
+
+	Command     uint8
+	Response    uint8
+	MachineType uint8
+	MachineCtr  uint32
+}
+
+func (*PaddingNegotiatedCell) ID() uint8              { return COMMAND_PADDING_NEGOTIATED }
+func (c *PaddingNegotiatedCell) GetStreamID() uint16  { return c.StreamID }
+func (c *PaddingNegotiatedCell) SetStreamID(n uint16) { c.StreamID = n }
+
+func (c *PaddingNegotiatedCell) Encode(w io.Writer) error {
+	var b [8]byte
+	b[0] = paddingNegotiateVersion
+	b[1] = c.Command
+	b[2] = c.Response
+	b[3] = c.MachineType
+	binary.BigEndian.PutUint32(b[4:], c.MachineCtr)
+	_, err := w.Write(b[:])
+	return err
+}
+
+func (c *PaddingNegotiatedCell) Decode(r io.Reader) error {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	if b[0] != paddingNegotiateVersion {
+		return fmt.Errorf("unsupported padding negotiated version %d", b[0])
+	}
+	c.Command = b[1]
+	c.Response = b[2]
+	c.MachineType = b[3]
+	c.MachineCtr = binary.BigEndian.Uint32(b[4:])
+	return nil
+}
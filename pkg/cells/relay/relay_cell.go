@@ -32,6 +32,10 @@ var AllKnownRellayCells = map[uint8]func() Cell{
 	COMMAND_INTRO_ESTABLISHED:      func() Cell { return &IntroEstablishedCell{} },
 	COMMAND_RENDEZVOUS_ESTABLISHED: func() Cell { return &RendezvousEstablishedCell{} },
 	COMMAND_INTRODUCE_ACK:          func() Cell { return &IntroduceAckCell{} },
+
+	COMMAND_DROP:               func() Cell { return &DropCell{} },
+	COMMAND_PADDING_NEGOTIATE:  func() Cell { return &PaddingNegotiateCell{} },
+	COMMAND_PADDING_NEGOTIATED: func() Cell { return &PaddingNegotiatedCell{} },
 }
 
 type Cell interface {
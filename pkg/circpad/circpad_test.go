@@ -0,0 +1,278 @@
+package circpad
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// loopback wires a runtime's send callback straight back into
+// EventPaddingSent, like a circuit whose write loop is instantaneous.
+type loopback struct {
+	rt   *Runtime
+	mu   sync.Mutex
+	sent int
+	done chan struct{}
+}
+
+func newLoopback(m *Machine) *loopback {
+	lb := &loopback{done: make(chan struct{})}
+	lb.rt = NewRuntime(m, func() {
+		lb.mu.Lock()
+		lb.sent++
+		lb.mu.Unlock()
+		lb.rt.Event(EventPaddingSent)
+	}, func() { close(lb.done) })
+	return lb
+}
+
+func (lb *loopback) wait(t *testing.T) int {
+	t.Helper()
+	select {
+	case <-lb.done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("machine did not finish, state=%d", lb.rt.State())
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.sent
+}
+
+func TestClientRendMachine_SendsOneDrop(t *testing.T) {
+	lb := newLoopback(ClientHideRendMachine())
+	if lb.rt.State() != StateStart {
+		t.Fatalf("state=%d", lb.rt.State())
+	}
+	lb.rt.Event(EventNonPaddingSent)
+	if n := lb.wait(t); n != 1 {
+		t.Fatalf("sent %d padding cells, want 1", n)
+	}
+	if lb.rt.State() != StateEnd {
+		t.Fatalf("state=%d, want end", lb.rt.State())
+	}
+}
+
+func TestRelayIntroMachine_PaddingBounds(t *testing.T) {
+	for range 20 {
+		lb := newLoopback(RelayHideIntroMachine())
+		lb.rt.Event(EventNonPaddingSent)
+		n := lb.wait(t)
+		if n < introMachineMinPadding || n >= introMachineMaxPadding {
+			t.Fatalf("sent %d padding cells, want [%d,%d)", n, introMachineMinPadding, introMachineMaxPadding)
+		}
+	}
+}
+
+func TestClientIntroMachine_NeverPads(t *testing.T) {
+	sent := false
+	rt := NewRuntime(ClientHideIntroMachine(), func() { sent = true }, nil)
+	rt.Event(EventNonPaddingSent)
+	rt.Event(EventNonPaddingRecv)
+	time.Sleep(10 * time.Millisecond)
+	if rt.State() != StateObfuscateCircSetup {
+		t.Fatalf("state=%d", rt.State())
+	}
+	if sent {
+		t.Fatal("client intro machine should not pad")
+	}
+}
+
+func TestRuntime_IgnoreAndStop(t *testing.T) {
+	sent := make(chan struct{}, 4)
+	m := &Machine{States: []State{
+		StateStart: {NextState: map[Event]uint16{EventNonPaddingRecv: StateBurst}},
+		StateBurst: {
+			HistogramEdges: []time.Duration{time.Hour, 2 * time.Hour},
+			Histogram:      []uint32{1, 0},
+			NextState:      map[Event]uint16{EventPaddingRecv: StateCancel},
+		},
+	}}
+	rt := NewRuntime(m, func() { sent <- struct{}{} }, nil)
+
+	rt.Event(EventPaddingRecv) // ignored in start
+	if rt.State() != StateStart {
+		t.Fatalf("state=%d", rt.State())
+	}
+	rt.Event(EventNonPaddingRecv)
+	if rt.State() != StateBurst || !rt.pending {
+		t.Fatalf("state=%d pending=%v", rt.State(), rt.pending)
+	}
+	rt.Event(EventPaddingRecv)
+	if rt.pending {
+		t.Fatal("cancel transition left padding scheduled")
+	}
+	rt.Stop()
+	rt.Event(EventNonPaddingRecv)
+	if rt.pending {
+		t.Fatal("stopped runtime scheduled padding")
+	}
+}
+
+func TestRuntime_InfinityBin(t *testing.T) {
+	m := &Machine{States: []State{
+		StateStart: {NextState: map[Event]uint16{EventNonPaddingSent: StateBurst}},
+		StateBurst: {
+			HistogramEdges: []time.Duration{0, time.Millisecond},
+			Histogram:      []uint32{0, 5},
+			NextState:      map[Event]uint16{EventInfinity: StateEnd},
+		},
+	}}
+	done := make(chan struct{})
+	rt := NewRuntime(m, func() { t.Error("infinity bin must not pad") }, func() { close(done) })
+	rt.Event(EventNonPaddingSent)
+	select {
+	case <-done:
+	default:
+		t.Fatal("infinity event did not end machine")
+	}
+}
+
+func TestRuntime_InfinitySelfTransition(t *testing.T) {
+	for name, st := range map[string]State{
+		"empty histogram": {
+			HistogramEdges: []time.Duration{0, time.Millisecond},
+			Histogram:      []uint32{0, 0},
+		},
+		"no delay source": {},
+	} {
+		st.NextState = map[Event]uint16{EventInfinity: StateBurst}
+		m := &Machine{States: []State{
+			StateStart: {NextState: map[Event]uint16{EventNonPaddingSent: StateBurst}},
+			StateBurst: st,
+		}}
+		rt := NewRuntime(m, func() { t.Errorf("%s: padded", name) }, nil)
+		rt.Event(EventNonPaddingSent)
+		if rt.State() != StateBurst || rt.pending {
+			t.Fatalf("%s: state=%d pending=%v", name, rt.State(), rt.pending)
+		}
+	}
+}
+
+func TestRuntime_InfinityCycle(t *testing.T) {
+	const stateA, stateB = StateBurst, StateGap
+	m := &Machine{States: []State{
+		StateStart: {NextState: map[Event]uint16{EventNonPaddingSent: stateA}},
+		stateA:     {NextState: map[Event]uint16{EventInfinity: stateB}},
+		stateB:     {NextState: map[Event]uint16{EventInfinity: stateA}},
+	}}
+	rt := NewRuntime(m, func() { t.Error("delayless cycle padded") }, nil)
+	rt.Event(EventNonPaddingSent)
+	if s := rt.State(); (s != stateA && s != stateB) || rt.pending {
+		t.Fatalf("state=%d pending=%v", s, rt.pending)
+	}
+}
+
+func TestRuntime_PaddingLimit(t *testing.T) {
+	m := &Machine{
+		AllowedPaddingCount: 1,
+		MaxPaddingPercent:   50,
+		States: []State{
+			StateStart: {NextState: map[Event]uint16{EventNonPaddingSent: StateBurst}},
+			StateBurst: {
+				HistogramEdges: []time.Duration{time.Hour, 2 * time.Hour},
+				Histogram:      []uint32{1, 0},
+				NextState:      map[Event]uint16{EventPaddingSent: StateBurst},
+			},
+		},
+	}
+	rt := NewRuntime(m, func() {}, nil)
+	rt.Event(EventNonPaddingSent)
+	rt.Event(EventPaddingSent)
+	rt.Event(EventPaddingSent)
+	if rt.pending {
+		t.Fatal("padding scheduled past max_padding_percent")
+	}
+	if p, np := rt.Counts(); p != 2 || np != 1 {
+		t.Fatalf("counts=%d/%d", p, np)
+	}
+}
+
+func tokenState(strategy TokenRemoval) *Machine {
+	us := time.Microsecond
+	return &Machine{States: []State{
+		StateStart: {
+			HistogramEdges: []time.Duration{0, 10 * us, 20 * us, 30 * us, 40 * us},
+			Histogram:      []uint32{1, 0, 1, 1, 0},
+			TokenRemoval:   strategy,
+		},
+	}}
+}
+
+func TestRemoveToken_Strategies(t *testing.T) {
+	us := time.Microsecond
+	cases := []struct {
+		strategy TokenRemoval
+		elapsed  time.Duration
+		want     []uint32
+	}{
+		{RemoveNone, 15 * us, []uint32{1, 0, 1, 1, 0}},
+		{RemoveHigher, 15 * us, []uint32{1, 0, 0, 1, 0}},
+		{RemoveLower, 15 * us, []uint32{0, 0, 1, 1, 0}},
+		{RemoveClosest, 15 * us, []uint32{0, 0, 1, 1, 0}},
+		{RemoveClosestUsec, 19 * us, []uint32{1, 0, 0, 1, 0}},
+		{RemoveExact, 15 * us, []uint32{1, 0, 1, 1, 0}},
+		{RemoveExact, 35 * us, []uint32{1, 0, 1, 0, 0}},
+	}
+	for _, c := range cases {
+		rt := NewRuntime(tokenState(c.strategy), func() {}, nil)
+		if c.strategy != RemoveNone {
+			rt.removeToken(c.elapsed)
+		}
+		for i := range c.want {
+			if rt.tokens[i] != c.want[i] {
+				t.Fatalf("strategy %d elapsed %v: tokens=%v want %v", c.strategy, c.elapsed, rt.tokens, c.want)
+			}
+		}
+	}
+}
+
+func TestRuntime_BinsEmpty(t *testing.T) {
+	m := tokenState(RemoveExact)
+	m.States[StateStart].Histogram = []uint32{1, 0, 0, 0, 0}
+	m.States[StateStart].NextState = map[Event]uint16{EventNonPaddingSent: StateStart, EventBinsEmpty: StateEnd}
+	rt := NewRuntime(m, func() {}, nil)
+	rt.Event(EventNonPaddingSent) // schedules
+	rt.Event(EventNonPaddingSent) // consumes the only token
+	if rt.State() != StateEnd {
+		t.Fatalf("state=%d, want end", rt.State())
+	}
+}
+
+func TestDistribution_Sample(t *testing.T) {
+	dists := []Distribution{
+		{Type: DistUniform, Param1: 3, Param2: 5},
+		{Type: DistLogistic, Param1: 10, Param2: 1},
+		{Type: DistLogLogistic, Param1: 10, Param2: 2},
+		{Type: DistGeometric, Param1: 0.5},
+		{Type: DistWeibull, Param1: 1.5, Param2: 10},
+		{Type: DistPareto, Param1: 10, Param2: 0.2},
+		{Type: DistPareto, Param1: 10},
+	}
+	for _, d := range dists {
+		for range 1000 {
+			v := d.Sample()
+			if v < 0 {
+				t.Fatalf("%+v sampled %v", d, v)
+			}
+			if d.Type == DistUniform && (v < 3 || v >= 5) {
+				t.Fatalf("uniform sample %v out of [3,5)", v)
+			}
+			if d.Type == DistGeometric && v < 1 {
+				t.Fatalf("geometric sample %v < 1", v)
+			}
+		}
+	}
+	if (Distribution{}).Sample() != 0 {
+		t.Fatal("DistNone should sample zero")
+	}
+}
+
+func TestDistribution_Median(t *testing.T) {
+	// Inverse CDF at u=0.5 is the median for each family.
+	if v := (Distribution{Type: DistLogistic, Param1: 7, Param2: 3}).sample(0.5); v != 7 {
+		t.Fatalf("logistic median=%v", v)
+	}
+	if v := (Distribution{Type: DistLogLogistic, Param1: 4, Param2: 2}).sample(0.5); v != 4 {
+		t.Fatalf("log-logistic median=%v", v)
+	}
+}
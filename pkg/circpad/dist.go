@@ -0,0 +1,83 @@
+package circpad
+
+import (
+	"math"
+	"math/rand/v2"
+)
+
+// DistType names a probability distribution (tor circpad_distribution_type_t).
+type DistType uint8
+
+const (
+	DistNone DistType = iota
+	// DistUniform: Param1 = min, Param2 = max (exclusive).
+	DistUniform
+	// DistLogistic: Param1 = mu, Param2 = sigma.
+	DistLogistic
+	// DistLogLogistic: Param1 = alpha (scale), Param2 = beta (shape).
+	DistLogLogistic
+	// DistGeometric: Param1 = success probability.
+	DistGeometric
+	// DistWeibull: Param1 = k (shape), Param2 = lambda (scale).
+	DistWeibull
+	// DistPareto is the generalized Pareto with mu = 0: Param1 = sigma,
+	// Param2 = xi.
+	DistPareto
+)
+
+// Distribution is a parametrised distribution sampled by inverse transform.
+type Distribution struct {
+	Type   DistType
+	Param1 float64
+	Param2 float64
+}
+
+// Sample draws one value. Negative results are clamped to zero and DistNone
+// always yields zero.
+func (d Distribution) Sample() float64 {
+	return clampSample(d.sample(uniform01()))
+}
+
+func (d Distribution) sample(u float64) float64 {
+	switch d.Type {
+	case DistUniform:
+		return d.Param1 + (d.Param2-d.Param1)*u
+	case DistLogistic:
+		return d.Param1 + d.Param2*math.Log(u/(1-u))
+	case DistLogLogistic:
+		return d.Param1 * math.Pow(u/(1-u), 1/d.Param2)
+	case DistGeometric:
+		if d.Param1 >= 1 {
+			return 1
+		}
+		return math.Ceil(math.Log(u) / math.Log1p(-d.Param1))
+	case DistWeibull:
+		return d.Param2 * math.Pow(-math.Log1p(-u), 1/d.Param1)
+	case DistPareto:
+		if d.Param2 == 0 {
+			return -d.Param1 * math.Log1p(-u)
+		}
+		return d.Param1 * (math.Pow(1-u, -d.Param2) - 1) / d.Param2
+	}
+	return 0
+}
+
+func clampSample(v float64) float64 {
+	if math.IsNaN(v) || v < 0 {
+		return 0
+	}
+	if v > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return v
+}
+
+// uniform01 returns a value in the open interval (0, 1), which keeps the
+// logarithms above finite.
+func uniform01() float64 {
+	for {
+		if u := rand.Float64(); u > 0 {
+			return u
+		}
+	}
+}
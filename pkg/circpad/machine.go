@@ -0,0 +1,168 @@
+// Package circpad implements the circuit padding framework from padding-spec
+// §3 (tor src/core/or/circuitpadding.c).
+//
+// A Machine is a static description: states, their histograms or delay
+// distributions, and the event transitions between them. A Runtime is one
+// instance of a Machine attached to a circuit; it is fed cell events and calls
+// back whenever a padding (RELAY_DROP) cell should be sent.
+package circpad
+
+import "time"
+
+// Event is an input to a padding machine (tor circpad_event_t).
+type Event uint8
+
+const (
+	EventNonPaddingRecv Event = iota
+	EventNonPaddingSent
+	EventPaddingSent
+	EventPaddingRecv
+	EventInfinity
+	EventBinsEmpty
+	EventLengthCount
+
+	eventCount
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventNonPaddingRecv:
+		return "nonpadding_recv"
+	case EventNonPaddingSent:
+		return "nonpadding_sent"
+	case EventPaddingSent:
+		return "padding_sent"
+	case EventPaddingRecv:
+		return "padding_recv"
+	case EventInfinity:
+		return "infinity"
+	case EventBinsEmpty:
+		return "bins_empty"
+	case EventLengthCount:
+		return "length_count"
+	}
+	return "unknown"
+}
+
+// State indices. Machines may define more states after StateGap; StateEnd
+// is terminal and never has a State entry.
+const (
+	StateStart uint16 = 0
+	StateBurst uint16 = 1
+	StateGap   uint16 = 2
+	StateEnd   uint16 = 0xffff
+
+	// StateIgnore is the implicit transition for events a state does not
+	// list: nothing happens.
+	StateIgnore uint16 = 0xfffe
+	// StateCancel cancels any scheduled padding without changing state.
+	StateCancel uint16 = 0xfffd
+)
+
+// TokenRemoval selects which histogram bin loses a token when a non-padding
+// cell is sent while padding was scheduled (tor circpad_removal_t).
+type TokenRemoval uint8
+
+const (
+	RemoveNone TokenRemoval = iota
+	// RemoveHigher takes a token from the closest non-empty bin at or above
+	// the bin of the observed delay.
+	RemoveHigher
+	// RemoveLower takes a token from the closest non-empty bin at or below.
+	RemoveLower
+	// RemoveClosest takes a token from the non-empty bin closest in index.
+	RemoveClosest
+	// RemoveClosestUsec takes a token from the non-empty bin whose midpoint
+	// is closest to the observed delay.
+	RemoveClosestUsec
+	// RemoveExact only removes from the exact bin, if it has tokens.
+	RemoveExact
+)
+
+// State describes one padding state. Delays come from the histogram when it
+// is non-empty, otherwise from IatDist.
+type State struct {
+	// HistogramEdges holds len(Histogram) delays: bin i covers
+	// [HistogramEdges[i], HistogramEdges[i+1]); the last bin is the
+	// infinity bin and never yields padding.
+	HistogramEdges []time.Duration
+	Histogram      []uint32
+	TokenRemoval   TokenRemoval
+
+	// IatDist is sampled in microseconds and shifted by DistAddedShift
+	// when no histogram is defined. DistMaxSample caps the result; zero
+	// means no cap.
+	IatDist        Distribution
+	DistAddedShift time.Duration
+	DistMaxSample  time.Duration
+
+	// LengthDist bounds the number of padding cells sent in this state.
+	// The zero Distribution means the length is unbounded.
+	LengthDist  Distribution
+	StartLength uint64
+	MaxLength   uint64
+	// LengthIncludesNonPadding counts non-padding cells against the state
+	// length too.
+	LengthIncludesNonPadding bool
+
+	// NextState maps events to the state entered. Events missing from the
+	// map are ignored.
+	NextState map[Event]uint16
+}
+
+// infinityBin returns the index of the infinity bin.
+func (s *State) infinityBin() int { return len(s.Histogram) - 1 }
+
+// binStart and binEnd return the delay range of bin i.
+func (s *State) binStart(i int) time.Duration {
+	return s.HistogramEdges[i]
+}
+
+func (s *State) binEnd(i int) time.Duration {
+	if i+1 < len(s.HistogramEdges) {
+		return s.HistogramEdges[i+1]
+	}
+	return s.HistogramEdges[i]
+}
+
+// binFor returns the bin whose range contains d, never the infinity bin.
+func (s *State) binFor(d time.Duration) int {
+	last := s.infinityBin() - 1
+	for i := 0; i < last; i++ {
+		if d < s.HistogramEdges[i+1] {
+			return i
+		}
+	}
+	return last
+}
+
+func (s *State) next(ev Event) uint16 {
+	if n, ok := s.NextState[ev]; ok {
+		return n
+	}
+	return StateIgnore
+}
+
+// Machine is a padding machine specification (tor circpad_machine_spec_t).
+type Machine struct {
+	Name string
+	// Number is the machine_type sent in PADDING_NEGOTIATE; it must match
+	// the index of the peer machine on the relay side.
+	Number uint8
+	// TargetHop is the 1-based hop that runs the peer machine.
+	TargetHop int
+	// OriginSide is true for machines that run on the client.
+	OriginSide bool
+	// ShouldNegotiateEnd asks the runtime owner to send a STOP when the
+	// machine reaches StateEnd.
+	ShouldNegotiateEnd bool
+
+	// AllowedPaddingCount is the number of padding cells that may be sent
+	// before MaxPaddingPercent is enforced.
+	AllowedPaddingCount uint16
+	// MaxPaddingPercent caps padding as a share of all cells sent; zero
+	// disables the limit.
+	MaxPaddingPercent uint8
+
+	States []State
+}
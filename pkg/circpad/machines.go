@@ -0,0 +1,129 @@
+package circpad
+
+import "time"
+
+// Standard machines from tor src/core/or/circuitpadding_machines.c. They make
+// the setup of onion service circuits look like general-purpose exit
+// circuits to the guard. Each constructor returns a fresh copy.
+
+// Machine numbers, shared by the client and relay halves of a pair.
+const (
+	MachineHideIntro uint8 = 0
+	MachineHideRend  uint8 = 1
+)
+
+// StateObfuscateCircSetup is the single padding state of the standard
+// machines (tor CIRCPAD_STATE_OBFUSCATE_CIRC_SETUP).
+const StateObfuscateCircSetup uint16 = 1
+
+// Bounds on the number of padding cells the relay side of the intro machine
+// sends (tor INTRO_MACHINE_MINIMUM/MAXIMUM_PADDING).
+const (
+	introMachineMinPadding = 7
+	introMachineMaxPadding = 10
+)
+
+// ClientHideIntroMachine runs on the client side of an introduction circuit.
+// It sends no padding itself; it only keeps the relay half alive until the
+// relay negotiates the end. A real INTRODUCE1 is followed by INTRODUCE_ACK;
+// the relay pads that exchange out to look like a short exit stream.
+func ClientHideIntroMachine() *Machine {
+	return &Machine{
+		Name:       "client_ip_circ",
+		Number:     MachineHideIntro,
+		TargetHop:  2,
+		OriginSide: true,
+		States: []State{
+			StateStart: {
+				NextState: map[Event]uint16{
+					EventNonPaddingSent: StateObfuscateCircSetup,
+				},
+			},
+			StateObfuscateCircSetup: {
+				// No histogram and no delay distribution: never pads.
+				NextState: map[Event]uint16{},
+			},
+		},
+	}
+}
+
+// RelayHideIntroMachine is the relay half of ClientHideIntroMachine. It sends
+// between 7 and 10 padding cells with delays under 10µs, then tells the client
+// to stop.
+func RelayHideIntroMachine() *Machine {
+	return &Machine{
+		Name:               "relay_ip_circ",
+		Number:             MachineHideIntro,
+		TargetHop:          2,
+		ShouldNegotiateEnd: true,
+		States: []State{
+			StateStart: {
+				NextState: map[Event]uint16{
+					EventNonPaddingSent: StateObfuscateCircSetup,
+				},
+			},
+			StateObfuscateCircSetup: {
+				HistogramEdges: []time.Duration{0, time.Microsecond, 10 * time.Microsecond},
+				Histogram:      []uint32{1, 0, 0},
+				TokenRemoval:   RemoveNone,
+				LengthDist: Distribution{
+					Type:   DistUniform,
+					Param1: introMachineMinPadding,
+					Param2: introMachineMaxPadding,
+				},
+				NextState: map[Event]uint16{
+					EventPaddingSent: StateObfuscateCircSetup,
+					EventLengthCount: StateEnd,
+				},
+			},
+		},
+	}
+}
+
+// ClientHideRendMachine runs on the client side of a rendezvous circuit. It
+// sends a single RELAY_DROP right after PADDING_NEGOTIATE, producing
+//
+//	[PADDING_NEGOTIATE] -> [DROP] -> PADDING_NEGOTIATED -> DROP
+//
+// which mirrors [BEGIN] -> [DATA] -> CONNECTED -> DATA on an exit circuit.
+func ClientHideRendMachine() *Machine {
+	return &Machine{
+		Name:       "client_rp_circ",
+		Number:     MachineHideRend,
+		TargetHop:  2,
+		OriginSide: true,
+		States: []State{
+			StateStart: {
+				NextState: map[Event]uint16{
+					EventNonPaddingSent: StateObfuscateCircSetup,
+				},
+			},
+			StateObfuscateCircSetup: {
+				// One token in [0, 1µs): the DROP must leave before
+				// PADDING_NEGOTIATED comes back.
+				HistogramEdges: []time.Duration{0, time.Microsecond, time.Second},
+				Histogram:      []uint32{1, 0, 0},
+				TokenRemoval:   RemoveNone,
+				// Uniform [1, 2) always yields one cell.
+				LengthDist: Distribution{Type: DistUniform, Param1: 1, Param2: 2},
+				NextState: map[Event]uint16{
+					EventLengthCount: StateEnd,
+				},
+			},
+		},
+	}
+}
+
+// RelayHideRendMachine is the relay half of ClientHideRendMachine: one DROP
+// after PADDING_NEGOTIATED.
+func RelayHideRendMachine() *Machine {
+	m := ClientHideRendMachine()
+	m.Name = "relay_rp_circ"
+	m.OriginSide = false
+	return m
+}
+
+// ClientMachines returns the origin-side machines indexed by Number.
+func ClientMachines() []*Machine {
+	return []*Machine{ClientHideIntroMachine(), ClientHideRendMachine()}
+}
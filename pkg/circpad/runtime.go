@@ -0,0 +1,403 @@
+package circpad
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Runtime is one instance of a Machine attached to a circuit (tor
+// circpad_machine_runtime_t).
+//
+// The owner reports every relay cell with Event. When the machine decides to
+// pad, send is called from a timer goroutine; the owner should queue a
+// RELAY_DROP and report EventPaddingSent once it has left. done, if set, is
+// called once when the machine reaches StateEnd.
+type Runtime struct {
+	m    *Machine
+	send func()
+	done func()
+
+	mu    sync.Mutex
+	state uint16
+
+	remaining     uint64
+	lengthBounded bool
+
+	tokens    []uint32
+	chosenBin int
+
+	paddingSent    uint64
+	nonPaddingSent uint64
+
+	timer       *time.Timer
+	gen         uint64
+	pending     bool
+	scheduledAt time.Time
+
+	ended   bool
+	stopped bool
+}
+
+// NewRuntime starts m in StateStart. Nothing is scheduled until the first
+// event moves the machine out of its start state.
+func NewRuntime(m *Machine, send func(), done func()) *Runtime {
+	rt := &Runtime{
+		m:         m,
+		send:      send,
+		done:      done,
+		state:     StateStart,
+		chosenBin: -1,
+	}
+	if len(m.States) == 0 {
+		rt.state = StateEnd
+		rt.ended = true
+		return rt
+	}
+	rt.enterState()
+	return rt
+}
+
+// Machine returns the specification this runtime runs.
+func (rt *Runtime) Machine() *Machine { return rt.m }
+
+// State returns the current state index, StateEnd once finished.
+func (rt *Runtime) State() uint16 {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.state
+}
+
+// Counts returns the padding and non-padding cells sent so far.
+func (rt *Runtime) Counts() (padding, nonPadding uint64) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.paddingSent, rt.nonPaddingSent
+}
+
+// Stop cancels any scheduled padding and freezes the machine.
+func (rt *Runtime) Stop() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.stopped = true
+	rt.cancel()
+}
+
+// Event feeds a cell event into the machine.
+func (rt *Runtime) Event(ev Event) {
+	rt.mu.Lock()
+	if rt.stopped || rt.ended {
+		rt.mu.Unlock()
+		return
+	}
+
+	switch ev {
+	case EventNonPaddingSent:
+		rt.nonPaddingSent++
+		st := rt.cur()
+		if rt.pending && st.TokenRemoval != RemoveNone {
+			rt.removeToken(time.Since(rt.scheduledAt))
+			rt.cancel()
+			if rt.binsEmpty() {
+				rt.transition(EventBinsEmpty)
+				break
+			}
+		}
+		if st.LengthIncludesNonPadding && rt.countLength() {
+			rt.transition(EventLengthCount)
+			break
+		}
+		rt.transition(ev)
+	case EventPaddingSent:
+		rt.paddingSent++
+		if rt.countLength() {
+			rt.transition(EventLengthCount)
+			break
+		}
+		if rt.binsEmpty() {
+			rt.transition(EventBinsEmpty)
+			break
+		}
+		rt.transition(ev)
+	default:
+		rt.transition(ev)
+	}
+
+	notify := rt.ended && !rt.stopped
+	if notify {
+		rt.stopped = true
+	}
+	rt.mu.Unlock()
+
+	if notify && rt.done != nil {
+		rt.done()
+	}
+}
+
+func (rt *Runtime) cur() *State {
+	if int(rt.state) >= len(rt.m.States) {
+		return nil
+	}
+	return &rt.m.States[rt.state]
+}
+
+// transition applies the event to the current state (tor
+// circpad_machine_spec_transition). Re-entering the same state only
+// reschedules; it keeps the remaining length and tokens.
+func (rt *Runtime) transition(ev Event) {
+	if rt.move(ev) {
+		rt.schedule()
+	}
+}
+
+// move is transition without the scheduling. It reports whether the
+// machine is in a state that wants padding scheduled.
+func (rt *Runtime) move(ev Event) bool {
+	st := rt.cur()
+	if st == nil {
+		return false
+	}
+
+	next := st.next(ev)
+	switch next {
+	case StateIgnore:
+		return false
+	case StateCancel:
+		rt.cancel()
+		return false
+	case StateEnd:
+		rt.cancel()
+		rt.state = StateEnd
+		rt.ended = true
+		return false
+	}
+	if int(next) >= len(rt.m.States) {
+		return false
+	}
+
+	if next != rt.state {
+		rt.state = next
+		rt.enterState()
+	}
+	return true
+}
+
+// enterState resets the token supply and draws a new state length.
+func (rt *Runtime) enterState() {
+	st := rt.cur()
+	rt.tokens = append(rt.tokens[:0], st.Histogram...)
+	rt.chosenBin = -1
+
+	rt.lengthBounded = st.LengthDist.Type != DistNone
+	if !rt.lengthBounded {
+		return
+	}
+	length := uint64(st.LengthDist.Sample()) + st.StartLength
+	if st.MaxLength > 0 && length > st.MaxLength {
+		length = st.MaxLength
+	}
+	rt.remaining = length
+}
+
+// countLength consumes one unit of state length and reports whether it has
+// run out.
+func (rt *Runtime) countLength() bool {
+	if !rt.lengthBounded {
+		return false
+	}
+	if rt.remaining > 0 {
+		rt.remaining--
+	}
+	return rt.remaining == 0
+}
+
+func (rt *Runtime) reachedLimit() bool {
+	if rt.m.MaxPaddingPercent == 0 || rt.paddingSent < uint64(rt.m.AllowedPaddingCount) {
+		return false
+	}
+	total := rt.paddingSent + rt.nonPaddingSent
+	return total > 0 && rt.paddingSent*100/total > uint64(rt.m.MaxPaddingPercent)
+}
+
+// schedule arms the padding timer, following EventInfinity while the
+// current state has no delay to give. Infinity transitions can loop, back
+// into the same state or around a cycle of states without delays; after
+// one hop per state it gives up and waits for the next event.
+func (rt *Runtime) schedule() {
+	for hops := 0; ; hops++ {
+		if rt.reachedLimit() {
+			rt.cancel()
+			return
+		}
+
+		delay, ok := rt.sampleDelay()
+		if ok {
+			rt.cancel()
+			rt.gen++
+			gen := rt.gen
+			rt.pending = true
+			rt.scheduledAt = time.Now()
+			rt.timer = time.AfterFunc(delay, func() { rt.fire(gen) })
+			return
+		}
+
+		rt.cancel()
+		st := rt.cur()
+		if st == nil || st.next(EventInfinity) == rt.state || hops >= len(rt.m.States) {
+			return
+		}
+		if !rt.move(EventInfinity) {
+			return
+		}
+	}
+}
+
+func (rt *Runtime) cancel() {
+	rt.pending = false
+	rt.gen++
+	if rt.timer != nil {
+		rt.timer.Stop()
+		rt.timer = nil
+	}
+}
+
+func (rt *Runtime) fire(gen uint64) {
+	rt.mu.Lock()
+	if rt.stopped || rt.ended || gen != rt.gen {
+		rt.mu.Unlock()
+		return
+	}
+	rt.pending = false
+	rt.timer = nil
+
+	st := rt.cur()
+	if st != nil && st.TokenRemoval != RemoveNone && rt.chosenBin >= 0 && rt.tokens[rt.chosenBin] > 0 {
+		rt.tokens[rt.chosenBin]--
+	}
+	rt.mu.Unlock()
+
+	rt.send()
+}
+
+// sampleDelay picks the next padding delay. ok is false for the infinity
+// bin or when the state has no delay source.
+func (rt *Runtime) sampleDelay() (time.Duration, bool) {
+	st := rt.cur()
+	if st == nil {
+		return 0, false
+	}
+
+	if len(st.Histogram) > 0 {
+		var total uint64
+		for _, n := range rt.tokens {
+			total += uint64(n)
+		}
+		if total == 0 {
+			return 0, false
+		}
+
+		pick := rand.Uint64N(total)
+		bin := 0
+		for ; bin < len(rt.tokens); bin++ {
+			if pick < uint64(rt.tokens[bin]) {
+				break
+			}
+			pick -= uint64(rt.tokens[bin])
+		}
+		rt.chosenBin = bin
+		if bin >= st.infinityBin() {
+			return 0, false
+		}
+
+		start, end := st.binStart(bin), st.binEnd(bin)
+		if end <= start {
+			return start, true
+		}
+		return start + time.Duration(rand.Int64N(int64(end-start))), true
+	}
+
+	if st.IatDist.Type == DistNone {
+		return 0, false
+	}
+	delay := time.Duration(st.IatDist.Sample())*time.Microsecond + st.DistAddedShift
+	if st.DistMaxSample > 0 && delay > st.DistMaxSample {
+		delay = st.DistMaxSample
+	}
+	return delay, true
+}
+
+// removeToken applies the state's token removal strategy for a non-padding
+// cell observed elapsed after padding was scheduled (tor
+// circpad_machine_remove_token). Ties go to the lower bin.
+func (rt *Runtime) removeToken(elapsed time.Duration) {
+	st := rt.cur()
+	inf := st.infinityBin()
+	if inf <= 0 {
+		return
+	}
+	target := st.binFor(elapsed)
+
+	bin := -1
+	switch st.TokenRemoval {
+	case RemoveHigher:
+		for i := target; i < inf; i++ {
+			if rt.tokens[i] > 0 {
+				bin = i
+				break
+			}
+		}
+	case RemoveLower:
+		for i := target; i >= 0; i-- {
+			if rt.tokens[i] > 0 {
+				bin = i
+				break
+			}
+		}
+	case RemoveClosest:
+		for off := 0; off < inf && bin < 0; off++ {
+			if lo := target - off; lo >= 0 && rt.tokens[lo] > 0 {
+				bin = lo
+			} else if hi := target + off; hi < inf && rt.tokens[hi] > 0 {
+				bin = hi
+			}
+		}
+	case RemoveClosestUsec:
+		var best time.Duration
+		for i := 0; i < inf; i++ {
+			if rt.tokens[i] == 0 {
+				continue
+			}
+			mid := (st.binStart(i) + st.binEnd(i)) / 2
+			dist := elapsed - mid
+			if dist < 0 {
+				dist = -dist
+			}
+			if bin < 0 || dist < best {
+				bin, best = i, dist
+			}
+		}
+	case RemoveExact:
+		if rt.tokens[target] > 0 {
+			bin = target
+		}
+	}
+
+	if bin >= 0 {
+		rt.tokens[bin]--
+	}
+}
+
+// binsEmpty reports whether a token-removing state has run out of
+// non-infinity tokens.
+func (rt *Runtime) binsEmpty() bool {
+	st := rt.cur()
+	if st == nil || st.TokenRemoval == RemoveNone || len(rt.tokens) == 0 {
+		return false
+	}
+	for i := 0; i < st.infinityBin(); i++ {
+		if rt.tokens[i] > 0 {
+			return false
+		}
+	}
+	return true
+}
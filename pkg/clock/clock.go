@@ -0,0 +1,194 @@
+// Package clock estimates how far the local clock is from network time.
+//
+// Relays put their clock in the NETINFO timestamp, and a consensus is only
+// valid between ValidAfter and ValidUntil. Combining both tells a client
+// whose clock is wrong (a container without NTP, a VM restored from a
+// snapshot) how wrong it is, so that time-sensitive code can use Now instead
+// of failing on "expired" certificates and "future" consensuses.
+package clock
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// DEFAULT_SKEW_THRESHOLD is the skew above which we consider the clock
+// wrong; tor warns about NETINFO skew from one hour (NETINFO_NOTICE_SKEW).
+const DEFAULT_SKEW_THRESHOLD = time.Hour
+
+// MAX_NETINFO_SAMPLES bounds how many relays the NETINFO median is taken over.
+const MAX_NETINFO_SAMPLES = 32
+
+// Source says where an observation came from.
+type Source uint8
+
+const (
+	SourceNetInfo Source = iota
+	SourceConsensus
+)
+
+// Event reports that the estimated skew crossed the threshold, in either
+// direction.
+type Event struct {
+	Source Source
+	// Skew is network time minus local time: positive when the local
+	// clock is behind.
+	Skew time.Duration
+	// Skewed is true when |Skew| is above the threshold.
+	Skewed bool
+}
+
+type sample struct {
+	relay string
+	skew  time.Duration
+}
+
+// Estimator combines NETINFO and consensus observations into a single skew
+// estimate. The zero value is not usable; call New.
+type Estimator struct {
+	// Threshold is the |skew| above which OnSkew fires. Zero means
+	// DEFAULT_SKEW_THRESHOLD.
+	Threshold time.Duration
+	// OnSkew, if set, is called (without locks held) whenever the
+	// estimate moves across Threshold.
+	OnSkew func(Event)
+
+	mu      sync.Mutex
+	samples []sample
+
+	// lower and upper bound the skew from consensus validity; a nil bound
+	// is unknown.
+	lower, upper *time.Duration
+
+	skewed bool
+
+	// now is the local clock, replaceable in tests.
+	now func() time.Time
+}
+
+// New returns an Estimator with no observations: Skew is 0 and Now is the
+// local clock.
+func New() *Estimator {
+	return &Estimator{now: time.Now}
+}
+
+// NewWithClock is New with a fake local clock, for tests.
+func NewWithClock(now func() time.Time) *Estimator {
+	return &Estimator{now: now}
+}
+
+// ObserveNetInfo records the timestamp a relay sent in NETINFO, received at
+// local time recv, and returns that relay's skew. A zero timestamp (sent by
+// clients, and by relays that hide their clock) is ignored.
+func (e *Estimator) ObserveNetInfo(relay string, timestamp uint32, recv time.Time) (time.Duration, bool) {
+	if timestamp == 0 {
+		return 0, false
+	}
+	skew := time.Unix(int64(timestamp), 0).Sub(recv).Round(time.Second)
+
+	e.mu.Lock()
+	e.samples = slices.DeleteFunc(e.samples, func(s sample) bool { return s.relay == relay })
+	e.samples = append(e.samples, sample{relay: relay, skew: skew})
+	if len(e.samples) > MAX_NETINFO_SAMPLES {
+		e.samples = e.samples[len(e.samples)-MAX_NETINFO_SAMPLES:]
+	}
+	ev, fire := e.update(SourceNetInfo)
+	e.mu.Unlock()
+
+	if fire && e.OnSkew != nil {
+		e.OnSkew(ev)
+	}
+	return skew, true
+}
+
+// ObserveConsensus bounds the skew with a freshly fetched consensus: network
+// time was at least validAfter and at most validUntil when it was received.
+func (e *Estimator) ObserveConsensus(validAfter, validUntil time.Time) {
+	if validAfter.IsZero() || validUntil.IsZero() || !validUntil.After(validAfter) {
+		return
+	}
+	now := e.now()
+	lower := validAfter.Sub(now)
+	upper := validUntil.Sub(now)
+
+	e.mu.Lock()
+	e.lower, e.upper = &lower, &upper
+	ev, fire := e.update(SourceConsensus)
+	e.mu.Unlock()
+
+	if fire && e.OnSkew != nil {
+		e.OnSkew(ev)
+	}
+}
+
+// Skew returns the estimated network time minus local time.
+func (e *Estimator) Skew() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.skew()
+}
+
+// Skewed reports whether the estimate is above the threshold.
+func (e *Estimator) Skewed() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.skewed
+}
+
+// Now returns the local time corrected by the estimated skew.
+func (e *Estimator) Now() time.Time {
+	return e.now().Add(e.Skew())
+}
+
+// skew is the NETINFO median clamped to the consensus bounds. Without
+// NETINFO samples it is the smallest correction that satisfies the bounds.
+func (e *Estimator) skew() time.Duration {
+	var s time.Duration
+	if n := len(e.samples); n > 0 {
+		skews := make([]time.Duration, n)
+		for i, v := range e.samples {
+			skews[i] = v.skew
+		}
+		slices.Sort(skews)
+		s = skews[n/2]
+		if n%2 == 0 {
+			s = (skews[n/2-1] + skews[n/2]) / 2
+		}
+	}
+	if e.lower != nil && s < *e.lower {
+		s = *e.lower
+	}
+	if e.upper != nil && s > *e.upper {
+		s = *e.upper
+	}
+	return s
+}
+
+func (e *Estimator) threshold() time.Duration {
+	if e.Threshold > 0 {
+		return e.Threshold
+	}
+	return DEFAULT_SKEW_THRESHOLD
+}
+
+// update recomputes the skewed state; fire is true when it changed.
+func (e *Estimator) update(src Source) (Event, bool) {
+	s := e.skew()
+	skewed := s > e.threshold() || s < -e.threshold()
+	if skewed == e.skewed {
+		return Event{}, false
+	}
+	e.skewed = skewed
+	return Event{Source: src, Skew: s, Skewed: skewed}, true
+}
+
+// Default is the process-wide estimator fed by every Conn and consensus
+// fetch.
+var Default = New()
+
+// Now is Default.Now.
+func Now() time.Time { return Default.Now() }
+
+// Skew is Default.Skew.
+func Skew() time.Duration { return Default.Skew() }
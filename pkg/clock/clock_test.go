@@ -0,0 +1,110 @@
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robogg133/gonion/pkg/clock"
+)
+
+var local = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func fixed() time.Time { return local }
+
+func ts(t time.Time) uint32 { return uint32(t.Unix()) }
+
+func TestEstimator_NoObservations(t *testing.T) {
+	e := clock.NewWithClock(fixed)
+	if e.Skew() != 0 || !e.Now().Equal(local) {
+		t.Fatalf("skew %v now %v", e.Skew(), e.Now())
+	}
+}
+
+func TestEstimator_NetInfoMedian(t *testing.T) {
+	e := clock.NewWithClock(fixed)
+	e.ObserveNetInfo("a", ts(local.Add(2*time.Hour)), local)
+	e.ObserveNetInfo("b", ts(local.Add(2*time.Hour+2*time.Second)), local)
+	// One relay with a broken clock must not move the median.
+	e.ObserveNetInfo("c", ts(local.Add(-30*24*time.Hour)), local)
+
+	if got := e.Skew(); got != 2*time.Hour {
+		t.Fatalf("skew = %v, want 2h", got)
+	}
+	if !e.Skewed() {
+		t.Fatal("expected skewed")
+	}
+}
+
+func TestEstimator_NetInfoZeroIgnored(t *testing.T) {
+	e := clock.NewWithClock(fixed)
+	if _, ok := e.ObserveNetInfo("a", 0, local); ok {
+		t.Fatal("zero timestamp should be ignored")
+	}
+	if e.Skew() != 0 {
+		t.Fatal("skew changed")
+	}
+}
+
+func TestEstimator_NetInfoReplacesSameRelay(t *testing.T) {
+	e := clock.NewWithClock(fixed)
+	e.ObserveNetInfo("a", ts(local.Add(5*time.Hour)), local)
+	e.ObserveNetInfo("a", ts(local.Add(time.Minute)), local)
+	if got := e.Skew(); got != time.Minute {
+		t.Fatalf("skew = %v, want 1m", got)
+	}
+}
+
+func TestEstimator_ConsensusBounds(t *testing.T) {
+	// Local clock is a day behind: the consensus is "from the future".
+	e := clock.NewWithClock(fixed)
+	va := local.Add(24 * time.Hour)
+	e.ObserveConsensus(va, va.Add(3*time.Hour))
+	if got := e.Skew(); got != 24*time.Hour {
+		t.Fatalf("skew = %v, want 24h", got)
+	}
+
+	// Local clock is ahead: the consensus already expired.
+	e = clock.NewWithClock(fixed)
+	va = local.Add(-10 * time.Hour)
+	e.ObserveConsensus(va, va.Add(3*time.Hour))
+	if got := e.Skew(); got != -7*time.Hour {
+		t.Fatalf("skew = %v, want -7h", got)
+	}
+
+	// A live consensus says nothing.
+	e = clock.NewWithClock(fixed)
+	e.ObserveConsensus(local.Add(-time.Hour), local.Add(2*time.Hour))
+	if e.Skew() != 0 {
+		t.Fatalf("skew = %v, want 0", e.Skew())
+	}
+}
+
+func TestEstimator_ConsensusClampsNetInfo(t *testing.T) {
+	e := clock.NewWithClock(fixed)
+	e.ObserveNetInfo("a", ts(local.Add(10*time.Hour)), local)
+	e.ObserveConsensus(local.Add(-time.Hour), local.Add(2*time.Hour))
+	if got := e.Skew(); got != 2*time.Hour {
+		t.Fatalf("skew = %v, want 2h", got)
+	}
+}
+
+func TestEstimator_OnSkewTransitions(t *testing.T) {
+	e := clock.NewWithClock(fixed)
+	var events []clock.Event
+	e.OnSkew = func(ev clock.Event) { events = append(events, ev) }
+
+	e.ObserveNetInfo("a", ts(local.Add(time.Minute)), local)
+	e.ObserveNetInfo("a", ts(local.Add(3*time.Hour)), local)
+	e.ObserveNetInfo("a", ts(local.Add(4*time.Hour)), local)
+	e.ObserveNetInfo("a", ts(local), local)
+
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	if !events[0].Skewed || events[0].Skew != 3*time.Hour || events[0].Source != clock.SourceNetInfo {
+		t.Fatalf("first event %+v", events[0])
+	}
+	if events[1].Skewed {
+		t.Fatalf("second event %+v", events[1])
+	}
+}
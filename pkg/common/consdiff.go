@@ -0,0 +1,182 @@
+package common
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// CONSDIFF_HEADER opens a consensus diff (dir-spec §E, prop140).
+const CONSDIFF_HEADER = "network-status-diff-version 1"
+
+var errNoSignedPart = errors.New("consensus has no directory-signature")
+
+// DigestAsSigned is the SHA3-256 digest of a consensus from
+// "network-status-version" up to and including the first
+// "\ndirectory-signature ". It names the consensus in
+// X-Or-Diff-From-Consensus and in diff hash lines, and is the same for
+// every signature set.
+func DigestAsSigned(doc []byte) ([32]byte, error) {
+	start := bytes.Index(doc, []byte("network-status-version"))
+	if start < 0 {
+		return [32]byte{}, fmt.Errorf("consensus has no network-status-version")
+	}
+	const end = "\ndirectory-signature "
+	i := bytes.Index(doc[start:], []byte(end))
+	if i < 0 {
+		return [32]byte{}, errNoSignedPart
+	}
+	return sha3.Sum256(doc[start : start+i+len(end)]), nil
+}
+
+// IsConsensusDiff reports whether a directory response is a diff rather
+// than a full consensus.
+func IsConsensusDiff(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(CONSDIFF_HEADER+"\n"))
+}
+
+// ApplyConsensusDiff applies an ed-style consensus diff to base and
+// returns the new consensus. Both the base and the result are checked
+// against the digests in the diff's hash line: FROM is the digest as
+// signed of base, TO the SHA3-256 of the whole result, signatures
+// included (tor consdiff.c).
+func ApplyConsensusDiff(base, diff []byte) ([]byte, error) {
+	lines := splitLines(diff)
+	if len(lines) < 2 || lines[0] != CONSDIFF_HEADER {
+		return nil, fmt.Errorf("consdiff: missing %q", CONSDIFF_HEADER)
+	}
+	f := strings.Fields(lines[1])
+	if len(f) != 3 || f[0] != "hash" {
+		return nil, fmt.Errorf("consdiff: malformed hash line %q", lines[1])
+	}
+	from, err := hex.DecodeString(f[1])
+	if err != nil || len(from) != 32 {
+		return nil, fmt.Errorf("consdiff: malformed base digest %q", f[1])
+	}
+	to, err := hex.DecodeString(f[2])
+	if err != nil || len(to) != 32 {
+		return nil, fmt.Errorf("consdiff: malformed result digest %q", f[2])
+	}
+
+	have, err := DigestAsSigned(base)
+	if err != nil {
+		return nil, fmt.Errorf("consdiff: base: %w", err)
+	}
+	if !bytes.Equal(have[:], from) {
+		return nil, fmt.Errorf("consdiff: diff is not from our consensus")
+	}
+
+	out, err := applyEd(splitLines(base), lines[2:])
+	if err != nil {
+		return nil, err
+	}
+	doc := []byte(strings.Join(out, "\n") + "\n")
+
+	got := sha3.Sum256(doc)
+	if !bytes.Equal(got[:], to) {
+		return nil, fmt.Errorf("consdiff: result digest mismatch")
+	}
+	return doc, nil
+}
+
+// applyEd runs the commands of an ed script on lines. prop140 only uses
+// "d", "c" and "a", ordered from the end of the document to its start, so
+// each command can be applied to the lines as they are.
+func applyEd(lines, script []string) ([]string, error) {
+	last := len(lines) + 1
+	for i := 0; i < len(script); i++ {
+		cmd := script[i]
+		if cmd == "" {
+			return nil, fmt.Errorf("consdiff: empty command")
+		}
+		op := cmd[len(cmd)-1]
+		start, end, err := parseRange(cmd[:len(cmd)-1], len(lines))
+		if err != nil {
+			return nil, fmt.Errorf("consdiff: command %q: %w", cmd, err)
+		}
+		if end >= last {
+			return nil, fmt.Errorf("consdiff: command %q out of order", cmd)
+		}
+		last = start
+
+		var body []string
+		if op == 'a' || op == 'c' {
+			j := i + 1
+			for ; j < len(script) && script[j] != "."; j++ {
+			}
+			if j == len(script) {
+				return nil, fmt.Errorf("consdiff: command %q: unterminated text", cmd)
+			}
+			body = script[i+1 : j]
+			i = j
+		}
+
+		switch op {
+		case 'd':
+			if start == 0 {
+				return nil, fmt.Errorf("consdiff: command %q: line 0", cmd)
+			}
+			lines = append(lines[:start-1], lines[end:]...)
+		case 'c':
+			if start == 0 {
+				return nil, fmt.Errorf("consdiff: command %q: line 0", cmd)
+			}
+			lines = spliceLines(lines, start-1, end, body)
+		case 'a':
+			if end != start {
+				return nil, fmt.Errorf("consdiff: command %q: append takes one line", cmd)
+			}
+			// "0a" inserts before the first line.
+			lines = spliceLines(lines, start, start, body)
+			last = start + 1
+		default:
+			return nil, fmt.Errorf("consdiff: unknown command %q", cmd)
+		}
+	}
+	return lines, nil
+}
+
+// parseRange parses "n", "n,m" or "n,$" into 1-based inclusive bounds.
+func parseRange(s string, n int) (int, int, error) {
+	a, b, isRange := strings.Cut(s, ",")
+	start, err := strconv.Atoi(a)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("bad line number %q", a)
+	}
+	end := start
+	if isRange {
+		if b == "$" {
+			end = n
+		} else if end, err = strconv.Atoi(b); err != nil {
+			return 0, 0, fmt.Errorf("bad line number %q", b)
+		}
+		if end < start {
+			return 0, 0, fmt.Errorf("range %d,%d reversed", start, end)
+		}
+	}
+	if end > n {
+		return 0, 0, fmt.Errorf("line %d past end (%d)", end, n)
+	}
+	return start, end, nil
+}
+
+func spliceLines(lines []string, i, j int, insert []string) []string {
+	out := make([]string, 0, len(lines)-(j-i)+len(insert))
+	out = append(out, lines[:i]...)
+	out = append(out, insert...)
+	return append(out, lines[j:]...)
+}
+
+// splitLines splits a newline-terminated document into its lines.
+func splitLines(b []byte) []string {
+	s := strings.TrimSuffix(string(b), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
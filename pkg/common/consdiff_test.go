@@ -0,0 +1,235 @@
+package common_test
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/robogg133/gonion/pkg/common"
+	"golang.org/x/crypto/sha3"
+)
+
+const diffBase = `network-status-version 3 microdesc
+valid-after 2026-01-30 22:00:00
+r relay1 AAoQ1DAR6kkoo19hBAX5K0QztNw 2038-01-01 00:00:00 10.0.0.1 9001 0
+s Fast Guard Running Stable Valid
+r relay2 ABoQ1DAR6kkoo19hBAX5K0QztNw 2038-01-01 00:00:00 10.1.0.1 443 0
+s Exit Fast Running Valid
+directory-footer
+directory-signature sha256 AAAA BBBB
+-----BEGIN SIGNATURE-----
+old
+-----END SIGNATURE-----
+`
+
+const diffTarget = `network-status-version 3 microdesc
+valid-after 2026-01-30 23:00:00
+r relay0 AAAQ1DAR6kkoo19hBAX5K0QztNw 2038-01-01 00:00:00 10.0.0.9 9001 0
+s Fast Running Valid
+r relay1 AAoQ1DAR6kkoo19hBAX5K0QztNw 2038-01-01 00:00:00 10.0.0.1 9001 0
+s Fast Guard Running Stable Valid
+directory-footer
+directory-signature sha256 AAAA BBBB
+-----BEGIN SIGNATURE-----
+new
+-----END SIGNATURE-----
+`
+
+// diffScript turns diffBase into diffTarget, last lines first.
+const diffScript = `10c
+new
+.
+5,6d
+2a
+r relay0 AAAQ1DAR6kkoo19hBAX5K0QztNw 2038-01-01 00:00:00 10.0.0.9 9001 0
+s Fast Running Valid
+.
+2c
+valid-after 2026-01-30 23:00:00
+.
+`
+
+func digestHex(t *testing.T, doc string) string {
+	t.Helper()
+	d, err := common.DigestAsSigned([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.ToUpper(hex.EncodeToString(d[:]))
+}
+
+// makeDiff builds the hash line as tor does: the base digest as signed,
+// the full SHA3-256 of the target.
+func makeDiff(t *testing.T, from, to, script string) string {
+	full := sha3.Sum256([]byte(to))
+	return common.CONSDIFF_HEADER + "\nhash " + digestHex(t, from) + " " + strings.ToUpper(hex.EncodeToString(full[:])) + "\n" + script
+}
+
+func TestApplyConsensusDiff(t *testing.T) {
+	diff := makeDiff(t, diffBase, diffTarget, diffScript)
+	if !common.IsConsensusDiff([]byte(diff)) || common.IsConsensusDiff([]byte(diffBase)) {
+		t.Fatal("IsConsensusDiff")
+	}
+	got, err := common.ApplyConsensusDiff([]byte(diffBase), []byte(diff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != diffTarget {
+		t.Fatalf("got\n%s", got)
+	}
+}
+
+// A consensus pair and diff in the exact form a directory cache serves:
+// multiple signatures, both changed, and a hash line whose digests were
+// computed outside this package (Python hashlib.sha3_256).
+const torDiffBase = `network-status-version 3 microdesc
+vote-status consensus
+consensus-method 34
+valid-after 2026-10-19 10:00:00
+fresh-until 2026-10-19 11:00:00
+valid-until 2026-10-19 13:00:00
+voting-delay 300 300
+known-flags Authority BadExit Exit Fast Guard HSDir MiddleOnly NoEdConsensus Running Stable StaleDesc Sybil V2Dir Valid
+params CircuitPriorityHalflifeMsec=30000 DoSCircuitCreationEnabled=1 bwweightscale=10000
+shared-rand-previous-value 9 kb3uKfTG6Lh/zpvtC9bhF6Fs3jygf0dQG+8Dwdmc8Zc=
+shared-rand-current-value 9 nfiNgMsm0o6mqj2H8Nbf1UrbEv3cMR+WUQsW0NwC+Yc=
+r seele AAoQ1DAR6kkoo19hBAX5K0QztNw 2026-10-19 04:33:21 104.53.221.159 9001 0
+m gpEUyu7KYn3VTDOyNa8I7WBiBYWRGGLJSSXP1iRvPV0
+s Running Stable V2Dir Valid
+v Tor 0.4.8.12
+pr Conflux=1 Cons=1-2 Desc=1-2 DirCache=2 FlowCtrl=1-2 HSDir=2 HSIntro=4-5 HSRend=1-2 Link=1-5 LinkAuth=1,3 Microdesc=1-2 Padding=2 Relay=1-4
+w Bandwidth=1220
+r CalyxInstitute14 ABG9JIWtRdmE7EFZyI/AZuXjMA4 2026-10-19 08:12:55 162.247.74.201 443 80
+m R8VJH5n2ZWrsQcQ0ZydnRXcQCTuHsI3KQzmMNm4TBUw
+s Exit Fast Guard HSDir Running Stable V2Dir Valid
+v Tor 0.4.8.12
+pr Conflux=1 Cons=1-2 Desc=1-2 DirCache=2 FlowCtrl=1-2 HSDir=2 HSIntro=4-5 HSRend=1-2 Link=1-5 LinkAuth=1,3 Microdesc=1-2 Padding=2 Relay=1-4
+w Bandwidth=22300
+r nicdex ABmMAT7fYwbcRn3cGtR87kHeUR4 2026-10-19 02:01:40 5.9.43.211 9001 0
+m 8n0bOoyaEL3VjZpmYJqYC8Ys7Bo6CKp1VZTYqY6HtIo
+s Fast Running Stable Valid
+v Tor 0.4.8.10
+pr Conflux=1 Cons=1-2 Desc=1-2 DirCache=2 FlowCtrl=1-2 HSDir=2 HSIntro=4-5 HSRend=1-2 Link=1-5 LinkAuth=1,3 Microdesc=1-2 Padding=2 Relay=1-4
+w Bandwidth=8190
+directory-footer
+bandwidth-weights Wbd=0 Wbe=0 Wbg=4132 Wbm=10000 Wdb=10000 Web=10000 Wed=10000 Wee=10000 Weg=10000 Wem=10000 Wgb=10000 Wgd=0 Wgg=5868 Wgm=5868 Wmb=10000 Wmd=0 Wme=0 Wmg=4132 Wmm=10000
+directory-signature sha256 0232AF901C31A04EE9848595AF9BB7620D4C5B2E 1F4D49989DA1503D5B20EAADB0673C948BA73B49
+-----BEGIN SIGNATURE-----
+Y2FjaGVkIHNpZ25hdHVyZSBvZiB0aGUgYmFzZSBjb25zZW5zdXMgZnJvbSBtb29y
+-----END SIGNATURE-----
+directory-signature sha256 14C131DFC5C6F93646BE72FA1401C02A8DF2E8B4 35E3B7A6E3B3F7A1C1A55D7AC9D4D43C1D8E9F11
+-----BEGIN SIGNATURE-----
+Y2FjaGVkIHNpZ25hdHVyZSBvZiB0aGUgYmFzZSBjb25zZW5zdXMgZnJvbSB0b3Iy
+-----END SIGNATURE-----
+`
+
+const torDiff = `network-status-diff-version 1
+hash A6A1CCB6C0E5EC0EFE897759E538489D7FD5AED3DF55FAD19841C12744B76399 3C13403C43B6D2B684F124BBAE10DB7B1FEA6ED83640CE9420D3EB8256E9ACCD
+38c
+dGhlIG5ldyBjb25zZW5zdXMgYXMgc2lnbmVkIGJ5IHRvcjI2IGF0IDExOjAwOjAw
+.
+34c
+dGhlIG5ldyBjb25zZW5zdXMgYXMgc2lnbmVkIGJ5IG1vcmlhMSBhdCAxMTowMDow
+.
+31c
+bandwidth-weights Wbd=0 Wbe=0 Wbg=4210 Wbm=10000 Wdb=10000 Web=10000 Wed=10000 Wee=10000 Weg=10000 Wem=10000 Wgb=10000 Wgd=0 Wgg=5790 Wgm=5790 Wmb=10000 Wmd=0 Wme=0 Wmg=4210 Wmm=10000
+.
+29c
+w Bandwidth=9020
+.
+12,17d
+4,6c
+valid-after 2026-10-19 11:00:00
+fresh-until 2026-10-19 12:00:00
+valid-until 2026-10-19 14:00:00
+.
+`
+
+const torDiffTarget = `network-status-version 3 microdesc
+vote-status consensus
+consensus-method 34
+valid-after 2026-10-19 11:00:00
+fresh-until 2026-10-19 12:00:00
+valid-until 2026-10-19 14:00:00
+voting-delay 300 300
+known-flags Authority BadExit Exit Fast Guard HSDir MiddleOnly NoEdConsensus Running Stable StaleDesc Sybil V2Dir Valid
+params CircuitPriorityHalflifeMsec=30000 DoSCircuitCreationEnabled=1 bwweightscale=10000
+shared-rand-previous-value 9 kb3uKfTG6Lh/zpvtC9bhF6Fs3jygf0dQG+8Dwdmc8Zc=
+shared-rand-current-value 9 nfiNgMsm0o6mqj2H8Nbf1UrbEv3cMR+WUQsW0NwC+Yc=
+r CalyxInstitute14 ABG9JIWtRdmE7EFZyI/AZuXjMA4 2026-10-19 08:12:55 162.247.74.201 443 80
+m R8VJH5n2ZWrsQcQ0ZydnRXcQCTuHsI3KQzmMNm4TBUw
+s Exit Fast Guard HSDir Running Stable V2Dir Valid
+v Tor 0.4.8.12
+pr Conflux=1 Cons=1-2 Desc=1-2 DirCache=2 FlowCtrl=1-2 HSDir=2 HSIntro=4-5 HSRend=1-2 Link=1-5 LinkAuth=1,3 Microdesc=1-2 Padding=2 Relay=1-4
+w Bandwidth=22300
+r nicdex ABmMAT7fYwbcRn3cGtR87kHeUR4 2026-10-19 02:01:40 5.9.43.211 9001 0
+m 8n0bOoyaEL3VjZpmYJqYC8Ys7Bo6CKp1VZTYqY6HtIo
+s Fast Running Stable Valid
+v Tor 0.4.8.10
+pr Conflux=1 Cons=1-2 Desc=1-2 DirCache=2 FlowCtrl=1-2 HSDir=2 HSIntro=4-5 HSRend=1-2 Link=1-5 LinkAuth=1,3 Microdesc=1-2 Padding=2 Relay=1-4
+w Bandwidth=9020
+directory-footer
+bandwidth-weights Wbd=0 Wbe=0 Wbg=4210 Wbm=10000 Wdb=10000 Web=10000 Wed=10000 Wee=10000 Weg=10000 Wem=10000 Wgb=10000 Wgd=0 Wgg=5790 Wgm=5790 Wmb=10000 Wmd=0 Wme=0 Wmg=4210 Wmm=10000
+directory-signature sha256 0232AF901C31A04EE9848595AF9BB7620D4C5B2E 1F4D49989DA1503D5B20EAADB0673C948BA73B49
+-----BEGIN SIGNATURE-----
+dGhlIG5ldyBjb25zZW5zdXMgYXMgc2lnbmVkIGJ5IG1vcmlhMSBhdCAxMTowMDow
+-----END SIGNATURE-----
+directory-signature sha256 14C131DFC5C6F93646BE72FA1401C02A8DF2E8B4 35E3B7A6E3B3F7A1C1A55D7AC9D4D43C1D8E9F11
+-----BEGIN SIGNATURE-----
+dGhlIG5ldyBjb25zZW5zdXMgYXMgc2lnbmVkIGJ5IHRvcjI2IGF0IDExOjAwOjAw
+-----END SIGNATURE-----
+`
+
+func TestApplyConsensusDiff_TorFixture(t *testing.T) {
+	got, err := common.ApplyConsensusDiff([]byte(torDiffBase), []byte(torDiff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != torDiffTarget {
+		t.Fatalf("got\n%s", got)
+	}
+
+	// The result digest covers the signatures: a diff that gets the
+	// digest as signed right but a signature wrong must fail.
+	bad := strings.Replace(torDiff, "IHRvcjI2IGF0IDExOjAwOjAw", "IHRvcjI2IGF0IDExOjAwOjAx", 1)
+	if _, err := common.ApplyConsensusDiff([]byte(torDiffBase), []byte(bad)); err == nil {
+		t.Fatal("result with other signatures accepted")
+	}
+}
+
+func TestApplyConsensusDiff_Rejects(t *testing.T) {
+	cases := map[string]string{
+		"wrong base":   makeDiff(t, diffTarget, diffTarget, diffScript),
+		"wrong result": makeDiff(t, diffBase, diffBase, diffScript),
+		"out of order": makeDiff(t, diffBase, diffTarget, "2c\nx\n.\n10c\nnew\n.\n"),
+		"past end":     makeDiff(t, diffBase, diffTarget, "40d\n"),
+		"unterminated": makeDiff(t, diffBase, diffTarget, "2c\nx\n"),
+		"unknown":      makeDiff(t, diffBase, diffTarget, "2x\n"),
+	}
+	for name, diff := range cases {
+		if _, err := common.ApplyConsensusDiff([]byte(diffBase), []byte(diff)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestDigestAsSigned_IgnoresSignatures(t *testing.T) {
+	resigned := strings.Replace(diffBase, "old", "other", 1)
+	if digestHex(t, diffBase) != digestHex(t, resigned) {
+		t.Fatal("digest covers signatures")
+	}
+	if _, err := common.DigestAsSigned([]byte("network-status-version 3\n")); err == nil {
+		t.Fatal("unsigned document accepted")
+	}
+}
+
+func TestParseConsensusDocument_KeepsRaw(t *testing.T) {
+	cns, err := common.ParseConsensusDocument([]byte(diffBase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := common.DigestAsSigned([]byte(diffBase))
+	if string(cns.Raw) != diffBase || cns.Digest != want {
+		t.Fatal("document or digest not kept")
+	}
+}
@@ -2,26 +2,12 @@ package common
 
 import (
 	"crypto/ecdh"
+	"net/netip"
 	"time"
 )
 
 const AUTH_DIR_NUM_AGREEMENTS uint8 = 9
 
-var GlobalConsensus *Consensus
-var alrInit bool
-
-func SetGlobalConsensus(c *Consensus) {
-	GlobalConsensus = c
-	alrInit = true
-}
-
-func GetGlobalConsensus() *Consensus {
-	if !alrInit {
-		return nil
-	}
-	return GlobalConsensus
-}
-
 const (
 	FLAG_AUTHORITY uint8 = iota
 	FLAG_BAD_EXIT
@@ -68,11 +54,30 @@ type Consensus struct {
 
 	SharedCurrentValue [32]byte
 
+	// Params holds the raw "params" line (dir-spec §3.4.1); see NetParams
+	// for typed access.
+	Params map[string]int32
+
+	// KnownFlags are the flags the authorities voted on.
+	KnownFlags []string
+
+	// Protocol recommendations and requirements for clients and relays.
+	RecommendedClientProtocols Proto
+	RequiredClientProtocols    Proto
+	RecommendedRelayProtocols  Proto
+	RequiredRelayProtocols     Proto
+
 	routerStatusTmp *RouterStatus
 
 	RelayInformation []RouterStatus
 
 	BandWidthWeight BandWidthWeight
+
+	// Raw is the document as fetched and Digest its DigestAsSigned. They
+	// are what a refresh asks a diff from; Raw is nil when the consensus
+	// was not parsed with ParseConsensusDocument.
+	Raw    []byte
+	Digest [32]byte
 }
 
 type RouterStatus struct {
@@ -83,6 +88,11 @@ type RouterStatus struct {
 	ORPort   uint16
 	IPLevel  uint32
 
+	// Country (lowercase ISO code) and ASN are set by geoip.DB.Annotate;
+	// empty and 0 when unknown.
+	Country string
+	ASN     uint32
+
 	MicrodescriptorDigest string
 
 	DirPort uint16
@@ -90,6 +100,9 @@ type RouterStatus struct {
 	BandWidth uint32
 
 	Ipv6Addr string // like [0000:00a:000:0000::000a]:8443 or empty string
+	// IPv6Level is the /32 network of Ipv6Addr (IPv6Prefix32), 0
+	// without one.
+	IPv6Level uint32
 
 	ProtoVersions Proto
 	StatusFlags   [FLAG_ARRAY_LENGTH + 1]bool
@@ -102,6 +115,11 @@ type RouterStatus struct {
 
 	Family  []Family
 	Familys []*FamilyIDs
+
+	// FamilyMembers holds the NodeIDs of the relays in a family with
+	// this one, itself included, once Consensus.ResolveFamilies ran. It
+	// may be shared between relays: do not modify it.
+	FamilyMembers map[[20]byte]struct{}
 }
 
 type BandWidthWeight struct {
@@ -151,6 +169,10 @@ type Proto struct {
 	Padding   VersionValue
 	FlowCtrl  VersionValue
 	Conflux   VersionValue
+	// Unknown holds the entries no field can carry, sorted and space
+	// separated: unknown subprotocols and versions above
+	// MAX_PROTO_VERSION, as in "NewThing=1 Relay=9".
+	Unknown string
 }
 
 func flagStringToNumber(s string) uint8 {
@@ -212,3 +234,33 @@ func (s *VersionValue) SetValue(n uint8, value bool) {
 		*s &^= 1 << n
 	}
 }
+
+// SetIPv6 sets Ipv6Addr and IPv6Level from a "[addr]:port" string and
+// reports whether it was an IPv6 address.
+func (rs *RouterStatus) SetIPv6(s string) bool {
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil || !ap.Addr().Is6() || ap.Addr().Is4In6() || ap.Port() == 0 {
+		return false
+	}
+	rs.Ipv6Addr = ap.String()
+	rs.IPv6Level = IPv6Prefix32(ap.Addr())
+	return true
+}
+
+// IPv4AddrPort returns the IPv4 ORPort address.
+func (rs *RouterStatus) IPv4AddrPort() (netip.AddrPort, bool) {
+	a, err := netip.ParseAddr(rs.Ipv4Addr)
+	if err != nil || rs.ORPort == 0 {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(a.Unmap(), rs.ORPort), true
+}
+
+// IPv6AddrPort returns the IPv6 ORPort address, if the relay has one.
+func (rs *RouterStatus) IPv6AddrPort() (netip.AddrPort, bool) {
+	ap, err := netip.ParseAddrPort(rs.Ipv6Addr)
+	if err != nil || !ap.Addr().Is6() {
+		return netip.AddrPort{}, false
+	}
+	return ap, true
+}
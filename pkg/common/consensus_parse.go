@@ -2,10 +2,13 @@ package common
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
 	"time"
@@ -22,6 +25,28 @@ const CONSENSUS_DATE_FORMAT string = "2006-01-02 15:04:05"
 
 var errUnknownToken = errors.New("uknown token")
 
+// ParseConsensusDocument parses a whole consensus and keeps its text and
+// digest so it can be the base of a consensus diff.
+func ParseConsensusDocument(doc []byte) (*Consensus, error) {
+	return ParseConsensusReader(bytes.NewReader(doc))
+}
+
+// ParseConsensusReader is ParseConsensusDocument for a stream: the
+// consensus is parsed while it is read, and its text is kept on the side.
+func ParseConsensusReader(r io.Reader) (*Consensus, error) {
+	var raw bytes.Buffer
+	cns, err := ParseConsensus(bufio.NewScanner(io.TeeReader(r, &raw)))
+	if err != nil {
+		return nil, err
+	}
+	doc := raw.Bytes()
+	if digest, err := DigestAsSigned(doc); err == nil {
+		cns.Raw = doc
+		cns.Digest = digest
+	}
+	return cns, nil
+}
+
 func ParseConsensus(scanner *bufio.Scanner) (*Consensus, error) {
 
 	var consensus Consensus
@@ -67,6 +92,12 @@ func ParseConsensus(scanner *bufio.Scanner) (*Consensus, error) {
 
 		line++
 	}
+	// A read error (a decompression bomb, a corrupt body) must not pass
+	// for the end of a shorter document.
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	consensus.flushRouter()
 
 	return &consensus, nil
 }
@@ -128,6 +159,39 @@ func (c *Consensus) parseHeaderState(s string) error {
 			c.SharedCurrentValue = [32]byte(a)
 		}
 
+		return nil
+	case strings.HasPrefix(s, "known-flags "):
+		c.KnownFlags = strings.Fields(strings.TrimPrefix(s, "known-flags "))
+
+		return nil
+	case strings.HasPrefix(s, "recommended-client-protocols "),
+		strings.HasPrefix(s, "required-client-protocols "),
+		strings.HasPrefix(s, "recommended-relay-protocols "),
+		strings.HasPrefix(s, "required-relay-protocols "):
+		keyword, list, _ := strings.Cut(s, " ")
+		proto, err := ParseProto(list)
+		if err != nil {
+			return fmt.Errorf("consensus: header_state: %s: %w", keyword, err)
+		}
+		switch keyword {
+		case "recommended-client-protocols":
+			c.RecommendedClientProtocols = proto
+		case "required-client-protocols":
+			c.RequiredClientProtocols = proto
+		case "recommended-relay-protocols":
+			c.RecommendedRelayProtocols = proto
+		case "required-relay-protocols":
+			c.RequiredRelayProtocols = proto
+		}
+
+		return nil
+	case strings.HasPrefix(s, "params "):
+		params, err := parseParams(strings.TrimPrefix(s, "params "))
+		if err != nil {
+			return err
+		}
+		c.Params = params
+
 		return nil
 	case strings.HasPrefix(s, "dir-source "):
 		return errUnknownToken
@@ -137,15 +201,37 @@ func (c *Consensus) parseHeaderState(s string) error {
 	}
 }
 
+// parseParams parses space separated Keyword=Int32 pairs.
+func parseParams(s string) (map[string]int32, error) {
+	params := make(map[string]int32)
+	for _, p := range strings.Fields(s) {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("consensus: header_state: invalid param token: %q", p)
+		}
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("consensus: header_state: invalid param value %q: %w", p, err)
+		}
+		params[k] = int32(n)
+	}
+	return params, nil
+}
+
+// Param returns the consensus parameter name, or def when it is absent.
+func (c *Consensus) Param(name string, def int32) int32 {
+	if v, ok := c.Params[name]; ok {
+		return v
+	}
+	return def
+}
+
 func (c *Consensus) parseRouterState(s string) error {
 	switch {
 	case strings.HasPrefix(s, "r "):
 		s = strings.TrimPrefix(s, "r ")
-		if c.routerStatusTmp != nil {
-			c.RelayInformation = append(c.RelayInformation, *c.routerStatusTmp)
-		} else {
-			c.routerStatusTmp = &RouterStatus{}
-		}
+		c.flushRouter()
+		c.routerStatusTmp = &RouterStatus{}
 
 		separated := strings.Split(s, " ")
 		// When the stream is truncated (e.g. due to circuit DESTROY),
@@ -167,7 +253,7 @@ func (c *Consensus) parseRouterState(s string) error {
 
 		c.routerStatusTmp.Ipv4Addr = separated[4]
 
-		c.routerStatusTmp.IPLevel, err = IPLevel(separated[4], 0)
+		c.routerStatusTmp.IPLevel, err = IPLevel(separated[4])
 		if err != nil {
 			return err
 		}
@@ -186,8 +272,10 @@ func (c *Consensus) parseRouterState(s string) error {
 
 		return nil
 	case strings.HasPrefix(s, "a "):
-		s = strings.TrimPrefix(s, "a ")
-		c.routerStatusTmp.Ipv6Addr = s
+		// Only the first IPv6 ORPort is kept.
+		if c.routerStatusTmp.Ipv6Addr == "" {
+			c.routerStatusTmp.SetIPv6(strings.TrimPrefix(s, "a "))
+		}
 
 		return nil
 	case strings.HasPrefix(s, "s "):
@@ -205,74 +293,11 @@ func (c *Consensus) parseRouterState(s string) error {
 		return nil
 
 	case strings.HasPrefix(s, "pr "):
-		s = strings.TrimPrefix(s, "pr ")
-
-		separated := strings.SplitSeq(s, " ")
-
-		for v := range separated {
-			sep := strings.Split(v, "=")
-			if len(sep) < 2 {
-				return fmt.Errorf("consensus: router_state: malformed pr line: %q", s)
-			}
-
-			var versionByte VersionValue
-
-			key := sep[0]
-			nums := strings.SplitSeq(sep[1], ",")
-			for num := range nums {
-				if !strings.Contains(num, "-") {
-					n, err := strconv.Atoi(num)
-					if err != nil {
-						return err
-					}
-					versionByte.SetValue(uint8(n), true)
-				} else {
-					start, err := strconv.Atoi(string(num[0]))
-					if err != nil {
-						return err
-					}
-					end, err := strconv.Atoi(string(num[2]))
-					if err != nil {
-						return err
-					}
-
-					var i uint8
-					for i = uint8(start); i <= uint8(end); i++ {
-						versionByte.SetValue(i, true)
-					}
-				}
-
-			}
-
-			switch key {
-			case "Link":
-				c.routerStatusTmp.ProtoVersions.Link = versionByte
-			case "LinkAuth":
-				c.routerStatusTmp.ProtoVersions.LinkAuth = versionByte
-			case "Relay":
-				c.routerStatusTmp.ProtoVersions.Relay = versionByte
-			case "DirCache":
-				c.routerStatusTmp.ProtoVersions.DirCache = versionByte
-			case "HSDir":
-				c.routerStatusTmp.ProtoVersions.HSDir = versionByte
-			case "HSIntro":
-				c.routerStatusTmp.ProtoVersions.HSIntro = versionByte
-			case "HSRend":
-				c.routerStatusTmp.ProtoVersions.HSRend = versionByte
-			case "Desc":
-				c.routerStatusTmp.ProtoVersions.Desc = versionByte
-			case "Microdesc":
-				c.routerStatusTmp.ProtoVersions.Microdesc = versionByte
-			case "Cons":
-				c.routerStatusTmp.ProtoVersions.Cons = versionByte
-			case "Padding":
-				c.routerStatusTmp.ProtoVersions.Padding = versionByte
-			case "FlowCtrl":
-				c.routerStatusTmp.ProtoVersions.FlowCtrl = versionByte
-			case "Conflux":
-				c.routerStatusTmp.ProtoVersions.Conflux = versionByte
-			}
+		proto, err := ParseProto(strings.TrimPrefix(s, "pr "))
+		if err != nil {
+			return fmt.Errorf("consensus: router_state: malformed pr line: %w", err)
 		}
+		c.routerStatusTmp.ProtoVersions = proto
 
 		return nil
 
@@ -298,10 +323,19 @@ func (c *Consensus) parseRouterState(s string) error {
 
 		return ParsePortsLine(&c.routerStatusTmp.Ports, s)
 	default:
+		c.flushRouter()
 		return errUnknownToken
 	}
 }
 
+// flushRouter appends the router being parsed, if any.
+func (c *Consensus) flushRouter() {
+	if c.routerStatusTmp != nil {
+		c.RelayInformation = append(c.RelayInformation, *c.routerStatusTmp)
+		c.routerStatusTmp = nil
+	}
+}
+
 func (c *Consensus) parseFooterState(s string) error {
 
 	switch {
@@ -452,8 +486,9 @@ func parseAccept(s string) (Ports, error) {
 	return p, nil
 }
 
+// IPLevel tags. Level 1 was once used for ASNs; AS separation now lives
+// in path selection through RouterStatus.ASN.
 const (
-	LEVEL_ASN  = 1
 	LEVEL_P24  = 2
 	LEVEL_P16  = 3
 	LEVEL_IPV6 = 4
@@ -489,7 +524,9 @@ func ParsePortsLine(dst *Ports, s string) error {
 
 }
 
-func IPLevel(ipStr string, asn uint32) (uint32, error) {
+// IPLevel returns the address family key of ipStr used to keep related
+// relays apart: the /16 for IPv4, a /28 for IPv6.
+func IPLevel(ipStr string) (uint32, error) {
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
 		return 0, fmt.Errorf("invalid IP")
@@ -497,10 +534,6 @@ func IPLevel(ipStr string, asn uint32) (uint32, error) {
 
 	if ip4 := ip.To4(); ip4 != nil {
 
-		if asn != 0 {
-			return uint32(LEVEL_ASN<<28) | (asn & 0x0FFFFFFF), nil
-		}
-
 		p24 := uint32(ip4[0])<<8 |
 			uint32(ip4[1])
 
@@ -512,10 +545,16 @@ func IPLevel(ipStr string, asn uint32) (uint32, error) {
 		return 0, fmt.Errorf("invalid IP")
 	}
 
-	var v uint32
-	for i := range 4 {
-		v = (v << 8) | uint32(ip[i])
-	}
+	// Only 28 bits fit under the level tag: IPv6 levels are /28s. Path
+	// selection compares exact /32s through RouterStatus.IPv6Level.
+	return uint32(LEVEL_IPV6<<28) | IPv6Prefix32(netip.AddrFrom16([16]byte(ip)))>>4, nil
+}
 
-	return uint32(LEVEL_IPV6<<28) | v, nil
+// IPv6Prefix32 returns the /32 network of a as an integer, 0 for IPv4.
+func IPv6Prefix32(a netip.Addr) uint32 {
+	if !a.Is6() || a.Is4In6() {
+		return 0
+	}
+	b := a.As16()
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
 }
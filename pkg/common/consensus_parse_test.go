@@ -0,0 +1,155 @@
+package common_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/robogg133/gonion/pkg/common"
+	"github.com/robogg133/gonion/pkg/dircompress"
+)
+
+const testConsensus = `network-status-version 3 microdesc
+vote-status consensus
+consensus-method 34
+valid-after 2026-01-30 22:00:00
+fresh-until 2026-01-30 23:00:00
+valid-until 2026-01-31 01:00:00
+known-flags Authority BadExit Exit Fast Guard HSDir MiddleOnly NoEdConsensus Running Stable StaleDesc Sybil V2Dir Valid
+recommended-client-protocols Conflux=1 Cons=2 Desc=2 DirCache=2 HSDir=2 HSIntro=4 HSRend=2 Link=4-5 Microdesc=2 Relay=2-4
+required-client-protocols Cons=2 Desc=2 Link=4 Microdesc=2 Relay=2
+params CircuitPriorityHalflifeMsec=30000 nf_ito_low=1600 nf_ito_high=9000 sendme_emit_min_version=1 neg=-5
+dir-source moria1 F533C81CEF0BC0267857C99B2F471ADF249FA232 128.31.0.39 128.31.0.39 9231 9201
+r relay1 AAoQ1DAR6kkoo19hBAX5K0QztNw 2038-01-01 00:00:00 10.0.0.1 9001 0
+s Fast Guard Running Stable Valid
+w Bandwidth=100
+r relay2 ABoQ1DAR6kkoo19hBAX5K0QztNw 2038-01-01 00:00:00 10.1.0.1 443 0
+s Exit Fast Running Valid
+w Bandwidth=200
+directory-footer
+bandwidth-weights Wbd=0 Wbe=0 Wbg=4148 Wbm=10000 Wdb=10000 Web=10000 Wed=10000 Wee=10000 Weg=10000 Wem=10000 Wgb=10000 Wgd=0 Wgg=5852 Wgm=5852 Wmb=10000 Wmd=0 Wme=0 Wmg=4148 Wmm=10000
+`
+
+func parseTestConsensus(t *testing.T, doc string) *common.Consensus {
+	t.Helper()
+	cns, err := common.ParseConsensus(bufio.NewScanner(strings.NewReader(doc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cns
+}
+
+func TestParseConsensus_Params(t *testing.T) {
+	cns := parseTestConsensus(t, testConsensus)
+
+	want := map[string]int32{
+		"CircuitPriorityHalflifeMsec": 30000,
+		"nf_ito_low":                  1600,
+		"nf_ito_high":                 9000,
+		"sendme_emit_min_version":     1,
+		"neg":                         -5,
+	}
+	if len(cns.Params) != len(want) {
+		t.Fatalf("params=%v", cns.Params)
+	}
+	for k, v := range want {
+		if cns.Params[k] != v {
+			t.Fatalf("%s=%d want %d", k, cns.Params[k], v)
+		}
+	}
+	if cns.Param("nf_ito_low", 1500) != 1600 {
+		t.Fatal("Param should return the consensus value")
+	}
+	if cns.Param("nf_pad_before_usage", 1) != 1 {
+		t.Fatal("Param should fall back to the default")
+	}
+}
+
+func TestParseConsensus_BadParams(t *testing.T) {
+	doc := strings.Replace(testConsensus, "neg=-5", "broken", 1)
+	if _, err := common.ParseConsensus(bufio.NewScanner(strings.NewReader(doc))); err == nil {
+		t.Fatal("expected error for malformed params")
+	}
+}
+
+func TestParseConsensus_ProtocolsAndFlags(t *testing.T) {
+	cns := parseTestConsensus(t, testConsensus)
+
+	if len(cns.KnownFlags) != 14 || cns.KnownFlags[0] != "Authority" {
+		t.Fatalf("known-flags %v", cns.KnownFlags)
+	}
+	if got := cns.RequiredClientProtocols.String(); got != "Cons=2 Desc=2 Link=4 Microdesc=2 Relay=2" {
+		t.Fatalf("required-client-protocols %q", got)
+	}
+	if !cns.RecommendedClientProtocols.Relay.CheckIsTrue(4) || cns.RecommendedClientProtocols.Relay.CheckIsTrue(1) {
+		t.Fatalf("recommended Relay %s", cns.RecommendedClientProtocols.Relay)
+	}
+}
+
+func TestParseConsensus_Routers(t *testing.T) {
+	doc := strings.Replace(testConsensus, "s Fast Guard", "a [2001:db8::1]:9001\ns Fast Guard", 1)
+	cns := parseTestConsensus(t, doc)
+
+	if len(cns.RelayInformation) != 2 {
+		t.Fatalf("relays=%d, want 2", len(cns.RelayInformation))
+	}
+	r1, r2 := cns.RelayInformation[0], cns.RelayInformation[1]
+	if r1.Nickname != "relay1" || r2.Nickname != "relay2" || r2.BandWidth != 200 {
+		t.Fatalf("routers %+v %+v", r1, r2)
+	}
+
+	ap, ok := r1.IPv6AddrPort()
+	if !ok || ap.String() != "[2001:db8::1]:9001" || r1.IPv6Level != 0x20010db8 {
+		t.Fatalf("relay1 IPv6 %q level %x", r1.Ipv6Addr, r1.IPv6Level)
+	}
+	// Nothing of relay1 leaks into relay2.
+	if r2.Ipv6Addr != "" || r2.IPv6Level != 0 || r2.StatusFlags[common.FLAG_GUARD] {
+		t.Fatalf("relay2 inherited relay1 fields: %+v", r2)
+	}
+	if v4, ok := r2.IPv4AddrPort(); !ok || v4.String() != "10.1.0.1:443" {
+		t.Fatalf("relay2 IPv4 %v", v4)
+	}
+}
+
+func TestIPLevel_IPv6(t *testing.T) {
+	a, err := common.IPLevel("2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := common.IPLevel("6001:db8::1")
+	v4, _ := common.IPLevel("10.0.0.1")
+	if a>>28 != common.LEVEL_IPV6 || a == b || a == v4 {
+		t.Fatalf("levels %x %x %x", a, b, v4)
+	}
+}
+
+// A body that stops with a read error is refused, not parsed as a shorter
+// document.
+func TestParseConsensus_CompressionBomb(t *testing.T) {
+	var body bytes.Buffer
+	w := zlib.NewWriter(&body)
+	w.Write(bytes.Repeat([]byte{'\n'}, 64<<20))
+	w.Close()
+	deflated := body.Bytes()
+
+	r, err := dircompress.NewReader(bytes.NewReader(deflated), dircompress.METHOD_DEFLATE, "/tor/status-vote/current/consensus-microdesc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if cns, err := common.ParseConsensusReader(r); !errors.Is(err, dircompress.ErrCompressionBomb) {
+		t.Fatalf("ParseConsensusReader = %v, %v; want ErrCompressionBomb", cns, err)
+	}
+
+	r, err = dircompress.NewReader(bytes.NewReader(deflated), dircompress.METHOD_DEFLATE, "/tor/micro/d/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := common.ParseMicrodescFile(bufio.NewScanner(r), []string{"x"}); !errors.Is(err, dircompress.ErrCompressionBomb) {
+		t.Fatalf("ParseMicrodescFile err = %v, want ErrCompressionBomb", err)
+	}
+}
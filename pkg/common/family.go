@@ -0,0 +1,124 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+)
+
+// ResolveFamilies computes FamilyMembers for every relay, once its
+// microdescriptor is applied. Two relays are in one family when they
+// declare each other on their legacy family lines, or when they share a
+// family-id (prop321), which the authorities only list after checking the
+// relay's family-cert. Call it before publishing the consensus.
+func (c *Consensus) ResolveFamilies() {
+	list := c.RelayInformation
+
+	byID := make(map[[20]byte]int, len(list))
+	byNick := make(map[string][]int)
+	for i := range list {
+		byID[list[i].NodeID] = i
+		nick := strings.ToLower(list[i].Nickname)
+		byNick[nick] = append(byNick[nick], i)
+	}
+
+	groups := make(map[string]map[[20]byte]struct{})
+	for i := range list {
+		for _, fid := range list[i].Familys {
+			if fid == nil {
+				continue
+			}
+			k := fid.key()
+			if groups[k] == nil {
+				groups[k] = make(map[[20]byte]struct{})
+			}
+			groups[k][list[i].NodeID] = struct{}{}
+		}
+	}
+
+	for i := range list {
+		rs := &list[i]
+
+		var mutual [][20]byte
+		for _, f := range rs.Family {
+			for _, j := range f.resolve(byID, byNick) {
+				if j != i && declares(&list[j], rs) {
+					mutual = append(mutual, list[j].NodeID)
+				}
+			}
+		}
+
+		var fids []map[[20]byte]struct{}
+		for _, fid := range rs.Familys {
+			if fid != nil {
+				fids = append(fids, groups[fid.key()])
+			}
+		}
+
+		// Most relays have a single family-id and no legacy family: share
+		// the group set instead of copying it.
+		if len(mutual) == 0 && len(fids) == 1 {
+			rs.FamilyMembers = fids[0]
+			continue
+		}
+		members := map[[20]byte]struct{}{rs.NodeID: {}}
+		for _, g := range fids {
+			for id := range g {
+				members[id] = struct{}{}
+			}
+		}
+		for _, id := range mutual {
+			members[id] = struct{}{}
+		}
+		rs.FamilyMembers = members
+	}
+}
+
+// SameFamily reports whether a and b are the same relay or in one family.
+// It is a map lookup once ResolveFamilies ran; relays without resolved
+// families, like bridges, are compared directly.
+func SameFamily(a, b *RouterStatus) bool {
+	if a.NodeID == b.NodeID {
+		return true
+	}
+	if a.FamilyMembers != nil && b.FamilyMembers != nil {
+		_, ok := a.FamilyMembers[b.NodeID]
+		return ok
+	}
+	for _, x := range a.Familys {
+		for _, y := range b.Familys {
+			if x != nil && y != nil && x.Kind == y.Kind && bytes.Equal(x.Value, y.Value) {
+				return true
+			}
+		}
+	}
+	return declares(a, b) && declares(b, a)
+}
+
+// declares reports whether a lists b on its legacy family line.
+func declares(a, b *RouterStatus) bool {
+	for _, f := range a.Family {
+		if f.Digest != nil {
+			if bytes.Equal(f.Digest, b.NodeID[:]) {
+				return true
+			}
+		} else if strings.EqualFold(f.Nickname, b.Nickname) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the indices of the relays f may name.
+func (f Family) resolve(byID map[[20]byte]int, byNick map[string][]int) []int {
+	if f.Digest != nil {
+		if len(f.Digest) == 20 {
+			if j, ok := byID[[20]byte(f.Digest)]; ok {
+				return []int{j}
+			}
+		}
+		return nil
+	}
+	return byNick[strings.ToLower(f.Nickname)]
+}
+
+func (f *FamilyIDs) key() string { return f.Kind + ":" + string(f.Value) }
@@ -0,0 +1,94 @@
+package common_test
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+func famRelay(nick string, id byte) common.RouterStatus {
+	rs := common.RouterStatus{Nickname: nick}
+	rs.NodeID[0] = id
+	return rs
+}
+
+func fp(rs common.RouterStatus) common.Family {
+	return common.Family{Digest: rs.NodeID[:]}
+}
+
+func TestParseMicrodesc_Families(t *testing.T) {
+	a, b := famRelay("a", 1), famRelay("b", 2)
+	block := "ntor-onion-key " + base64.RawStdEncoding.EncodeToString(make([]byte, 32)) + "\n" +
+		"family $" + strings.ToUpper(hex.EncodeToString(a.NodeID[:])) + " $" + hex.EncodeToString(b.NodeID[:]) + "~b Carol\n" +
+		"family-ids ed25519:" + base64.RawStdEncoding.EncodeToString(make([]byte, 32)) + "\n" +
+		"id ed25519 " + base64.RawStdEncoding.EncodeToString(make([]byte, 32)) + "\n"
+	sum := sha256.Sum256([]byte(block))
+	digest := base64.RawStdEncoding.EncodeToString(sum[:])
+
+	mds, err := common.ParseMicrodescFile(bufio.NewScanner(strings.NewReader(block)), []string{digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mds[0]
+	if m == nil || len(m.Family) != 3 {
+		t.Fatalf("family not parsed: %+v", m)
+	}
+	if m.Family[1].Nickname != "b" || m.Family[2].Nickname != "Carol" || m.Family[2].Digest != nil {
+		t.Fatalf("family members: %+v", m.Family)
+	}
+	if len(m.Familys) != 1 || m.Familys[0].Kind != "ed25519" || len(m.Familys[0].Value) != 32 {
+		t.Fatalf("family-ids not parsed: %+v", m.Familys)
+	}
+}
+
+func TestResolveFamilies(t *testing.T) {
+	a, b, c, d, e, f := famRelay("a", 1), famRelay("b", 2), famRelay("c", 3), famRelay("d", 4), famRelay("e", 5), famRelay("f", 6)
+	// a and b declare each other; c claims a, which does not agree.
+	a.Family = []common.Family{fp(b)}
+	b.Family = []common.Family{fp(a)}
+	c.Family = []common.Family{fp(a)}
+	// d and e by nickname.
+	d.Family = []common.Family{{Nickname: "E"}}
+	e.Family = []common.Family{{Nickname: "d"}}
+	// e and f share a family-id.
+	id := &common.FamilyIDs{Kind: "ed25519", Value: make([]byte, 32)}
+	e.Familys = []*common.FamilyIDs{id}
+	f.Familys = []*common.FamilyIDs{{Kind: "ed25519", Value: make([]byte, 32)}}
+
+	cns := &common.Consensus{RelayInformation: []common.RouterStatus{a, b, c, d, e, f}}
+
+	check := func(stage string) {
+		t.Helper()
+		r := cns.RelayInformation
+		for _, tc := range []struct {
+			x, y int
+			want bool
+		}{
+			{0, 1, true},
+			{0, 2, false},
+			{1, 2, false},
+			{3, 4, true},
+			{4, 5, true},
+			{3, 5, false},
+			{0, 0, true},
+		} {
+			if got := common.SameFamily(&r[tc.x], &r[tc.y]); got != tc.want {
+				t.Errorf("%s: SameFamily(%s, %s) = %v", stage, r[tc.x].Nickname, r[tc.y].Nickname, got)
+			}
+			if got := common.SameFamily(&r[tc.y], &r[tc.x]); got != tc.want {
+				t.Errorf("%s: SameFamily(%s, %s) = %v", stage, r[tc.y].Nickname, r[tc.x].Nickname, got)
+			}
+		}
+	}
+	check("unresolved")
+	cns.ResolveFamilies()
+	if cns.RelayInformation[0].FamilyMembers == nil {
+		t.Fatal("families not resolved")
+	}
+	check("resolved")
+}
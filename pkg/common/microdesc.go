@@ -5,12 +5,13 @@ package common
 import (
 	"bufio"
 	"bytes"
+	"crypto/ecdh"
 	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/pem"
-
+	"fmt"
 	"io"
 	"strings"
 )
@@ -33,6 +34,62 @@ type Microdesc struct {
 	ExitRules *Ports
 }
 
+// ApplyMicrodesc fills in the fields of rs that come from its
+// microdescriptor.
+func (rs *RouterStatus) ApplyMicrodesc(m *Microdesc) error {
+	rs.OnionKey = m.OnionKey
+	if len(m.NTorOnionKey) > 0 {
+		ntor, err := ecdh.X25519().NewPublicKey(m.NTorOnionKey)
+		if err != nil {
+			return err
+		}
+		rs.NTorOnionKey = ntor
+	}
+	if m.ExitRules != nil {
+		rs.Ports = *m.ExitRules
+	}
+	rs.Family = m.Family
+	rs.Familys = m.Familys
+	if len(m.IdEd25519) > 0 {
+		rs.IdEd25519 = m.IdEd25519
+	}
+	return nil
+}
+
+// CarryMicrodescs copies the microdescriptor fields of every relay whose
+// microdescriptor digest is unchanged since prev, and returns the digests
+// that still have to be fetched, each once.
+func (c *Consensus) CarryMicrodescs(prev *Consensus) (missing []string) {
+	known := map[string]*RouterStatus{}
+	if prev != nil {
+		for i := range prev.RelayInformation {
+			rs := &prev.RelayInformation[i]
+			if rs.NTorOnionKey != nil {
+				known[rs.MicrodescriptorDigest] = rs
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	for i := range c.RelayInformation {
+		rs := &c.RelayInformation[i]
+		if old, ok := known[rs.MicrodescriptorDigest]; ok {
+			rs.OnionKey = old.OnionKey
+			rs.NTorOnionKey = old.NTorOnionKey
+			rs.Ports = old.Ports
+			rs.Family = old.Family
+			rs.Familys = old.Familys
+			rs.IdEd25519 = old.IdEd25519
+			continue
+		}
+		if rs.MicrodescriptorDigest != "" && !seen[rs.MicrodescriptorDigest] {
+			seen[rs.MicrodescriptorDigest] = true
+			missing = append(missing, rs.MicrodescriptorDigest)
+		}
+	}
+	return missing
+}
+
 type Family struct {
 	Digest   []byte
 	Nickname string
@@ -82,6 +139,9 @@ func ParseMicrodescFile(scanner *bufio.Scanner, digests []string) (microdesc []*
 		}
 
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
 
 	return microdesc, nil
 
@@ -190,17 +250,17 @@ func parseOnionKey(r *bufio.Reader) ([]byte, error) {
 }
 
 func parseFamilys(s string) (ids []*FamilyIDs, err error) {
-	split := strings.SplitSeq(s, " ")
-
-	for str := range split {
-
-		id := strings.SplitN(str, ":", 2)
+	for str := range strings.FieldsSeq(s) {
+		kind, value, ok := strings.Cut(str, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid family id %q", str)
+		}
 
 		a := &FamilyIDs{
-			Kind: id[0],
+			Kind: kind,
 		}
-		var err error
-		a.Value, err = base64.RawStdEncoding.DecodeString(id[1])
+		// Unpadded base64 in practice; accept padding too.
+		a.Value, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
 		if err != nil {
 			return nil, err
 		}
@@ -208,25 +268,32 @@ func parseFamilys(s string) (ids []*FamilyIDs, err error) {
 		ids = append(ids, a)
 	}
 
-	return nil, nil
+	return ids, nil
 }
 
+// parseFamily parses a legacy family line: "$HEX" members, optionally
+// followed by "=nick" or "~nick", and bare nicknames.
 func parseFamily(s string) (family []Family, err error) {
-	split := strings.SplitSeq(s, " ")
-
-	for str := range split {
+	for str := range strings.FieldsSeq(s) {
 		var f Family
 
 		str, ok := strings.CutPrefix(str, "$")
 		if !ok {
 			f.Nickname = str
+			family = append(family, f)
 			continue
 		}
+		if i := strings.IndexAny(str, "=~"); i >= 0 {
+			str, f.Nickname = str[:i], str[i+1:]
+		}
 
 		b, err := hex.DecodeString(str)
 		if err != nil {
 			return nil, err
 		}
+		if len(b) != 20 {
+			return nil, fmt.Errorf("invalid family fingerprint %q", str)
+		}
 		f.Digest = b
 
 		family = append(family, f)
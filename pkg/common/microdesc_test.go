@@ -0,0 +1,62 @@
+package common_test
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"slices"
+	"testing"
+
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+func TestCarryMicrodescs(t *testing.T) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := &common.Consensus{RelayInformation: []common.RouterStatus{
+		{Nickname: "same", MicrodescriptorDigest: "d1", NTorOnionKey: key.PublicKey(), IdEd25519: []byte{1}},
+		{Nickname: "changed", MicrodescriptorDigest: "d2", NTorOnionKey: key.PublicKey()},
+		{Nickname: "nokeys", MicrodescriptorDigest: "d3"},
+	}}
+	next := &common.Consensus{RelayInformation: []common.RouterStatus{
+		{Nickname: "same", MicrodescriptorDigest: "d1"},
+		{Nickname: "changed", MicrodescriptorDigest: "d2new"},
+		{Nickname: "nokeys", MicrodescriptorDigest: "d3"},
+		{Nickname: "new", MicrodescriptorDigest: "d4"},
+		{Nickname: "new-twin", MicrodescriptorDigest: "d4"},
+	}}
+
+	missing := next.CarryMicrodescs(prev)
+	if want := []string{"d2new", "d3", "d4"}; !slices.Equal(missing, want) {
+		t.Fatalf("missing %v, want %v", missing, want)
+	}
+	if next.RelayInformation[0].NTorOnionKey == nil || len(next.RelayInformation[0].IdEd25519) != 1 {
+		t.Fatal("unchanged microdesc not carried over")
+	}
+	if next.RelayInformation[1].NTorOnionKey != nil {
+		t.Fatal("changed microdesc carried over")
+	}
+	if prev.RelayInformation[1].MicrodescriptorDigest != "d2" {
+		t.Fatal("previous consensus modified")
+	}
+}
+
+func TestApplyMicrodesc(t *testing.T) {
+	key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	var rs common.RouterStatus
+	var exits common.Ports
+	exits.SetPort(443, true)
+
+	m := &common.Microdesc{NTorOnionKey: key.PublicKey().Bytes(), IdEd25519: make([]byte, 32), ExitRules: &exits}
+	if err := rs.ApplyMicrodesc(m); err != nil {
+		t.Fatal(err)
+	}
+	if !rs.NTorOnionKey.Equal(key.PublicKey()) || len(rs.IdEd25519) != 32 || !rs.Ports.IsAllowed(443) {
+		t.Fatalf("fields not applied: %+v", rs)
+	}
+
+	if err := rs.ApplyMicrodesc(&common.Microdesc{NTorOnionKey: []byte{1, 2}}); err == nil {
+		t.Fatal("short ntor key accepted")
+	}
+}
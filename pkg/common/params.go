@@ -0,0 +1,212 @@
+package common
+
+import "time"
+
+// NetParams are the consensus parameters gonion uses, typed and with the
+// defaults and ranges of tor's param-spec. A value outside its range is
+// treated as absent.
+type NetParams struct {
+	// CircWindow is the initial circuit package window (circwindow).
+	CircWindow int32
+	// SendmeEmitMinVersion and SendmeAcceptMinVersion select the SENDME
+	// format (prop289).
+	SendmeEmitMinVersion   int32
+	SendmeAcceptMinVersion int32
+
+	// Circuit build timeout learning (cbt*).
+	CBTDisabled        bool
+	CBTNumModes        int32
+	CBTRecentCount     int32
+	CBTMaxTimeouts     int32
+	CBTMinCircs        int32
+	CBTQuantile        int32
+	CBTCloseQuantile   int32
+	CBTTestFreq        time.Duration
+	CBTMinTimeout      time.Duration
+	CBTInitialTimeout  time.Duration
+	CBTLearningTimeout time.Duration
+	CBTMaxOpenCircs    int32
+
+	// Link padding (nf_*), in milliseconds.
+	NfItoLow         int32
+	NfItoHigh        int32
+	NfItoLowReduced  int32
+	NfItoHighReduced int32
+	NfPadBeforeUsage bool
+	// Circuit padding switches (circpad_*).
+	CircpadDisabled bool
+	CircpadReduced  bool
+
+	// Congestion control (cc_*, prop324).
+	CCAlg         int32
+	CCSendmeInc   int32
+	CCCwndInit    int32
+	CCCwndMin     int32
+	CCCwndMax     int32
+	CCCwndInc     int32
+	CCCwndIncRate int32
+
+	// Onion services.
+	HSDirReplicas    int32
+	HSDirSpreadFetch int32
+	HSDirSpreadStore int32
+	// HSDirInterval is the time period length in minutes (hsdir-interval).
+	HSDirInterval int32
+	// Vanguards-lite layer 2 guards (guard-hs-l2-*, prop333).
+	GuardHSL2Number      int32
+	GuardHSL2LifetimeMin time.Duration
+	GuardHSL2LifetimeMax time.Duration
+
+	// Path bias detection (pb_*). Percentages are 0-100.
+	PBMinCircs      int32
+	PBNoticePct     int32
+	PBWarnPct       int32
+	PBExtremePct    int32
+	PBDropGuards    bool
+	PBScaleCircs    int32
+	PBScaleFactor   int32
+	PBMultFactor    int32
+	PBMinUse        int32
+	PBNoticeUsePct  int32
+	PBExtremeUsePct int32
+	PBScaleUse      int32
+}
+
+type paramSpec struct {
+	name          string
+	def, min, max int32
+}
+
+var (
+	paramCircWindow         = paramSpec{"circwindow", 1000, 100, 1000}
+	paramSendmeEmitMin      = paramSpec{"sendme_emit_min_version", 0, 0, 255}
+	paramSendmeAcceptMin    = paramSpec{"sendme_accept_min_version", 0, 0, 255}
+	paramCBTDisabled        = paramSpec{"cbtdisabled", 0, 0, 1}
+	paramCBTNumModes        = paramSpec{"cbtnummodes", 10, 1, 20}
+	paramCBTRecentCount     = paramSpec{"cbtrecentcount", 20, 3, 1000}
+	paramCBTMaxTimeouts     = paramSpec{"cbtmaxtimeouts", 18, 3, 10000}
+	paramCBTMinCircs        = paramSpec{"cbtmincircs", 100, 1, 10000}
+	paramCBTQuantile        = paramSpec{"cbtquantile", 80, 10, 99}
+	paramCBTCloseQuantile   = paramSpec{"cbtclosequantile", 99, 10, 99}
+	paramCBTTestFreq        = paramSpec{"cbttestfreq", 10, 1, 1<<31 - 1}
+	paramCBTMinTimeout      = paramSpec{"cbtmintimeout", 10, 10, 1<<31 - 1}
+	paramCBTInitialTimeout  = paramSpec{"cbtinitialtimeout", 60000, 10, 1<<31 - 1}
+	paramCBTLearningTimeout = paramSpec{"cbtlearntimeout", 180, 10, 60000}
+	paramCBTMaxOpenCircs    = paramSpec{"cbtmaxopencircs", 10, 0, 14}
+	paramNfItoLow           = paramSpec{"nf_ito_low", 1500, 0, 60000}
+	paramNfItoHigh          = paramSpec{"nf_ito_high", 9500, 0, 60000}
+	paramNfItoLowReduced    = paramSpec{"nf_ito_low_reduced", 9000, 0, 60000}
+	paramNfItoHighReduced   = paramSpec{"nf_ito_high_reduced", 14000, 0, 60000}
+	paramNfPadBeforeUsage   = paramSpec{"nf_pad_before_usage", 1, 0, 1}
+	paramCircpadDisabled    = paramSpec{"circpad_padding_disabled", 0, 0, 1}
+	paramCircpadReduced     = paramSpec{"circpad_padding_reduced", 0, 0, 1}
+	paramCCAlg              = paramSpec{"cc_alg", 2, 0, 3}
+	paramCCSendmeInc        = paramSpec{"cc_sendme_inc", 31, 1, 254}
+	paramCCCwndInit         = paramSpec{"cc_cwnd_init", 124, 31, 10000}
+	paramCCCwndMin          = paramSpec{"cc_cwnd_min", 124, 31, 1000}
+	paramCCCwndMax          = paramSpec{"cc_cwnd_max", 1<<31 - 1, 500, 1<<31 - 1}
+	paramCCCwndInc          = paramSpec{"cc_cwnd_inc", 31, 1, 1000}
+	paramCCCwndIncRate      = paramSpec{"cc_cwnd_inc_rate", 1, 1, 250}
+	paramHSDirReplicas      = paramSpec{"hsdir_n_replicas", 2, 1, 16}
+	paramHSDirSpreadFetch   = paramSpec{"hsdir_spread_fetch", 3, 1, 128}
+	paramHSDirSpreadStore   = paramSpec{"hsdir_spread_store", 4, 1, 128}
+	paramHSDirInterval      = paramSpec{"hsdir-interval", 1440, 30, 14400}
+	paramGuardHSL2Number    = paramSpec{"guard-hs-l2-number", 4, 1, 19}
+	paramGuardHSL2LifeMin   = paramSpec{"guard-hs-l2-lifetime-min", 86400, 60, 1<<31 - 1}
+	paramGuardHSL2LifeMax   = paramSpec{"guard-hs-l2-lifetime-max", 1036800, 60, 1<<31 - 1}
+	paramPBMinCircs         = paramSpec{"pb_mincircs", 150, 5, 1<<31 - 1}
+	paramPBNoticePct        = paramSpec{"pb_noticepct", 70, 0, 100}
+	paramPBWarnPct          = paramSpec{"pb_warnpct", 50, 0, 100}
+	paramPBExtremePct       = paramSpec{"pb_extremepct", 30, 0, 100}
+	paramPBDropGuards       = paramSpec{"pb_dropguards", 0, 0, 1}
+	paramPBScaleCircs       = paramSpec{"pb_scalecircs", 300, 10, 1<<31 - 1}
+	paramPBScaleFactor      = paramSpec{"pb_scalefactor", 2, 1, 1<<31 - 1}
+	paramPBMultFactor       = paramSpec{"pb_multfactor", 1, 1, 1<<31 - 1}
+	paramPBMinUse           = paramSpec{"pb_minuse", 20, 3, 1<<31 - 1}
+	paramPBNoticeUsePct     = paramSpec{"pb_noticeusepct", 80, 3, 100}
+	paramPBExtremeUsePct    = paramSpec{"pb_extremeusepct", 60, 3, 100}
+	paramPBScaleUse         = paramSpec{"pb_scaleuse", 100, 10, 1<<31 - 1}
+)
+
+// DefaultNetParams returns the values used without a consensus.
+func DefaultNetParams() NetParams {
+	return (*Consensus)(nil).NetParams()
+}
+
+// ParamInRange returns the consensus parameter name, or def when it is
+// absent or outside [min, max].
+func (c *Consensus) ParamInRange(name string, def, min, max int32) int32 {
+	if c == nil {
+		return def
+	}
+	v := c.Param(name, def)
+	if v < min || v > max {
+		return def
+	}
+	return v
+}
+
+// NetParams reads the typed consensus parameters. c may be nil, which
+// yields the defaults.
+func (c *Consensus) NetParams() NetParams {
+	get := func(p paramSpec) int32 { return c.ParamInRange(p.name, p.def, p.min, p.max) }
+	ms := func(p paramSpec) time.Duration { return time.Duration(get(p)) * time.Millisecond }
+	sec := func(p paramSpec) time.Duration { return time.Duration(get(p)) * time.Second }
+
+	return NetParams{
+		CircWindow:             get(paramCircWindow),
+		SendmeEmitMinVersion:   get(paramSendmeEmitMin),
+		SendmeAcceptMinVersion: get(paramSendmeAcceptMin),
+
+		CBTDisabled:        get(paramCBTDisabled) != 0,
+		CBTNumModes:        get(paramCBTNumModes),
+		CBTRecentCount:     get(paramCBTRecentCount),
+		CBTMaxTimeouts:     get(paramCBTMaxTimeouts),
+		CBTMinCircs:        get(paramCBTMinCircs),
+		CBTQuantile:        get(paramCBTQuantile),
+		CBTCloseQuantile:   get(paramCBTCloseQuantile),
+		CBTTestFreq:        sec(paramCBTTestFreq),
+		CBTMinTimeout:      ms(paramCBTMinTimeout),
+		CBTInitialTimeout:  ms(paramCBTInitialTimeout),
+		CBTLearningTimeout: sec(paramCBTLearningTimeout),
+		CBTMaxOpenCircs:    get(paramCBTMaxOpenCircs),
+
+		NfItoLow:         get(paramNfItoLow),
+		NfItoHigh:        get(paramNfItoHigh),
+		NfItoLowReduced:  get(paramNfItoLowReduced),
+		NfItoHighReduced: get(paramNfItoHighReduced),
+		NfPadBeforeUsage: get(paramNfPadBeforeUsage) != 0,
+		CircpadDisabled:  get(paramCircpadDisabled) != 0,
+		CircpadReduced:   get(paramCircpadReduced) != 0,
+
+		CCAlg:         get(paramCCAlg),
+		CCSendmeInc:   get(paramCCSendmeInc),
+		CCCwndInit:    get(paramCCCwndInit),
+		CCCwndMin:     get(paramCCCwndMin),
+		CCCwndMax:     get(paramCCCwndMax),
+		CCCwndInc:     get(paramCCCwndInc),
+		CCCwndIncRate: get(paramCCCwndIncRate),
+
+		HSDirReplicas:    get(paramHSDirReplicas),
+		HSDirSpreadFetch: get(paramHSDirSpreadFetch),
+		HSDirSpreadStore: get(paramHSDirSpreadStore),
+		HSDirInterval:    get(paramHSDirInterval),
+
+		GuardHSL2Number:      get(paramGuardHSL2Number),
+		GuardHSL2LifetimeMin: sec(paramGuardHSL2LifeMin),
+		GuardHSL2LifetimeMax: sec(paramGuardHSL2LifeMax),
+
+		PBMinCircs:      get(paramPBMinCircs),
+		PBNoticePct:     get(paramPBNoticePct),
+		PBWarnPct:       get(paramPBWarnPct),
+		PBExtremePct:    get(paramPBExtremePct),
+		PBDropGuards:    get(paramPBDropGuards) != 0,
+		PBScaleCircs:    get(paramPBScaleCircs),
+		PBScaleFactor:   get(paramPBScaleFactor),
+		PBMultFactor:    get(paramPBMultFactor),
+		PBMinUse:        get(paramPBMinUse),
+		PBNoticeUsePct:  get(paramPBNoticeUsePct),
+		PBExtremeUsePct: get(paramPBExtremeUsePct),
+		PBScaleUse:      get(paramPBScaleUse),
+	}
+}
@@ -0,0 +1,49 @@
+package common_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+func TestNetParams_Defaults(t *testing.T) {
+	p := common.DefaultNetParams()
+	if p.CircWindow != 1000 || p.HSDirReplicas != 2 || p.HSDirInterval != 1440 {
+		t.Fatalf("defaults drifted: %+v", p)
+	}
+	if p.CBTInitialTimeout != time.Minute || p.CBTQuantile != 80 || p.CBTDisabled {
+		t.Fatalf("cbt defaults drifted: %+v", p)
+	}
+	if p.CCSendmeInc != 31 || !p.NfPadBeforeUsage {
+		t.Fatalf("cc/padding defaults drifted: %+v", p)
+	}
+	if p.GuardHSL2Number != 4 || p.GuardHSL2LifetimeMin != 24*time.Hour || p.GuardHSL2LifetimeMax != 12*24*time.Hour {
+		t.Fatalf("vanguards defaults drifted: %+v", p)
+	}
+	if (&common.Consensus{}).NetParams() != p {
+		t.Fatal("empty params differ from defaults")
+	}
+}
+
+func TestNetParams_Consensus(t *testing.T) {
+	cns := &common.Consensus{Params: map[string]int32{
+		"circwindow":        500,
+		"hsdir_n_replicas":  3,
+		"hsdir-interval":    60,
+		"cbtdisabled":       1,
+		"cbtinitialtimeout": 30000,
+		"cc_sendme_inc":     0, // out of range
+		"circwindow_bogus":  1,
+	}}
+	p := cns.NetParams()
+	if p.CircWindow != 500 || p.HSDirReplicas != 3 || p.HSDirInterval != 60 {
+		t.Fatalf("params not read: %+v", p)
+	}
+	if !p.CBTDisabled || p.CBTInitialTimeout != 30*time.Second {
+		t.Fatalf("cbt params not read: %+v", p)
+	}
+	if p.CCSendmeInc != 31 {
+		t.Fatalf("out-of-range value used: %d", p.CCSendmeInc)
+	}
+}
@@ -0,0 +1,174 @@
+package common
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MAX_PROTO_VERSION is the highest subprotocol version a VersionValue
+// holds.
+const MAX_PROTO_VERSION = 7
+
+// ProtoNames are the subprotocols of a Proto, in tor's sorted order.
+var ProtoNames = []string{
+	"Conflux", "Cons", "Desc", "DirCache", "FlowCtrl", "HSDir", "HSIntro",
+	"HSRend", "Link", "LinkAuth", "Microdesc", "Padding", "Relay",
+}
+
+// Get returns the versions of the subprotocol called name.
+func (p *Proto) Get(name string) (*VersionValue, bool) {
+	switch name {
+	case "Link":
+		return &p.Link, true
+	case "LinkAuth":
+		return &p.LinkAuth, true
+	case "Relay":
+		return &p.Relay, true
+	case "DirCache":
+		return &p.DirCache, true
+	case "HSDir":
+		return &p.HSDir, true
+	case "HSIntro":
+		return &p.HSIntro, true
+	case "HSRend":
+		return &p.HSRend, true
+	case "Desc":
+		return &p.Desc, true
+	case "Microdesc":
+		return &p.Microdesc, true
+	case "Cons":
+		return &p.Cons, true
+	case "Padding":
+		return &p.Padding, true
+	case "FlowCtrl":
+		return &p.FlowCtrl, true
+	case "Conflux":
+		return &p.Conflux, true
+	}
+	return nil, false
+}
+
+// ParseProto parses a protocol list like "Cons=1-2 Link=4,5 Relay=2"
+// (dir-spec §3.4.1 "pr" and the *-protocols lines). Unknown subprotocols
+// and versions above MAX_PROTO_VERSION go to Unknown, so a requirement we
+// cannot represent still shows up as missing.
+func ParseProto(s string) (Proto, error) {
+	var (
+		p       Proto
+		unknown []string
+	)
+	for entry := range strings.FieldsSeq(s) {
+		name, list, ok := strings.Cut(entry, "=")
+		if !ok {
+			return Proto{}, fmt.Errorf("malformed protocol entry %q", entry)
+		}
+		dst, known := p.Get(name)
+		var (
+			v    VersionValue
+			over []string
+		)
+		if list != "" {
+			for item := range strings.SplitSeq(list, ",") {
+				lo, hi, isRange := strings.Cut(item, "-")
+				start, err := strconv.ParseUint(lo, 10, 32)
+				if err != nil {
+					return Proto{}, fmt.Errorf("protocol %s: bad version %q", name, item)
+				}
+				end := start
+				if isRange {
+					if end, err = strconv.ParseUint(hi, 10, 32); err != nil || end < start {
+						return Proto{}, fmt.Errorf("protocol %s: bad range %q", name, item)
+					}
+				}
+				if !known {
+					continue
+				}
+				for n := start; n <= end && n <= MAX_PROTO_VERSION; n++ {
+					v.SetValue(uint8(n), true)
+				}
+				if end > MAX_PROTO_VERSION {
+					over = append(over, versionRange(max(start, MAX_PROTO_VERSION+1), end))
+				}
+			}
+		}
+		switch {
+		case !known:
+			unknown = append(unknown, entry)
+		case len(over) > 0:
+			*dst = v
+			unknown = append(unknown, name+"="+strings.Join(over, ","))
+		default:
+			*dst = v
+		}
+	}
+	slices.Sort(unknown)
+	p.Unknown = strings.Join(unknown, " ")
+	return p, nil
+}
+
+func versionRange(start, end uint64) string {
+	if start == end {
+		return strconv.FormatUint(start, 10)
+	}
+	return fmt.Sprintf("%d-%d", start, end)
+}
+
+// Missing returns the versions listed in p that have does not support.
+// Unknown entries are missing unless have lists them too.
+func (p Proto) Missing(have Proto) Proto {
+	var out Proto
+	for _, name := range ProtoNames {
+		want, _ := p.Get(name)
+		got, _ := have.Get(name)
+		dst, _ := out.Get(name)
+		*dst = *want &^ *got
+	}
+	var unknown []string
+	haveUnknown := strings.Fields(have.Unknown)
+	for entry := range strings.FieldsSeq(p.Unknown) {
+		if !slices.Contains(haveUnknown, entry) {
+			unknown = append(unknown, entry)
+		}
+	}
+	out.Unknown = strings.Join(unknown, " ")
+	return out
+}
+
+// IsZero reports whether p lists no version at all.
+func (p Proto) IsZero() bool {
+	return p == Proto{}
+}
+
+// String formats p the way tor does: sorted names, versions as ranges.
+func (p Proto) String() string {
+	var parts []string
+	for _, name := range ProtoNames {
+		v, _ := p.Get(name)
+		if *v != 0 {
+			parts = append(parts, name+"="+v.String())
+		}
+	}
+	if p.Unknown != "" {
+		parts = append(parts, p.Unknown)
+	}
+	return strings.Join(parts, " ")
+}
+
+// String formats v as "1-2,4".
+func (v VersionValue) String() string {
+	var ranges []string
+	for n := 0; n <= MAX_PROTO_VERSION; n++ {
+		if !v.CheckIsTrue(uint8(n)) {
+			continue
+		}
+		end := n
+		for end < MAX_PROTO_VERSION && v.CheckIsTrue(uint8(end+1)) {
+			end++
+		}
+		ranges = append(ranges, versionRange(uint64(n), uint64(end)))
+		n = end
+	}
+	return strings.Join(ranges, ",")
+}
@@ -0,0 +1,56 @@
+package common_test
+
+import (
+	"testing"
+
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+func TestParseProto(t *testing.T) {
+	p, err := common.ParseProto("Link=1-3,5 Relay=2 Unknown=1 HSDir= Cons=1-12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.String(); got != "Cons=1-7 Link=1-3,5 Relay=2 Cons=8-12 Unknown=1" {
+		t.Fatalf("got %q", got)
+	}
+	if p.Unknown != "Cons=8-12 Unknown=1" {
+		t.Fatalf("unknown %q", p.Unknown)
+	}
+
+	for _, bad := range []string{"Link", "Link=x", "Link=3-1", "Link=1-"} {
+		if _, err := common.ParseProto(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestProto_Missing(t *testing.T) {
+	need, _ := common.ParseProto("Cons=2 Link=4-5 Relay=3")
+	have, _ := common.ParseProto("Cons=1-2 Link=4")
+	if got := need.Missing(have).String(); got != "Link=5 Relay=3" {
+		t.Fatalf("missing %q", got)
+	}
+	if !need.Missing(need).IsZero() {
+		t.Fatal("a protocol set misses itself")
+	}
+}
+
+// Requirements gonion cannot represent are missing, not dropped.
+func TestProto_MissingUnknown(t *testing.T) {
+	have, _ := common.ParseProto("Cons=1-2 Link=4-5 Relay=1-2")
+	for _, tc := range []struct{ need, want string }{
+		{"Relay=9", "Relay=9"},
+		{"NewThing=1", "NewThing=1"},
+		{"Link=4 Relay=2,8-9 NewThing=1-2", "NewThing=1-2 Relay=8-9"},
+	} {
+		need, err := common.ParseProto(tc.need)
+		if err != nil {
+			t.Fatal(err)
+		}
+		missing := need.Missing(have)
+		if missing.IsZero() || missing.String() != tc.want {
+			t.Errorf("%s: missing %q, want %q", tc.need, missing, tc.want)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ServerDescriptor is the subset of a relay's self-published descriptor
+// (dir-spec §2.1.1) needed to build circuits through it. Clients only see
+// these for bridges, which are not listed in the consensus.
+type ServerDescriptor struct {
+	Nickname string
+	Address  string
+	ORPort   uint16
+	DirPort  uint16
+
+	// Fingerprint is the RSA identity digest.
+	Fingerprint [20]byte
+
+	IdEd25519    ed25519.PublicKey
+	OnionKey     []byte
+	NTorOnionKey []byte
+
+	// ORAddresses are the extra "or-address" lines, usually one IPv6
+	// "[addr]:port".
+	ORAddresses []string
+
+	Family []Family
+
+	Platform string
+}
+
+// ParseServerDescriptor parses the first descriptor in r. Signatures are not
+// checked: callers fetch bridge descriptors from the bridge itself, over a
+// link already authenticated as Fingerprint.
+func ParseServerDescriptor(r io.Reader) (*ServerDescriptor, error) {
+	br := bufio.NewReader(r)
+	d := &ServerDescriptor{}
+	seenRouter, seenFingerprint := false, false
+
+	for {
+		line, rerr := br.ReadString('\n')
+		if rerr != nil && rerr != io.EOF {
+			return nil, rerr
+		}
+		if line == "" && rerr == io.EOF {
+			break
+		}
+		line = strings.TrimRight(line, "\r\n")
+		keyword, args, _ := strings.Cut(line, " ")
+
+		if !seenRouter && keyword != "router" {
+			// Annotations such as "@type server-descriptor 1.0".
+			if strings.HasPrefix(keyword, "@") {
+				continue
+			}
+			return nil, fmt.Errorf("server descriptor: expected router line, got %q", keyword)
+		}
+
+		switch keyword {
+		case "router":
+			if seenRouter {
+				// Start of the next descriptor.
+				return d.check(seenFingerprint)
+			}
+			seenRouter = true
+			f := strings.Fields(args)
+			if len(f) != 5 {
+				return nil, fmt.Errorf("server descriptor: malformed router line %q", line)
+			}
+			d.Nickname, d.Address = f[0], f[1]
+			or, err := strconv.ParseUint(f[2], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("server descriptor: ORPort: %w", err)
+			}
+			dir, err := strconv.ParseUint(f[4], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("server descriptor: DirPort: %w", err)
+			}
+			d.ORPort, d.DirPort = uint16(or), uint16(dir)
+
+		case "fingerprint":
+			b, err := hex.DecodeString(strings.ReplaceAll(args, " ", ""))
+			if err != nil || len(b) != 20 {
+				return nil, fmt.Errorf("server descriptor: malformed fingerprint %q", args)
+			}
+			d.Fingerprint = [20]byte(b)
+			seenFingerprint = true
+
+		case "master-key-ed25519":
+			b, err := decodeBase64(args)
+			if err != nil || len(b) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("server descriptor: malformed master-key-ed25519")
+			}
+			d.IdEd25519 = b
+
+		case "ntor-onion-key":
+			b, err := decodeBase64(args)
+			if err != nil || len(b) != 32 {
+				return nil, fmt.Errorf("server descriptor: malformed ntor-onion-key")
+			}
+			d.NTorOnionKey = b
+
+		case "onion-key":
+			block, err := readObject(br)
+			if err != nil {
+				return nil, fmt.Errorf("server descriptor: onion-key: %w", err)
+			}
+			d.OnionKey = block
+
+		case "or-address":
+			d.ORAddresses = append(d.ORAddresses, args)
+
+		case "family":
+			var err error
+			d.Family, err = parseFamily(args)
+			if err != nil {
+				return nil, fmt.Errorf("server descriptor: family: %w", err)
+			}
+
+		case "platform":
+			d.Platform = args
+
+		default:
+			// Other keywords may carry an object (identity-ed25519,
+			// signatures, crosscerts); skip it.
+			if next, _ := br.Peek(5); string(next) == "-----" {
+				if _, err := readObject(br); err != nil {
+					return nil, fmt.Errorf("server descriptor: %s: %w", keyword, err)
+				}
+			}
+		}
+
+		if rerr == io.EOF {
+			break
+		}
+	}
+
+	if !seenRouter {
+		return nil, fmt.Errorf("server descriptor: empty document")
+	}
+	return d.check(seenFingerprint)
+}
+
+func (d *ServerDescriptor) check(seenFingerprint bool) (*ServerDescriptor, error) {
+	if !seenFingerprint {
+		return nil, fmt.Errorf("server descriptor: missing fingerprint")
+	}
+	if len(d.NTorOnionKey) == 0 {
+		return nil, fmt.Errorf("server descriptor: missing ntor-onion-key")
+	}
+	return d, nil
+}
+
+// RouterStatus builds the consensus-shaped entry for the described relay so
+// it can be used as a first hop. Flags are those a usable bridge implicitly
+// has; the exit policy is left empty.
+func (d *ServerDescriptor) RouterStatus() (RouterStatus, error) {
+	rs := RouterStatus{
+		Nickname:  d.Nickname,
+		NodeID:    d.Fingerprint,
+		Ipv4Addr:  d.Address,
+		ORPort:    d.ORPort,
+		DirPort:   d.DirPort,
+		OnionKey:  d.OnionKey,
+		IdEd25519: d.IdEd25519,
+		Family:    d.Family,
+	}
+	for _, a := range d.ORAddresses {
+		if rs.SetIPv6(a) {
+			break
+		}
+	}
+	var err error
+	rs.IPLevel, err = IPLevel(d.Address)
+	if err != nil {
+		return RouterStatus{}, fmt.Errorf("server descriptor: address %q: %w", d.Address, err)
+	}
+	rs.NTorOnionKey, err = ecdh.X25519().NewPublicKey(d.NTorOnionKey)
+	if err != nil {
+		return RouterStatus{}, err
+	}
+	for _, f := range []uint8{FLAG_RUNNING, FLAG_VALID, FLAG_GUARD, FLAG_FAST, FLAG_STABLE, FLAG_V2DIR} {
+		rs.StatusFlags[f] = true
+	}
+	return rs, nil
+}
+
+// readObject reads a "-----BEGIN X-----" ... "-----END X-----" block and
+// returns its decoded body.
+func readObject(r *bufio.Reader) ([]byte, error) {
+	b := &bytes.Buffer{}
+	for {
+		txt, err := r.ReadString('\n')
+		b.WriteString(txt)
+		if strings.HasPrefix(txt, "-----END") {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	p, _ := pem.Decode(b.Bytes())
+	if p == nil {
+		return nil, fmt.Errorf("malformed object")
+	}
+	return p.Bytes, nil
+}
+
+// decodeBase64 accepts both padded and unpadded base64, as descriptors use
+// either depending on the tor version.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(s), "="))
+}
@@ -0,0 +1,98 @@
+package common_test
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+func testServerDescriptor(t *testing.T) (string, []byte) {
+	t.Helper()
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ntor := sk.PublicKey().Bytes()
+	doc := `@type bridge-server-descriptor 1.2
+router Unnamed 10.0.0.1 9001 0 0
+identity-ed25519
+-----BEGIN ED25519 CERT-----
+AQQABvnhAV2dJVoS9WEWSnsmxpOKlkBx6cXTdNYpvsdOFZcuSm8sAQAgBAB1xRJI
+-----END ED25519 CERT-----
+master-key-ed25519 dcUSSG75g+ByJ0iSRvAHYrhgCXuJnclShMtPmL6dcEM
+or-address [2001:db8::1]:9001
+platform Tor 0.4.8.12 on Linux
+published 2026-03-01 12:00:00
+fingerprint 99ED 3503 16AF C4ED 1964 CFE9 EC84 C201 416D 143D
+family $0011223344556677889900112233445566778899
+onion-key
+-----BEGIN RSA PUBLIC KEY-----
+MIGJAoGBAMvLp5v8Q+7y3ig1E9mQ5z2x1b1wY4u4p7zZt1V4m1y0Qp5m9Zt1V4m1
+-----END RSA PUBLIC KEY-----
+ntor-onion-key ` + base64.StdEncoding.EncodeToString(ntor) + `
+reject *:*
+router-sig-ed25519 abc
+router-signature
+-----BEGIN SIGNATURE-----
+AAAA
+-----END SIGNATURE-----
+`
+	return doc, ntor
+}
+
+func TestParseServerDescriptor(t *testing.T) {
+	doc, ntor := testServerDescriptor(t)
+	d, err := common.ParseServerDescriptor(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Nickname != "Unnamed" || d.Address != "10.0.0.1" || d.ORPort != 9001 {
+		t.Fatalf("router line: %+v", d)
+	}
+	if d.Fingerprint[0] != 0x99 || d.Fingerprint[19] != 0x3D {
+		t.Fatalf("fingerprint %x", d.Fingerprint)
+	}
+	if len(d.IdEd25519) != 32 || len(d.OnionKey) == 0 || string(d.NTorOnionKey) != string(ntor) {
+		t.Fatal("keys not parsed")
+	}
+	if len(d.ORAddresses) != 1 || len(d.Family) != 1 {
+		t.Fatalf("or-address %v family %v", d.ORAddresses, d.Family)
+	}
+
+	rs, err := d.RouterStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.NodeID != d.Fingerprint || rs.NTorOnionKey == nil || !rs.StatusFlags[common.FLAG_GUARD] {
+		t.Fatalf("router status %+v", rs)
+	}
+}
+
+func TestParseServerDescriptor_Rejects(t *testing.T) {
+	doc, _ := testServerDescriptor(t)
+	for name, bad := range map[string]string{
+		"empty":          "",
+		"no router":      "fingerprint 99ED 3503 16AF C4ED 1964 CFE9 EC84 C201 416D 143D\n",
+		"no fingerprint": removeLine(doc, "fingerprint "),
+		"no ntor key":    removeLine(doc, "ntor-onion-key "),
+		"bad ORPort":     strings.Replace(doc, "9001 0 0", "x 0 0", 1),
+	} {
+		if _, err := common.ParseServerDescriptor(strings.NewReader(bad)); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func removeLine(doc, prefix string) string {
+	var out []string
+	for _, l := range strings.Split(doc, "\n") {
+		if !strings.HasPrefix(l, prefix) {
+			out = append(out, l)
+		}
+	}
+	return strings.Join(out, "\n")
+}
@@ -35,31 +35,54 @@ type TorCert struct {
 }
 
 func VerifyConnection(cert4, cert5 *TorCert, tlsCert []byte) error {
-	// Verifying certificate 4
+	return verifyEdChain(cert4, cert5, tlsCert, time.Now())
+}
 
-	if time.Unix(int64(cert4.ExpirationDate)*3600, 0).Before(time.Now()) {
-		return fmt.Errorf("invalid certificate 4 from server: expired")
+// verifyEdChain checks identity -> signing (type 4) and signing -> TLS link
+// (type 5) certificates.
+func verifyEdChain(cert4, cert5 *TorCert, tlsCert []byte, now time.Time) error {
+	if cert4 == nil {
+		return fmt.Errorf("%w: type %d", ErrMissingCert, CERTTYPE_ED_ID_SIGN)
+	}
+	if cert5 == nil {
+		return fmt.Errorf("%w: type %d", ErrMissingCert, CERTTYPE_ED_SIGN_LINK)
 	}
 
-	dataToCheck := cert4.rawCertificate[:len(cert4.rawCertificate)-64]
+	// Verifying certificate 4
+	if cert4.CertType != CERTTYPE_ED_ID_SIGN {
+		return fmt.Errorf("invalid certificate 4 from server: wrong type %d", cert4.CertType)
+	}
+	if expired(cert4.ExpirationDate, now) {
+		return fmt.Errorf("invalid certificate 4 from server: expired")
+	}
+	if err := cert4.checkExtensions(); err != nil {
+		return fmt.Errorf("invalid certificate 4 from server: %w", err)
+	}
 
-	key := ed25519.PublicKey(cert4.Extensions[4].Data)
+	key := cert4.SigningKey()
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid certificate 4 from server: missing signed-with-ed25519-key extension")
+	}
 
-	if !ed25519.Verify(key, dataToCheck, cert4.Signature) {
+	if !ed25519.Verify(ed25519.PublicKey(key), cert4.signedPart(), cert4.Signature) {
 		return fmt.Errorf("invalid certificate 4 from server: public key don't match the signature")
 	}
 
 	// Verifying certificate 5
-	//
-	if time.Unix(int64(cert5.ExpirationDate)*3600, 0).Before(time.Now()) {
+	if cert5.CertType != CERTTYPE_ED_SIGN_LINK {
+		return fmt.Errorf("invalid certificate 5 from server: wrong type %d", cert5.CertType)
+	}
+	if expired(cert5.ExpirationDate, now) {
 		return fmt.Errorf("invalid certificate 5 from server: expired")
 	}
+	if err := cert5.checkExtensions(); err != nil {
+		return fmt.Errorf("invalid certificate 5 from server: %w", err)
+	}
+	if len(cert4.CertifiedKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid certificate 4 from server: bad certified key")
+	}
 
-	dataToCheck = cert5.rawCertificate[:len(cert5.rawCertificate)-64]
-
-	key = ed25519.PublicKey(cert4.CertifiedKey)
-
-	if !ed25519.Verify(key, dataToCheck, cert5.Signature) {
+	if !ed25519.Verify(ed25519.PublicKey(cert4.CertifiedKey), cert5.signedPart(), cert5.Signature) {
 		return fmt.Errorf("invalid certificate 5 from server: public key from cert 4 don't match the signature")
 	}
 
@@ -73,11 +96,37 @@ func VerifyConnection(cert4, cert5 *TorCert, tlsCert []byte) error {
 	return nil
 }
 
+// SigningKey returns the signed-with-ed25519-key extension, the key that
+// signed this certificate, or nil when absent.
+func (c *TorCert) SigningKey() []byte {
+	return c.Extensions[CERT_EXT_SIGNED_WITH_ED25519].Data
+}
+
+func (c *TorCert) signedPart() []byte {
+	return c.rawCertificate[:len(c.rawCertificate)-ed25519.SignatureSize]
+}
+
+// checkExtensions rejects unknown extensions flagged AFFECTS_VALIDATION
+// (cert-spec §2.2.1).
+func (c *TorCert) checkExtensions() error {
+	for t, ext := range c.Extensions {
+		if t != CERT_EXT_SIGNED_WITH_ED25519 && ext.Flag&CERT_EXT_FLAG_AFFECTS_VALID != 0 {
+			return fmt.Errorf("unknown extension %d affects validation", t)
+		}
+	}
+	return nil
+}
+
 func ParseIdentityVSigningCert(b []byte) (*TorCert, error) {
 
 	var cert TorCert
 	cert.rawCertificate = b
 
+	// VERSION TYPE EXPIRATION(4) KEY_TYPE KEY(32) N_EXTENSIONS ... SIGNATURE(64)
+	if len(b) < 40+ed25519.SignatureSize {
+		return nil, fmt.Errorf("certificate too short")
+	}
+
 	if b[0] != 1 {
 		return nil, fmt.Errorf("invalid version")
 	}
@@ -91,20 +140,27 @@ func ParseIdentityVSigningCert(b []byte) (*TorCert, error) {
 
 	cert.Extensions = make(map[uint8]extension)
 
-	reader := bytes.NewReader(b[40:])
+	body := b[40 : len(b)-ed25519.SignatureSize]
+	reader := bytes.NewReader(body)
 	for range b[39] {
-		parseCertExtension(reader, &cert.Extensions)
+		if err := parseCertExtension(reader, &cert.Extensions); err != nil {
+			return nil, fmt.Errorf("bad extension: %w", err)
+		}
+	}
+	if reader.Len() != 0 {
+		return nil, fmt.Errorf("trailing bytes before signature")
 	}
 
-	var err error
-	cert.Signature, err = io.ReadAll(reader)
+	cert.Signature = b[len(b)-ed25519.SignatureSize:]
 
-	return &cert, err
+	return &cert, nil
 }
 
 func parseCertExtension(reader *bytes.Reader, extensions *map[uint8]extension) error {
 	extLenBlob := make([]byte, 2)
-	reader.Read(extLenBlob)
+	if _, err := io.ReadFull(reader, extLenBlob); err != nil {
+		return err
+	}
 
 	extLen := binary.BigEndian.Uint16(extLenBlob)
 
@@ -114,10 +170,6 @@ func parseCertExtension(reader *bytes.Reader, extensions *map[uint8]extension) e
 	}
 	tmp := *extensions
 
-	if _, exists := tmp[extType]; exists {
-		return nil
-	}
-
 	var a extension
 	a.Flag, err = reader.ReadByte()
 	if err != nil {
@@ -125,9 +177,15 @@ func parseCertExtension(reader *bytes.Reader, extensions *map[uint8]extension) e
 	}
 
 	buffer := make([]byte, extLen)
-	reader.Read(buffer)
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		return err
+	}
 	a.Data = buffer
 
+	if _, exists := tmp[extType]; exists {
+		return fmt.Errorf("duplicate extension %d", extType)
+	}
+
 	tmp[extType] = a
 
 	return nil
@@ -0,0 +1,173 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CERTS cell certificate types (tor-spec §4.2).
+const (
+	CERTTYPE_RSA1024_ID_ID       uint8 = 2
+	CERTTYPE_ED_ID_SIGN          uint8 = 4
+	CERTTYPE_ED_SIGN_LINK        uint8 = 5
+	CERTTYPE_RSA1024_ID_EDID     uint8 = 7
+	CERT_EXT_SIGNED_WITH_ED25519 uint8 = 4
+	CERT_EXT_FLAG_AFFECTS_VALID  uint8 = 1
+)
+
+// CERTTYPE_HS_DESC_SIGNING certifies an onion service descriptor signing
+// key with the blinded key (cert-spec §A.1).
+const CERTTYPE_HS_DESC_SIGNING uint8 = 8
+
+// X.509 lifetime slop, as tor's TOR_X509_PAST_SLOP / TOR_X509_FUTURE_SLOP.
+const (
+	x509PastSlop   = 2 * 24 * time.Hour
+	x509FutureSlop = 30 * 24 * time.Hour
+)
+
+const rsaCrossCertPrefix = "Tor TLS RSA/Ed25519 cross-certificate"
+
+var ErrMissingCert = errors.New("missing certificate")
+
+// LinkIdentity is the authenticated identity of the relay at the other end of
+// a link.
+type LinkIdentity struct {
+	// RSA is the SHA1 of the DER PKCS#1 identity key: the relay fingerprint
+	// and consensus NodeID.
+	RSA [20]byte
+	// Ed25519 is the master identity key.
+	Ed25519 ed25519.PublicKey
+}
+
+// VerifyLinkCerts validates a responder CERTS cell as an initiator must
+// (tor-spec §4.2): certs maps a certificate type to its body and must hold
+// types 2, 4, 5 and 7. tlsCert is the DER certificate the relay presented in
+// TLS.
+func VerifyLinkCerts(certs map[uint8][]byte, tlsCert []byte, now time.Time) (*LinkIdentity, error) {
+	for _, t := range []uint8{CERTTYPE_RSA1024_ID_ID, CERTTYPE_ED_ID_SIGN, CERTTYPE_ED_SIGN_LINK, CERTTYPE_RSA1024_ID_EDID} {
+		if len(certs[t]) == 0 {
+			return nil, fmt.Errorf("%w: type %d", ErrMissingCert, t)
+		}
+	}
+
+	rsaKey, err := ParseRSAIdentityCert(certs[CERTTYPE_RSA1024_ID_ID], now)
+	if err != nil {
+		return nil, fmt.Errorf("certificate 2: %w", err)
+	}
+
+	cross, err := ParseRSACrossCert(certs[CERTTYPE_RSA1024_ID_EDID])
+	if err != nil {
+		return nil, fmt.Errorf("certificate 7: %w", err)
+	}
+	if err := cross.Verify(rsaKey, now); err != nil {
+		return nil, fmt.Errorf("certificate 7: %w", err)
+	}
+
+	cert4, err := ParseIdentityVSigningCert(certs[CERTTYPE_ED_ID_SIGN])
+	if err != nil {
+		return nil, fmt.Errorf("certificate 4: %w", err)
+	}
+	cert5, err := ParseIdentityVSigningCert(certs[CERTTYPE_ED_SIGN_LINK])
+	if err != nil {
+		return nil, fmt.Errorf("certificate 5: %w", err)
+	}
+	if err := verifyEdChain(cert4, cert5, tlsCert, now); err != nil {
+		return nil, err
+	}
+
+	edID := cert4.SigningKey()
+	if !bytes.Equal(edID, cross.Ed25519Key) {
+		return nil, fmt.Errorf("certificate 7 certifies a different ed25519 identity than certificate 4")
+	}
+
+	return &LinkIdentity{
+		RSA:     RSAIdentity(rsaKey),
+		Ed25519: ed25519.PublicKey(bytes.Clone(edID)),
+	}, nil
+}
+
+// RSAIdentity returns the SHA1 digest of the DER PKCS#1 encoding of key.
+func RSAIdentity(key *rsa.PublicKey) [20]byte {
+	return sha1.Sum(x509.MarshalPKCS1PublicKey(key))
+}
+
+// ParseRSAIdentityCert checks a self-signed RSA1024 identity certificate
+// (CERTS type 2) and returns its key.
+func ParseRSAIdentityCert(der []byte, now time.Time) (*rsa.PublicKey, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("identity key is not RSA")
+	}
+	if key.N.BitLen() != 1024 || key.E != 65537 {
+		return nil, fmt.Errorf("identity key is not RSA1024 with e=65537")
+	}
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return nil, fmt.Errorf("identity certificate is not self-signed: %w", err)
+	}
+	if now.Add(x509FutureSlop).Before(cert.NotBefore) || now.Add(-x509PastSlop).After(cert.NotAfter) {
+		return nil, fmt.Errorf("identity certificate outside its validity period")
+	}
+	return key, nil
+}
+
+// RSACrossCert certifies an Ed25519 identity with an RSA identity key
+// (cert-spec §2.3, CERTS type 7).
+type RSACrossCert struct {
+	Ed25519Key []byte
+	// ExpirationDate is in hours since the epoch.
+	ExpirationDate uint32
+	Signature      []byte
+
+	signed []byte
+}
+
+// ParseRSACrossCert parses ED25519_KEY(32) EXPIRATION_DATE(4) SIGLEN(1)
+// SIGNATURE(SIGLEN).
+func ParseRSACrossCert(b []byte) (*RSACrossCert, error) {
+	if len(b) < 37 {
+		return nil, fmt.Errorf("cross-certificate too short")
+	}
+	sigLen := int(b[36])
+	if len(b) != 37+sigLen {
+		return nil, fmt.Errorf("cross-certificate length mismatch")
+	}
+	return &RSACrossCert{
+		Ed25519Key:     b[:32],
+		ExpirationDate: binary.BigEndian.Uint32(b[32:36]),
+		Signature:      b[37:],
+		signed:         b[:36],
+	}, nil
+}
+
+// Verify checks the signature against key and the expiration date.
+func (c *RSACrossCert) Verify(key *rsa.PublicKey, now time.Time) error {
+	if expired(c.ExpirationDate, now) {
+		return fmt.Errorf("expired")
+	}
+	h := sha256.New()
+	h.Write([]byte(rsaCrossCertPrefix))
+	h.Write(c.signed)
+	// The digest is signed bare, without a DigestInfo prefix.
+	if err := rsa.VerifyPKCS1v15(key, crypto.Hash(0), h.Sum(nil), c.Signature); err != nil {
+		return fmt.Errorf("bad signature: %w", err)
+	}
+	return nil
+}
+
+func expired(hours uint32, now time.Time) bool {
+	return time.Unix(int64(hours)*3600, 0).Before(now)
+}
@@ -0,0 +1,190 @@
+package crypto_test
+
+import (
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/robogg133/gonion/pkg/crypto"
+)
+
+type relayCerts struct {
+	rsaKey  *rsa.PrivateKey
+	idPub   ed25519.PublicKey
+	idPriv  ed25519.PrivateKey
+	tlsCert []byte
+	certs   map[uint8][]byte
+}
+
+func hoursFromNow(d time.Duration) uint32 {
+	return uint32(time.Now().Add(d).Unix() / 3600)
+}
+
+// edCert builds a cert-spec §2.1 Ed25519 certificate with a
+// signed-with-ed25519-key extension.
+func edCert(certType uint8, certified []byte, signer ed25519.PrivateKey, exp uint32) []byte {
+	var b bytes.Buffer
+	b.WriteByte(1)
+	b.WriteByte(certType)
+	binary.Write(&b, binary.BigEndian, exp)
+	b.WriteByte(1)
+	b.Write(certified)
+	b.WriteByte(1) // N_EXTENSIONS
+	binary.Write(&b, binary.BigEndian, uint16(32))
+	b.WriteByte(crypto.CERT_EXT_SIGNED_WITH_ED25519)
+	b.WriteByte(0)
+	b.Write(signer.Public().(ed25519.PublicKey))
+	b.Write(ed25519.Sign(signer, b.Bytes()))
+	return b.Bytes()
+}
+
+func crossCert(t *testing.T, key *rsa.PrivateKey, ed ed25519.PublicKey, exp uint32) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	b.Write(ed)
+	binary.Write(&b, binary.BigEndian, exp)
+	h := sha256.New()
+	h.Write([]byte("Tor TLS RSA/Ed25519 cross-certificate"))
+	h.Write(b.Bytes())
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, stdcrypto.Hash(0), h.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.WriteByte(byte(len(sig)))
+	b.Write(sig)
+	return b.Bytes()
+}
+
+func newRelayCerts(t *testing.T) *relayCerts {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "www.example.net"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &rsaKey.PublicKey, rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idPub, idPriv, _ := ed25519.GenerateKey(rand.Reader)
+	signPub, signPriv, _ := ed25519.GenerateKey(rand.Reader)
+	tlsCert := []byte("pretend this is the TLS link certificate")
+	tlsDigest := sha256.Sum256(tlsCert)
+
+	exp := hoursFromNow(48 * time.Hour)
+	return &relayCerts{
+		rsaKey:  rsaKey,
+		idPub:   idPub,
+		idPriv:  idPriv,
+		tlsCert: tlsCert,
+		certs: map[uint8][]byte{
+			crypto.CERTTYPE_RSA1024_ID_ID:   der,
+			crypto.CERTTYPE_ED_ID_SIGN:      edCert(crypto.CERTTYPE_ED_ID_SIGN, signPub, idPriv, exp),
+			crypto.CERTTYPE_ED_SIGN_LINK:    edCert(crypto.CERTTYPE_ED_SIGN_LINK, tlsDigest[:], signPriv, exp),
+			crypto.CERTTYPE_RSA1024_ID_EDID: crossCert(t, rsaKey, idPub, exp),
+		},
+	}
+}
+
+func TestVerifyLinkCerts_Valid(t *testing.T) {
+	rc := newRelayCerts(t)
+	id, err := crypto.VerifyLinkCerts(rc.certs, rc.tlsCert, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id.Ed25519, rc.idPub) {
+		t.Fatal("ed25519 identity mismatch")
+	}
+	if id.RSA != crypto.RSAIdentity(&rc.rsaKey.PublicKey) {
+		t.Fatal("rsa identity mismatch")
+	}
+}
+
+func TestVerifyLinkCerts_Rejects(t *testing.T) {
+	cases := []struct {
+		name   string
+		mutate func(t *testing.T, rc *relayCerts)
+	}{
+		{"missing type 2", func(t *testing.T, rc *relayCerts) {
+			delete(rc.certs, crypto.CERTTYPE_RSA1024_ID_ID)
+		}},
+		{"missing type 7", func(t *testing.T, rc *relayCerts) {
+			delete(rc.certs, crypto.CERTTYPE_RSA1024_ID_EDID)
+		}},
+		{"expired cross-cert", func(t *testing.T, rc *relayCerts) {
+			rc.certs[crypto.CERTTYPE_RSA1024_ID_EDID] = crossCert(t, rc.rsaKey, rc.idPub, hoursFromNow(-2*time.Hour))
+		}},
+		{"cross-cert for other identity", func(t *testing.T, rc *relayCerts) {
+			other, _, _ := ed25519.GenerateKey(rand.Reader)
+			rc.certs[crypto.CERTTYPE_RSA1024_ID_EDID] = crossCert(t, rc.rsaKey, other, hoursFromNow(time.Hour))
+		}},
+		{"cross-cert signed by other RSA key", func(t *testing.T, rc *relayCerts) {
+			other, err := rsa.GenerateKey(rand.Reader, 1024)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc.certs[crypto.CERTTYPE_RSA1024_ID_EDID] = crossCert(t, other, rc.idPub, hoursFromNow(time.Hour))
+		}},
+		{"expired identity cert", func(t *testing.T, rc *relayCerts) {
+			signPub, _, _ := ed25519.GenerateKey(rand.Reader)
+			rc.certs[crypto.CERTTYPE_ED_ID_SIGN] = edCert(crypto.CERTTYPE_ED_ID_SIGN, signPub, rc.idPriv, hoursFromNow(-2*time.Hour))
+		}},
+		{"wrong TLS cert", func(t *testing.T, rc *relayCerts) {
+			rc.tlsCert = []byte("another certificate")
+		}},
+		{"truncated type 5", func(t *testing.T, rc *relayCerts) {
+			rc.certs[crypto.CERTTYPE_ED_SIGN_LINK] = rc.certs[crypto.CERTTYPE_ED_SIGN_LINK][:50]
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rc := newRelayCerts(t)
+			c.mutate(t, rc)
+			if _, err := crypto.VerifyLinkCerts(rc.certs, rc.tlsCert, time.Now()); err == nil {
+				t.Fatal("expected verification failure")
+			}
+		})
+	}
+}
+
+func TestVerifyLinkCerts_MissingIsTyped(t *testing.T) {
+	_, err := crypto.VerifyLinkCerts(map[uint8][]byte{}, nil, time.Now())
+	if !errors.Is(err, crypto.ErrMissingCert) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestParseRSAIdentityCert_RejectsLargeKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := crypto.ParseRSAIdentityCert(der, time.Now()); err == nil {
+		t.Fatal("expected RSA2048 identity to be rejected")
+	}
+}
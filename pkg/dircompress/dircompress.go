@@ -0,0 +1,124 @@
+// Package dircompress decodes compressed directory responses (dir-spec
+// §6.2): zlib ("deflate", and any ".z" URL), zstd ("x-zstd") and LZMA
+// ("x-tor-lzma", the classic .lzma format).
+package dircompress
+
+import (
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+const (
+	METHOD_IDENTITY = "identity"
+	METHOD_DEFLATE  = "deflate"
+	METHOD_ZSTD     = "x-zstd"
+	METHOD_LZMA     = "x-tor-lzma"
+
+	// Z_SUFFIX asks a directory for a zlib-compressed document.
+	Z_SUFFIX = ".z"
+)
+
+// ACCEPT_ENCODING lists every method we decode, best ratio first.
+const ACCEPT_ENCODING = METHOD_ZSTD + ", " + METHOD_LZMA + ", " + METHOD_DEFLATE + ", " + METHOD_IDENTITY
+
+// Compression bomb limits, as tor_compress_is_compression_bomb: past
+// BOMB_CHECK_AFTER bytes of output, a stream that expanded more than
+// MAX_UNCOMPRESSION_FACTOR times is refused.
+const (
+	MAX_UNCOMPRESSION_FACTOR = 25
+	BOMB_CHECK_AFTER         = 1024 * 1024
+)
+
+// ErrCompressionBomb is returned by a reader whose output grew past
+// MAX_UNCOMPRESSION_FACTOR times its input.
+var ErrCompressionBomb = errors.New("dircompress: compression bomb")
+
+// NewReader decodes body sent with the given Content-Encoding. path is the
+// request path: a ".z" document without a Content-Encoding is zlib.
+// Compressed bodies are checked for compression bombs, so the output is
+// bounded by what the directory actually sent.
+func NewReader(body io.Reader, contentEncoding, path string) (io.ReadCloser, error) {
+	enc := strings.ToLower(strings.TrimSpace(contentEncoding))
+	if enc == "" && strings.HasSuffix(path, Z_SUFFIX) {
+		enc = METHOD_DEFLATE
+	}
+	if enc == "" || enc == METHOD_IDENTITY {
+		return io.NopCloser(body), nil
+	}
+
+	in := &countingReader{r: body}
+	d, err := newDecoder(in, enc)
+	if err != nil {
+		if errors.Is(err, errUnsupported) {
+			return nil, fmt.Errorf("dircompress: unsupported encoding %q", contentEncoding)
+		}
+		return nil, err
+	}
+	return &bombReader{d: d, in: in}, nil
+}
+
+var errUnsupported = errors.New("unsupported encoding")
+
+func newDecoder(body io.Reader, enc string) (io.ReadCloser, error) {
+	switch enc {
+	case METHOD_DEFLATE:
+		return zlib.NewReader(body)
+	case METHOD_ZSTD:
+		d, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case METHOD_LZMA:
+		r, err := lzma.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(r), nil
+	default:
+		return nil, errUnsupported
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// bombReader fails with ErrCompressionBomb once the output of d outgrows
+// its input.
+type bombReader struct {
+	d   io.ReadCloser
+	in  *countingReader
+	out int64
+}
+
+func (b *bombReader) Read(p []byte) (int, error) {
+	n, err := b.d.Read(p)
+	b.out += int64(n)
+	if isBomb(b.in.n, b.out) {
+		return 0, ErrCompressionBomb
+	}
+	return n, err
+}
+
+func (b *bombReader) Close() error { return b.d.Close() }
+
+func isBomb(in, out int64) bool {
+	if out < BOMB_CHECK_AFTER {
+		return false
+	}
+	return in == 0 || out/in > MAX_UNCOMPRESSION_FACTOR
+}
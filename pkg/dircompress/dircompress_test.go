@@ -0,0 +1,107 @@
+package dircompress_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/robogg133/gonion/pkg/dircompress"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+var doc = []byte(strings.Repeat("r relay AAoQ1DAR6kkoo19hBAX5K0QztNw 2038-01-01 00:00:00 10.0.0.1 9001 0\n", 200))
+
+func compress(t *testing.T, enc string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch enc {
+	case dircompress.METHOD_DEFLATE:
+		w = zlib.NewWriter(&buf)
+	case dircompress.METHOD_ZSTD:
+		w, err = zstd.NewWriter(&buf)
+	case dircompress.METHOD_LZMA:
+		w, err = lzma.NewWriter(&buf)
+	default:
+		return doc
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNewReader_RoundTrip(t *testing.T) {
+	for _, enc := range []string{"", dircompress.METHOD_IDENTITY, dircompress.METHOD_DEFLATE, dircompress.METHOD_ZSTD, dircompress.METHOD_LZMA} {
+		body := compress(t, enc)
+		r, err := dircompress.NewReader(bytes.NewReader(body), enc, "/tor/micro/d/x")
+		if err != nil {
+			t.Fatalf("%q: %v", enc, err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%q: %v", enc, err)
+		}
+		if !bytes.Equal(got, doc) {
+			t.Fatalf("%q: output differs", enc)
+		}
+	}
+}
+
+func TestNewReader_ZSuffix(t *testing.T) {
+	body := compress(t, dircompress.METHOD_DEFLATE)
+	r, err := dircompress.NewReader(bytes.NewReader(body), "", "/tor/status-vote/current/consensus-microdesc.z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(r)
+	if !bytes.Equal(got, doc) {
+		t.Fatal(".z document not inflated")
+	}
+}
+
+func TestNewReader_Unknown(t *testing.T) {
+	if _, err := dircompress.NewReader(bytes.NewReader(nil), "br", "/"); err == nil {
+		t.Fatal("unknown encoding accepted")
+	}
+}
+
+func TestNewReader_CompressionBomb(t *testing.T) {
+	zeros := bytes.Repeat([]byte{0}, 64<<20)
+	for _, enc := range []string{dircompress.METHOD_DEFLATE, dircompress.METHOD_ZSTD} {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		if enc == dircompress.METHOD_ZSTD {
+			w, _ = zstd.NewWriter(&buf)
+		} else {
+			w = zlib.NewWriter(&buf)
+		}
+		w.Write(zeros)
+		w.Close()
+
+		r, err := dircompress.NewReader(&buf, enc, "/tor/status-vote/current/consensus")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(io.Discard, r)
+		r.Close()
+		if !errors.Is(err, dircompress.ErrCompressionBomb) {
+			t.Fatalf("%s: read %d bytes, err %v", enc, n, err)
+		}
+		if n > 2*dircompress.BOMB_CHECK_AFTER {
+			t.Fatalf("%s: %d bytes read before the bomb was caught", enc, n)
+		}
+	}
+}
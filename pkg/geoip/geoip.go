@@ -0,0 +1,210 @@
+// Package geoip maps addresses to countries and autonomous systems from
+// offline databases, so path selection can avoid hops in the same AS and
+// node sets can name countries without a network lookup.
+//
+// Country data uses tor's geoip and geoip6 files. ASN data uses the same
+// layout, "low,high,asn", with tab separated lines and extra columns
+// accepted so iptoasn.com dumps load as they are.
+package geoip
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+type span[T any] struct {
+	lo, hi netip.Addr
+	val    T
+}
+
+// table is a sorted list of non-overlapping address ranges.
+type table[T any] []span[T]
+
+func (t table[T]) lookup(a netip.Addr) (T, bool) {
+	var zero T
+	i, found := slices.BinarySearchFunc(t, a, func(s span[T], a netip.Addr) int {
+		return s.lo.Compare(a)
+	})
+	if !found {
+		if i == 0 {
+			return zero, false
+		}
+		i--
+	}
+	if s := t[i]; s.lo.Compare(a) <= 0 && a.Compare(s.hi) <= 0 {
+		return s.val, true
+	}
+	return zero, false
+}
+
+func (t *table[T]) sort() {
+	slices.SortFunc(*t, func(a, b span[T]) int { return a.lo.Compare(b.lo) })
+}
+
+// DB is a country and ASN database. Load everything before sharing it;
+// lookups are safe for concurrent use.
+type DB struct {
+	country table[string]
+	asn     table[uint32]
+}
+
+func New() *DB { return &DB{} }
+
+// Open loads whichever of the tor geoip, geoip6 and ASN files are given;
+// empty paths are skipped.
+func Open(geoipPath, geoip6Path, asnPath string) (*DB, error) {
+	db := New()
+	for _, f := range []struct {
+		path string
+		load func(io.Reader) error
+	}{
+		{geoipPath, db.LoadGeoIP},
+		{geoip6Path, db.LoadGeoIP6},
+		{asnPath, db.LoadASN},
+	} {
+		if f.path == "" {
+			continue
+		}
+		fh, err := os.Open(f.path)
+		if err != nil {
+			return nil, err
+		}
+		err = f.load(fh)
+		fh.Close()
+		if err != nil {
+			return nil, fmt.Errorf("geoip: %s: %w", f.path, err)
+		}
+	}
+	return db, nil
+}
+
+// LoadGeoIP reads a tor geoip file: "INTIPLOW,INTIPHIGH,CC" lines with
+// IPv4 addresses as integers.
+func (db *DB) LoadGeoIP(r io.Reader) error {
+	return db.loadCountry(r, parseIntAddr)
+}
+
+// LoadGeoIP6 reads a tor geoip6 file: "IPV6LOW,IPV6HIGH,CC" lines.
+func (db *DB) LoadGeoIP6(r io.Reader) error {
+	return db.loadCountry(r, netip.ParseAddr)
+}
+
+func (db *DB) loadCountry(r io.Reader, parse func(string) (netip.Addr, error)) error {
+	err := eachRange(r, parse, func(lo, hi netip.Addr, rest []string) error {
+		cc := strings.ToLower(rest[0])
+		if len(cc) != 2 {
+			return fmt.Errorf("invalid country %q", rest[0])
+		}
+		if cc == "??" {
+			return nil
+		}
+		db.country = append(db.country, span[string]{lo, hi, cc})
+		return nil
+	})
+	db.country.sort()
+	return err
+}
+
+// LoadASN reads "LOW,HIGH,ASN" lines, comma or tab separated. Addresses
+// are IPv4 or IPv6 text or IPv4 integers; ASN may carry an "AS" prefix.
+// ASN 0 marks unrouted space and is skipped.
+func (db *DB) LoadASN(r io.Reader) error {
+	err := eachRange(r, parseAnyAddr, func(lo, hi netip.Addr, rest []string) error {
+		n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(rest[0]), "AS"), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid ASN %q", rest[0])
+		}
+		if n != 0 {
+			db.asn = append(db.asn, span[uint32]{lo, hi, uint32(n)})
+		}
+		return nil
+	})
+	db.asn.sort()
+	return err
+}
+
+func eachRange(r io.Reader, parse func(string) (netip.Addr, error), fn func(lo, hi netip.Addr, rest []string) error) error {
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		fields := strings.FieldsFunc(s, func(c rune) bool { return c == ',' || c == '\t' })
+		if len(fields) < 3 {
+			return fmt.Errorf("line %d: want low,high,value", line)
+		}
+		lo, err := parse(fields[0])
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		hi, err := parse(fields[1])
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if lo.Is4() != hi.Is4() || hi.Less(lo) {
+			return fmt.Errorf("line %d: invalid range", line)
+		}
+		if err := fn(lo, hi, fields[2:]); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return sc.Err()
+}
+
+func parseIntAddr(s string) (netip.Addr, error) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid IPv4 integer %q", s)
+	}
+	return netip.AddrFrom4([4]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}), nil
+}
+
+func parseAnyAddr(s string) (netip.Addr, error) {
+	if a, err := netip.ParseAddr(s); err == nil {
+		return a.Unmap(), nil
+	}
+	return parseIntAddr(s)
+}
+
+// Country returns the lowercase country code of a, or "" when unknown.
+func (db *DB) Country(a netip.Addr) string {
+	cc, _ := db.country.lookup(a.Unmap())
+	return cc
+}
+
+// ASN returns the autonomous system of a, or 0 when unknown.
+func (db *DB) ASN(a netip.Addr) uint32 {
+	n, _ := db.asn.lookup(a.Unmap())
+	return n
+}
+
+// Annotate sets Country and ASN on every relay of cns from its IPv4
+// address. IPLevel keeps the /16: path selection checks the ASN as an
+// extra rule, not instead of the subnet one. Call it before the consensus
+// is published.
+func (db *DB) Annotate(cns *common.Consensus) {
+	for i := range cns.RelayInformation {
+		db.AnnotateRelay(&cns.RelayInformation[i])
+	}
+}
+
+// AnnotateRelay is Annotate for a single relay, e.g. a bridge.
+func (db *DB) AnnotateRelay(rs *common.RouterStatus) {
+	a, err := netip.ParseAddr(rs.Ipv4Addr)
+	if err != nil {
+		return
+	}
+	rs.Country = db.Country(a)
+	rs.ASN = db.ASN(a)
+}
@@ -0,0 +1,110 @@
+package geoip_test
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/robogg133/gonion/pkg/common"
+	"github.com/robogg133/gonion/pkg/geoip"
+)
+
+const testGeoIP = `# Last updated based on February 7 2023 Maxmind GeoLite2 Country
+16777216,16777471,AU
+16777472,16778239,CN
+167772160,184549375,??
+3232235520,3232301055,DE
+`
+
+const testGeoIP6 = `2001:200::,2001:200:ffff:ffff:ffff:ffff:ffff:ffff,JP
+2a00:1450::,2a00:1450:ffff:ffff:ffff:ffff:ffff:ffff,IE
+`
+
+const testASN = "1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+	"1.0.1.0\t1.0.3.255\t0\tNone\tNot routed\n" +
+	"192.168.0.0,192.168.127.255,AS64512\n" +
+	"192.168.128.0,192.168.255.255,64513\n"
+
+func testDB(t *testing.T) *geoip.DB {
+	t.Helper()
+	db := geoip.New()
+	if err := db.LoadGeoIP(strings.NewReader(testGeoIP)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.LoadGeoIP6(strings.NewReader(testGeoIP6)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.LoadASN(strings.NewReader(testASN)); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestLookup(t *testing.T) {
+	db := testDB(t)
+	for _, tc := range []struct {
+		addr string
+		cc   string
+		asn  uint32
+	}{
+		{"1.0.0.1", "au", 13335},
+		{"1.0.2.1", "cn", 0},
+		{"1.0.4.1", "", 0},
+		{"10.1.2.3", "", 0},
+		{"192.168.1.1", "de", 64512},
+		{"192.168.200.1", "de", 64513},
+		{"::ffff:1.0.0.1", "au", 13335},
+		{"2001:200::1", "jp", 0},
+		{"2a00:1450:4001::1", "ie", 0},
+		{"2a01::1", "", 0},
+		{"0.0.0.1", "", 0},
+	} {
+		a := netip.MustParseAddr(tc.addr)
+		if cc := db.Country(a); cc != tc.cc {
+			t.Errorf("%s: country %q, want %q", tc.addr, cc, tc.cc)
+		}
+		if asn := db.ASN(a); asn != tc.asn {
+			t.Errorf("%s: ASN %d, want %d", tc.addr, asn, tc.asn)
+		}
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	db := geoip.New()
+	for _, s := range []string{"1,2", "x,2,US", "2,1,US", "1,2,USA"} {
+		if err := db.LoadGeoIP(strings.NewReader(s)); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+	if err := db.LoadASN(strings.NewReader("1.0.0.0,::1,5")); err == nil {
+		t.Error("mixed families: expected error")
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	db := testDB(t)
+	cns := &common.Consensus{RelayInformation: []common.RouterStatus{
+		{Nickname: "a", Ipv4Addr: "192.168.1.1"},
+		{Nickname: "b", Ipv4Addr: "192.168.100.1"},
+		{Nickname: "c", Ipv4Addr: "1.0.2.1"},
+		{Nickname: "d", Ipv4Addr: "192.168.200.1"},
+	}}
+	for i := range cns.RelayInformation {
+		r := &cns.RelayInformation[i]
+		r.IPLevel, _ = common.IPLevel(r.Ipv4Addr)
+	}
+	db.Annotate(cns)
+
+	a, b, c, d := cns.RelayInformation[0], cns.RelayInformation[1], cns.RelayInformation[2], cns.RelayInformation[3]
+	if a.Country != "de" || a.ASN != 64512 || b.ASN != 64512 {
+		t.Fatalf("a: %q %d", a.Country, a.ASN)
+	}
+	if c.ASN != 0 || d.ASN != 64513 {
+		t.Fatalf("c, d: %d %d", c.ASN, d.ASN)
+	}
+	// The /16 level survives annotation, so same-subnet relays in
+	// different ASes still conflict.
+	if a.IPLevel>>28 != common.LEVEL_P24 || a.IPLevel != d.IPLevel {
+		t.Fatalf("subnet level lost: %x %x", a.IPLevel, d.IPLevel)
+	}
+}
@@ -0,0 +1,311 @@
+package hs
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/robogg133/gonion/pkg/clock"
+	"github.com/robogg133/gonion/pkg/lspec"
+)
+
+// Client descriptor cache, after tor hs_cache.c.
+//
+// Descriptors are keyed by blinded key and time period. A fetched
+// descriptor replaces the cached one unless its revision counter is lower.
+// Intro point failures are kept apart from the descriptors, keyed by
+// blinded key and intro auth key, so they survive a refetch that lists
+// the same intro points.
+
+// DEFAULT_DESC_LIFETIME is used for descriptors that carry no lifetime.
+const DEFAULT_DESC_LIFETIME = 3 * time.Hour
+
+// INTRO_STATE_MAX_AGE is how long an intro point failure is remembered
+// (HS_CACHE_CLIENT_INTRO_STATE_MAX_AGE).
+const INTRO_STATE_MAX_AGE = 2 * time.Minute
+
+// MAX_INTRO_UNREACHABLE is how many unreachable failures make an intro
+// point unusable (MAX_INTRO_POINT_REACHABILITY_FAILURES).
+const MAX_INTRO_UNREACHABLE = 5
+
+// ErrDescRevision is returned by Store for a descriptor older than the
+// cached one.
+var ErrDescRevision = errors.New("hs: descriptor revision counter went backwards")
+
+// IntroPoint is one introduction point of a descriptor.
+type IntroPoint struct {
+	// AuthKey is the intro point auth key; it identifies the intro point
+	// in the failure cache.
+	AuthKey ed25519.PublicKey
+	// EncKey is the x25519 key for INTRODUCE2 encryption.
+	EncKey [32]byte
+	// LinkSpecifiers locate the intro relay.
+	LinkSpecifiers []lspec.Lspec
+}
+
+// Descriptor is the decoded client view of an onion service descriptor.
+type Descriptor struct {
+	BlindedKey      ed25519.PublicKey
+	PeriodNum       uint64
+	RevisionCounter uint64
+	// Lifetime is descriptor-lifetime; zero means DEFAULT_DESC_LIFETIME.
+	Lifetime    time.Duration
+	IntroPoints []IntroPoint
+}
+
+// IntroFailure is the kind of an intro point failure.
+type IntroFailure uint8
+
+const (
+	// IntroFailureGeneric is a NACK or any other error on the intro
+	// circuit.
+	IntroFailureGeneric IntroFailure = iota
+	// IntroFailureTimeout is an introduction that got no answer.
+	IntroFailureTimeout
+	// IntroFailureUnreachable is a circuit that could not be extended to
+	// the intro point.
+	IntroFailureUnreachable
+)
+
+type descKey struct {
+	blinded [32]byte
+	period  uint64
+}
+
+type descEntry struct {
+	desc    *Descriptor
+	expires time.Time
+}
+
+type introState struct {
+	failed      bool
+	timedOut    bool
+	unreachable int
+	created     time.Time
+}
+
+func (s *introState) usable() bool {
+	return !s.failed && !s.timedOut && s.unreachable < MAX_INTRO_UNREACHABLE
+}
+
+// DescCache holds fetched descriptors and intro point failures. It is
+// safe for concurrent use.
+type DescCache struct {
+	mu    sync.Mutex
+	descs map[descKey]*descEntry
+	intro map[[32]byte]map[[32]byte]*introState
+
+	// periodLen and rotation are in minutes; see PeriodStart.
+	periodLen int
+	rotation  int
+	now       func() time.Time
+}
+
+// NewDescCache returns an empty cache using the default time period.
+func NewDescCache() *DescCache {
+	return &DescCache{
+		descs:     make(map[descKey]*descEntry),
+		intro:     make(map[[32]byte]map[[32]byte]*introState),
+		periodLen: DefaultPeriodLengthMinutes,
+		rotation:  DefaultRotationOffsetMinutes,
+		now:       clock.Now,
+	}
+}
+
+// SetNow replaces the clock, for tests.
+func (c *DescCache) SetNow(fn func() time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = fn
+}
+
+// SetPeriodLength sets the time period length in minutes, usually
+// PeriodLength(consensus).
+func (c *DescCache) SetPeriodLength(periodLenMin int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.periodLen = periodLenMin
+}
+
+func keyOf(pk ed25519.PublicKey) (k [32]byte, ok bool) {
+	if len(pk) != ed25519.PublicKeySize {
+		return k, false
+	}
+	copy(k[:], pk)
+	return k, true
+}
+
+// Store caches d. A descriptor with a lower revision counter than the
+// cached one is refused with ErrDescRevision; an equal one replaces it,
+// as in tor.
+func (c *DescCache) Store(d *Descriptor) error {
+	bk, ok := keyOf(d.BlindedKey)
+	if !ok {
+		return errors.New("hs: descriptor without blinded key")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := descKey{bk, d.PeriodNum}
+	if old, ok := c.descs[k]; ok && old.desc.RevisionCounter > d.RevisionCounter {
+		return ErrDescRevision
+	}
+	lifetime := d.Lifetime
+	if lifetime <= 0 {
+		lifetime = DEFAULT_DESC_LIFETIME
+	}
+	c.descs[k] = &descEntry{desc: d, expires: c.now().Add(lifetime)}
+	return nil
+}
+
+// Lookup returns the cached descriptor for the blinded key and period, or
+// nil when there is none or it has expired.
+func (c *DescCache) Lookup(blinded ed25519.PublicKey, periodNum uint64) *Descriptor {
+	bk, ok := keyOf(blinded)
+	if !ok {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.live(descKey{bk, periodNum}, c.now())
+	if e == nil {
+		return nil
+	}
+	return e.desc
+}
+
+// live returns the entry at k, dropping it when it has expired.
+func (c *DescCache) live(k descKey, now time.Time) *descEntry {
+	e, ok := c.descs[k]
+	if !ok {
+		return nil
+	}
+	if c.expired(k, e, now) {
+		delete(c.descs, k)
+		return nil
+	}
+	return e
+}
+
+// expired reports whether e has outlived its lifetime or its time period.
+// A descriptor stays usable through the period after its own, which
+// covers the overlap in which services still publish for it.
+func (c *DescCache) expired(k descKey, e *descEntry, now time.Time) bool {
+	if !now.Before(e.expires) {
+		return true
+	}
+	end := PeriodStart(k.period+2, c.periodLen, c.rotation)
+	return now.Unix() >= end
+}
+
+// IntroPoints returns the usable intro points of the cached descriptor,
+// in descriptor order. ok is false when the descriptor must be fetched:
+// it is missing, expired, or every intro point has failed. In the last
+// case the descriptor and the failures of the service are dropped, so the
+// refetched descriptor starts clean.
+func (c *DescCache) IntroPoints(blinded ed25519.PublicKey, periodNum uint64) (ips []IntroPoint, ok bool) {
+	bk, valid := keyOf(blinded)
+	if !valid {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	k := descKey{bk, periodNum}
+	e := c.live(k, now)
+	if e == nil {
+		return nil, false
+	}
+	for _, ip := range e.desc.IntroPoints {
+		if c.introUsable(bk, ip.AuthKey, now) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		delete(c.descs, k)
+		delete(c.intro, bk)
+		return nil, false
+	}
+	return ips, true
+}
+
+func (c *DescCache) introUsable(bk [32]byte, auth ed25519.PublicKey, now time.Time) bool {
+	ak, ok := keyOf(auth)
+	if !ok {
+		return false
+	}
+	s := c.intro[bk][ak]
+	if s == nil {
+		return true
+	}
+	if now.Sub(s.created) >= INTRO_STATE_MAX_AGE {
+		delete(c.intro[bk], ak)
+		return true
+	}
+	return s.usable()
+}
+
+// NoteIntroFailure records a failure of the intro point with the given
+// auth key for the service with the blinded key.
+func (c *DescCache) NoteIntroFailure(blinded, authKey ed25519.PublicKey, kind IntroFailure) {
+	bk, ok1 := keyOf(blinded)
+	ak, ok2 := keyOf(authKey)
+	if !ok1 || !ok2 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	states := c.intro[bk]
+	if states == nil {
+		states = make(map[[32]byte]*introState)
+		c.intro[bk] = states
+	}
+	s := states[ak]
+	if s == nil || now.Sub(s.created) >= INTRO_STATE_MAX_AGE {
+		s = &introState{created: now}
+		states[ak] = s
+	}
+	switch kind {
+	case IntroFailureTimeout:
+		s.timedOut = true
+	case IntroFailureUnreachable:
+		s.unreachable++
+	default:
+		s.failed = true
+	}
+}
+
+// Clean drops expired descriptors and intro point failures.
+func (c *DescCache) Clean() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for k, e := range c.descs {
+		if c.expired(k, e, now) {
+			delete(c.descs, k)
+		}
+	}
+	for bk, states := range c.intro {
+		for ak, s := range states {
+			if now.Sub(s.created) >= INTRO_STATE_MAX_AGE {
+				delete(states, ak)
+			}
+		}
+		if len(states) == 0 {
+			delete(c.intro, bk)
+		}
+	}
+}
+
+// Purge empties the cache, e.g. on a new identity.
+func (c *DescCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.descs)
+	clear(c.intro)
+}
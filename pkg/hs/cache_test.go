@@ -0,0 +1,107 @@
+package hs
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testKey(b byte) ed25519.PublicKey {
+	k := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	k[0] = b
+	return k
+}
+
+func testCache(now *time.Time) *DescCache {
+	c := NewDescCache()
+	c.SetNow(func() time.Time { return *now })
+	return c
+}
+
+func TestDescCache_Revision(t *testing.T) {
+	now := time.Unix(1460546101, 0)
+	c := testCache(&now)
+	period := PeriodNum(now.Unix(), DefaultPeriodLengthMinutes, DefaultRotationOffsetMinutes)
+	bk := testKey(1)
+
+	if err := c.Store(&Descriptor{BlindedKey: bk, PeriodNum: period, RevisionCounter: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store(&Descriptor{BlindedKey: bk, PeriodNum: period, RevisionCounter: 4}); !errors.Is(err, ErrDescRevision) {
+		t.Fatalf("older revision: %v", err)
+	}
+	if err := c.Store(&Descriptor{BlindedKey: bk, PeriodNum: period, RevisionCounter: 6}); err != nil {
+		t.Fatal(err)
+	}
+	if d := c.Lookup(bk, period); d == nil || d.RevisionCounter != 6 {
+		t.Fatalf("lookup: %+v", d)
+	}
+	if c.Lookup(bk, period+1) != nil {
+		t.Fatal("descriptor found under another period")
+	}
+
+	now = now.Add(DEFAULT_DESC_LIFETIME)
+	if c.Lookup(bk, period) != nil {
+		t.Fatal("expired descriptor returned")
+	}
+}
+
+func TestDescCache_PeriodExpiry(t *testing.T) {
+	now := time.Unix(1460546101, 0)
+	c := testCache(&now)
+	period := PeriodNum(now.Unix(), DefaultPeriodLengthMinutes, DefaultRotationOffsetMinutes)
+	bk := testKey(1)
+	c.Store(&Descriptor{BlindedKey: bk, PeriodNum: period - 1, Lifetime: 72 * time.Hour})
+	c.Store(&Descriptor{BlindedKey: bk, PeriodNum: period, Lifetime: 72 * time.Hour})
+
+	now = time.Unix(PeriodStart(period+1, DefaultPeriodLengthMinutes, DefaultRotationOffsetMinutes), 0)
+	c.Clean()
+	if c.Lookup(bk, period-1) != nil {
+		t.Fatal("descriptor kept two periods on")
+	}
+	if c.Lookup(bk, period) == nil {
+		t.Fatal("descriptor dropped in the overlap period")
+	}
+}
+
+func TestDescCache_IntroFailures(t *testing.T) {
+	now := time.Unix(1460546101, 0)
+	c := testCache(&now)
+	period := PeriodNum(now.Unix(), DefaultPeriodLengthMinutes, DefaultRotationOffsetMinutes)
+	bk := testKey(1)
+	a, b := testKey(2), testKey(3)
+	c.Store(&Descriptor{BlindedKey: bk, PeriodNum: period, IntroPoints: []IntroPoint{{AuthKey: a}, {AuthKey: b}}})
+
+	c.NoteIntroFailure(bk, a, IntroFailureGeneric)
+	ips, ok := c.IntroPoints(bk, period)
+	if !ok || len(ips) != 1 || !ips[0].AuthKey.Equal(b) {
+		t.Fatalf("failed intro point not skipped: %v %v", ips, ok)
+	}
+
+	for range MAX_INTRO_UNREACHABLE - 1 {
+		c.NoteIntroFailure(bk, b, IntroFailureUnreachable)
+	}
+	if _, ok := c.IntroPoints(bk, period); !ok {
+		t.Fatal("intro point skipped below the unreachable limit")
+	}
+
+	now = now.Add(INTRO_STATE_MAX_AGE)
+	if ips, _ := c.IntroPoints(bk, period); len(ips) != 2 {
+		t.Fatalf("failures not forgotten: %d usable", len(ips))
+	}
+
+	c.NoteIntroFailure(bk, a, IntroFailureTimeout)
+	c.NoteIntroFailure(bk, b, IntroFailureGeneric)
+	if _, ok := c.IntroPoints(bk, period); ok {
+		t.Fatal("all intro points failed but no refetch asked")
+	}
+	if c.Lookup(bk, period) != nil {
+		t.Fatal("descriptor kept after all intro points failed")
+	}
+
+	c.Store(&Descriptor{BlindedKey: bk, PeriodNum: period, IntroPoints: []IntroPoint{{AuthKey: a}}})
+	if _, ok := c.IntroPoints(bk, period); !ok {
+		t.Fatal("refetched descriptor inherited old failures")
+	}
+}
@@ -3,6 +3,8 @@ package hs
 import (
 	"encoding/binary"
 
+	"github.com/robogg133/gonion/pkg/common"
+
 	"golang.org/x/crypto/sha3"
 )
 
@@ -18,8 +20,14 @@ import (
 // INT_8 fields are big-endian uint64 (tor htonll). Note the service index comes
 // replica || period_len || period_num, but the relay index is period_num first.
 
-// ReplicaCount is the consensus default for hsdir_n_replicas.
-const ReplicaCount = 2
+// DefaultReplicaCount is the consensus default for hsdir_n_replicas.
+const DefaultReplicaCount = 2
+
+// ReplicaCount is hsdir_n_replicas in cns, or DefaultReplicaCount when cns
+// is nil or does not set it.
+func ReplicaCount(cns *common.Consensus) int {
+	return int(cns.NetParams().HSDirReplicas)
+}
 
 // ServiceIndex returns the hash-ring position where the descriptor for the
 // given blinded key + replica is stored during the given period.
@@ -113,8 +113,13 @@ func BlindSecretKey(seed []byte, secret []byte, periodNum uint64, periodLenMin i
 		return nil, errors.New("hs: ed25519 seed must be 32 bytes")
 	}
 	priv := ed25519.NewKeyFromSeed(seed)
-	pub := ed25519.PublicKey(priv[pub25519Len:])
+	expanded := sha512.Sum512(seed)
+	return blindExpanded(expanded[:], ed25519.PublicKey(priv[pub25519Len:]), secret, periodNum, periodLenMin)
+}
 
+// blindExpanded is BlindSecretKey for an expanded secret key (scalar || RH)
+// whose public key is pub, as tor stores identity keys.
+func blindExpanded(expanded []byte, pub ed25519.PublicKey, secret []byte, periodNum uint64, periodLenMin int) ([]byte, error) {
 	param, err := BlindingParameter(pub, secret, periodNum, periodLenMin)
 	if err != nil {
 		return nil, err
@@ -124,7 +129,6 @@ func BlindSecretKey(seed []byte, secret []byte, periodNum uint64, periodLenMin i
 		return nil, err
 	}
 
-	expanded := sha512.Sum512(seed)
 	var scalarBytes [pub25519Len]byte
 	copy(scalarBytes[:], expanded[:pub25519Len])
 	scalar, err := blindedScalar(scalarBytes)
@@ -141,7 +145,7 @@ func BlindSecretKey(seed []byte, secret []byte, periodNum uint64, periodLenMin i
 	out = append(out, ab[:pub25519Len]...)
 
 	// RH' = SHA512-256 of (blindHashInput || RH)
-	rh := sha512.Sum512(append([]byte(blindHashInput), expanded[pub25519Len:]...))
+	rh := sha512.Sum512(append([]byte(blindHashInput), expanded[pub25519Len:expandedSecretKeyLen]...))
 	out = append(out, rh[:pub25519Len]...)
 	return out, nil
 }
@@ -0,0 +1,370 @@
+package hs
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/edwards25519"
+	"github.com/robogg133/gonion/pkg/crypto"
+)
+
+// Onion service key files, in the layout tor uses for HiddenServiceDir:
+//
+//	hs_ed25519_secret_key  "== ed25519v1-secret: type0 ==" NUL-padded to
+//	                       32 bytes || expanded secret key (64)
+//	hs_ed25519_public_key  "== ed25519v1-public: type0 ==" NUL-padded to
+//	                       32 bytes || public key (32)
+//	hostname               the .onion address and a newline
+//
+// An offline service keeps only the public key and hostname; the secret
+// key stays on another machine, which certifies a descriptor signing key
+// for each upcoming time period (rend-spec §OFFLINE-KEYS). Those are
+// stored next to it as desc_signing_key_<period>.
+const (
+	SECRET_KEY_FILE         = "hs_ed25519_secret_key"
+	PUBLIC_KEY_FILE         = "hs_ed25519_public_key"
+	HOSTNAME_FILE           = "hostname"
+	DESC_SIGNING_KEY_PREFIX = "desc_signing_key_"
+
+	secretKeyTag = "== ed25519v1-secret: type0 =="
+	publicKeyTag = "== ed25519v1-public: type0 =="
+	keyTagLen    = 32
+)
+
+// DESC_SIGNING_CERT_LIFETIME is how long a descriptor signing certificate
+// outlives the start of its time period: the period itself and the
+// overlap after it.
+const DESC_SIGNING_CERT_LIFETIME = 54 * time.Hour
+
+var errOffline = errors.New("hs: identity secret key is offline")
+
+// IdentityKey is an onion service identity key (KP_hs_id). Its secret part
+// is kept expanded, as tor stores it; it is nil for an offline key.
+type IdentityKey struct {
+	Public   ed25519.PublicKey
+	expanded []byte
+}
+
+// GenerateIdentityKey returns a new identity key read from rand.
+func GenerateIdentityKey(rand io.Reader) (*IdentityKey, error) {
+	var seed [ed25519.SeedSize]byte
+	if _, err := io.ReadFull(rand, seed[:]); err != nil {
+		return nil, err
+	}
+	return IdentityKeyFromSeed(seed[:])
+}
+
+// IdentityKeyFromSeed returns the identity key of a 32-byte ed25519 seed.
+func IdentityKeyFromSeed(seed []byte) (*IdentityKey, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("hs: ed25519 seed must be 32 bytes")
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	h := sha512.Sum512(seed)
+	h[0] &= 248
+	h[31] &= 63
+	h[31] |= 64
+	return &IdentityKey{
+		Public:   ed25519.PublicKey(priv[pub25519Len:]),
+		expanded: h[:],
+	}, nil
+}
+
+// IdentityKeyFromExpanded returns the identity key of a 64-byte expanded
+// secret key, checking that it matches pub when pub is not nil.
+func IdentityKeyFromExpanded(expanded []byte, pub ed25519.PublicKey) (*IdentityKey, error) {
+	if len(expanded) != expandedSecretKeyLen {
+		return nil, errors.New("hs: expanded secret key must be 64 bytes")
+	}
+	a, err := expandedScalar(expanded)
+	if err != nil {
+		return nil, err
+	}
+	derived := ed25519.PublicKey(new(edwards25519.Point).ScalarBaseMult(a).Bytes())
+	if pub != nil && !pub.Equal(derived) {
+		return nil, errors.New("hs: secret key does not match public key")
+	}
+	return &IdentityKey{Public: derived, expanded: bytes.Clone(expanded)}, nil
+}
+
+// Addr returns the onion address of k.
+func (k *IdentityKey) Addr() OnionAddr {
+	return OnionAddr{PublicKey: k.Public}
+}
+
+// Offline reports whether k has no secret key.
+func (k *IdentityKey) Offline() bool {
+	return k.expanded == nil
+}
+
+// PublicOnly returns k without its secret key, as it is kept on an
+// offline service.
+func (k *IdentityKey) PublicOnly() *IdentityKey {
+	return &IdentityKey{Public: k.Public}
+}
+
+// BlindedSecretKey returns the expanded blinded secret key for a period.
+func (k *IdentityKey) BlindedSecretKey(periodNum uint64, periodLenMin int) ([]byte, error) {
+	if k.Offline() {
+		return nil, errOffline
+	}
+	return blindExpanded(k.expanded, k.Public, nil, periodNum, periodLenMin)
+}
+
+// Sign signs msg with the identity key.
+func (k *IdentityKey) Sign(msg []byte) ([]byte, error) {
+	if k.Offline() {
+		return nil, errOffline
+	}
+	return signExpanded(k.expanded, k.Public, msg)
+}
+
+// DescSigningKey is a descriptor signing key (KP_hs_desc_sign) with its
+// certificate from the blinded key of PeriodNum.
+type DescSigningKey struct {
+	PeriodNum uint64
+	Key       ed25519.PrivateKey
+	// Cert is the CERTTYPE_HS_DESC_SIGNING certificate of Key, signed by
+	// the blinded key, as it goes in the descriptor.
+	Cert []byte
+}
+
+// CertifyDescSigningKeys creates and certifies a descriptor signing key
+// for each of the n periods from periodNum on. Run it where the identity
+// secret key lives and ship the result to the offline service.
+func (k *IdentityKey) CertifyDescSigningKeys(rand io.Reader, periodNum uint64, n, periodLenMin int) ([]*DescSigningKey, error) {
+	if k.Offline() {
+		return nil, errOffline
+	}
+	out := make([]*DescSigningKey, 0, n)
+	for p := periodNum; p < periodNum+uint64(n); p++ {
+		blinded, err := k.BlindedSecretKey(p, periodLenMin)
+		if err != nil {
+			return nil, err
+		}
+		blindedPub, err := BlindedPublicKey(k.Public, nil, p, periodLenMin)
+		if err != nil {
+			return nil, err
+		}
+		_, key, err := ed25519.GenerateKey(rand)
+		if err != nil {
+			return nil, err
+		}
+		start := time.Unix(PeriodStart(p, periodLenMin, DefaultRotationOffsetMinutes), 0)
+		cert, err := descSigningCert(key.Public().(ed25519.PublicKey), blinded, blindedPub, start.Add(DESC_SIGNING_CERT_LIFETIME))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &DescSigningKey{PeriodNum: p, Key: key, Cert: cert})
+	}
+	return out, nil
+}
+
+// descSigningCert builds the cert-spec §2.1 certificate of key, signed by
+// the blinded key and expiring at exp.
+func descSigningCert(key ed25519.PublicKey, blinded []byte, blindedPub ed25519.PublicKey, exp time.Time) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte(1)
+	b.WriteByte(crypto.CERTTYPE_HS_DESC_SIGNING)
+	binary.Write(&b, binary.BigEndian, uint32(exp.Unix()/3600))
+	b.WriteByte(crypto.CERT_KEY_TYPE_ED25519)
+	b.Write(key)
+	b.WriteByte(1) // N_EXTENSIONS
+	binary.Write(&b, binary.BigEndian, uint16(pub25519Len))
+	b.WriteByte(crypto.CERT_EXT_SIGNED_WITH_ED25519)
+	b.WriteByte(0)
+	b.Write(blindedPub)
+	sig, err := signExpanded(blinded, blindedPub, b.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	b.Write(sig)
+	return b.Bytes(), nil
+}
+
+// VerifyDescSigningCert checks that cert certifies a descriptor signing
+// key with the blinded key of identity for the period, and returns that
+// key.
+func VerifyDescSigningCert(cert []byte, identity ed25519.PublicKey, periodNum uint64, periodLenMin int, now time.Time) (ed25519.PublicKey, error) {
+	c, err := crypto.ParseIdentityVSigningCert(cert)
+	if err != nil {
+		return nil, fmt.Errorf("hs: descriptor signing cert: %w", err)
+	}
+	if c.CertType != crypto.CERTTYPE_HS_DESC_SIGNING || c.CertKeyType != crypto.CERT_KEY_TYPE_ED25519 {
+		return nil, fmt.Errorf("hs: descriptor signing cert: wrong type %d", c.CertType)
+	}
+	if time.Unix(int64(c.ExpirationDate)*3600, 0).Before(now) {
+		return nil, errors.New("hs: descriptor signing cert: expired")
+	}
+	blinded, err := BlindedPublicKey(identity, nil, periodNum, periodLenMin)
+	if err != nil {
+		return nil, err
+	}
+	if !blinded.Equal(ed25519.PublicKey(c.SigningKey())) {
+		return nil, errors.New("hs: descriptor signing cert: not signed by the blinded key")
+	}
+	if !ed25519.Verify(blinded, cert[:len(cert)-ed25519.SignatureSize], c.Signature) {
+		return nil, errors.New("hs: descriptor signing cert: bad signature")
+	}
+	return ed25519.PublicKey(bytes.Clone(c.CertifiedKey)), nil
+}
+
+// expandedScalar returns the secret scalar of an expanded key, reduced
+// mod l; tor keeps it clamped, blinded keys keep it reduced.
+func expandedScalar(expanded []byte) (*edwards25519.Scalar, error) {
+	var wide [64]byte
+	copy(wide[:], expanded[:pub25519Len])
+	return new(edwards25519.Scalar).SetUniformBytes(wide[:])
+}
+
+// signExpanded is ed25519 signing with an expanded secret key, which the
+// standard library cannot do: blinded keys have no seed.
+func signExpanded(expanded []byte, pub ed25519.PublicKey, msg []byte) ([]byte, error) {
+	if len(expanded) != expandedSecretKeyLen {
+		return nil, errors.New("hs: expanded secret key must be 64 bytes")
+	}
+	a, err := expandedScalar(expanded)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha512.New()
+	h.Write(expanded[pub25519Len:])
+	h.Write(msg)
+	r, err := new(edwards25519.Scalar).SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	R := new(edwards25519.Point).ScalarBaseMult(r).Bytes()
+
+	h.Reset()
+	h.Write(R)
+	h.Write(pub)
+	h.Write(msg)
+	k, err := new(edwards25519.Scalar).SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	S := new(edwards25519.Scalar).MultiplyAdd(k, a, r)
+	return append(R, S.Bytes()...), nil
+}
+
+// SaveIdentityKey writes k into dir, creating it with mode 0700. The
+// secret key file is only written when k has one.
+func SaveIdentityKey(dir string, k *IdentityKey) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	if !k.Offline() {
+		if err := writeKeyFile(filepath.Join(dir, SECRET_KEY_FILE), secretKeyTag, k.expanded); err != nil {
+			return err
+		}
+	}
+	if err := writeKeyFile(filepath.Join(dir, PUBLIC_KEY_FILE), publicKeyTag, k.Public); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, HOSTNAME_FILE), []byte(k.Addr().String()+"\n"))
+}
+
+// LoadIdentityKey reads the identity key in dir. Without a secret key file
+// it returns the offline public key.
+func LoadIdentityKey(dir string) (*IdentityKey, error) {
+	pub, err := readKeyFile(filepath.Join(dir, PUBLIC_KEY_FILE), publicKeyTag, pub25519Len)
+	if err != nil {
+		return nil, err
+	}
+	expanded, err := readKeyFile(filepath.Join(dir, SECRET_KEY_FILE), secretKeyTag, expandedSecretKeyLen)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if hasTorsion(pub) {
+			return nil, fmt.Errorf("hs: %s: %w", PUBLIC_KEY_FILE, errTorsion)
+		}
+		return &IdentityKey{Public: ed25519.PublicKey(pub)}, nil
+	case err != nil:
+		return nil, err
+	}
+	return IdentityKeyFromExpanded(expanded, pub)
+}
+
+// SaveDescSigningKeys writes each key into dir as
+// desc_signing_key_<period>: the 32-byte seed followed by the certificate.
+func SaveDescSigningKeys(dir string, keys []*DescSigningKey) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		b := append(bytes.Clone(k.Key.Seed()), k.Cert...)
+		name := DESC_SIGNING_KEY_PREFIX + strconv.FormatUint(k.PeriodNum, 10)
+		if err := writeFileAtomic(filepath.Join(dir, name), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadDescSigningKey reads the descriptor signing key of a period from dir
+// and checks its certificate against identity.
+func LoadDescSigningKey(dir string, identity ed25519.PublicKey, periodNum uint64, periodLenMin int, now time.Time) (*DescSigningKey, error) {
+	name := DESC_SIGNING_KEY_PREFIX + strconv.FormatUint(periodNum, 10)
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) <= ed25519.SeedSize {
+		return nil, fmt.Errorf("hs: %s: truncated", name)
+	}
+	key := ed25519.NewKeyFromSeed(b[:ed25519.SeedSize])
+	cert := b[ed25519.SeedSize:]
+	certified, err := VerifyDescSigningCert(cert, identity, periodNum, periodLenMin, now)
+	if err != nil {
+		return nil, fmt.Errorf("hs: %s: %w", name, err)
+	}
+	if !certified.Equal(key.Public()) {
+		return nil, fmt.Errorf("hs: %s: certificate is for another key", name)
+	}
+	return &DescSigningKey{PeriodNum: periodNum, Key: key, Cert: cert}, nil
+}
+
+func writeKeyFile(name, tag string, key []byte) error {
+	b := make([]byte, keyTagLen, keyTagLen+len(key))
+	copy(b, tag)
+	return writeFileAtomic(name, append(b, key...))
+}
+
+func readKeyFile(name, tag string, n int) ([]byte, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != keyTagLen+n || strings.TrimRight(string(b[:keyTagLen]), "\x00") != tag {
+		return nil, fmt.Errorf("hs: %s: not a %q key file", filepath.Base(name), tag)
+	}
+	return b[keyTagLen:], nil
+}
+
+// writeFileAtomic replaces name with b, readable by the owner only.
+func writeFileAtomic(name string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
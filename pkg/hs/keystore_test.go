@@ -0,0 +1,142 @@
+package hs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdentityKey_SignMatchesStdlib(t *testing.T) {
+	seed := bytes.Repeat([]byte{7}, ed25519.SeedSize)
+	k, err := IdentityKeyFromSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("onion service")
+	sig, err := k.Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sig, ed25519.Sign(ed25519.NewKeyFromSeed(seed), msg)) {
+		t.Fatal("expanded signature differs from crypto/ed25519")
+	}
+
+	blinded, err := k.BlindedSecretKey(16903, DefaultPeriodLengthMinutes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := BlindSecretKey(seed, nil, 16903, DefaultPeriodLengthMinutes)
+	if err != nil || !bytes.Equal(blinded, want) {
+		t.Fatalf("blinded key differs from BlindSecretKey: %v", err)
+	}
+}
+
+func TestIdentityKey_SaveLoad(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "hs")
+	k, err := GenerateIdentityKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveIdentityKey(dir, k); err != nil {
+		t.Fatal(err)
+	}
+	host, err := os.ReadFile(filepath.Join(dir, HOSTNAME_FILE))
+	if err != nil || strings.TrimSpace(string(host)) != k.Addr().String() {
+		t.Fatalf("hostname %q: %v", host, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, SECRET_KEY_FILE)); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("secret key file: %v %v", fi, err)
+	}
+
+	got, err := LoadIdentityKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Offline() || !got.Public.Equal(k.Public) || !bytes.Equal(got.expanded, k.expanded) {
+		t.Fatal("loaded key differs")
+	}
+
+	os.Remove(filepath.Join(dir, SECRET_KEY_FILE))
+	got, err = LoadIdentityKey(dir)
+	if err != nil || !got.Offline() || !got.Public.Equal(k.Public) {
+		t.Fatalf("offline load: %v", err)
+	}
+	if _, err := got.Sign(nil); err == nil {
+		t.Fatal("offline key signed")
+	}
+}
+
+func TestDescSigningKeys_Offline(t *testing.T) {
+	k, err := GenerateIdentityKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1460546101, 0)
+	period := PeriodNum(now.Unix(), DefaultPeriodLengthMinutes, DefaultRotationOffsetMinutes)
+	keys, err := k.CertifyDescSigningKeys(rand.Reader, period, 3, DefaultPeriodLengthMinutes)
+	if err != nil || len(keys) != 3 {
+		t.Fatalf("certify: %d keys, %v", len(keys), err)
+	}
+
+	// Only the public key and the signing keys reach the service.
+	dir := t.TempDir()
+	if err := SaveIdentityKey(dir, k.PublicOnly()); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveDescSigningKeys(dir, keys); err != nil {
+		t.Fatal(err)
+	}
+	id, err := LoadIdentityKey(dir)
+	if err != nil || !id.Offline() {
+		t.Fatalf("offline identity: %v", err)
+	}
+	for i, want := range keys {
+		got, err := LoadDescSigningKey(dir, id.Public, want.PeriodNum, DefaultPeriodLengthMinutes, now)
+		if err != nil {
+			t.Fatalf("key %d: %v", i, err)
+		}
+		if !got.Key.Equal(want.Key) {
+			t.Fatalf("key %d differs", i)
+		}
+	}
+
+	// The certificate binds the period's blinded key.
+	if _, err := VerifyDescSigningCert(keys[0].Cert, k.Public, period+1, DefaultPeriodLengthMinutes, now); err == nil {
+		t.Fatal("cert accepted for another period")
+	}
+	other, _ := GenerateIdentityKey(rand.Reader)
+	if _, err := VerifyDescSigningCert(keys[0].Cert, other.Public, period, DefaultPeriodLengthMinutes, now); err == nil {
+		t.Fatal("cert accepted for another identity")
+	}
+	if _, err := VerifyDescSigningCert(keys[0].Cert, k.Public, period, DefaultPeriodLengthMinutes, now.Add(7*24*time.Hour)); err == nil {
+		t.Fatal("expired cert accepted")
+	}
+}
+
+func TestVanitySearch(t *testing.T) {
+	k, err := VanitySearch(context.Background(), "ab", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(k.Addr().String(), "ab") {
+		t.Fatalf("got %s", k.Addr())
+	}
+	if _, err := ParseOnionAddr(k.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := VanitySearch(context.Background(), "ab1", 1); err == nil {
+		t.Fatal("non-base32 prefix accepted")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := VanitySearch(ctx, strings.Repeat("a", 20), 1); err != context.Canceled {
+		t.Fatalf("cancelled search: %v", err)
+	}
+}
@@ -1,5 +1,10 @@
 package hs
 
+import (
+	"github.com/robogg133/gonion/pkg/clock"
+	"github.com/robogg133/gonion/pkg/common"
+)
+
 // Time-period math, rend-spec §TIME-PERIODS.
 //
 //	minutes_since_epoch = unix / 60
@@ -15,6 +20,12 @@ const DefaultRotationOffsetMinutes = 12 * 60
 // DefaultPeriodLengthMinutes is the consensus default for hsdir-interval.
 const DefaultPeriodLengthMinutes = 24 * 60
 
+// PeriodLength is hsdir-interval in cns, in minutes, or
+// DefaultPeriodLengthMinutes when cns is nil or does not set it.
+func PeriodLength(cns *common.Consensus) int {
+	return int(cns.NetParams().HSDirInterval)
+}
+
 // PeriodNum returns the hidden-service time-period number for the given unix
 // time, period length (minutes) and rotation offset (minutes).
 func PeriodNum(now int64, periodLenMin, rotationOffsetMin int) uint64 {
@@ -32,6 +43,13 @@ func PeriodNum(now int64, periodLenMin, rotationOffsetMin int) uint64 {
 	return uint64(minutes / int64(periodLenMin))
 }
 
+// CurrentPeriodNum is PeriodNum at network time, i.e. the local clock
+// corrected by clock.Default. A client whose clock is off by more than the
+// rotation margin would otherwise compute the wrong blinded keys and HSDirs.
+func CurrentPeriodNum(periodLenMin, rotationOffsetMin int) uint64 {
+	return PeriodNum(clock.Now().Unix(), periodLenMin, rotationOffsetMin)
+}
+
 // PeriodStart returns the unix time (seconds) at which the given period began.
 func PeriodStart(periodNum uint64, periodLenMin, rotationOffsetMin int) int64 {
 	if periodLenMin <= 0 {
@@ -1,6 +1,10 @@
 package hs
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/robogg133/gonion/pkg/common"
+)
 
 // rend-spec §TIME-PERIODS worked example:
 //
@@ -29,3 +33,13 @@ func TestPeriodDefaults(t *testing.T) {
 		t.Fatal("period too large")
 	}
 }
+
+func TestPeriodLengthAndReplicas(t *testing.T) {
+	if PeriodLength(nil) != DefaultPeriodLengthMinutes || ReplicaCount(nil) != DefaultReplicaCount {
+		t.Fatal("nil consensus should give the defaults")
+	}
+	cns := &common.Consensus{Params: map[string]int32{"hsdir-interval": 120, "hsdir_n_replicas": 4}}
+	if PeriodLength(cns) != 120 || ReplicaCount(cns) != 4 {
+		t.Fatal("consensus values ignored")
+	}
+}
@@ -0,0 +1,97 @@
+package hs
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// MAX_VANITY_PREFIX is the longest prefix VanitySearch accepts: the
+// characters fully determined by the public key. Each character costs a
+// factor of 32, so anything past about 8 is out of reach anyway.
+const MAX_VANITY_PREFIX = pub25519Len * 8 / 5
+
+var errVanityPrefix = errors.New("hs: vanity prefix must be base32 (a-z, 2-7)")
+
+// vanityCheckEvery is how many keys a worker tries between context checks.
+const vanityCheckEvery = 4096
+
+// VanitySearch generates identity keys on workers goroutines until one has
+// an onion address starting with prefix, and returns it. workers <= 0
+// means one per CPU. It stops with ctx.Err() when ctx is done first.
+func VanitySearch(ctx context.Context, prefix string, workers int) (*IdentityKey, error) {
+	prefix = strings.ToLower(strings.TrimSuffix(prefix, hsSuffix))
+	if len(prefix) > MAX_VANITY_PREFIX {
+		return nil, errVanityPrefix
+	}
+	for _, r := range prefix {
+		if (r < 'a' || r > 'z') && (r < '2' || r > '7') {
+			return nil, errVanityPrefix
+		}
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	found := make(chan *IdentityKey, 1)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if k := vanityWorker(ctx, prefix); k != nil {
+				select {
+				case found <- k:
+				default:
+				}
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case k := <-found:
+		return k, nil
+	default:
+		return nil, ctx.Err()
+	}
+}
+
+// vanityWorker tries random seeds until one matches or ctx is done. Only
+// the leading bytes of each public key are encoded.
+func vanityWorker(ctx context.Context, prefix string) *IdentityKey {
+	n := (len(prefix)*5 + 7) / 8
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	want := []byte(strings.ToUpper(prefix))
+	buf := make([]byte, enc.EncodedLen(n))
+	var seed [ed25519.SeedSize]byte
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		for range vanityCheckEvery {
+			rand.Read(seed[:])
+			pub := ed25519.NewKeyFromSeed(seed[:])[ed25519.SeedSize:]
+			enc.Encode(buf, pub[:n])
+			if string(buf[:len(want)]) != string(want) {
+				continue
+			}
+			k, err := IdentityKeyFromSeed(seed[:])
+			if err != nil {
+				continue
+			}
+			return k
+		}
+	}
+}
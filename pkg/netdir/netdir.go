@@ -0,0 +1,180 @@
+// Package netdir holds a client's view of the network: the current
+// consensus, indexed for lookups, replaced whole on every refresh.
+//
+// A Snapshot is never modified once published, so readers can keep using
+// one without locks while a refresh swaps in the next.
+package netdir
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/robogg133/gonion/pkg/common"
+	"github.com/robogg133/gonion/pkg/geoip"
+)
+
+// Snapshot is an immutable, indexed consensus.
+type Snapshot struct {
+	cns *common.Consensus
+
+	byID   map[[20]byte]int
+	byEd   map[string]int
+	byNick map[string][]int
+}
+
+// NewSnapshot indexes cns. cns must not be modified afterwards.
+func NewSnapshot(cns *common.Consensus) *Snapshot {
+	s := &Snapshot{
+		cns:    cns,
+		byID:   make(map[[20]byte]int, len(cns.RelayInformation)),
+		byEd:   make(map[string]int, len(cns.RelayInformation)),
+		byNick: make(map[string][]int),
+	}
+	for i := range cns.RelayInformation {
+		rs := &cns.RelayInformation[i]
+		s.byID[rs.NodeID] = i
+		if len(rs.IdEd25519) > 0 {
+			s.byEd[string(rs.IdEd25519)] = i
+		}
+		s.byNick[rs.Nickname] = append(s.byNick[rs.Nickname], i)
+	}
+	return s
+}
+
+// Consensus returns the snapshot's consensus. It is shared: callers must
+// not modify it.
+func (s *Snapshot) Consensus() *common.Consensus { return s.cns }
+
+// Relays returns every relay. The slice is shared: callers must not
+// modify it.
+func (s *Snapshot) Relays() []common.RouterStatus { return s.cns.RelayInformation }
+
+// ByNodeID looks a relay up by RSA identity.
+func (s *Snapshot) ByNodeID(id [20]byte) (*common.RouterStatus, bool) {
+	i, ok := s.byID[id]
+	if !ok {
+		return nil, false
+	}
+	return &s.cns.RelayInformation[i], true
+}
+
+// ByEd25519 looks a relay up by ed25519 identity, known once its
+// microdescriptor is.
+func (s *Snapshot) ByEd25519(id []byte) (*common.RouterStatus, bool) {
+	i, ok := s.byEd[string(id)]
+	if !ok {
+		return nil, false
+	}
+	return &s.cns.RelayInformation[i], true
+}
+
+// ByNickname returns every relay using name. Nicknames are not unique and
+// not authenticated; prefer identities.
+func (s *Snapshot) ByNickname(name string) []*common.RouterStatus {
+	idx := s.byNick[name]
+	out := make([]*common.RouterStatus, len(idx))
+	for j, i := range idx {
+		out[j] = &s.cns.RelayInformation[i]
+	}
+	return out
+}
+
+// NetDir is one client's network directory. Separate clients in one
+// process use separate NetDirs.
+type NetDir struct {
+	cur   atomic.Pointer[Snapshot]
+	geoip atomic.Pointer[geoip.DB]
+
+	mu     sync.Mutex
+	subs   map[int]chan *Snapshot
+	nextID int
+	ready  chan struct{}
+}
+
+// Default is the directory used when a caller does not pass one.
+var Default = New()
+
+func New() *NetDir {
+	return &NetDir{
+		subs:  make(map[int]chan *Snapshot),
+		ready: make(chan struct{}),
+	}
+}
+
+// UseGeoIP annotates every consensus set from now on with db. The
+// current snapshot is left as it is.
+func (d *NetDir) UseGeoIP(db *geoip.DB) { d.geoip.Store(db) }
+
+// GeoIP returns the database set with UseGeoIP, or nil.
+func (d *NetDir) GeoIP() *geoip.DB { return d.geoip.Load() }
+
+// Set publishes cns as the current consensus and notifies subscribers,
+// after resolving relay families and annotating it with the GeoIP
+// database if one is set. cns must not be modified afterwards.
+func (d *NetDir) Set(cns *common.Consensus) *Snapshot {
+	cns.ResolveFamilies()
+	if db := d.geoip.Load(); db != nil {
+		db.Annotate(cns)
+	}
+	s := NewSnapshot(cns)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	first := d.cur.Swap(s) == nil
+	if first {
+		close(d.ready)
+	}
+	for _, ch := range d.subs {
+		// Drop a notification the subscriber has not read yet: only the
+		// newest snapshot matters.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- s
+	}
+	return s
+}
+
+// Current returns the current snapshot, nil before the first Set.
+func (d *NetDir) Current() *Snapshot { return d.cur.Load() }
+
+// Consensus returns the current consensus, nil before the first Set.
+func (d *NetDir) Consensus() *common.Consensus {
+	if s := d.cur.Load(); s != nil {
+		return s.cns
+	}
+	return nil
+}
+
+// Wait returns the current snapshot, waiting for the first one if needed.
+func (d *NetDir) Wait(ctx context.Context) (*Snapshot, error) {
+	select {
+	case <-d.ready:
+		return d.cur.Load(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Subscribe returns a channel receiving each new snapshot. A slow reader
+// only sees the newest one. cancel stops the notifications.
+func (d *NetDir) Subscribe() (updates <-chan *Snapshot, cancel func()) {
+	ch := make(chan *Snapshot, 1)
+
+	d.mu.Lock()
+	id := d.nextID
+	d.nextID++
+	d.subs[id] = ch
+	d.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			d.mu.Lock()
+			delete(d.subs, id)
+			d.mu.Unlock()
+		})
+	}
+}
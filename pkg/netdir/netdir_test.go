@@ -0,0 +1,102 @@
+package netdir_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robogg133/gonion/pkg/common"
+	"github.com/robogg133/gonion/pkg/netdir"
+)
+
+func testConsensus(nicks ...string) *common.Consensus {
+	cns := &common.Consensus{}
+	for i, n := range nicks {
+		cns.RelayInformation = append(cns.RelayInformation, common.RouterStatus{
+			Nickname:  n,
+			NodeID:    [20]byte{byte(i + 1)},
+			IdEd25519: []byte{byte(i + 1), 0xed},
+		})
+	}
+	return cns
+}
+
+func TestSnapshot_Lookups(t *testing.T) {
+	s := netdir.NewSnapshot(testConsensus("a", "b", "a"))
+
+	if rs, ok := s.ByNodeID([20]byte{2}); !ok || rs.Nickname != "b" {
+		t.Fatalf("ByNodeID: %v %v", rs, ok)
+	}
+	if rs, ok := s.ByEd25519([]byte{3, 0xed}); !ok || rs.NodeID != [20]byte{3} {
+		t.Fatalf("ByEd25519: %v %v", rs, ok)
+	}
+	if got := s.ByNickname("a"); len(got) != 2 {
+		t.Fatalf("ByNickname: %d relays", len(got))
+	}
+	if _, ok := s.ByNodeID([20]byte{9}); ok {
+		t.Fatal("unknown id found")
+	}
+}
+
+func TestNetDir_SetAndSubscribe(t *testing.T) {
+	d := netdir.New()
+	if d.Current() != nil || d.Consensus() != nil {
+		t.Fatal("empty directory has a consensus")
+	}
+
+	updates, cancel := d.Subscribe()
+	defer cancel()
+
+	first := testConsensus("a")
+	d.Set(first)
+	second := testConsensus("b")
+	d.Set(second)
+
+	// Only the newest snapshot is kept for a slow subscriber.
+	if s := <-updates; s.Consensus() != second {
+		t.Fatal("stale snapshot delivered")
+	}
+	if d.Consensus() != second {
+		t.Fatal("Current not swapped")
+	}
+
+	cancel()
+	d.Set(testConsensus("c"))
+	select {
+	case <-updates:
+		t.Fatal("notified after cancel")
+	default:
+	}
+}
+
+func TestNetDir_Independent(t *testing.T) {
+	a, b := netdir.New(), netdir.New()
+	a.Set(testConsensus("a"))
+	if b.Current() != nil {
+		t.Fatal("directories share state")
+	}
+}
+
+func TestNetDir_Wait(t *testing.T) {
+	d := netdir.New()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := d.Wait(ctx); err == nil {
+		t.Fatal("Wait returned without a consensus")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var got *netdir.Snapshot
+	go func() {
+		defer wg.Done()
+		got, _ = d.Wait(context.Background())
+	}()
+	cns := testConsensus("a")
+	d.Set(cns)
+	wg.Wait()
+	if got == nil || got.Consensus() != cns {
+		t.Fatal("Wait did not return the first snapshot")
+	}
+}
@@ -0,0 +1,170 @@
+package path
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+// CountryFunc maps an address to its lowercase ISO country code, "" when
+// unknown.
+type CountryFunc func(netip.Addr) string
+
+// NodeSet is a torrc node list: comma separated fingerprints ("$FP",
+// "$FP~nick" or bare hex), nicknames, addresses or CIDR ranges and
+// country codes in braces ("{us}").
+type NodeSet struct {
+	fingerprints map[[20]byte]bool
+	nicknames    map[string]bool
+	prefixes     []netip.Prefix
+	countries    map[string]bool
+}
+
+// ParseNodeSet parses a node list; an empty string gives an empty set.
+func ParseNodeSet(s string) (*NodeSet, error) {
+	ns := &NodeSet{
+		fingerprints: map[[20]byte]bool{},
+		nicknames:    map[string]bool{},
+		countries:    map[string]bool{},
+	}
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if err := ns.add(e); err != nil {
+			return nil, err
+		}
+	}
+	return ns, nil
+}
+
+// MustParseNodeSet is ParseNodeSet for constant lists; it panics on error.
+func MustParseNodeSet(s string) *NodeSet {
+	ns, err := ParseNodeSet(s)
+	if err != nil {
+		panic(err)
+	}
+	return ns
+}
+
+func (ns *NodeSet) add(e string) error {
+	switch {
+	case strings.HasPrefix(e, "{") && strings.HasSuffix(e, "}"):
+		cc := strings.ToLower(e[1 : len(e)-1])
+		if len(cc) != 2 && cc != "??" {
+			return fmt.Errorf("node set: invalid country %q", e)
+		}
+		ns.countries[cc] = true
+		return nil
+	case strings.Contains(e, "/"):
+		p, err := netip.ParsePrefix(e)
+		if err != nil {
+			return fmt.Errorf("node set: %w", err)
+		}
+		ns.prefixes = append(ns.prefixes, p.Masked())
+		return nil
+	}
+	if a, err := netip.ParseAddr(e); err == nil {
+		ns.prefixes = append(ns.prefixes, netip.PrefixFrom(a, a.BitLen()))
+		return nil
+	}
+
+	hexID, hasDollar := strings.CutPrefix(e, "$")
+	// "$FP~nick" and "$FP=nick" name the relay by fingerprint only.
+	if i := strings.IndexAny(hexID, "~="); i >= 0 {
+		hexID = hexID[:i]
+	}
+	if len(hexID) == 40 {
+		if b, err := hex.DecodeString(hexID); err == nil {
+			ns.fingerprints[[20]byte(b)] = true
+			return nil
+		}
+	}
+	if hasDollar {
+		return fmt.Errorf("node set: invalid fingerprint %q", e)
+	}
+	if !validNickname(e) {
+		return fmt.Errorf("node set: invalid entry %q", e)
+	}
+	ns.nicknames[strings.ToLower(e)] = true
+	return nil
+}
+
+// IsEmpty reports whether the set lists nothing.
+func (ns *NodeSet) IsEmpty() bool {
+	return ns == nil || len(ns.fingerprints)+len(ns.nicknames)+len(ns.prefixes)+len(ns.countries) == 0
+}
+
+// HasCountries reports whether the set needs a CountryFunc.
+func (ns *NodeSet) HasCountries() bool {
+	return ns != nil && len(ns.countries) > 0
+}
+
+// Match reports whether r is in the set. country resolves "{cc}" entries;
+// without it they are checked against r.Country. Either way a relay of
+// unknown country matches "{??}".
+func (ns *NodeSet) Match(r *common.RouterStatus, country CountryFunc) bool {
+	if ns.IsEmpty() {
+		return false
+	}
+	if ns.fingerprints[r.NodeID] || ns.nicknames[strings.ToLower(r.Nickname)] {
+		return true
+	}
+	addrs := relayAddrs(r)
+	for _, p := range ns.prefixes {
+		for _, a := range addrs {
+			if p.Contains(a) {
+				return true
+			}
+		}
+	}
+	if len(ns.countries) > 0 && country == nil {
+		cc := r.Country
+		if cc == "" {
+			cc = "??"
+		}
+		return ns.countries[cc]
+	}
+	if len(ns.countries) > 0 {
+		for _, a := range addrs {
+			cc := country(a)
+			if cc == "" {
+				cc = "??"
+			}
+			if ns.countries[cc] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// relayAddrs returns the OR addresses of r.
+func relayAddrs(r *common.RouterStatus) []netip.Addr {
+	var out []netip.Addr
+	if ap, ok := r.IPv4AddrPort(); ok {
+		out = append(out, ap.Addr())
+	} else if a, err := netip.ParseAddr(r.Ipv4Addr); err == nil {
+		out = append(out, a.Unmap())
+	}
+	if ap, ok := r.IPv6AddrPort(); ok {
+		out = append(out, ap.Addr())
+	}
+	return out
+}
+
+func validNickname(s string) bool {
+	if len(s) == 0 || len(s) > 19 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
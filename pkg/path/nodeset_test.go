@@ -0,0 +1,156 @@
+package path_test
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/robogg133/gonion/pkg/common"
+	"github.com/robogg133/gonion/pkg/path"
+)
+
+func TestParseNodeSet_Match(t *testing.T) {
+	r := common.RouterStatus{
+		Nickname: "Relay1",
+		Ipv4Addr: "10.1.2.3",
+		Ipv6Addr: "[2001:db8::1]:443",
+	}
+	copy(r.NodeID[:], "abcdefghijklmnopqrst")
+	fp := "6162636465666768696A6B6C6D6E6F7071727374"
+	country := func(a netip.Addr) string {
+		if a.Is4() {
+			return "de"
+		}
+		return ""
+	}
+
+	for _, tc := range []struct {
+		list string
+		want bool
+	}{
+		{"", false},
+		{"$" + fp, true},
+		{strings.ToLower(fp), true},
+		{"$" + fp + "~Relay1", true},
+		{"relay1", true},
+		{"other", false},
+		{"10.0.0.0/8", true},
+		{"10.1.2.3", true},
+		{"2001:db8::/32", true},
+		{"192.168.0.0/16", false},
+		{"{de}", true},
+		{"{us}", false},
+		{"other, {us}, 10.1.0.0/16", true},
+	} {
+		ns, err := path.ParseNodeSet(tc.list)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.list, err)
+		}
+		if got := ns.Match(&r, country); got != tc.want {
+			t.Errorf("%q: Match = %v, want %v", tc.list, got, tc.want)
+		}
+	}
+
+	// Country entries need a lookup.
+	if path.MustParseNodeSet("{de}").Match(&r, nil) {
+		t.Fatal("country matched without lookup")
+	}
+}
+
+func TestParseNodeSet_Invalid(t *testing.T) {
+	for _, s := range []string{"$abc", "{usa}", "10.0.0.0/33", "bad-nick", "waytoolongnicknameforarelay"} {
+		if _, err := path.ParseNodeSet(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+var restrictRelays = []relaySpec{
+	{"guard1", guardFlags},
+	{"guard2", guardFlags},
+	{"mid1", fastFlags},
+	{"exit1", exitFlags},
+	{"exit2", exitFlags},
+}
+
+func TestSelectRandomCircuit_Restrictions(t *testing.T) {
+	sl := path.New(testConsensus(t, restrictRelays...), false)
+	sl.SetRestrictions(path.Restrictions{
+		EntryNodes:   path.MustParseNodeSet("guard2"),
+		ExitNodes:    path.MustParseNodeSet("exit1,exit2"),
+		ExcludeNodes: path.MustParseNodeSet("exit2"),
+	})
+	for range 20 {
+		if err := sl.SelectRandomCircuit(3, 80); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := sl.Guard().Nickname, sl.Exit().Nickname; g != "guard2" || e != "exit1" {
+			t.Fatalf("path %s -> %s, want guard2 -> exit1", g, e)
+		}
+	}
+
+	sl.SetRestrictions(path.Restrictions{ExcludeExitNodes: path.MustParseNodeSet("exit1,exit2")})
+	if err := sl.SelectRandomCircuit(3, 80); err == nil {
+		t.Fatal("expected no eligible exit")
+	}
+}
+
+func TestSelectInternalCircuit_StrictNodes(t *testing.T) {
+	sl := path.New(testConsensus(t, restrictRelays...), false)
+	r := path.Restrictions{ExcludeNodes: path.MustParseNodeSet("mid1,exit1,exit2")}
+	sl.SetRestrictions(r)
+
+	// Normal circuits never use excluded relays.
+	if err := sl.SelectRandomCircuit(3, 80); err == nil {
+		t.Fatal("expected no eligible exit")
+	}
+
+	// Internal circuits fall back to them without StrictNodes.
+	if err := sl.SelectInternalCircuit(4); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sl.Circuit()); n != 4 {
+		t.Fatalf("path length %d", n)
+	}
+
+	r.StrictNodes = true
+	sl.SetRestrictions(r)
+	if err := sl.SelectInternalCircuit(4); err == nil {
+		t.Fatal("expected StrictNodes to forbid excluded relays")
+	}
+	if err := sl.SelectInternalCircuit(2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeSet_AnnotatedCountry(t *testing.T) {
+	r := common.RouterStatus{Nickname: "r", Ipv4Addr: "10.0.0.1", Country: "se"}
+	if !path.MustParseNodeSet("{se}").Match(&r, nil) {
+		t.Fatal("annotated country not matched")
+	}
+	if path.MustParseNodeSet("{no}").Match(&r, nil) {
+		t.Fatal("wrong country matched")
+	}
+}
+
+// "{??}" is how ExcludeNodes drops relays of unknown country; it must work
+// with and without a lookup.
+func TestNodeSet_UnknownCountry(t *testing.T) {
+	unknown := common.RouterStatus{Nickname: "u", Ipv4Addr: "10.0.0.1"}
+	known := common.RouterStatus{Nickname: "k", Ipv4Addr: "10.0.0.2", Country: "se"}
+	lookup := func(a netip.Addr) string {
+		if a == netip.MustParseAddr("10.0.0.2") {
+			return "se"
+		}
+		return ""
+	}
+	ns := path.MustParseNodeSet("{??}")
+	for name, country := range map[string]path.CountryFunc{"annotation": nil, "lookup": lookup} {
+		if !ns.Match(&unknown, country) {
+			t.Errorf("%s: unknown country not matched by {??}", name)
+		}
+		if ns.Match(&known, country) {
+			t.Errorf("%s: known country matched by {??}", name)
+		}
+	}
+}
@@ -2,7 +2,6 @@
 package path
 
 import (
-	"bytes"
 	"fmt"
 	"math/rand/v2"
 
@@ -12,8 +11,21 @@ import (
 type Selector struct {
 	list     []common.RouterStatus
 	weight   common.BandWidthWeight
+	params   common.NetParams
 	longLive bool
 
+	// guards, when set, replaces consensus guard selection (bridges).
+	guards []*common.RouterStatus
+
+	strategy Strategy
+	restrict Restrictions
+	// relaxed ignores ExcludeNodes while an internal circuit falls back.
+	relaxed bool
+
+	vanguards *Vanguards
+	// hs takes the second hop from vanguards while SelectHSCircuit runs.
+	hs bool
+
 	guard    *common.RouterStatus
 	middles  []*common.RouterStatus
 	exit     *common.RouterStatus
@@ -25,29 +37,35 @@ type value struct {
 	ptr *common.RouterStatus
 }
 
-type validateFunc func(r common.RouterStatus) bool
 type weightFunc func(flags [15]bool, weights common.BandWidthWeight) int64
 
 func New(cns *common.Consensus, longlive bool) *Selector {
 	return &Selector{
 		list:     cns.RelayInformation,
 		weight:   cns.BandWidthWeight,
+		params:   cns.NetParams(),
 		longLive: longlive,
+		strategy: Default,
 	}
 }
 
+// SetStrategy replaces the selection strategy; nil restores Default.
+func (sl *Selector) SetStrategy(s Strategy) {
+	if s == nil {
+		s = Default
+	}
+	sl.strategy = s
+}
+
 func (sl *Selector) SelectRandomCircuit(hops uint, port uint16) error {
 	if hops == 0 {
 		return fmt.Errorf("invalid number of hops: %d need to be greater than 0", hops)
 	}
 
-	// Reset previous selection so retries are clean.
-	sl.guard = nil
-	sl.middles = nil
-	sl.exit = nil
-	sl.fullPath = nil
+	sl.reset()
+	n := int(hops)
 
-	exitInfo, err := sl.selectRelay(exitValidateFunc, exitWeightFunc, port)
+	exitInfo, err := sl.selectRelay(Hop{PositionExit, n - 1, n}, port)
 	if err != nil {
 		return fmt.Errorf("select exit: %w", err)
 	}
@@ -59,7 +77,7 @@ func (sl *Selector) SelectRandomCircuit(hops uint, port uint16) error {
 		return nil
 	}
 
-	guardInfo, err := sl.selectRelay(guardValideFunc, guardWeightFunc, 0)
+	guardInfo, err := sl.selectGuard(Hop{PositionGuard, 0, n})
 	if err != nil {
 		return fmt.Errorf("select guard: %w", err)
 	}
@@ -67,8 +85,8 @@ func (sl *Selector) SelectRandomCircuit(hops uint, port uint16) error {
 	sl.fullPath = append(sl.fullPath, guardInfo)
 	hops--
 
-	for range hops {
-		middleInfo, err := sl.selectRelay(middleValideFunc, middleWeightFunc, 0)
+	for i := range int(hops) {
+		middleInfo, err := sl.selectRelay(Hop{PositionMiddle, i + 1, n}, 0)
 		if err != nil {
 			return fmt.Errorf("select middle: %w", err)
 		}
@@ -79,13 +97,48 @@ func (sl *Selector) SelectRandomCircuit(hops uint, port uint16) error {
 	return nil
 }
 
+// reset clears the previous selection so retries are clean.
+func (sl *Selector) reset() {
+	sl.guard = nil
+	sl.middles = nil
+	sl.exit = nil
+	sl.fullPath = nil
+}
+
+// UseGuards restricts the first hop to gs, typically bridge.Manager.Guards.
+// gs need not be in the consensus. An empty gs restores normal guard
+// selection. Bridges are not filtered by EntryNodes or the Strategy but
+// still honor ExcludeNodes.
+func (sl *Selector) UseGuards(gs []*common.RouterStatus) {
+	sl.guards = gs
+}
+
+func (sl *Selector) selectGuard(h Hop) (*common.RouterStatus, error) {
+	if len(sl.guards) == 0 {
+		return sl.selectRelay(h, 0)
+	}
+	var free []*common.RouterStatus
+	for _, g := range sl.guards {
+		if sl.restrict.ExcludeNodes.Match(g, sl.restrict.Country) && !sl.relaxed {
+			continue
+		}
+		if haveAllKeys(g) && !sl.conflicts(g) {
+			free = append(free, g)
+		}
+	}
+	if len(free) == 0 {
+		return nil, fmt.Errorf("no usable configured guard (configured=%d)", len(sl.guards))
+	}
+	return free[rand.IntN(len(free))], nil
+}
+
 func (sl *Selector) Guard() *common.RouterStatus    { return sl.guard }
 func (sl *Selector) Exit() *common.RouterStatus     { return sl.exit }
 func (sl *Selector) Middle() []*common.RouterStatus { return sl.middles }
 
 func (sl *Selector) Circuit() []*common.RouterStatus { return sl.fullPath }
 
-func (sl *Selector) selectRelay(fn validateFunc, wfn weightFunc, desiredPort uint16) (*common.RouterStatus, error) {
+func (sl *Selector) selectRelay(h Hop, desiredPort uint16) (*common.RouterStatus, error) {
 	var totalBw int64
 	var values []value
 
@@ -103,11 +156,11 @@ func (sl *Selector) selectRelay(fn validateFunc, wfn weightFunc, desiredPort uin
 			continue
 		}
 
-		if !fn(*v) {
+		if !haveAllKeys(v) || !sl.allowed(v, h.Position, sl.relaxed) || !sl.strategy.Allow(v, h) {
 			continue
 		}
 
-		w := weightedBandwidth(int64(v.BandWidth), wfn(v.StatusFlags, sl.weight))
+		w := sl.strategy.Weight(v, h, sl.weight)
 		if w <= 0 {
 			continue
 		}
@@ -116,7 +169,7 @@ func (sl *Selector) selectRelay(fn validateFunc, wfn weightFunc, desiredPort uin
 	}
 
 	if len(values) == 0 || totalBw <= 0 {
-		return nil, fmt.Errorf("no eligible relays (candidates=%d total_bw=%d port=%d)", len(values), totalBw, desiredPort)
+		return nil, fmt.Errorf("no eligible %s relays (candidates=%d total_bw=%d port=%d)", h.Position, len(values), totalBw, desiredPort)
 	}
 
 	// Family /16 uniqueness: sample until a free relay is found.
@@ -135,39 +188,30 @@ func (sl *Selector) selectRelay(fn validateFunc, wfn weightFunc, desiredPort uin
 }
 
 func (sl *Selector) conflicts(r *common.RouterStatus) bool {
-	if sl.guard != nil {
-		if sl.guard.IPLevel == r.IPLevel || cmpFamily(sl.guard.Familys, r.Familys) {
-			return true
-		}
+	if sl.guard != nil && related(sl.guard, r) {
+		return true
 	}
-	if sl.exit != nil {
-		if sl.exit.IPLevel == r.IPLevel || cmpFamily(sl.exit.Familys, r.Familys) {
-			return true
-		}
+	if sl.exit != nil && related(sl.exit, r) {
+		return true
 	}
 	for _, m := range sl.middles {
-		if m.IPLevel == r.IPLevel || cmpFamily(m.Familys, r.Familys) {
+		if related(m, r) {
 			return true
 		}
 	}
 	return false
 }
 
-func cmpFamily(b, o []*common.FamilyIDs) bool {
-	for _, v := range b {
-		if v == nil {
-			continue
-		}
-		for _, r := range o {
-			if r == nil || r.Kind != v.Kind {
-				continue
-			}
-			if bytes.Equal(v.Value, r.Value) {
-				return true
-			}
-		}
+// related reports whether a and b may not share a path: same IPv4 /16,
+// same IPv6 /32, same autonomous system or same family.
+func related(a, b *common.RouterStatus) bool {
+	if a.IPLevel == b.IPLevel || (a.ASN != 0 && a.ASN == b.ASN) {
+		return true
 	}
-	return false
+	if a.IPv6Level != 0 && a.IPv6Level == b.IPv6Level {
+		return true
+	}
+	return common.SameFamily(a, b)
 }
 
 // weightedBandwidth applies consensus position weights. Falls back to raw
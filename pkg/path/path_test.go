@@ -46,6 +46,32 @@ func testRelay(t *testing.T, nick string, flags ...uint8) common.RouterStatus {
 	}
 }
 
+// relaySpec is one relay of testConsensus: its nickname and the flags it
+// has besides Running and Valid.
+type relaySpec struct {
+	nick  string
+	flags []uint8
+}
+
+var (
+	guardFlags = []uint8{common.FLAG_GUARD, common.FLAG_FAST, common.FLAG_STABLE, common.FLAG_V2DIR}
+	fastFlags  = []uint8{common.FLAG_FAST}
+	exitFlags  = []uint8{common.FLAG_EXIT, common.FLAG_FAST}
+)
+
+// testConsensus builds a consensus of the given relays, in order, each in
+// its own IP level.
+func testConsensus(t *testing.T, specs ...relaySpec) *common.Consensus {
+	t.Helper()
+	cns := &common.Consensus{}
+	for i, s := range specs {
+		r := testRelay(t, s.nick, s.flags...)
+		r.IPLevel = uint32(i + 1)
+		cns.RelayInformation = append(cns.RelayInformation, r)
+	}
+	return cns
+}
+
 func TestSelectRandomCircuit_ThreeHop(t *testing.T) {
 	cns := &common.Consensus{
 		RelayInformation: []common.RouterStatus{
@@ -111,3 +137,142 @@ func TestSelectRandomCircuit_ZeroWeightConsensusStillWorks(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSelectRandomCircuit_UseGuards(t *testing.T) {
+	cns := &common.Consensus{
+		RelayInformation: []common.RouterStatus{
+			testRelay(t, "guard1", common.FLAG_GUARD, common.FLAG_FAST, common.FLAG_STABLE, common.FLAG_V2DIR),
+			testRelay(t, "mid1", common.FLAG_FAST),
+			testRelay(t, "exit1", common.FLAG_EXIT, common.FLAG_FAST),
+		},
+	}
+	for i := range cns.RelayInformation {
+		cns.RelayInformation[i].IPLevel = uint32(i + 1)
+	}
+	bridge := testRelay(t, "bridge", common.FLAG_GUARD)
+	bridge.IPLevel = 100
+
+	sl := path.New(cns, false)
+	sl.UseGuards([]*common.RouterStatus{&bridge})
+	for range 20 {
+		if err := sl.SelectRandomCircuit(3, 80); err != nil {
+			t.Fatal(err)
+		}
+		if sl.Guard() != &bridge {
+			t.Fatalf("guard = %s, want bridge", sl.Guard().Nickname)
+		}
+	}
+
+	// A bridge sharing an IP level with the only exit cannot be used.
+	bridge.IPLevel = 3
+	if err := sl.SelectRandomCircuit(3, 80); err == nil {
+		t.Fatal("expected conflict error")
+	}
+}
+
+func TestSelectRandomCircuit_SameASN(t *testing.T) {
+	cns := &common.Consensus{
+		RelayInformation: []common.RouterStatus{
+			testRelay(t, "guard1", common.FLAG_GUARD, common.FLAG_FAST, common.FLAG_STABLE, common.FLAG_V2DIR),
+			testRelay(t, "mid1", common.FLAG_FAST),
+			testRelay(t, "exit1", common.FLAG_EXIT, common.FLAG_FAST),
+		},
+	}
+	for i := range cns.RelayInformation {
+		cns.RelayInformation[i].IPLevel = uint32(i + 1)
+		cns.RelayInformation[i].ASN = uint32(64500 + i)
+	}
+	sl := path.New(cns, false)
+	if err := sl.SelectRandomCircuit(3, 80); err != nil {
+		t.Fatal(err)
+	}
+
+	cns.RelayInformation[1].ASN = cns.RelayInformation[2].ASN
+	if err := sl.SelectRandomCircuit(3, 80); err == nil {
+		t.Fatal("expected same-AS conflict")
+	}
+}
+
+// The ASN rule adds to the /16 rule: relays in one subnet conflict
+// whatever their ASes.
+func TestSelectRandomCircuit_SameSubnetOtherASN(t *testing.T) {
+	cns := &common.Consensus{
+		RelayInformation: []common.RouterStatus{
+			testRelay(t, "guard1", common.FLAG_GUARD, common.FLAG_FAST, common.FLAG_STABLE, common.FLAG_V2DIR),
+			testRelay(t, "mid1", common.FLAG_FAST),
+			testRelay(t, "exit1", common.FLAG_EXIT, common.FLAG_FAST),
+		},
+	}
+	for i := range cns.RelayInformation {
+		cns.RelayInformation[i].IPLevel = uint32(i + 1)
+	}
+	cns.RelayInformation[1].IPLevel = cns.RelayInformation[2].IPLevel
+	sl := path.New(cns, false)
+
+	for _, asns := range [][2]uint32{{64512, 64513}, {64512, 0}} {
+		cns.RelayInformation[1].ASN, cns.RelayInformation[2].ASN = asns[0], asns[1]
+		if err := sl.SelectRandomCircuit(3, 80); err == nil {
+			t.Fatalf("ASNs %v: same-subnet relays share a path", asns)
+		}
+	}
+}
+
+func TestSelectRandomCircuit_DeclaredFamily(t *testing.T) {
+	cns := &common.Consensus{
+		RelayInformation: []common.RouterStatus{
+			testRelay(t, "guard1", common.FLAG_GUARD, common.FLAG_FAST, common.FLAG_STABLE, common.FLAG_V2DIR),
+			testRelay(t, "mid1", common.FLAG_FAST),
+			testRelay(t, "exit1", common.FLAG_EXIT, common.FLAG_FAST),
+		},
+	}
+	for i := range cns.RelayInformation {
+		cns.RelayInformation[i].IPLevel = uint32(i + 1)
+	}
+	mid, exit := &cns.RelayInformation[1], &cns.RelayInformation[2]
+
+	// A one-sided declaration is not a family.
+	mid.Family = []common.Family{{Digest: exit.NodeID[:]}}
+	cns.ResolveFamilies()
+	sl := path.New(cns, false)
+	if err := sl.SelectRandomCircuit(3, 80); err != nil {
+		t.Fatal(err)
+	}
+
+	exit.Family = []common.Family{{Digest: mid.NodeID[:]}}
+	cns.ResolveFamilies()
+	if err := sl.SelectRandomCircuit(3, 80); err == nil {
+		t.Fatal("expected family conflict")
+	}
+}
+
+func TestSelectRandomCircuit_IPv6(t *testing.T) {
+	cns := &common.Consensus{
+		RelayInformation: []common.RouterStatus{
+			testRelay(t, "guard1", common.FLAG_GUARD, common.FLAG_FAST, common.FLAG_STABLE, common.FLAG_V2DIR),
+			testRelay(t, "guard6", common.FLAG_GUARD, common.FLAG_FAST, common.FLAG_STABLE, common.FLAG_V2DIR),
+			testRelay(t, "mid1", common.FLAG_FAST),
+			testRelay(t, "exit1", common.FLAG_EXIT, common.FLAG_FAST),
+		},
+	}
+	for i := range cns.RelayInformation {
+		cns.RelayInformation[i].IPLevel = uint32(i + 1)
+	}
+	cns.RelayInformation[1].SetIPv6("[2001:db8:1::1]:9001")
+
+	sl := path.New(cns, false)
+	sl.SetStrategy(path.Restrict(path.Default, path.ReachableIPv6))
+	for range 10 {
+		if err := sl.SelectRandomCircuit(3, 80); err != nil {
+			t.Fatal(err)
+		}
+		if sl.Guard().Nickname != "guard6" {
+			t.Fatalf("guard %s has no IPv6 ORPort", sl.Guard().Nickname)
+		}
+	}
+
+	// Same IPv6 /32 as the guard.
+	cns.RelayInformation[3].SetIPv6("[2001:db8:ffff::2]:443")
+	if err := sl.SelectRandomCircuit(3, 80); err == nil {
+		t.Fatal("expected IPv6 /32 conflict")
+	}
+}
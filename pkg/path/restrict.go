@@ -0,0 +1,104 @@
+package path
+
+import (
+	"fmt"
+
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+// Restrictions limit which relays a Selector may use, like tor's
+// EntryNodes, ExitNodes, ExcludeNodes, ExcludeExitNodes and StrictNodes.
+// Nil sets restrict nothing.
+type Restrictions struct {
+	// EntryNodes, when set, is the only source of first hops.
+	EntryNodes *NodeSet
+	// ExitNodes, when set, is the only source of exits.
+	ExitNodes *NodeSet
+	// ExcludeNodes are never used on normal circuits. Internal circuits
+	// may still use them when nothing else works, unless StrictNodes.
+	ExcludeNodes *NodeSet
+	// ExcludeExitNodes are never used as exits.
+	ExcludeExitNodes *NodeSet
+
+	// StrictNodes forbids the ExcludeNodes fallback of internal circuits.
+	StrictNodes bool
+
+	// Country resolves "{cc}" entries; without it they use the relay's
+	// geoip annotation.
+	Country CountryFunc
+}
+
+// SetRestrictions applies r to every later selection.
+func (sl *Selector) SetRestrictions(r Restrictions) {
+	sl.restrict = r
+}
+
+// Restrictions returns the restrictions set with SetRestrictions.
+func (sl *Selector) Restrictions() Restrictions { return sl.restrict }
+
+// allowed reports whether the restrictions let r be used at pos. relaxed
+// ignores ExcludeNodes, for internal circuits without StrictNodes.
+func (sl *Selector) allowed(r *common.RouterStatus, pos Position, relaxed bool) bool {
+	rs := &sl.restrict
+	if !relaxed && rs.ExcludeNodes.Match(r, rs.Country) {
+		return false
+	}
+	switch pos {
+	case PositionGuard:
+		if !rs.EntryNodes.IsEmpty() && !rs.EntryNodes.Match(r, rs.Country) {
+			return false
+		}
+	case PositionExit:
+		if !rs.ExitNodes.IsEmpty() && !rs.ExitNodes.Match(r, rs.Country) {
+			return false
+		}
+		if rs.ExcludeExitNodes.Match(r, rs.Country) {
+			return false
+		}
+	}
+	return true
+}
+
+// SelectInternalCircuit picks a hops-long path that ends at a middle
+// relay, for directory and onion service circuits. When the restrictions
+// leave no usable path and StrictNodes is off, it retries allowing
+// ExcludeNodes, as tor does for its internal circuits.
+func (sl *Selector) SelectInternalCircuit(hops uint) error {
+	err := sl.selectInternal(hops)
+	if err == nil || sl.restrict.StrictNodes || sl.restrict.ExcludeNodes.IsEmpty() {
+		return err
+	}
+	sl.relaxed = true
+	defer func() { sl.relaxed = false }()
+	return sl.selectInternal(hops)
+}
+
+func (sl *Selector) selectInternal(hops uint) error {
+	if hops == 0 {
+		return fmt.Errorf("invalid number of hops: %d need to be greater than 0", hops)
+	}
+	sl.reset()
+
+	guardInfo, err := sl.selectGuard(Hop{PositionGuard, 0, int(hops)})
+	if err != nil {
+		return fmt.Errorf("select guard: %w", err)
+	}
+	sl.guard = guardInfo
+	sl.fullPath = append(sl.fullPath, guardInfo)
+
+	for i := range int(hops) - 1 {
+		h := Hop{PositionMiddle, i + 1, int(hops)}
+		var middleInfo *common.RouterStatus
+		if sl.hs && h.Index == 1 {
+			middleInfo, err = sl.selectLayer2(h)
+		} else {
+			middleInfo, err = sl.selectRelay(h, 0)
+		}
+		if err != nil {
+			return fmt.Errorf("select middle: %w", err)
+		}
+		sl.middles = append(sl.middles, middleInfo)
+		sl.fullPath = append(sl.fullPath, middleInfo)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package path
+
+import "github.com/robogg133/gonion/pkg/common"
+
+// Position is the role of a hop in a path.
+type Position uint8
+
+const (
+	PositionGuard Position = iota
+	PositionMiddle
+	PositionExit
+)
+
+func (p Position) String() string {
+	switch p {
+	case PositionGuard:
+		return "guard"
+	case PositionMiddle:
+		return "middle"
+	case PositionExit:
+		return "exit"
+	}
+	return "unknown"
+}
+
+// Hop describes the hop being selected: its role, its index in the path
+// (0 is the first hop) and the length of the path.
+type Hop struct {
+	Position Position
+	Index    int
+	Len      int
+}
+
+// Strategy decides which relays may fill a hop and how likely each is.
+//
+// The Selector only offers relays that are Running, Valid, have every key
+// a circuit needs, allow the exit port and pass the Restrictions; a
+// Strategy narrows that further. Family, network and AS conflicts between
+// hops are always checked after the Strategy picked.
+type Strategy interface {
+	// Allow reports whether r may be used at h.
+	Allow(r *common.RouterStatus, h Hop) bool
+	// Weight returns the selection weight of r at h; 0 or less skips r.
+	Weight(r *common.RouterStatus, h Hop, w common.BandWidthWeight) int64
+}
+
+// Filter is a composable Strategy.Allow.
+type Filter func(r *common.RouterStatus, h Hop) bool
+
+// Weigher is a composable Strategy.Weight.
+type Weigher func(r *common.RouterStatus, h Hop, w common.BandWidthWeight) int64
+
+type strategy struct {
+	weigh   Weigher
+	filters []Filter
+}
+
+func (s *strategy) Allow(r *common.RouterStatus, h Hop) bool {
+	for _, f := range s.filters {
+		if !f(r, h) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *strategy) Weight(r *common.RouterStatus, h Hop, w common.BandWidthWeight) int64 {
+	return s.weigh(r, h, w)
+}
+
+// Custom builds a Strategy allowing relays that pass every filter and
+// weighted by weigh, ConsensusWeight when nil.
+func Custom(weigh Weigher, filters ...Filter) Strategy {
+	if weigh == nil {
+		weigh = ConsensusWeight
+	}
+	return &strategy{weigh: weigh, filters: filters}
+}
+
+// Restrict returns s with filters added.
+func Restrict(s Strategy, filters ...Filter) Strategy {
+	return Custom(s.Weight, append([]Filter{s.Allow}, filters...)...)
+}
+
+// Reweight returns s with its weights replaced by weigh.
+func Reweight(s Strategy, weigh Weigher) Strategy {
+	return Custom(weigh, s.Allow)
+}
+
+// Default is tor's selection: position flags and consensus weights.
+var Default = Custom(ConsensusWeight, PositionFlags)
+
+// Bandwidth keeps the position flags but weighs by raw bandwidth only.
+var Bandwidth = Custom(BandwidthWeight, PositionFlags)
+
+// Uniform keeps the position flags and picks uniformly, for measurement.
+var Uniform = Custom(UniformWeight, PositionFlags)
+
+// PositionFlags requires the flags tor wants for each position: Guard,
+// Fast, Stable and V2Dir for guards, Exit without BadExit for exits.
+func PositionFlags(r *common.RouterStatus, h Hop) bool {
+	switch h.Position {
+	case PositionGuard:
+		return guardValideFunc(*r)
+	case PositionExit:
+		return exitValidateFunc(*r)
+	default:
+		return middleValideFunc(*r)
+	}
+}
+
+// ConsensusWeight weighs bandwidth with the consensus position weights.
+func ConsensusWeight(r *common.RouterStatus, h Hop, w common.BandWidthWeight) int64 {
+	var wfn weightFunc
+	switch h.Position {
+	case PositionGuard:
+		wfn = guardWeightFunc
+	case PositionExit:
+		wfn = exitWeightFunc
+	default:
+		wfn = middleWeightFunc
+	}
+	return weightedBandwidth(int64(r.BandWidth), wfn(r.StatusFlags, w))
+}
+
+// BandwidthWeight weighs by advertised bandwidth, ignoring position.
+func BandwidthWeight(r *common.RouterStatus, h Hop, w common.BandWidthWeight) int64 {
+	return int64(r.BandWidth)
+}
+
+// UniformWeight gives every relay the same weight.
+func UniformWeight(r *common.RouterStatus, h Hop, w common.BandWidthWeight) int64 {
+	return 1
+}
+
+// Pinned restricts hop index to the relays with the given identities,
+// e.g. to pin middles.
+func Pinned(index int, ids ...[20]byte) Filter {
+	set := make(map[[20]byte]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return func(r *common.RouterStatus, h Hop) bool {
+		return h.Index != index || set[r.NodeID]
+	}
+}
+
+// AtPosition applies f only at pos.
+func AtPosition(pos Position, f Filter) Filter {
+	return func(r *common.RouterStatus, h Hop) bool {
+		return h.Position != pos || f(r, h)
+	}
+}
+
+// ReachableIPv6 keeps relays without an IPv6 ORPort out of the first hop,
+// for clients that can only reach guards over IPv6.
+var ReachableIPv6 = AtPosition(PositionGuard, func(r *common.RouterStatus, _ Hop) bool {
+	_, ok := r.IPv6AddrPort()
+	return ok
+})
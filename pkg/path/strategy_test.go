@@ -0,0 +1,73 @@
+package path_test
+
+import (
+	"testing"
+
+	"github.com/robogg133/gonion/pkg/common"
+	"github.com/robogg133/gonion/pkg/path"
+)
+
+var strategyRelays = []relaySpec{
+	{"guard1", guardFlags},
+	{"mid1", fastFlags},
+	{"mid2", fastFlags},
+	{"mid3", fastFlags},
+	{"exit1", exitFlags},
+}
+
+func TestStrategy_PinnedMiddles(t *testing.T) {
+	cns := testConsensus(t, strategyRelays...)
+	mid2, mid3 := cns.RelayInformation[2].NodeID, cns.RelayInformation[3].NodeID
+
+	sl := path.New(cns, false)
+	sl.SetStrategy(path.Restrict(path.Default, path.Pinned(1, mid2), path.Pinned(2, mid3)))
+	for range 20 {
+		if err := sl.SelectRandomCircuit(4, 80); err != nil {
+			t.Fatal(err)
+		}
+		m := sl.Middle()
+		if m[0].Nickname != "mid2" || m[1].Nickname != "mid3" {
+			t.Fatalf("middles %s, %s", m[0].Nickname, m[1].Nickname)
+		}
+	}
+
+	// Conflicts still apply to pinned hops.
+	cns.RelayInformation[3].IPLevel = cns.RelayInformation[2].IPLevel
+	if err := sl.SelectRandomCircuit(4, 80); err == nil {
+		t.Fatal("expected conflict between pinned middles")
+	}
+}
+
+func TestStrategy_CustomWeight(t *testing.T) {
+	cns := testConsensus(t, strategyRelays...)
+	// Only mid3 has a weight as a middle.
+	weigh := func(r *common.RouterStatus, h path.Hop, w common.BandWidthWeight) int64 {
+		if h.Position == path.PositionMiddle && r.Nickname != "mid3" {
+			return 0
+		}
+		return path.UniformWeight(r, h, w)
+	}
+
+	sl := path.New(cns, false)
+	sl.SetStrategy(path.Reweight(path.Default, weigh))
+	for range 20 {
+		if err := sl.SelectRandomCircuit(3, 80); err != nil {
+			t.Fatal(err)
+		}
+		if got := sl.Middle()[0].Nickname; got != "mid3" {
+			t.Fatalf("middle %s, want mid3", got)
+		}
+	}
+
+	// A filter dropping every exit leaves nothing to pick.
+	sl.SetStrategy(path.Custom(nil, path.PositionFlags, path.AtPosition(path.PositionExit,
+		func(*common.RouterStatus, path.Hop) bool { return false })))
+	if err := sl.SelectRandomCircuit(3, 80); err == nil {
+		t.Fatal("expected no eligible exit")
+	}
+
+	sl.SetStrategy(nil)
+	if err := sl.SelectRandomCircuit(3, 80); err != nil {
+		t.Fatal(err)
+	}
+}
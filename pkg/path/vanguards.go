@@ -0,0 +1,277 @@
+package path
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+// Vanguards is the vanguards-lite state (prop333): a small set of layer 2
+// guards, each kept for a random lifetime, used as the second hop of every
+// onion service circuit so an attacker running many middles cannot learn
+// the guard quickly.
+type Vanguards struct {
+	mu     sync.Mutex
+	layer2 []vanguard
+
+	// file, when set, is rewritten whenever the set changes.
+	file string
+	now  func() time.Time
+}
+
+type vanguard struct {
+	id      [20]byte
+	expires time.Time
+}
+
+// NewVanguards returns an empty, in-memory set. It is filled by the first
+// Update or Selector.UseVanguards.
+func NewVanguards() *Vanguards {
+	return &Vanguards{now: time.Now}
+}
+
+// OpenVanguards loads the set persisted at file, if it exists, and keeps
+// file up to date from then on.
+func OpenVanguards(file string) (*Vanguards, error) {
+	v := NewVanguards()
+	f, err := os.Open(file)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		err = v.Load(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("vanguards: %s: %w", file, err)
+		}
+	}
+	v.file = file
+	return v, nil
+}
+
+// SetNow replaces the clock, for tests.
+func (v *Vanguards) SetNow(fn func() time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.now = fn
+}
+
+type vanguardsState struct {
+	Layer2 []vanguardState `json:"layer2"`
+}
+
+type vanguardState struct {
+	ID      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+// Save writes the set as JSON.
+func (v *Vanguards) Save(w io.Writer) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.save(w)
+}
+
+func (v *Vanguards) save(w io.Writer) error {
+	st := vanguardsState{Layer2: make([]vanguardState, len(v.layer2))}
+	for i, g := range v.layer2 {
+		st.Layer2[i] = vanguardState{ID: hex.EncodeToString(g.id[:]), Expires: g.expires.UTC()}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(st)
+}
+
+// Load replaces the set with one written by Save.
+func (v *Vanguards) Load(r io.Reader) error {
+	var st vanguardsState
+	if err := json.NewDecoder(r).Decode(&st); err != nil {
+		return err
+	}
+	layer2 := make([]vanguard, 0, len(st.Layer2))
+	for _, g := range st.Layer2 {
+		b, err := hex.DecodeString(g.ID)
+		if err != nil || len(b) != 20 {
+			return fmt.Errorf("invalid layer 2 identity %q", g.ID)
+		}
+		layer2 = append(layer2, vanguard{id: [20]byte(b), expires: g.Expires})
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.layer2 = layer2
+	return nil
+}
+
+// Layer2 returns the identities of the current layer 2 guards.
+func (v *Vanguards) Layer2() [][20]byte {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	out := make([][20]byte, len(v.layer2))
+	for i, g := range v.layer2 {
+		out[i] = g.id
+	}
+	return out
+}
+
+// Update rotates out expired layer 2 guards and those no longer usable in
+// cns, and tops the set up to guard-hs-l2-number. Call it on every new
+// consensus.
+func (v *Vanguards) Update(cns *common.Consensus) error {
+	return v.update(cns.RelayInformation, cns.BandWidthWeight, cns.NetParams(), nil)
+}
+
+// layer2Usable reports whether r may stay or become a layer 2 guard.
+func layer2Usable(r *common.RouterStatus) bool {
+	f := r.StatusFlags
+	return f[common.FLAG_RUNNING] && f[common.FLAG_VALID] && f[common.FLAG_STABLE] && f[common.FLAG_FAST] && haveAllKeys(r)
+}
+
+func (v *Vanguards) update(list []common.RouterStatus, weights common.BandWidthWeight, np common.NetParams, allow func(*common.RouterStatus) bool) error {
+	usable := func(r *common.RouterStatus) bool {
+		return layer2Usable(r) && (allow == nil || allow(r))
+	}
+	byID := make(map[[20]byte]*common.RouterStatus, len(list))
+	for i := range list {
+		byID[list[i].NodeID] = &list[i]
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := v.now()
+	changed := false
+
+	kept := v.layer2[:0]
+	inSet := make(map[[20]byte]bool, len(v.layer2))
+	for _, g := range v.layer2 {
+		r, ok := byID[g.id]
+		if !now.Before(g.expires) || !ok || !usable(r) || len(kept) >= int(np.GuardHSL2Number) {
+			changed = true
+			continue
+		}
+		kept = append(kept, g)
+		inSet[g.id] = true
+	}
+	v.layer2 = kept
+
+	for len(v.layer2) < int(np.GuardHSL2Number) {
+		var total int64
+		var values []value
+		for i := range list {
+			r := &list[i]
+			if inSet[r.NodeID] || !usable(r) {
+				continue
+			}
+			w := weightedBandwidth(int64(r.BandWidth), middleWeightFunc(r.StatusFlags, weights))
+			if w <= 0 {
+				continue
+			}
+			total += w
+			values = append(values, value{wb: w, ptr: r})
+		}
+		if len(values) == 0 {
+			break
+		}
+		r, err := selectRandom(total, values)
+		if err != nil {
+			break
+		}
+		inSet[r.NodeID] = true
+		v.layer2 = append(v.layer2, vanguard{
+			id:      r.NodeID,
+			expires: now.Add(layer2Lifetime(np.GuardHSL2LifetimeMin, np.GuardHSL2LifetimeMax)),
+		})
+		changed = true
+	}
+
+	if changed && v.file != "" {
+		if err := v.persist(); err != nil {
+			return fmt.Errorf("vanguards: save %s: %w", v.file, err)
+		}
+	}
+	if len(v.layer2) == 0 {
+		return fmt.Errorf("vanguards: no usable layer 2 guard")
+	}
+	return nil
+}
+
+// layer2Lifetime draws max(X, Y) with X, Y uniform in [lo, hi].
+func layer2Lifetime(lo, hi time.Duration) time.Duration {
+	if hi <= lo {
+		return lo
+	}
+	draw := func() time.Duration {
+		return lo + rand.N(hi-lo+1)
+	}
+	return max(draw(), draw())
+}
+
+// persist replaces v.file atomically.
+func (v *Vanguards) persist() error {
+	tmp, err := os.CreateTemp(filepath.Dir(v.file), ".vanguards-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := v.save(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), v.file)
+}
+
+// UseVanguards makes SelectHSCircuit take its second hop from v, and
+// updates v from the Selector's consensus. Set the restrictions first:
+// excluded relays are not chosen as layer 2 guards.
+func (sl *Selector) UseVanguards(v *Vanguards) error {
+	sl.vanguards = v
+	if v == nil {
+		return nil
+	}
+	return v.update(sl.list, sl.weight, sl.params, func(r *common.RouterStatus) bool {
+		return sl.allowed(r, PositionMiddle, false)
+	})
+}
+
+// SelectHSCircuit is SelectInternalCircuit for onion service circuits:
+// with vanguards set, the second hop is one of the layer 2 guards, picked
+// uniformly. The Strategy does not apply to that hop.
+func (sl *Selector) SelectHSCircuit(hops uint) error {
+	sl.hs = sl.vanguards != nil
+	defer func() { sl.hs = false }()
+	return sl.SelectInternalCircuit(hops)
+}
+
+// selectLayer2 picks a usable, conflict free layer 2 guard for h.
+func (sl *Selector) selectLayer2(h Hop) (*common.RouterStatus, error) {
+	ids := sl.vanguards.Layer2()
+	set := make(map[[20]byte]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	var free []*common.RouterStatus
+	for i := range sl.list {
+		r := &sl.list[i]
+		if !set[r.NodeID] || !layer2Usable(r) || !sl.allowed(r, h.Position, sl.relaxed) || sl.conflicts(r) {
+			continue
+		}
+		free = append(free, r)
+	}
+	if len(free) == 0 {
+		return nil, fmt.Errorf("no usable layer 2 guard (configured=%d)", len(ids))
+	}
+	return free[rand.IntN(len(free))], nil
+}
@@ -0,0 +1,138 @@
+package path_test
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/robogg133/gonion/pkg/common"
+	"github.com/robogg133/gonion/pkg/path"
+)
+
+// vanguardRelays is a guard, n Stable middles and one middle that is not
+// Stable, so never a layer 2 guard.
+func vanguardRelays(n int) []relaySpec {
+	specs := []relaySpec{{"guard1", guardFlags}}
+	for i := range n {
+		specs = append(specs, relaySpec{fmt.Sprintf("mid%d", i), []uint8{common.FLAG_FAST, common.FLAG_STABLE}})
+	}
+	return append(specs, relaySpec{"flaky", fastFlags})
+}
+
+func TestVanguards_UpdateAndRotate(t *testing.T) {
+	cns := testConsensus(t, vanguardRelays(30)...)
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	v := path.NewVanguards()
+	v.SetNow(func() time.Time { return now })
+
+	if err := v.Update(cns); err != nil {
+		t.Fatal(err)
+	}
+	first := v.Layer2()
+	if len(first) != 4 {
+		t.Fatalf("layer 2 size %d, want 4", len(first))
+	}
+	for _, id := range first {
+		if id == cns.RelayInformation[len(cns.RelayInformation)-1].NodeID {
+			t.Fatal("unstable relay chosen")
+		}
+	}
+
+	// Within the minimum lifetime nothing rotates.
+	now = now.Add(23 * time.Hour)
+	if err := v.Update(cns); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(v.Layer2(), first) {
+		t.Fatal("rotated before minimum lifetime")
+	}
+
+	// A relay leaving the consensus is replaced at once.
+	gone := first[0]
+	cns.RelayInformation = slices.DeleteFunc(cns.RelayInformation, func(r common.RouterStatus) bool {
+		return r.NodeID == gone
+	})
+	if err := v.Update(cns); err != nil {
+		t.Fatal(err)
+	}
+	if got := v.Layer2(); len(got) != 4 || slices.Contains(got, gone) {
+		t.Fatalf("departed relay kept: %x", got)
+	}
+
+	// After the maximum lifetime everything has rotated.
+	now = now.Add(12*24*time.Hour + time.Hour)
+	before := v.Layer2()
+	if err := v.Update(cns); err != nil {
+		t.Fatal(err)
+	}
+	if slices.Equal(v.Layer2(), before) {
+		t.Fatal("nothing rotated after maximum lifetime")
+	}
+
+	cns.Params = map[string]int32{"guard-hs-l2-number": 2}
+	if err := v.Update(cns); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(v.Layer2()); n != 2 {
+		t.Fatalf("layer 2 size %d, want 2", n)
+	}
+}
+
+func TestVanguards_Persist(t *testing.T) {
+	cns := testConsensus(t, vanguardRelays(6)...)
+	file := filepath.Join(t.TempDir(), "vanguards.json")
+
+	v, err := path.OpenVanguards(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Update(cns); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := path.OpenVanguards(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(reopened.Layer2(), v.Layer2()) {
+		t.Fatal("persisted set differs")
+	}
+
+	var buf bytes.Buffer
+	if err := v.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := path.NewVanguards()
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(loaded.Layer2(), v.Layer2()) {
+		t.Fatal("Save/Load round trip differs")
+	}
+}
+
+func TestSelectHSCircuit_Layer2(t *testing.T) {
+	cns := testConsensus(t, vanguardRelays(10)...)
+	sl := path.New(cns, false)
+	v := path.NewVanguards()
+	if err := sl.UseVanguards(v); err != nil {
+		t.Fatal(err)
+	}
+	layer2 := v.Layer2()
+
+	for range 30 {
+		if err := sl.SelectHSCircuit(4); err != nil {
+			t.Fatal(err)
+		}
+		p := sl.Circuit()
+		if len(p) != 4 {
+			t.Fatalf("path length %d", len(p))
+		}
+		if !slices.Contains(layer2, p[1].NodeID) {
+			t.Fatalf("second hop %s is not a layer 2 guard", p[1].Nickname)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Package pathbias detects guards that fail circuits selectively (path
+// bias, path-spec §7). A guard that only lets through circuits it can
+// correlate shows an unusually low build or use success rate; the Tracker
+// counts both per guard and reports when the pb_* consensus thresholds are
+// crossed.
+package pathbias
+
+import (
+	"sync"
+
+	"github.com/robogg133/gonion/pkg/common"
+	"github.com/robogg133/gonion/pkg/path"
+)
+
+// Level is how far below the expected success rate a guard is.
+type Level uint8
+
+const (
+	LevelOK Level = iota
+	LevelNotice
+	LevelWarn
+	LevelExtreme
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelOK:
+		return "ok"
+	case LevelNotice:
+		return "notice"
+	case LevelWarn:
+		return "warn"
+	case LevelExtreme:
+		return "extreme"
+	}
+	return "unknown"
+}
+
+// Stats are the (scaled) counters of one guard.
+type Stats struct {
+	CircAttempts  float64
+	CircSuccesses float64
+	UseAttempts   float64
+	UseSuccesses  float64
+
+	// BuildLevel and UseLevel are the worst levels reached so far.
+	BuildLevel Level
+	UseLevel   Level
+	// Disabled guards must not be used for new circuits.
+	Disabled bool
+}
+
+// Event reports a guard newly crossing a threshold.
+type Event struct {
+	Guard [20]byte
+	// Use is true for the stream use rate, false for the build rate.
+	Use   bool
+	Level Level
+	Rate  float64
+	// Disabled is true when the guard was disabled by this event.
+	Disabled bool
+}
+
+// Tracker holds path bias counters for every guard. It is safe for
+// concurrent use.
+type Tracker struct {
+	mu     sync.Mutex
+	params common.NetParams
+	guards map[[20]byte]*Stats
+
+	// DropGuards disables guards at the extreme level even when the
+	// consensus leaves pb_dropguards at 0.
+	DropGuards bool
+}
+
+// New returns a Tracker with the default pb_* parameters.
+func New() *Tracker {
+	return &Tracker{
+		params: common.DefaultNetParams(),
+		guards: make(map[[20]byte]*Stats),
+	}
+}
+
+// SetParams replaces the thresholds, usually with Consensus.NetParams.
+func (t *Tracker) SetParams(np common.NetParams) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.params = np
+}
+
+func (t *Tracker) get(id [20]byte) *Stats {
+	s := t.guards[id]
+	if s == nil {
+		s = &Stats{}
+		t.guards[id] = s
+	}
+	return s
+}
+
+// BuildAttempt counts a circuit through guard that got past the first hop.
+func (t *Tracker) BuildAttempt(guard [20]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.get(guard)
+	s.CircAttempts++
+}
+
+// BuildSuccess counts a circuit through guard that finished building.
+func (t *Tracker) BuildSuccess(guard [20]byte) *Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.get(guard)
+	s.CircSuccesses = min(s.CircSuccesses+1, s.CircAttempts)
+	return t.checkBuild(guard, s)
+}
+
+// BuildFailure re-evaluates guard after a circuit through it failed to
+// build. The attempt was already counted.
+func (t *Tracker) BuildFailure(guard [20]byte) *Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.checkBuild(guard, t.get(guard))
+}
+
+// UseAttempt counts a built circuit through guard that a stream was tried
+// on.
+func (t *Tracker) UseAttempt(guard [20]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(guard).UseAttempts++
+}
+
+// UseSuccess counts a circuit through guard that carried a stream.
+func (t *Tracker) UseSuccess(guard [20]byte) *Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.get(guard)
+	s.UseSuccesses = min(s.UseSuccesses+1, s.UseAttempts)
+	return t.checkUse(guard, s)
+}
+
+// UseFailure re-evaluates guard after a stream on a circuit through it
+// failed.
+func (t *Tracker) UseFailure(guard [20]byte) *Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.checkUse(guard, t.get(guard))
+}
+
+func (t *Tracker) checkBuild(guard [20]byte, s *Stats) *Event {
+	p := &t.params
+	var ev *Event
+	if s.CircAttempts >= float64(p.PBMinCircs) {
+		rate := s.CircSuccesses / s.CircAttempts
+		lvl := LevelOK
+		switch {
+		case rate < pct(p.PBExtremePct):
+			lvl = LevelExtreme
+		case rate < pct(p.PBWarnPct):
+			lvl = LevelWarn
+		case rate < pct(p.PBNoticePct):
+			lvl = LevelNotice
+		}
+		ev = t.raise(guard, s, &s.BuildLevel, lvl, rate, false)
+	}
+	if s.CircAttempts > float64(p.PBScaleCircs) {
+		f := float64(p.PBMultFactor) / float64(p.PBScaleFactor)
+		s.CircAttempts *= f
+		s.CircSuccesses *= f
+	}
+	return ev
+}
+
+func (t *Tracker) checkUse(guard [20]byte, s *Stats) *Event {
+	p := &t.params
+	var ev *Event
+	if s.UseAttempts >= float64(p.PBMinUse) {
+		rate := s.UseSuccesses / s.UseAttempts
+		lvl := LevelOK
+		switch {
+		case rate < pct(p.PBExtremeUsePct):
+			lvl = LevelExtreme
+		case rate < pct(p.PBNoticeUsePct):
+			lvl = LevelNotice
+		}
+		ev = t.raise(guard, s, &s.UseLevel, lvl, rate, true)
+	}
+	if s.UseAttempts > float64(p.PBScaleUse) {
+		f := float64(p.PBMultFactor) / float64(p.PBScaleFactor)
+		s.UseAttempts *= f
+		s.UseSuccesses *= f
+	}
+	return ev
+}
+
+// raise records lvl and returns an event when it is worse than before.
+func (t *Tracker) raise(guard [20]byte, s *Stats, cur *Level, lvl Level, rate float64, use bool) *Event {
+	if lvl <= *cur {
+		return nil
+	}
+	*cur = lvl
+	ev := &Event{Guard: guard, Use: use, Level: lvl, Rate: rate}
+	if lvl == LevelExtreme && !s.Disabled && (t.params.PBDropGuards || t.DropGuards) {
+		s.Disabled = true
+		ev.Disabled = true
+	}
+	return ev
+}
+
+func pct(v int32) float64 { return float64(v) / 100 }
+
+// Stats returns the counters of guard.
+func (t *Tracker) Stats(guard [20]byte) Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s := t.guards[guard]; s != nil {
+		return *s
+	}
+	return Stats{}
+}
+
+// Disabled reports whether guard was disabled for path bias.
+func (t *Tracker) Disabled(guard [20]byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.guards[guard]
+	return s != nil && s.Disabled
+}
+
+// Reset forgets guard, e.g. after the user re-enabled it.
+func (t *Tracker) Reset(guard [20]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.guards, guard)
+}
+
+// Filter keeps disabled guards out of the first hop, for
+// path.Restrict(strategy, tracker.Filter()).
+func (t *Tracker) Filter() path.Filter {
+	return path.AtPosition(path.PositionGuard, func(r *common.RouterStatus, _ path.Hop) bool {
+		return !t.Disabled(r.NodeID)
+	})
+}
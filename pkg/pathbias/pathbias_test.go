@@ -0,0 +1,107 @@
+package pathbias_test
+
+import (
+	"testing"
+
+	"github.com/robogg133/gonion/pkg/common"
+	"github.com/robogg133/gonion/pkg/path"
+	"github.com/robogg133/gonion/pkg/pathbias"
+)
+
+func build(t *pathbias.Tracker, id [20]byte, attempts, successes int) []*pathbias.Event {
+	var evs []*pathbias.Event
+	for i := range attempts {
+		t.BuildAttempt(id)
+		var ev *pathbias.Event
+		if i < successes {
+			ev = t.BuildSuccess(id)
+		} else {
+			ev = t.BuildFailure(id)
+		}
+		if ev != nil {
+			evs = append(evs, ev)
+		}
+	}
+	return evs
+}
+
+func TestTracker_BuildLevels(t *testing.T) {
+	tr := pathbias.New()
+	good, bad := [20]byte{1}, [20]byte{2}
+
+	if evs := build(tr, good, 200, 190); len(evs) != 0 {
+		t.Fatalf("healthy guard reported: %+v", evs[0])
+	}
+
+	// Failures come last, so the rate falls through every level.
+	evs := build(tr, bad, 150, 40)
+	if len(evs) == 0 || evs[len(evs)-1].Level != pathbias.LevelExtreme {
+		t.Fatalf("events %+v, want extreme last", evs)
+	}
+	for i := 1; i < len(evs); i++ {
+		if evs[i].Level <= evs[i-1].Level {
+			t.Fatal("levels must only be reported when worsening")
+		}
+	}
+	// pb_dropguards defaults to 0.
+	if tr.Disabled(bad) {
+		t.Fatal("guard disabled without pb_dropguards")
+	}
+}
+
+func TestTracker_DropGuards(t *testing.T) {
+	tr := pathbias.New()
+	np := common.DefaultNetParams()
+	np.PBDropGuards = true
+	np.PBMinCircs = 10
+	tr.SetParams(np)
+
+	bad, good := [20]byte{2}, [20]byte{3}
+	evs := build(tr, bad, 20, 2)
+	if len(evs) == 0 || !evs[len(evs)-1].Disabled || !tr.Disabled(bad) {
+		t.Fatalf("guard not disabled: %+v", evs)
+	}
+
+	f := tr.Filter()
+	h := path.Hop{Position: path.PositionGuard}
+	if f(&common.RouterStatus{NodeID: bad}, h) || !f(&common.RouterStatus{NodeID: good}, h) {
+		t.Fatal("filter does not follow disabled state")
+	}
+	if !f(&common.RouterStatus{NodeID: bad}, path.Hop{Position: path.PositionMiddle}) {
+		t.Fatal("filter must only apply to guards")
+	}
+
+	tr.Reset(bad)
+	if tr.Disabled(bad) {
+		t.Fatal("reset guard still disabled")
+	}
+}
+
+func TestTracker_UseAndScaling(t *testing.T) {
+	tr := pathbias.New()
+	tr.DropGuards = true
+	id := [20]byte{4}
+
+	var last *pathbias.Event
+	for i := range 40 {
+		tr.UseAttempt(id)
+		var ev *pathbias.Event
+		if i < 10 {
+			ev = tr.UseSuccess(id)
+		} else {
+			ev = tr.UseFailure(id)
+		}
+		if ev != nil {
+			last = ev
+		}
+	}
+	if last == nil || !last.Use || last.Level != pathbias.LevelExtreme || !last.Disabled {
+		t.Fatalf("use event %+v", last)
+	}
+
+	// Counters are halved once they exceed pb_scalecircs.
+	build(tr, [20]byte{5}, 301, 301)
+	if s := tr.Stats([20]byte{5}); s.CircAttempts > 300 || s.CircSuccesses != s.CircAttempts {
+		t.Fatalf("not scaled: %+v", s)
+	}
+}
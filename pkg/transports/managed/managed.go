@@ -0,0 +1,378 @@
+// Package managed runs external pluggable transport binaries with the
+// managed-proxy protocol (pt-spec §3): snowflake, webtunnel, meek, or any
+// goptlib-based client. The proxy announces one SOCKS listener per
+// transport with CMETHOD lines; we dial bridges through those listeners,
+// passing the bridge line arguments in the SOCKS5 username and password.
+package managed
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robogg133/gonion/pkg/transports"
+	"github.com/robogg133/gonion/pkg/upstream"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// PROTOCOL_VERSION is the only managed-proxy version in use.
+	PROTOCOL_VERSION = "1"
+
+	DEFAULT_LAUNCH_TIMEOUT = 30 * time.Second
+	// closeGrace is how long a proxy has to exit after stdin is closed.
+	closeGrace = 5 * time.Second
+)
+
+var ErrNoMethods = errors.New("managed proxy: no usable CMETHOD")
+
+// ErrUpstreamBypass is returned by Method.Dial when asked to use an
+// upstream proxy the managed proxy was not launched with: its traffic
+// would go out directly.
+var ErrUpstreamBypass = errors.New("managed proxy: upstream proxy set but proxy launched without ProxyURL")
+
+// Config describes how to launch a managed proxy.
+type Config struct {
+	// Path and Args are the proxy binary and its arguments.
+	Path string
+	Args []string
+
+	// Transports are the method names asked for in
+	// TOR_PT_CLIENT_TRANSPORTS, e.g. []string{"snowflake"}.
+	Transports []string
+
+	// StateDir is TOR_PT_STATE_LOCATION; empty means a directory under
+	// os.TempDir.
+	StateDir string
+
+	// ProxyURL, if set, is passed as TOR_PT_PROXY so the transport
+	// reaches the network through an upstream proxy. It must name the
+	// same proxy as the upstream dialer given to Method.Dial, e.g.
+	// RelayDialer.Upstream. Launch fails when the proxy does not
+	// acknowledge it with PROXY DONE.
+	ProxyURL string
+
+	// Env is appended to the inherited environment.
+	Env []string
+
+	// Timeout bounds the wait for CMETHODS DONE; zero means
+	// DEFAULT_LAUNCH_TIMEOUT.
+	Timeout time.Duration
+
+	// OnLog, if set, receives LOG and STATUS lines and proxy stderr.
+	OnLog func(line string)
+}
+
+// Method is one CMETHOD announced by the proxy. It implements
+// transports.Transport.
+type Method struct {
+	name     string
+	Protocol string // "socks5" or "socks4"
+	Addr     string
+
+	// proxied is set when the proxy accepted TOR_PT_PROXY.
+	proxied bool
+}
+
+func (m *Method) Name() string { return m.name }
+
+// Dial connects to addr through the proxy's SOCKS listener, with args
+// encoded as pt-spec §3.5 describes. The listener is local, so upstream is
+// not dialed here: the proxy reaches it through Config.ProxyURL. Dial
+// fails with ErrUpstreamBypass when upstream is set and the proxy was
+// launched without one.
+func (m *Method) Dial(ctx context.Context, up proxy.ContextDialer, addr string, args map[string]string) (net.Conn, error) {
+	if up != nil && up != upstream.Direct && !m.proxied {
+		return nil, fmt.Errorf("%w: %s", ErrUpstreamBypass, m.name)
+	}
+	if m.Protocol != "socks5" {
+		return nil, fmt.Errorf("managed proxy: %s: unsupported SOCKS protocol %q", m.name, m.Protocol)
+	}
+	var auth *proxy.Auth
+	if len(args) > 0 {
+		user, pass := EncodeSocksArgs(args)
+		auth = &proxy.Auth{User: user, Password: pass}
+	}
+	d, err := proxy.SOCKS5("tcp", m.Addr, auth, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	return d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+}
+
+// Proxy is a running managed proxy.
+type Proxy struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	methods []*Method
+
+	mu         sync.Mutex
+	registered bool
+
+	exited  chan struct{}
+	waitErr error
+}
+
+// Launch starts the proxy and waits until it has announced its methods.
+// Methods that failed (CMETHOD-ERROR) are left out; Launch fails only
+// when none is usable.
+func Launch(cfg Config) (*Proxy, error) {
+	if len(cfg.Transports) == 0 {
+		return nil, fmt.Errorf("managed proxy: no transports requested")
+	}
+	stateDir := cfg.StateDir
+	if stateDir == "" {
+		stateDir = filepath.Join(os.TempDir(), "gonion-pt-state")
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_LAUNCH_TIMEOUT
+	}
+
+	cmd := exec.Command(cfg.Path, cfg.Args...)
+	cmd.Env = append(os.Environ(),
+		"TOR_PT_MANAGED_TRANSPORT_VER="+PROTOCOL_VERSION,
+		"TOR_PT_CLIENT_TRANSPORTS="+strings.Join(cfg.Transports, ","),
+		"TOR_PT_STATE_LOCATION="+stateDir,
+		"TOR_PT_EXIT_ON_STDIN_CLOSE=1",
+	)
+	if cfg.ProxyURL != "" {
+		cmd.Env = append(cmd.Env, "TOR_PT_PROXY="+cfg.ProxyURL)
+	}
+	cmd.Env = append(cmd.Env, cfg.Env...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("managed proxy: start %s: %w", cfg.Path, err)
+	}
+
+	p := &Proxy{cmd: cmd, stdin: stdin, exited: make(chan struct{})}
+	logLine := cfg.OnLog
+	if logLine == nil {
+		logLine = func(string) {}
+	}
+	// cmd.Wait closes the pipes, so it may only run once both readers
+	// have hit EOF.
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			logLine(sc.Text())
+		}
+	}()
+
+	type result struct {
+		methods []*Method
+		err     error
+	}
+	ready := make(chan result, 1)
+	go func() {
+		defer readers.Done()
+		sc := bufio.NewScanner(stdout)
+		methods, err := handshake(sc, cfg, logLine)
+		ready <- result{methods, err}
+		// Keep draining LOG and STATUS lines for the proxy's lifetime.
+		for sc.Scan() {
+			logLine(sc.Text())
+		}
+	}()
+	go func() {
+		readers.Wait()
+		p.waitErr = cmd.Wait()
+		close(p.exited)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ready:
+		if r.err != nil {
+			p.Close()
+			return nil, r.err
+		}
+		p.methods = r.methods
+		return p, nil
+	case <-p.exited:
+		return nil, fmt.Errorf("managed proxy: exited during launch: %v", p.waitErr)
+	case <-timer.C:
+		p.Close()
+		return nil, fmt.Errorf("managed proxy: no CMETHODS DONE after %s", timeout)
+	}
+}
+
+// handshake reads the proxy's configuration lines up to CMETHODS DONE.
+func handshake(sc *bufio.Scanner, cfg Config, logLine func(string)) ([]*Method, error) {
+	var methods []*Method
+	proxyDone := false
+	for sc.Scan() {
+		line := sc.Text()
+		keyword, rest, _ := strings.Cut(line, " ")
+		switch keyword {
+		case "VERSION":
+			if rest != PROTOCOL_VERSION {
+				return nil, fmt.Errorf("managed proxy: unsupported version %q", rest)
+			}
+		case "VERSION-ERROR", "ENV-ERROR", "PROXY-ERROR":
+			return nil, fmt.Errorf("managed proxy: %s %s", keyword, rest)
+		case "CMETHOD":
+			m, err := parseCmethod(rest)
+			if err != nil {
+				return nil, err
+			}
+			methods = append(methods, m)
+		case "CMETHOD-ERROR":
+			logLine(line)
+		case "CMETHODS":
+			if rest != "DONE" {
+				return nil, fmt.Errorf("managed proxy: unexpected %q", line)
+			}
+			if len(methods) == 0 {
+				return nil, ErrNoMethods
+			}
+			if cfg.ProxyURL != "" && !proxyDone {
+				return nil, fmt.Errorf("managed proxy: TOR_PT_PROXY not acknowledged with PROXY DONE")
+			}
+			for _, m := range methods {
+				m.proxied = proxyDone
+			}
+			return methods, nil
+		case "PROXY":
+			if cfg.ProxyURL == "" || rest != "DONE" {
+				return nil, fmt.Errorf("managed proxy: unexpected %q", line)
+			}
+			proxyDone = true
+		default:
+			// LOG, STATUS and anything newer than us.
+			logLine(line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("managed proxy: stdout closed before CMETHODS DONE")
+}
+
+// parseCmethod parses "<name> <socks4|socks5> <addr:port> [options]".
+func parseCmethod(s string) (*Method, error) {
+	f := strings.Fields(s)
+	if len(f) < 3 {
+		return nil, fmt.Errorf("managed proxy: malformed CMETHOD %q", s)
+	}
+	if f[1] != "socks4" && f[1] != "socks5" {
+		return nil, fmt.Errorf("managed proxy: CMETHOD %s: unknown protocol %q", f[0], f[1])
+	}
+	if _, _, err := net.SplitHostPort(f[2]); err != nil {
+		return nil, fmt.Errorf("managed proxy: CMETHOD %s: %w", f[0], err)
+	}
+	return &Method{name: f[0], Protocol: f[1], Addr: f[2]}, nil
+}
+
+// Methods returns the announced methods.
+func (p *Proxy) Methods() []*Method { return p.methods }
+
+// Method returns the announced method called name.
+func (p *Proxy) Method(name string) (*Method, bool) {
+	for _, m := range p.methods {
+		if m.name == name {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// Register adds every method to the transports registry, so bridge lines
+// naming them dial through this proxy.
+func (p *Proxy) Register() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range p.methods {
+		transports.Register(m)
+	}
+	p.registered = true
+}
+
+// Close unregisters the methods and stops the proxy: stdin is closed (the
+// proxy was told to exit on that), then it is killed after a grace period.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	if p.registered {
+		for _, m := range p.methods {
+			transports.Unregister(m)
+		}
+		p.registered = false
+	}
+	p.mu.Unlock()
+
+	p.stdin.Close()
+	timer := time.NewTimer(closeGrace)
+	defer timer.Stop()
+	select {
+	case <-p.exited:
+		return nil
+	case <-timer.C:
+	}
+	if err := p.cmd.Process.Kill(); err != nil {
+		return err
+	}
+	<-p.exited
+	return nil
+}
+
+// Done is closed when the proxy process exits.
+func (p *Proxy) Done() <-chan struct{} { return p.exited }
+
+// EncodeSocksArgs packs bridge line arguments into SOCKS5 credentials
+// (pt-spec §3.5): "k=v;k=v" with \, = and ; escaped, split at 255 bytes
+// between username and password. An unused password is a single NUL.
+func EncodeSocksArgs(args map[string]string) (user, pass string) {
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = escapeArg(k) + "=" + escapeArg(args[k])
+	}
+	s := strings.Join(parts, ";")
+	if len(s) <= 255 {
+		return s, "\x00"
+	}
+	return s[:255], s[255:]
+}
+
+func escapeArg(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\\' || r == '=' || r == ';' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
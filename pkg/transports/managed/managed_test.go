@@ -0,0 +1,190 @@
+package managed_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robogg133/gonion/pkg/transports"
+	"github.com/robogg133/gonion/pkg/transports/managed"
+	"github.com/robogg133/gonion/pkg/upstream"
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+// TestHelperPT is not a real test: it is the stub proxy binary, run by
+// re-executing the test binary with GONION_TEST_PT set. It answers each
+// SOCKS request with the target and arguments it was given.
+func TestHelperPT(t *testing.T) {
+	if os.Getenv("GONION_TEST_PT") == "" {
+		return
+	}
+	go func() {
+		io.Copy(io.Discard, os.Stdin)
+		os.Exit(0)
+	}()
+
+	info, err := pt.ClientSetup(nil)
+	if err != nil {
+		os.Exit(1)
+	}
+	if info.ProxyURL != nil {
+		pt.ProxyDone()
+	}
+	ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
+	if err != nil {
+		pt.CmethodError("stub", err.Error())
+		os.Exit(1)
+	}
+	for _, name := range info.MethodNames {
+		if name == "stub" {
+			pt.Cmethod(name, ln.Version(), ln.Addr())
+		} else {
+			pt.CmethodError(name, "no such transport")
+		}
+	}
+	pt.CmethodsDone()
+
+	for {
+		conn, err := ln.AcceptSocks()
+		if err != nil {
+			os.Exit(1)
+		}
+		conn.Grant(nil)
+		var kv []string
+		for _, k := range slices.Sorted(maps.Keys(conn.Req.Args)) {
+			kv = append(kv, k+"="+conn.Req.Args[k][0])
+		}
+		io.WriteString(conn, conn.Req.Target+" "+strings.Join(kv, ";")+"\n")
+		conn.Close()
+	}
+}
+
+func launchStub(t *testing.T, transports []string, env ...string) (*managed.Proxy, error) {
+	t.Helper()
+	return launchStubProxy(t, transports, "", env...)
+}
+
+func launchStubProxy(t *testing.T, transports []string, proxyURL string, env ...string) (*managed.Proxy, error) {
+	t.Helper()
+	return managed.Launch(managed.Config{
+		Path:       os.Args[0],
+		Args:       []string{"-test.run=^TestHelperPT$"},
+		Transports: transports,
+		StateDir:   t.TempDir(),
+		ProxyURL:   proxyURL,
+		Env:        append([]string{"GONION_TEST_PT=1"}, env...),
+		Timeout:    10 * time.Second,
+	})
+}
+
+func TestLaunch_DialThroughSocks(t *testing.T) {
+	p, err := launchStub(t, []string{"stub", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if len(p.Methods()) != 1 {
+		t.Fatalf("got %d methods, want 1 (missing must be skipped)", len(p.Methods()))
+	}
+	m, ok := p.Method("stub")
+	if !ok || m.Protocol != "socks5" {
+		t.Fatalf("stub method: %+v", m)
+	}
+
+	p.Register()
+	tr, ok := transports.Get("stub")
+	if !ok {
+		t.Fatal("stub not registered")
+	}
+	c, err := tr.Dial(context.Background(), upstream.Direct, "192.0.2.1:443", map[string]string{"url": "https://example.com/a;b", "ice": "x=y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "192.0.2.1:443 ice=x=y;url=https://example.com/a;b\n"; line != want {
+		t.Fatalf("got %q, want %q", line, want)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := transports.Get("stub"); ok {
+		t.Fatal("stub still registered after Close")
+	}
+	select {
+	case <-p.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy did not exit")
+	}
+}
+
+// An upstream proxy the managed proxy does not know about must not be
+// silently bypassed.
+func TestMethodDial_Upstream(t *testing.T) {
+	up, err := upstream.FromURL("socks5://127.0.0.1:1080", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := launchStub(t, []string{"stub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := p.Method("stub")
+	_, err = m.Dial(context.Background(), up, "192.0.2.1:443", nil)
+	p.Close()
+	if !errors.Is(err, managed.ErrUpstreamBypass) {
+		t.Fatalf("got %v", err)
+	}
+
+	p, err = launchStubProxy(t, []string{"stub"}, "socks5://127.0.0.1:1080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	m, _ = p.Method("stub")
+	c, err := m.Dial(context.Background(), up, "192.0.2.1:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestLaunch_VersionError(t *testing.T) {
+	_, err := launchStub(t, []string{"stub"}, "TOR_PT_MANAGED_TRANSPORT_VER=2")
+	if err == nil || !strings.Contains(err.Error(), "VERSION-ERROR") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestLaunch_NoMethods(t *testing.T) {
+	_, err := launchStub(t, []string{"missing"})
+	if err != managed.ErrNoMethods {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestEncodeSocksArgs(t *testing.T) {
+	user, pass := managed.EncodeSocksArgs(map[string]string{"b": "x;y", "a": `1=2\`})
+	if user != `a=1\=2\\;b=x\;y` || pass != "\x00" {
+		t.Fatalf("got %q %q", user, pass)
+	}
+
+	long := strings.Repeat("z", 300)
+	user, pass = managed.EncodeSocksArgs(map[string]string{"k": long})
+	if len(user) != 255 || user+pass != "k="+long {
+		t.Fatalf("split %d+%d", len(user), len(pass))
+	}
+}
@@ -1,14 +1,41 @@
 package obfs4
 
 import (
+	"context"
 	"net"
 
+	"github.com/robogg133/gonion/pkg/transports"
 	"gitlab.com/yawning/obfs4.git/transports/obfs4"
 	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
 	"golang.org/x/net/proxy"
 )
 
+const NAME = "obfs4"
+
+func init() {
+	transports.Register(Transport{})
+}
+
+// Transport is the built-in obfs4 client.
+type Transport struct{}
+
+func (Transport) Name() string { return NAME }
+
+// Dial takes the bridge line arguments: cert, iat-mode (default 0) and
+// optionally node-id (cert already encodes it).
+func (Transport) Dial(ctx context.Context, upstream proxy.ContextDialer, addr string, args map[string]string) (net.Conn, error) {
+	return dial(ctx, upstream, addr, args)
+}
+
 func Dial(addr, nodeID, cert, iatMode string) (net.Conn, error) {
+	return dial(context.Background(), proxy.Direct, addr, map[string]string{
+		"cert":     cert,
+		"iat-mode": iatMode,
+		"node-id":  nodeID,
+	})
+}
+
+func dial(ctx context.Context, upstream proxy.ContextDialer, addr string, args map[string]string) (net.Conn, error) {
 	transport := new(obfs4.Transport)
 
 	fac, err := transport.ClientFactory("")
@@ -16,16 +43,24 @@ func Dial(addr, nodeID, cert, iatMode string) (net.Conn, error) {
 		return nil, err
 	}
 
-	args := &pt.Args{}
-
-	args.Add("cert", cert)
-	args.Add("iat-mode", iatMode)
-	args.Add("node-id", nodeID)
+	ptArgs := &pt.Args{}
+	if args["iat-mode"] == "" {
+		ptArgs.Add("iat-mode", "0")
+	}
+	for k, v := range args {
+		if v == "" {
+			continue
+		}
+		ptArgs.Add(k, v)
+	}
 
-	obfsArgs, err := fac.ParseArgs(args)
+	obfsArgs, err := fac.ParseArgs(ptArgs)
 	if err != nil {
 		return nil, err
 	}
 
-	return fac.Dial("tcp", addr, proxy.Direct.Dial, obfsArgs)
+	dialFn := func(network, addr string) (net.Conn, error) {
+		return upstream.DialContext(ctx, network, addr)
+	}
+	return fac.Dial("tcp", addr, dialFn, obfsArgs)
 }
@@ -0,0 +1,65 @@
+// Package transports is the registry of pluggable transports a bridge line
+// can name. Built-in transports register themselves from init; external
+// ones are added by a managed proxy (package managed).
+package transports
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+
+	"golang.org/x/net/proxy"
+)
+
+// Transport opens connections to bridges through one pluggable transport.
+type Transport interface {
+	// Name is the transport name used in bridge lines, e.g. "obfs4".
+	Name() string
+	// Dial connects to addr with the bridge line's key=value arguments.
+	// Network connections the transport makes go through upstream
+	// (never nil; see upstream.Direct).
+	Dial(ctx context.Context, upstream proxy.ContextDialer, addr string, args map[string]string) (net.Conn, error)
+}
+
+var registry = struct {
+	mu sync.RWMutex
+	m  map[string]Transport
+}{m: make(map[string]Transport)}
+
+// Register adds t, replacing any transport with the same name.
+func Register(t Transport) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.m[t.Name()] = t
+}
+
+// Unregister removes the transport called name if it is t, so that closing
+// a managed proxy does not remove a transport registered after it.
+func Unregister(t Transport) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.m[t.Name()] == t {
+		delete(registry.m, t.Name())
+	}
+}
+
+// Get returns the transport called name.
+func Get(name string) (Transport, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	t, ok := registry.m[name]
+	return t, ok
+}
+
+// Names returns the registered transport names, sorted.
+func Names() []string {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	out := make([]string, 0, len(registry.m))
+	for name := range registry.m {
+		out = append(out, name)
+	}
+	slices.Sort(out)
+	return out
+}
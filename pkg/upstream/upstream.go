@@ -0,0 +1,226 @@
+// Package upstream dials link connections through an outbound proxy, for
+// networks that only allow traffic through HTTP or SOCKS proxies.
+//
+// Every dialer is a proxy.ContextDialer, so anything implementing that
+// interface can be used as well.
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/net/proxy"
+)
+
+// Direct dials without a proxy.
+var Direct proxy.ContextDialer = proxy.Direct
+
+// OrDirect returns d, or Direct when d is nil.
+func OrDirect(d proxy.ContextDialer) proxy.ContextDialer {
+	if d == nil {
+		return Direct
+	}
+	return d
+}
+
+// FromURL builds a dialer from a proxy URL:
+//
+//	http://[user:pass@]host:port      HTTP CONNECT
+//	socks4://[userid@]host:port       SOCKS4, SOCKS4a for hostnames
+//	socks4a://[userid@]host:port      same as socks4
+//	socks5://[user:pass@]host:port    SOCKS5
+//
+// These are the schemes tor accepts in TOR_PT_PROXY. forward dials the
+// proxy itself; nil means Direct.
+func FromURL(raw string, forward proxy.ContextDialer) (proxy.ContextDialer, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || u.Port() == "" {
+		return nil, fmt.Errorf("upstream: %q needs host:port", raw)
+	}
+	user, pass := "", ""
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+
+	switch u.Scheme {
+	case "http":
+		return &HTTPConnect{ProxyAddr: u.Host, Username: user, Password: pass, Forward: forward}, nil
+	case "socks4", "socks4a":
+		if pass != "" {
+			return nil, fmt.Errorf("upstream: SOCKS4 has no password")
+		}
+		return &SOCKS4{ProxyAddr: u.Host, UserID: user, Forward: forward}, nil
+	case "socks5":
+		return SOCKS5(u.Host, user, pass, forward)
+	default:
+		return nil, fmt.Errorf("upstream: unsupported proxy scheme %q", u.Scheme)
+	}
+}
+
+// SOCKS5 returns a SOCKS5 dialer, with username/password authentication
+// when user is set.
+func SOCKS5(addr, user, pass string, forward proxy.ContextDialer) (proxy.ContextDialer, error) {
+	var auth *proxy.Auth
+	if user != "" {
+		auth = &proxy.Auth{User: user, Password: pass}
+	}
+	d, err := proxy.SOCKS5("tcp", addr, auth, forwarder{OrDirect(forward)})
+	if err != nil {
+		return nil, err
+	}
+	return d.(proxy.ContextDialer), nil
+}
+
+// HTTPConnect tunnels through an HTTP proxy with CONNECT.
+type HTTPConnect struct {
+	ProxyAddr string
+	// Username and Password, if set, are sent as Basic
+	// Proxy-Authorization.
+	Username string
+	Password string
+
+	Forward proxy.ContextDialer
+}
+
+func (h *HTTPConnect) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := OrDirect(h.Forward).DialContext(ctx, "tcp", h.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	stop := closeOnCancel(ctx, conn)
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if h.Username != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(h.Username + ":" + h.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream: CONNECT %s: %w", addr, err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream: CONNECT %s: %w", addr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream: CONNECT %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// SOCKS4 dials through a SOCKS4 proxy, using the SOCKS4a extension for
+// anything that is not an IPv4 address.
+type SOCKS4 struct {
+	ProxyAddr string
+	UserID    string
+
+	Forward proxy.ContextDialer
+}
+
+func (s *SOCKS4) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("upstream: bad port %q", portStr)
+	}
+
+	req := []byte{4, 1, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], uint16(port))
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		if net.ParseIP(host) != nil {
+			return nil, fmt.Errorf("upstream: SOCKS4 cannot reach IPv6 %s", host)
+		}
+		// 0.0.0.x with x != 0 asks the proxy to resolve the name.
+		ip = net.IPv4(0, 0, 0, 1).To4()
+	}
+	req = append(req, ip...)
+	req = append(req, s.UserID...)
+	req = append(req, 0)
+	if ip[0] == 0 {
+		req = append(req, host...)
+		req = append(req, 0)
+	}
+
+	conn, err := OrDirect(s.Forward).DialContext(ctx, "tcp", s.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	stop := closeOnCancel(ctx, conn)
+	defer stop()
+
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream: SOCKS4 %s: %w", addr, err)
+	}
+	var resp [8]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream: SOCKS4 %s: %w", addr, err)
+	}
+	if resp[1] != 90 {
+		conn.Close()
+		return nil, fmt.Errorf("upstream: SOCKS4 %s: rejected with code %d", addr, resp[1])
+	}
+	return conn, nil
+}
+
+// forwarder lets a ContextDialer be passed where proxy wants a Dialer;
+// proxy.SOCKS5 still uses DialContext.
+type forwarder struct{ proxy.ContextDialer }
+
+func (f forwarder) Dial(network, addr string) (net.Conn, error) {
+	return f.DialContext(context.Background(), network, addr)
+}
+
+// closeOnCancel closes conn if ctx ends before stop is called, so a proxy
+// that never answers cannot hang the handshake.
+func closeOnCancel(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// bufferedConn returns bytes the proxy sent right after its response
+// before reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
@@ -0,0 +1,207 @@
+package upstream_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/robogg133/gonion/pkg/upstream"
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+// serveOnce accepts one connection on a fresh listener and hands it to fn.
+func serveOnce(t *testing.T, fn func(c net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		fn(c)
+	}()
+	return ln.Addr().String()
+}
+
+func readGreeting(t *testing.T, c net.Conn) string {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestHTTPConnect(t *testing.T) {
+	got := make(chan *http.Request, 1)
+	addr := serveOnce(t, func(c net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		got <- req
+		// Bytes right after the response must reach the caller.
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\nhello")
+		io.Copy(io.Discard, c)
+	})
+
+	d, err := upstream.FromURL("http://alice:s3cret@"+addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(context.Background(), "tcp", "192.0.2.1:9001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := <-got
+	if req.Method != http.MethodConnect || req.Host != "192.0.2.1:9001" {
+		t.Fatalf("request %s %s", req.Method, req.Host)
+	}
+	if req.Header.Get("Proxy-Authorization") != "Basic YWxpY2U6czNjcmV0" {
+		t.Fatalf("auth %q", req.Header.Get("Proxy-Authorization"))
+	}
+	if s := readGreeting(t, c); s != "hello" {
+		t.Fatalf("read %q", s)
+	}
+}
+
+func TestHTTPConnect_Refused(t *testing.T) {
+	addr := serveOnce(t, func(c net.Conn) {
+		http.ReadRequest(bufio.NewReader(c))
+		io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+	})
+	d := &upstream.HTTPConnect{ProxyAddr: addr}
+	if _, err := d.DialContext(context.Background(), "tcp", "192.0.2.1:9001"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSOCKS4a(t *testing.T) {
+	got := make(chan []byte, 1)
+	addr := serveOnce(t, func(c net.Conn) {
+		buf := make([]byte, 256)
+		n, _ := c.Read(buf)
+		got <- buf[:n]
+		c.Write([]byte{0, 90, 0, 0, 0, 0, 0, 0})
+		c.Write([]byte("hello"))
+	})
+
+	d, err := upstream.FromURL("socks4a://bob@"+addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(context.Background(), "tcp", "relay.example:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	want := append([]byte{4, 1, 0x01, 0xbb, 0, 0, 0, 1}, "bob\x00relay.example\x00"...)
+	if req := <-got; !bytes.Equal(req, want) {
+		t.Fatalf("request %q, want %q", req, want)
+	}
+	if s := readGreeting(t, c); s != "hello" {
+		t.Fatalf("read %q", s)
+	}
+}
+
+func TestSOCKS4_Rejected(t *testing.T) {
+	addr := serveOnce(t, func(c net.Conn) {
+		c.Read(make([]byte, 256))
+		c.Write([]byte{0, 91, 0, 0, 0, 0, 0, 0})
+	})
+	d := &upstream.SOCKS4{ProxyAddr: addr}
+	if _, err := d.DialContext(context.Background(), "tcp", "192.0.2.1:9001"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSOCKS5_Auth(t *testing.T) {
+	ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan pt.SocksRequest, 1)
+	go func() {
+		c, err := ln.AcceptSocks()
+		if err != nil {
+			return
+		}
+		got <- c.Req
+		c.Grant(nil)
+		c.Write([]byte("hello"))
+		c.Close()
+	}()
+
+	// goptlib parses the credentials as PT arguments, so they must look
+	// like k=v once concatenated.
+	d, err := upstream.SOCKS5(ln.Addr().String(), "user=carol", ";pass=pw", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(context.Background(), "tcp", "192.0.2.1:9001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := <-got
+	if req.Target != "192.0.2.1:9001" || req.Username != "user=carol" || req.Password != ";pass=pw" {
+		t.Fatalf("request %+v", req)
+	}
+	if s := readGreeting(t, c); s != "hello" {
+		t.Fatalf("read %q", s)
+	}
+}
+
+func TestFromURL_Schemes(t *testing.T) {
+	for _, raw := range []string{
+		"http://127.0.0.1:3128",
+		"socks4://127.0.0.1:1080",
+		"socks4a://id@127.0.0.1:1080",
+		"socks5://127.0.0.1:1080",
+		"socks5://u:p@127.0.0.1:1080",
+	} {
+		if _, err := upstream.FromURL(raw, nil); err != nil {
+			t.Fatalf("%q: %v", raw, err)
+		}
+	}
+}
+
+func TestFromURL_Rejects(t *testing.T) {
+	for _, raw := range []string{
+		"ftp://127.0.0.1:21",
+		"http://127.0.0.1",
+		"socks4://u:p@127.0.0.1:1080",
+		"://",
+	} {
+		if _, err := upstream.FromURL(raw, nil); err == nil {
+			t.Fatalf("%q: expected error", raw)
+		}
+	}
+}
+
+func TestDialContext_Cancel(t *testing.T) {
+	// A proxy that accepts and never answers must not hang the dial.
+	addr := serveOnce(t, func(c net.Conn) { io.Copy(io.Discard, c) })
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	d := &upstream.HTTPConnect{ProxyAddr: addr}
+	if _, err := d.DialContext(ctx, "tcp", "192.0.2.1:9001"); err == nil {
+		t.Fatal("expected error")
+	}
+}
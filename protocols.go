@@ -0,0 +1,39 @@
+package gonion
+
+import (
+	"context"
+
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+// SupportedProtocols are the subprotocols gonion implements as a client,
+// checked against the consensus required-client-protocols. Onion service
+// subprotocols (HSDir, HSIntro, HSRend) are left out until the client
+// can reach onion services; add them with that code.
+var SupportedProtocols = mustParseProto("Cons=1-2 Desc=1-2 DirCache=2 FlowCtrl=1 Link=4-5 Microdesc=1-2 Padding=2 Relay=1-2")
+
+func mustParseProto(s string) common.Proto {
+	p, err := common.ParseProto(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// checkProtocols fails when cns requires a client protocol we lack; the
+// network would reject us in confusing ways later. Missing recommended
+// protocols are only logged.
+func checkProtocols(ctx context.Context, cns *common.Consensus) error {
+	log := logger(ctx)
+	if missing := cns.RequiredClientProtocols.Missing(SupportedProtocols); !missing.IsZero() {
+		log.Error().
+			Str("missing", missing.String()).
+			Str("required", cns.RequiredClientProtocols.String()).
+			Msg("consensus requires protocols we do not support")
+		return Publicf(ErrUnsupportedProto, "consensus requires %s; upgrade gonion", missing)
+	}
+	if missing := cns.RecommendedClientProtocols.Missing(SupportedProtocols); !missing.IsZero() {
+		log.Warn().Str("missing", missing.String()).Msg("consensus recommends protocols we do not support")
+	}
+	return nil
+}
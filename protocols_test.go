@@ -0,0 +1,45 @@
+package gonion_test
+
+import (
+	"testing"
+
+	"github.com/robogg133/gonion"
+	"github.com/robogg133/gonion/pkg/common"
+)
+
+// The protocols the live network requires of clients, as of 2026.
+func TestSupportedProtocols_Network(t *testing.T) {
+	required, err := common.ParseProto("Cons=2 Desc=2 Link=4 Microdesc=2 Relay=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing := required.Missing(gonion.SupportedProtocols); !missing.IsZero() {
+		t.Fatalf("missing required protocols: %s", missing)
+	}
+}
+
+// Onion services are not reachable yet, so their subprotocols must not be
+// advertised.
+func TestSupportedProtocols_NoOnionServices(t *testing.T) {
+	hs, err := common.ParseProto("HSDir=2 HSIntro=4 HSRend=1-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing := hs.Missing(gonion.SupportedProtocols); missing.String() != hs.String() {
+		t.Fatalf("onion service protocols advertised: have %s missing", missing)
+	}
+}
+
+// A consensus requiring a version or subprotocol gonion has never heard of
+// must not pass the check.
+func TestSupportedProtocols_UnknownRequirement(t *testing.T) {
+	for _, s := range []string{"Relay=9", "NewThing=1"} {
+		required, err := common.ParseProto(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if required.Missing(gonion.SupportedProtocols).IsZero() {
+			t.Errorf("required %s reported as supported", s)
+		}
+	}
+}
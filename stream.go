@@ -4,6 +4,8 @@ import (
 	"context"
 	"io"
 	"net"
+	"net/netip"
+	"strconv"
 	"sync"
 	"time"
 
@@ -31,6 +33,11 @@ type Stream struct {
 	circuit          *Circuit
 	addr             net.Addr
 
+	// connected is the CONNECTED cell of an exit stream; end is the END
+	// that refused it instead.
+	connected *relay.ConnectedCell
+	end       *relay.RelayEndCell
+
 	InboundControl chan relay.Cell
 	Ctx            context.Context
 	freeCtx        context.Context
@@ -53,9 +60,49 @@ type Stream struct {
 	receiveSendMe chan struct{}
 }
 
+// DialOptions are the BEGIN flags of an exit stream (tor-spec §6.2). An
+// IPv6 literal target always sets IPv6OK and IPv4NotOK.
+type DialOptions struct {
+	// IPv6OK lets the exit connect to an IPv6 address.
+	IPv6OK bool
+	// IPv4NotOK forbids IPv4 addresses.
+	IPv4NotOK bool
+	// IPv6Preferred asks for IPv6 when the name has both.
+	IPv6Preferred bool
+}
+
+func (o DialOptions) flags() uint32 {
+	var f uint32
+	if o.IPv6OK {
+		f |= relay.BEGIN_FLAG_IPV6_OK
+	}
+	if o.IPv4NotOK {
+		f |= relay.BEGIN_FLAG_IPV4_NOT_OK
+	}
+	if o.IPv6Preferred {
+		f |= relay.BEGIN_FLAG_IPV6_PREFERRED
+	}
+	return f
+}
+
+// NewStream is NewStreamWith with default options.
 func (c *Circuit) NewStream(target string, hopDest int) (*Stream, error) {
+	return c.NewStreamWith(target, hopDest, DialOptions{})
+}
+
+// NewStreamWith opens a stream to target at hop hopDest: "dir" for a
+// directory stream, otherwise host:port with IPv6 hosts in brackets.
+func (c *Circuit) NewStreamWith(target string, hopDest int, opts DialOptions) (*Stream, error) {
 	var suc bool
 
+	if target != "dir" {
+		addrport, err := beginAddrport(target, &opts)
+		if err != nil {
+			return nil, err
+		}
+		target = addrport
+	}
+
 	id := c.nextStreamID
 	c.nextStreamID++
 
@@ -103,18 +150,22 @@ func (c *Circuit) NewStream(target string, hopDest int) (*Stream, error) {
 	log := logger(ctx)
 	log.Info().Msg("opening stream")
 
+	c.pbStreamAttempt()
 	switch target {
 	case "dir":
 		stream.addr = shared.NewAddr("tcp", "")
 		if err := stream.beginDir(); err != nil {
+			c.pbStreamResult(pbStreamOutcome(stream, err))
 			return nil, err
 		}
 	default:
 		stream.addr = shared.NewAddr("tcp", target)
-		if err := stream.begin(target); err != nil {
+		if err := stream.begin(target, opts.flags()); err != nil {
+			c.pbStreamResult(pbStreamOutcome(stream, err))
 			return nil, err
 		}
 	}
+	c.pbStreamResult(pbUseOK)
 	stream.mu.Lock()
 	stream.State = STREAM_OPEN
 	stream.mu.Unlock()
@@ -298,6 +349,62 @@ func (s *Stream) writeDataCell(cell *relay.DataCell) error {
 	return nil
 }
 
+// RemoteAddr returns the address the exit reported in CONNECTED, with the
+// target port, or the target itself when it reported none.
+func (s *Stream) RemoteAddr() net.Addr {
+	s.mu.RLock()
+	cc := s.connected
+	s.mu.RUnlock()
+	if cc == nil || !cc.Addr.IsValid() {
+		return s.addr
+	}
+	_, port, _ := net.SplitHostPort(s.addr.String())
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(cc.Addr, uint16(p)))
+}
+
+func (s *Stream) endCell() *relay.RelayEndCell {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.end
+}
+
+// AddrTTL is how long the CONNECTED address may be cached; zero when the
+// exit sent none.
+func (s *Stream) AddrTTL() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.connected == nil {
+		return 0
+	}
+	return time.Duration(s.connected.TTL) * time.Second
+}
+
+// BeginAddrportForTest exposes beginAddrport for unit tests.
+func BeginAddrportForTest(target string, opts DialOptions) (string, DialOptions, error) {
+	addrport, err := beginAddrport(target, &opts)
+	return addrport, opts, err
+}
+
+// beginAddrport checks target and returns it as BEGIN expects it, with IPv6
+// literals in brackets. An IPv6 literal turns on the flags it needs.
+func beginAddrport(target string, opts *DialOptions) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || host == "" {
+		return "", Publicf(ErrStream, "invalid target %q", target)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return "", Publicf(ErrStream, "invalid port in %q", target)
+	}
+	if a, err := netip.ParseAddr(host); err == nil && a.Is6() && !a.Is4In6() {
+		if a.Zone() != "" {
+			return "", Publicf(ErrStream, "scoped address %q cannot be reached through an exit", target)
+		}
+		opts.IPv6OK, opts.IPv4NotOK = true, true
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
 func (s *Stream) Conn() net.Conn {
 	return &netWrapper{s: s}
 }
@@ -333,7 +440,7 @@ func (w *netWrapper) LocalAddr() net.Addr {
 	return w.s.circuit.conn.socket.LocalAddr()
 }
 func (w *netWrapper) RemoteAddr() net.Addr {
-	return w.s.addr
+	return w.s.RemoteAddr()
 }
 
 func (w *netWrapper) Close() error {
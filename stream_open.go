@@ -19,6 +19,11 @@ func (s *Stream) beginDir() error {
 	select {
 	case relayCell := <-s.InboundControl:
 		if relayCell.ID() != relay.COMMAND_CONNECTED {
+			if end, ok := relayCell.(*relay.RelayEndCell); ok {
+				s.setEnd(end)
+				log.Error().Uint8("reason", end.Reason).Msg("BEGIN_DIR rejected with RELAY_END")
+				return Publicf(ErrStream, "BEGIN_DIR rejected: %s", relay.EndReasonString(end.Reason))
+			}
 			log.Error().Uint8("cmd", relayCell.ID()).Msg("BEGIN_DIR expected CONNECTED")
 			return Publicf(ErrStream, "BEGIN_DIR failed: expected CONNECTED, got command %d", relayCell.ID())
 		}
@@ -29,13 +34,13 @@ func (s *Stream) beginDir() error {
 	return nil
 }
 
-func (s *Stream) begin(addrport string) error {
+func (s *Stream) begin(addrport string, flags uint32) error {
 	log := logger(s.Ctx)
-	log.Debug().Str("addrport", addrport).Msg("sending BEGIN")
+	log.Debug().Str("addrport", addrport).Uint32("flags", flags).Msg("sending BEGIN")
 
 	select {
 	case s.circuit.WriteRelayCell <- RelayOut{
-		Cell: &relay.BeginCell{Addrport: addrport, StreamID: s.ID},
+		Cell: &relay.BeginCell{Addrport: addrport, Flags: flags, StreamID: s.ID},
 		Dst:  s.myHopDestination,
 	}:
 	case <-s.Ctx.Done():
@@ -46,15 +51,30 @@ func (s *Stream) begin(addrport string) error {
 	case relayCell := <-s.InboundControl:
 		if relayCell.ID() != relay.COMMAND_CONNECTED {
 			if end, ok := relayCell.(*relay.RelayEndCell); ok {
+				s.setEnd(end)
 				log.Error().Uint8("reason", end.Reason).Msg("BEGIN rejected with RELAY_END")
 				return Publicf(ErrStream, "BEGIN rejected: %s", relay.EndReasonString(end.Reason))
 			}
 			log.Error().Uint8("cmd", relayCell.ID()).Msg("BEGIN expected CONNECTED")
 			return Publicf(ErrStream, "BEGIN failed: expected CONNECTED, got command %d", relayCell.ID())
 		}
-		log.Debug().Msg("BEGIN connected")
+		cc, _ := relayCell.(*relay.ConnectedCell)
+		s.mu.Lock()
+		s.connected = cc
+		s.mu.Unlock()
+		if cc != nil && cc.Addr.IsValid() {
+			log.Debug().Stringer("addr", cc.Addr).Uint32("ttl", cc.TTL).Msg("BEGIN connected")
+		} else {
+			log.Debug().Msg("BEGIN connected")
+		}
 	case <-s.Ctx.Done():
 		return fail(s.Ctx, ErrStream, "stream closed waiting CONNECTED", context.Cause(s.Ctx))
 	}
 	return nil
 }
+
+func (s *Stream) setEnd(end *relay.RelayEndCell) {
+	s.mu.Lock()
+	s.end = end
+	s.mu.Unlock()
+}